@@ -2,15 +2,18 @@ package cmd
 
 import (
 	"fmt"
-	"os"
 	"strings"
 
+	api "github.com/nanovms/ops/lepton"
 	"github.com/spf13/cobra"
 )
 
 func buildCommandHandler(cmd *cobra.Command, args []string) {
 	targetRoot, _ := cmd.Flags().GetString("target-root")
 	provider, _ := cmd.Flags().GetString("target-cloud")
+	reproducible, _ := cmd.Flags().GetBool("reproducible")
+	noCache, _ := cmd.Flags().GetBool("no-cache")
+	nightly, _ := cmd.Flags().GetBool("nightly")
 
 	cmdenvs, err := cmd.Flags().GetStringArray("envs")
 	if err != nil {
@@ -20,12 +23,55 @@ func buildCommandHandler(cmd *cobra.Command, args []string) {
 	config, _ := cmd.Flags().GetString("config")
 	config = strings.TrimSpace(config)
 
+	manifestFile, _ := cmd.Flags().GetString("manifest-file")
+
 	c := unWarpConfig(config)
 
-	c.Program = args[0]
 	c.TargetRoot = targetRoot
+	if reproducible {
+		c.Reproducible = true
+	}
+	if noCache {
+		c.NoCache = true
+	}
+	if nightly {
+		c.NightlyBuild = true
+	}
 	AppendGlobalCmdFlagsToConfig(cmd.Flags(), c)
 
+	if manifestFile != "" {
+		buildFromManifest(cmd, c, manifestFile)
+		return
+	}
+
+	if jar, _ := cmd.Flags().GetString("jar"); jar != "" {
+		c.Java.Jar = jar
+	}
+	if goPackage, _ := cmd.Flags().GetString("go"); goPackage != "" {
+		c.Go.Package = goPackage
+	}
+	c.Program = c.Java.Jar
+	if c.Go.Package != "" {
+		c.Program = goProgramName(c.Go.Package)
+	}
+	if len(args) > 0 {
+		c.Program = args[0]
+	}
+	if ociImage, _ := cmd.Flags().GetString("from-oci"); ociImage != "" {
+		c.OCI.Image = ociImage
+	}
+	if fullRootFS, _ := cmd.Flags().GetBool("full-rootfs"); fullRootFS {
+		c.OCI.FullRootFS = true
+	}
+	if c.OCI.Image != "" {
+		if err := api.ApplyOCIImage(c); err != nil {
+			exitWithError(err.Error())
+		}
+	}
+	if c.Program == "" {
+		exitForCmd(cmd, "Please mention ELF file, manifest file, --jar, --go or --from-oci")
+	}
+
 	if len(cmdenvs) > 0 {
 		if len(c.Env) == 0 {
 			c.Env = make(map[string]string)
@@ -39,6 +85,17 @@ func buildCommandHandler(cmd *cobra.Command, args []string) {
 
 	setDefaultImageName(cmd, c)
 
+	if explain, _ := cmd.Flags().GetBool("explain"); explain {
+		asJSON, _ := cmd.Flags().GetBool("json")
+		prepareImages(c)
+		report, err := api.ExplainManifest(c)
+		if err != nil {
+			exitWithError(buildErrorMessage(err))
+		}
+		printDependencyReport(report, asJSON)
+		return
+	}
+
 	p, ctx, err := getProviderAndContext(c, provider)
 	if err != nil {
 		exitWithError(err.Error())
@@ -46,8 +103,34 @@ func buildCommandHandler(cmd *cobra.Command, args []string) {
 
 	prepareImages(c)
 	if _, err := p.BuildImage(ctx); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		exitWithError(buildErrorMessage(err))
+	}
+	fmt.Printf("Bootable image file:%s\n", c.RunConfig.Imagename)
+}
+
+// buildFromManifest builds an image from a hand-edited manifest. The kernel
+// of the current release is used when the manifest names none, a kernel of
+// the config or of a nightly build replaces the one of the manifest.
+func buildFromManifest(cmd *cobra.Command, c *api.Config, manifestFile string) {
+	m, err := api.ReadManifestFile(manifestFile, c.TargetRoot)
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	c.Program = m.HostPath(m.Program())
+	if c.Program == "" {
+		exitWithError(fmt.Sprintf("%s: program %q is not a file in the manifest", manifestFile, m.Program()))
+	}
+
+	userKernel := c.Kernel != "" || c.NightlyBuild
+	setDefaultImageName(cmd, c)
+	prepareImages(c)
+	if userKernel || !m.HasKernel() {
+		m.AddKernel(c.Kernel)
+	}
+
+	if err := api.BuildImageFromManifest(*c, m); err != nil {
+		exitWithError(buildErrorMessage(err))
 	}
 	fmt.Printf("Bootable image file:%s\n", c.RunConfig.Imagename)
 }
@@ -59,11 +142,20 @@ func BuildCommand() *cobra.Command {
 	var targetCloud string
 	var imageName string
 	var envs []string
+	var manifestFile string
+	var reproducible bool
+	var noCache bool
+	var nightly bool
+	var explain bool
+	var asJSON bool
+	var jar string
+	var goPackage string
+	var ociImage string
+	var fullRootFS bool
 
 	var cmdBuild = &cobra.Command{
 		Use:   "build [ELF file]",
 		Short: "Build an image from ELF",
-		Args:  cobra.MinimumNArgs(1),
 		Run:   buildCommandHandler,
 	}
 
@@ -72,5 +164,15 @@ func BuildCommand() *cobra.Command {
 	cmdBuild.PersistentFlags().StringVarP(&targetRoot, "target-root", "r", "", "target root")
 	cmdBuild.PersistentFlags().StringVarP(&targetCloud, "target-cloud", "t", "onprem", "cloud platform[gcp, onprem]")
 	cmdBuild.PersistentFlags().StringVarP(&imageName, "imagename", "i", "", "image name")
+	cmdBuild.PersistentFlags().BoolVar(&reproducible, "reproducible", false, "build a reproducible image, timestamps are taken from SOURCE_DATE_EPOCH")
+	cmdBuild.PersistentFlags().BoolVar(&noCache, "no-cache", false, "build the image even if the build cache has it")
+	cmdBuild.PersistentFlags().BoolVarP(&nightly, "nightly", "n", false, "nightly build")
+	cmdBuild.PersistentFlags().StringVar(&manifestFile, "manifest-file", "", "build from manifest file instead of ELF")
+	cmdBuild.PersistentFlags().StringVar(&jar, "jar", "", "build an image that runs a jar with the JRE on the host or in the target root")
+	cmdBuild.PersistentFlags().StringVar(&goPackage, "go", "", "build an image that runs a Go package, such as ./cmd/server")
+	cmdBuild.PersistentFlags().StringVar(&ociImage, "from-oci", "", "build an image that runs a 'docker save' archive or an OCI image layout")
+	cmdBuild.PersistentFlags().BoolVar(&fullRootFS, "full-rootfs", false, "add every file of the --from-oci image instead of only the files the program needs")
+	cmdBuild.PersistentFlags().BoolVar(&explain, "explain", false, "print what goes into the image and why instead of building it")
+	cmdBuild.PersistentFlags().BoolVar(&asJSON, "json", false, "print the --explain report as JSON")
 	return cmdBuild
 }
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	api "github.com/nanovms/ops/lepton"
+)
+
+// buildErrorMessage returns the message shown when an image can not be
+// built, pointing at the manifest entry of missing and conflicting files
+func buildErrorMessage(err error) string {
+	var (
+		missing  *api.MissingFileError
+		conflict *api.FileConflictError
+		badLink  *api.BadLinkError
+		library  *api.LibraryNotFoundError
+		interp   *api.InterpreterNotFoundError
+	)
+	switch {
+	case errors.As(err, &missing):
+		return fmt.Sprintf("please check your manifest for the missing file %s (image path %s)", missing.HostPath, missing.VMPath)
+	case errors.As(err, &conflict):
+		return fmt.Sprintf("please check your manifest: %v", conflict)
+	case errors.As(err, &badLink):
+		return fmt.Sprintf("bad link %s (image path %s): %v", badLink.HostPath, badLink.VMPath, badLink.Cause)
+	case errors.As(err, &library):
+		return fmt.Sprintf("%v, please check --target-root or add the library to your config", library)
+	case errors.As(err, &interp):
+		return fmt.Sprintf("%v, please install it or check --target-root", interp)
+	}
+	return err.Error()
+}
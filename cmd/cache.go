@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	api "github.com/nanovms/ops/lepton"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+func cacheLsCommandHandler(cmd *cobra.Command, args []string) {
+	entries, err := api.ListBuildCache()
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Key", "Size", "Last Used"})
+	table.SetHeaderColor(
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor})
+	table.SetRowLine(true)
+
+	for _, e := range entries {
+		key := e.Key
+		if len(key) > 12 {
+			key = key[:12]
+		}
+		table.Append([]string{key, api.Bytes2Human(e.Size), api.Time2Human(e.LastUsed)})
+	}
+
+	table.Render()
+}
+
+func cacheLsCommand() *cobra.Command {
+	var cmdCacheLs = &cobra.Command{
+		Use:   "ls",
+		Short: "list images in the build cache",
+		Run:   cacheLsCommandHandler,
+	}
+	return cmdCacheLs
+}
+
+func cachePruneCommandHandler(cmd *cobra.Command, args []string) {
+	lru, _ := cmd.Flags().GetString("lru")
+
+	before := time.Now()
+	if lru != "" {
+		var err error
+		before, err = SubtractTimeNotation(time.Now(), lru)
+		if err != nil {
+			exitWithError(fmt.Errorf("failed getting date from lru flag: %s", err).Error())
+		}
+	}
+
+	pruned, err := api.PruneBuildCache(before)
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	var size int64
+	for _, e := range pruned {
+		size += e.Size
+	}
+	fmt.Printf("removed %d images, %s\n", len(pruned), api.Bytes2Human(size))
+}
+
+func cachePruneCommand() *cobra.Command {
+	var lru string
+	var cmdCachePrune = &cobra.Command{
+		Use:   "prune",
+		Short: "remove images from the build cache",
+		Run:   cachePruneCommandHandler,
+	}
+	cmdCachePrune.PersistentFlags().StringVar(&lru, "lru", "", "only remove images not used for a time notation, such as 1w, 300d, 3w, 1m or 2y")
+	return cmdCachePrune
+}
+
+// CacheCommands handles the build cache of images
+func CacheCommands() *cobra.Command {
+	var cmdCache = &cobra.Command{
+		Use:       "cache",
+		Short:     "manage the build cache of images",
+		ValidArgs: []string{"ls", "prune"},
+		Args:      cobra.OnlyValidArgs,
+	}
+	cmdCache.AddCommand(cacheLsCommand())
+	cmdCache.AddCommand(cachePruneCommand())
+	return cmdCache
+}
@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	api "github.com/nanovms/ops/lepton"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+func configShowCommandHandler(cmd *cobra.Command, args []string) {
+	config, _ := cmd.Flags().GetString("config")
+	config = strings.TrimSpace(config)
+	asJSON, _ := cmd.Flags().GetBool("json")
+
+	c, sources, err := loadConfig(config, configProfile)
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		exitWithError(err.Error())
+	}
+	if asJSON {
+		fmt.Println(string(data))
+		return
+	}
+
+	var values map[string]interface{}
+	if err = json.Unmarshal(data, &values); err != nil {
+		exitWithError(err.Error())
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Field", "Value", "Source"})
+	table.SetHeaderColor(
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor})
+	table.SetRowLine(true)
+	table.SetAutoWrapText(false)
+
+	for _, row := range configRows(values, "", sources) {
+		table.Append(row)
+	}
+
+	table.Render()
+}
+
+// configRows flattens the effective config to rows of field path, value and
+// source. Fields that are not set by a config file are listed when they have
+// a default value.
+func configRows(values map[string]interface{}, path string, sources api.ConfigSources) [][]string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var rows [][]string
+	for _, k := range keys {
+		p := k
+		if path != "" {
+			p = path + "." + k
+		}
+
+		v := values[k]
+		if m, ok := v.(map[string]interface{}); ok {
+			rows = append(rows, configRows(m, p, sources)...)
+			continue
+		}
+
+		source := strings.Join(sources[p], ", ")
+		if source == "" {
+			if isZeroConfigValue(v) {
+				continue
+			}
+			source = "default"
+		}
+
+		value, ok := v.(string)
+		if !ok {
+			data, _ := json.Marshal(v)
+			value = string(data)
+		}
+		rows = append(rows, []string{p, value, source})
+	}
+	return rows
+}
+
+func isZeroConfigValue(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case bool:
+		return !v
+	case float64:
+		return v == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+func configShowCommand() *cobra.Command {
+	var config string
+	var asJSON bool
+	var cmdConfigShow = &cobra.Command{
+		Use:   "show",
+		Short: "show the effective config and the file each value comes from",
+		Run:   configShowCommandHandler,
+	}
+	cmdConfigShow.PersistentFlags().StringVarP(&config, "config", "c", "", "ops config file")
+	cmdConfigShow.PersistentFlags().BoolVar(&asJSON, "json", false, "print the effective config as json")
+	return cmdConfigShow
+}
+
+func configValidateCommandHandler(cmd *cobra.Command, args []string) {
+	files := args
+	if len(files) == 0 {
+		files = []string{""}
+	}
+
+	failed := false
+	for _, file := range files {
+		_, _, err := loadConfig(file, configProfile)
+		if err != nil {
+			fmt.Println(fmt.Sprintf(api.ErrorColor, err.Error()))
+			failed = true
+			continue
+		}
+		if file == "" {
+			file = defaultConfigFile()
+		}
+		if file == "" {
+			fmt.Println("no config file to validate")
+			continue
+		}
+		fmt.Printf("%s is valid\n", file)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func configValidateCommand() *cobra.Command {
+	var cmdConfigValidate = &cobra.Command{
+		Use:   "validate [config files]",
+		Short: "check config files for unknown fields and values of the wrong type",
+		Run:   configValidateCommandHandler,
+	}
+	return cmdConfigValidate
+}
+
+func configSchemaCommandHandler(cmd *cobra.Command, args []string) {
+	data, err := json.MarshalIndent(api.ConfigSchema(), "", "  ")
+	if err != nil {
+		exitWithError(err.Error())
+	}
+	fmt.Println(string(data))
+}
+
+func configSchemaCommand() *cobra.Command {
+	var cmdConfigSchema = &cobra.Command{
+		Use:   "schema",
+		Short: "print the JSON Schema of config files, for editors",
+		Run:   configSchemaCommandHandler,
+	}
+	return cmdConfigSchema
+}
+
+// ConfigCommands handles config related operations
+func ConfigCommands() *cobra.Command {
+	var cmdConfig = &cobra.Command{
+		Use:       "config",
+		Short:     "inspect ops config files",
+		ValidArgs: []string{"show", "validate", "schema"},
+		Args:      cobra.OnlyValidArgs,
+	}
+	cmdConfig.AddCommand(configShowCommand())
+	cmdConfig.AddCommand(configValidateCommand())
+	cmdConfig.AddCommand(configSchemaCommand())
+	return cmdConfig
+}
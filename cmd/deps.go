@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	api "github.com/nanovms/ops/lepton"
+	"github.com/spf13/cobra"
+)
+
+func depsCommandHandler(cmd *cobra.Command, args []string) {
+	targetRoot, _ := cmd.Flags().GetString("target-root")
+	dlopen, _ := cmd.Flags().GetStringArray("dlopen")
+	asJSON, _ := cmd.Flags().GetBool("json")
+
+	report, err := api.ExplainProgram(targetRoot, args[0], dlopen)
+	if err != nil {
+		exitWithError(buildErrorMessage(err))
+	}
+	printDependencyReport(report, asJSON)
+}
+
+// printDependencyReport prints the files of an image as trees under the
+// config entries that added them, with the libraries each ELF file pulled in
+func printDependencyReport(report *api.DependencyReport, asJSON bool) {
+	if asJSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			exitWithError(err.Error())
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	for _, s := range report.Sources {
+		fmt.Printf("%s (%s)\n", s.Entry, api.Bytes2Human(s.TotalSize))
+		printDependencies(s.Files, "")
+	}
+	fmt.Printf("\ntotal: %s\n", api.Bytes2Human(report.TotalSize))
+
+	if len(report.Missing) > 0 {
+		fmt.Printf(api.ErrorColor, "\nmissing libraries:\n")
+		for _, e := range report.Missing {
+			fmt.Printf("  %s needed by %s\n", e.Library, e.NeededBy)
+		}
+	}
+	if len(report.OutsideTargetRoot) > 0 {
+		fmt.Printf(api.WarningColor, "\nlibraries found outside the target root:\n")
+		for _, lib := range report.OutsideTargetRoot {
+			fmt.Printf("  %s\n", lib)
+		}
+	}
+}
+
+func printDependencies(deps []*api.Dependency, indent string) {
+	for i, dep := range deps {
+		branch, next := "├── ", "│   "
+		if i == len(deps)-1 {
+			branch, next = "└── ", "    "
+		}
+
+		line := dep.Path
+		switch {
+		case dep.Missing:
+			line += " " + fmt.Sprintf(api.ErrorColor, "not found")
+		case len(dep.Dependencies) > 0:
+			line += fmt.Sprintf(" (%s, %s with dependencies)", api.Bytes2Human(dep.Size), api.Bytes2Human(dep.TotalSize))
+		default:
+			line += fmt.Sprintf(" (%s)", api.Bytes2Human(dep.Size))
+		}
+		if dep.OutsideTargetRoot {
+			line += " " + fmt.Sprintf(api.WarningColor, "outside target root")
+		}
+
+		fmt.Println(indent + branch + line)
+		printDependencies(dep.Dependencies, indent+next)
+	}
+}
+
+// DepsCommand prints the shared libraries an ELF file loads
+func DepsCommand() *cobra.Command {
+	var targetRoot string
+	var dlopen []string
+	var asJSON bool
+
+	var cmdDeps = &cobra.Command{
+		Use:   "deps <ELF file>",
+		Short: "Print the shared libraries an ELF file loads, as a tree",
+		Args:  cobra.ExactArgs(1),
+		Run:   depsCommandHandler,
+	}
+
+	cmdDeps.PersistentFlags().StringVarP(&targetRoot, "target-root", "r", "", "target root")
+	cmdDeps.PersistentFlags().StringArrayVar(&dlopen, "dlopen", nil, "library the program loads with dlopen")
+	cmdDeps.PersistentFlags().BoolVar(&asJSON, "json", false, "print as JSON")
+	return cmdDeps
+}
@@ -18,7 +18,7 @@ func ImageCommands() *cobra.Command {
 	var cmdImage = &cobra.Command{
 		Use:       "image",
 		Short:     "manage nanos images",
-		ValidArgs: []string{"create", "list", "delete", "resize", "sync"},
+		ValidArgs: []string{"create", "list", "delete", "resize", "sync", "ls", "cat", "extract", "inspect", "convert", "sign", "verify", "keygen", "push", "pull"},
 		Args:      cobra.OnlyValidArgs,
 	}
 	cmdImage.PersistentFlags().StringVarP(&config, "config", "c", "", "ops config file")
@@ -29,6 +29,16 @@ func ImageCommands() *cobra.Command {
 	cmdImage.AddCommand(imageDeleteCommand())
 	cmdImage.AddCommand(imageResizeCommand())
 	cmdImage.AddCommand(imageSyncCommand())
+	cmdImage.AddCommand(imageLsCommand())
+	cmdImage.AddCommand(imageCatCommand())
+	cmdImage.AddCommand(imageExtractCommand())
+	cmdImage.AddCommand(imageInspectCommand())
+	cmdImage.AddCommand(imageConvertCommand())
+	cmdImage.AddCommand(imageSignCommand())
+	cmdImage.AddCommand(imageVerifyCommand())
+	cmdImage.AddCommand(imageKeygenCommand())
+	cmdImage.AddCommand(imagePushCommand())
+	cmdImage.AddCommand(imagePullCommand())
 	return cmdImage
 }
 
@@ -69,7 +79,7 @@ func imageCreateCommandHandler(cmd *cobra.Command, args []string) {
 		panic(err)
 	}
 
-	c := unWarpConfig(config)
+	c, sources := unWarpConfigSources(config)
 	AppendGlobalCmdFlagsToConfig(cmd.Flags(), c)
 
 	// override config from command line
@@ -93,6 +103,12 @@ func imageCreateCommandHandler(cmd *cobra.Command, args []string) {
 		exitWithError("Please specify a cloud bucket in config")
 	}
 
+	// images are deployed as the instance of the configuration, which
+	// names their host
+	if c.Hostname == "" {
+		c.Hostname = c.RunConfig.InstanceName
+	}
+
 	prepareImages(c)
 
 	// borrow BuildDir from config
@@ -121,8 +137,8 @@ func imageCreateCommandHandler(cmd *cobra.Command, args []string) {
 			exitWithError(err.Error())
 		}
 
-		pkgConfig := unWarpConfig(manifest)
-		c = mergeConfigs(pkgConfig, c)
+		pkgConfig := unWarpPackageConfig(manifest)
+		c = mergeConfigs(pkgConfig, c, sources)
 		setDefaultImageName(cmd, c)
 
 		// Config merged with package config, need to update context
@@ -130,7 +146,7 @@ func imageCreateCommandHandler(cmd *cobra.Command, args []string) {
 
 		keypath, err = p.BuildImageWithPackage(ctx, expackage)
 		if err != nil {
-			exitWithError(err.Error())
+			exitWithError(buildErrorMessage(err))
 		}
 	} else {
 		if len(cmdargs) != 0 {
@@ -144,7 +160,7 @@ func imageCreateCommandHandler(cmd *cobra.Command, args []string) {
 		setDefaultImageName(cmd, c)
 		keypath, err = p.BuildImage(ctx)
 		if err != nil {
-			exitWithError(err.Error())
+			exitWithError(buildErrorMessage(err))
 		}
 	}
 
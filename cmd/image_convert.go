@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nanovms/ops/imageformat"
+	api "github.com/nanovms/ops/lepton"
+	"github.com/spf13/cobra"
+)
+
+func imageConvertCommand() *cobra.Command {
+	var format, output, size string
+	var formats []string
+	for _, f := range imageformat.Formats {
+		formats = append(formats, string(f))
+	}
+
+	var cmdImageConvert = &cobra.Command{
+		Use:   "convert <image_name>",
+		Short: "convert a local image to the disk format of a hypervisor",
+		Run:   imageConvertCommandHandler,
+		Args:  cobra.ExactArgs(1),
+	}
+	cmdImageConvert.PersistentFlags().StringVarP(&format, "format", "f", "", "disk format: "+strings.Join(formats, ", "))
+	cmdImageConvert.PersistentFlags().StringVarP(&output, "output", "o", "", "path of the converted disk, defaults to the image path with the extension of the format")
+	cmdImageConvert.PersistentFlags().StringVar(&size, "size", "", "size of the virtual disk, such as 512m or 2g")
+	cmdImageConvert.MarkPersistentFlagRequired("format")
+	return cmdImageConvert
+}
+
+func imageConvertCommandHandler(cmd *cobra.Command, args []string) {
+	formatName, _ := cmd.Flags().GetString("format")
+	output, _ := cmd.Flags().GetString("output")
+	size, _ := cmd.Flags().GetString("size")
+
+	format, err := imageformat.ParseFormat(formatName)
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	imagePath, err := localImagePath(args[0])
+	if err != nil {
+		exitWithError(err.Error())
+	}
+	if output == "" {
+		output = strings.TrimSuffix(imagePath, ".img") + format.Extension()
+	}
+
+	var opts imageformat.Options
+	if size != "" {
+		if opts.Size, err = api.ParseBytes(size); err != nil {
+			exitWithError(err.Error())
+		}
+	}
+
+	if err = imageformat.Convert(imagePath, output, format, opts); err != nil {
+		exitWithError(err.Error())
+	}
+	fmt.Printf("%s written to %s\n", format, output)
+}
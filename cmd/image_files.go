@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/nanovms/ops/fs"
+	api "github.com/nanovms/ops/lepton"
+	"github.com/spf13/cobra"
+)
+
+// localImagePath finds an image or volume by path, by the name of an image
+// in the images directory, or by the label or UUID of a local volume
+func localImagePath(name string) (string, error) {
+	images := path.Join(api.GetOpsHome(), "images")
+	candidates := []string{
+		name,
+		path.Join(images, name),
+		path.Join(images, name+".img"),
+		path.Join(api.LocalVolumeDir, name),
+		path.Join(api.LocalVolumeDir, name+".raw"),
+	}
+	// volumes are named <label>:<uuid>.raw
+	for _, pattern := range []string{name + api.VolumeDelimiter + "*.raw", "*" + api.VolumeDelimiter + name + ".raw"} {
+		volumes, _ := filepath.Glob(path.Join(api.LocalVolumeDir, pattern))
+		candidates = append(candidates, volumes...)
+	}
+
+	for _, c := range candidates {
+		if fi, err := os.Stat(c); err == nil && !fi.IsDir() {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("image or volume %s not found", name)
+}
+
+// openLocalImage opens an image or volume found by localImagePath
+func openLocalImage(name string) (*fs.Reader, error) {
+	imagePath, err := localImagePath(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Open(imagePath)
+}
+
+func imageLsCommand() *cobra.Command {
+	var cmdImageLs = &cobra.Command{
+		Use:   "ls <image_name> [path]",
+		Short: "list files of a local image or volume",
+		Run:   imageLsCommandHandler,
+		Args:  cobra.RangeArgs(1, 2),
+	}
+	return cmdImageLs
+}
+
+func imageLsCommandHandler(cmd *cobra.Command, args []string) {
+	r, err := openLocalImage(args[0])
+	if err != nil {
+		exitWithError(err.Error())
+	}
+	defer r.Close()
+
+	dir := "/"
+	if len(args) > 1 {
+		dir = args[1]
+	}
+
+	fi, err := r.Stat(dir)
+	if err != nil {
+		exitWithError(err.Error())
+	}
+	if !fi.IsDir() {
+		if fi, err = r.Lstat(dir); err != nil {
+			exitWithError(err.Error())
+		}
+		printImageFile(r, dir, fi)
+		return
+	}
+
+	files, err := r.ReadDir(dir)
+	if err != nil {
+		exitWithError(err.Error())
+	}
+	for _, fi := range files {
+		printImageFile(r, path.Join("/", dir, fi.Name()), fi)
+	}
+}
+
+// printImageFile prints the mode, size and name of a file, and the target of
+// links
+func printImageFile(r *fs.Reader, vmpath string, fi os.FileInfo) {
+	name := fi.Name()
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if target, err := r.Readlink(vmpath); err == nil {
+			name += " -> " + target
+		}
+	}
+	fmt.Printf("%s %10d %s\n", fi.Mode(), fi.Size(), name)
+}
+
+func imageCatCommand() *cobra.Command {
+	var cmdImageCat = &cobra.Command{
+		Use:   "cat <image_name> <file>",
+		Short: "print a file of a local image or volume",
+		Run:   imageCatCommandHandler,
+		Args:  cobra.ExactArgs(2),
+	}
+	return cmdImageCat
+}
+
+func imageCatCommandHandler(cmd *cobra.Command, args []string) {
+	r, err := openLocalImage(args[0])
+	if err != nil {
+		exitWithError(err.Error())
+	}
+	defer r.Close()
+
+	if err = r.CopyFile(os.Stdout, args[1]); err != nil {
+		exitWithError(err.Error())
+	}
+}
+
+func imageExtractCommand() *cobra.Command {
+	var vmpath string
+	var cmdImageExtract = &cobra.Command{
+		Use:   "extract <image_name> <dir>",
+		Short: "copy the files of a local image or volume to a directory",
+		Run:   imageExtractCommandHandler,
+		Args:  cobra.ExactArgs(2),
+	}
+	cmdImageExtract.PersistentFlags().StringVarP(&vmpath, "path", "p", "/", "file or directory of the image to extract")
+	return cmdImageExtract
+}
+
+func imageExtractCommandHandler(cmd *cobra.Command, args []string) {
+	vmpath, _ := cmd.Flags().GetString("path")
+
+	r, err := openLocalImage(args[0])
+	if err != nil {
+		exitWithError(err.Error())
+	}
+	defer r.Close()
+
+	if err = r.Extract(vmpath, args[1]); err != nil {
+		exitWithError(err.Error())
+	}
+}
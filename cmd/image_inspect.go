@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	api "github.com/nanovms/ops/lepton"
+	"github.com/spf13/cobra"
+)
+
+func imageInspectCommand() *cobra.Command {
+	var asJSON bool
+	var cmdImageInspect = &cobra.Command{
+		Use:   "inspect <image_name>",
+		Short: "show how a local image was built",
+		Run:   imageInspectCommandHandler,
+		Args:  cobra.ExactArgs(1),
+	}
+	cmdImageInspect.PersistentFlags().BoolVar(&asJSON, "json", false, "print the provenance record as JSON")
+	return cmdImageInspect
+}
+
+func imageInspectCommandHandler(cmd *cobra.Command, args []string) {
+	asJSON, _ := cmd.Flags().GetBool("json")
+
+	imagePath, err := localImagePath(args[0])
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	p, err := api.ReadProvenance(imagePath)
+	if os.IsNotExist(err) {
+		exitWithError(fmt.Sprintf("image %s has no provenance record, it was built by an older version of ops", args[0]))
+	}
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	if asJSON {
+		b, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			exitWithError(err.Error())
+		}
+		fmt.Println(string(b))
+		return
+	}
+
+	fmt.Printf("Image:          %s\n", imagePath)
+	fmt.Printf("Program:        %s\n", p.Program)
+	fmt.Printf("Program sha256: %s\n", p.ProgramSha256)
+	fmt.Printf("Target root:    %s\n", p.TargetRoot)
+	fmt.Printf("Ops version:    %s\n", p.OpsVersion)
+	fmt.Printf("Nanos version:  %s\n", p.NanosVersion)
+	fmt.Printf("Mkfs version:   %s\n", p.MkfsVersion)
+	fmt.Printf("Build host:     %s\n", p.BuildHost)
+	fmt.Printf("Built:          %s\n", p.Built.Format("2006-01-02 15:04:05 MST"))
+	fmt.Printf("\nManifest:\n%s\n", p.Manifest)
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	api "github.com/nanovms/ops/lepton"
+	"github.com/spf13/cobra"
+)
+
+// registryFlags adds the flags of the commands that connect to an OCI
+// registry
+func registryFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringP("username", "u", "", "registry username, defaults to OPS_REGISTRY_USERNAME or the credentials of 'docker login'")
+	cmd.PersistentFlags().Bool("insecure", false, "connect to the registry with plain HTTP")
+}
+
+// registryOptions returns the registry options of the flags, the password
+// is taken from OPS_REGISTRY_PASSWORD
+func registryOptions(cmd *cobra.Command) api.RegistryOptions {
+	username, _ := cmd.Flags().GetString("username")
+	insecure, _ := cmd.Flags().GetBool("insecure")
+	if username == "" {
+		username = os.Getenv("OPS_REGISTRY_USERNAME")
+	}
+	return api.RegistryOptions{
+		Username: username,
+		Password: os.Getenv("OPS_REGISTRY_PASSWORD"),
+		Insecure: insecure,
+	}
+}
+
+func imagePushCommand() *cobra.Command {
+	var cmdImagePush = &cobra.Command{
+		Use:   "push <image_name> <registry/repository:tag>",
+		Short: "push a local image with its provenance record and signature to an OCI registry",
+		Run:   imagePushCommandHandler,
+		Args:  cobra.ExactArgs(2),
+	}
+	registryFlags(cmdImagePush)
+	return cmdImagePush
+}
+
+func imagePushCommandHandler(cmd *cobra.Command, args []string) {
+	imagePath, err := localImagePath(args[0])
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	digest, err := api.PushImage(imagePath, args[1], registryOptions(cmd))
+	if err != nil {
+		exitWithError(err.Error())
+	}
+	fmt.Printf("pushed %s to %s@%s\n", imagePath, args[1], digest)
+}
+
+func imagePullCommand() *cobra.Command {
+	var cmdImagePull = &cobra.Command{
+		Use:   "pull <registry/repository[:tag|@digest]> [image_name]",
+		Short: "pull an image pushed by ops from an OCI registry to the local images",
+		Run:   imagePullCommandHandler,
+		Args:  cobra.RangeArgs(1, 2),
+	}
+	registryFlags(cmdImagePull)
+	return cmdImagePull
+}
+
+func imagePullCommandHandler(cmd *cobra.Command, args []string) {
+	ref, err := api.ParseImageReference(args[0])
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	// images are named after their repository by default
+	name := path.Base(ref.Repository)
+	if len(args) > 1 {
+		name = strings.TrimSuffix(path.Base(args[1]), ".img")
+	}
+	imagePath := path.Join(api.GetOpsHome(), "images", name+".img")
+
+	if err = api.PullImage(args[0], imagePath, registryOptions(cmd)); err != nil {
+		exitWithError(err.Error())
+	}
+	fmt.Printf("pulled %s to %s\n", ref, imagePath)
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+
+	api "github.com/nanovms/ops/lepton"
+	"github.com/spf13/cobra"
+)
+
+func imageSignCommand() *cobra.Command {
+	var key string
+	var cmdImageSign = &cobra.Command{
+		Use:   "sign <image_name>",
+		Short: "sign a local image and its provenance record",
+		Run:   imageSignCommandHandler,
+		Args:  cobra.ExactArgs(1),
+	}
+	cmdImageSign.PersistentFlags().StringVarP(&key, "key", "k", "", "ed25519 or ECDSA private key in PEM format")
+	cmdImageSign.MarkPersistentFlagRequired("key")
+	return cmdImageSign
+}
+
+func imageSignCommandHandler(cmd *cobra.Command, args []string) {
+	key, _ := cmd.Flags().GetString("key")
+
+	imagePath, err := localImagePath(args[0])
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	s, err := api.SignImage(imagePath, key)
+	if err != nil {
+		exitWithError(err.Error())
+	}
+	fmt.Printf("signed %s with key %s\n", imagePath, s.KeyID)
+}
+
+func imageVerifyCommand() *cobra.Command {
+	var keys []string
+	var cmdImageVerify = &cobra.Command{
+		Use:   "verify <image_name>",
+		Short: "verify the signature of a local image",
+		Run:   imageVerifyCommandHandler,
+		Args:  cobra.ExactArgs(1),
+	}
+	cmdImageVerify.PersistentFlags().StringArrayVarP(&keys, "key", "k", nil, "trusted public key in PEM format, defaults to TrustedKeys of the config")
+	return cmdImageVerify
+}
+
+func imageVerifyCommandHandler(cmd *cobra.Command, args []string) {
+	keys, _ := cmd.Flags().GetStringArray("key")
+	config, _ := cmd.Flags().GetString("config")
+
+	if len(keys) == 0 {
+		keys = unWarpConfig(config).TrustedKeys
+	}
+
+	imagePath, err := localImagePath(args[0])
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	s, err := api.VerifyImage(imagePath, keys)
+	if err != nil {
+		exitWithError(err.Error())
+	}
+	fmt.Printf("%s is signed by key %s\n", imagePath, s.KeyID)
+}
+
+func imageKeygenCommand() *cobra.Command {
+	var cmdImageKeygen = &cobra.Command{
+		Use:   "keygen <key_file>",
+		Short: "generate an ed25519 key pair to sign images with",
+		Run:   imageKeygenCommandHandler,
+		Args:  cobra.ExactArgs(1),
+	}
+	return cmdImageKeygen
+}
+
+func imageKeygenCommandHandler(cmd *cobra.Command, args []string) {
+	if err := api.GenerateSigningKey(args[0]); err != nil {
+		exitWithError(err.Error())
+	}
+	fmt.Printf("private key written to %s, public key to %s.pub\n", args[0], args[0])
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	api "github.com/nanovms/ops/lepton"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+// klibOptions describes the klibs configured through Klibs in the config
+var klibOptions = map[string]string{
+	"ntp":   "Klibs.NTP: Address, Port, PollMin, PollMax",
+	"radar": "Klibs.Radar: Key",
+}
+
+func klibListCommandHandler(cmd *cobra.Command, args []string) {
+	nightly, _ := cmd.Flags().GetBool("nightly")
+
+	var err error
+	if nightly {
+		_, err = downloadNightlyImages(&api.Config{NightlyBuild: true})
+	} else {
+		_, err = downloadReleaseImages()
+	}
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	klibs, err := api.ListKlibs(nightly)
+	if err != nil {
+		exitWithError(fmt.Sprintf("no klibs found for the current kernel release: %v", err))
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Name", "Options"})
+	table.SetHeaderColor(
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor})
+	table.SetRowLine(true)
+
+	for _, klib := range klibs {
+		table.Append([]string{klib, klibOptions[klib]})
+	}
+
+	table.Render()
+}
+
+func klibListCommand() *cobra.Command {
+	var cmdKlibList = &cobra.Command{
+		Use:   "list",
+		Short: "list klibs available in the current kernel release",
+		Run:   klibListCommandHandler,
+	}
+	return cmdKlibList
+}
+
+// KlibCommands handles klib related operations
+func KlibCommands() *cobra.Command {
+	var nightly bool
+	var cmdKlib = &cobra.Command{
+		Use:       "klib",
+		Short:     "manage nanos klibs",
+		ValidArgs: []string{"list"},
+		Args:      cobra.OnlyValidArgs,
+	}
+	cmdKlib.PersistentFlags().BoolVarP(&nightly, "nightly", "n", false, "nightly build")
+	cmdKlib.AddCommand(klibListCommand())
+	return cmdKlib
+}
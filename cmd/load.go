@@ -59,41 +59,18 @@ func downloadNightlyImages(c *api.Config) (string, error) {
 	return "nightly", err
 }
 
-// merge userconfig to package config, user config takes precedence
-func mergeConfigs(pkgConfig *api.Config, usrConfig *api.Config) *api.Config {
-
-	pkgConfig.Args = append(pkgConfig.Args, usrConfig.Args...)
-	pkgConfig.Dirs = append(pkgConfig.Dirs, usrConfig.Dirs...)
-	pkgConfig.Files = append(pkgConfig.Files, usrConfig.Files...)
-
-	if pkgConfig.MapDirs == nil {
-		pkgConfig.MapDirs = make(map[string]string)
-	}
-
-	if pkgConfig.Env == nil {
-		pkgConfig.Env = make(map[string]string)
-	}
-
-	for k, v := range usrConfig.MapDirs {
-		pkgConfig.MapDirs[k] = v
-	}
-
-	for k, v := range usrConfig.Env {
-		pkgConfig.Env[k] = v
-	}
-
-	pkgConfig.BaseVolumeSz = usrConfig.BaseVolumeSz
-	pkgConfig.RunConfig = usrConfig.RunConfig
-	pkgConfig.CloudConfig = usrConfig.CloudConfig
-	pkgConfig.Kernel = usrConfig.Kernel
-	pkgConfig.Boot = usrConfig.Boot
-	pkgConfig.Mkfs = usrConfig.Mkfs
-	pkgConfig.TargetRoot = usrConfig.TargetRoot
-	pkgConfig.Force = usrConfig.Force
-	pkgConfig.NightlyBuild = usrConfig.NightlyBuild
-	pkgConfig.NameServer = usrConfig.NameServer
-	pkgConfig.ManifestName = usrConfig.ManifestName
-
+// merge userconfig to package config, user config takes precedence: the
+// package config is the lower layer and the user config is merged over it,
+// sources are the fields the config files of the user set. The arguments of
+// the user follow the ones of the package, which start with the name of its
+// program.
+func mergeConfigs(pkgConfig *api.Config, usrConfig *api.Config, sources api.ConfigSources) *api.Config {
+	args := pkgConfig.Args
+	if len(usrConfig.Args) > 0 {
+		args = append(append([]string{}, pkgConfig.Args...), usrConfig.Args...)
+	}
+	api.MergeConfig(pkgConfig, usrConfig, sources)
+	pkgConfig.Args = args
 	return pkgConfig
 }
 
@@ -135,7 +112,7 @@ func loadCommandHandler(cmd *cobra.Command, args []string) {
 		panic(err)
 	}
 
-	pkgConfig := unWarpConfig(manifest)
+	pkgConfig := unWarpPackageConfig(manifest)
 
 	debugflags, err := strconv.ParseBool(cmd.Flag("debug").Value.String())
 	if err != nil {
@@ -205,7 +182,7 @@ func loadCommandHandler(cmd *cobra.Command, args []string) {
 	config, _ := cmd.Flags().GetString("config")
 	config = strings.TrimSpace(config)
 	cmdargs, _ := cmd.Flags().GetStringArray("args")
-	c := unWarpConfig(config)
+	c, sources := unWarpConfigSources(config)
 	c.Args = append(c.Args, cmdargs...)
 	AppendGlobalCmdFlagsToConfig(cmd.Flags(), c)
 
@@ -217,7 +194,7 @@ func loadCommandHandler(cmd *cobra.Command, args []string) {
 		pkgConfig.Debugflags = append(pkgConfig.Debugflags, "syscall_summary")
 	}
 
-	c = mergeConfigs(pkgConfig, c)
+	c = mergeConfigs(pkgConfig, c, sources)
 	pkgConfig.RunConfig.Verbose = verbose
 	pkgConfig.RunConfig.Bridged = bridged
 	pkgConfig.RunConfig.TapName = tapDeviceName
@@ -259,7 +236,7 @@ func loadCommandHandler(cmd *cobra.Command, args []string) {
 
 	if !skipbuild {
 		if err = buildFromPackage(expackage, c); err != nil {
-			panic(err)
+			exitWithError(buildErrorMessage(err))
 		}
 	}
 
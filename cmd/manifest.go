@@ -26,6 +26,20 @@ func printManifestHandler(cmd *cobra.Command, args []string) {
 	}
 	config = strings.TrimSpace(config)
 
+	manifestFile, _ := cmd.Flags().GetString("manifest-file")
+	if manifestFile != "" {
+		m, err := api.ReadManifestFile(manifestFile, targetRoot)
+		if err != nil {
+			exitWithError(err.Error())
+		}
+		fmt.Println(m.String())
+		return
+	}
+
+	if len(args) == 0 {
+		exitForCmd(cmd, "Please mention ELF file or manifest file")
+	}
+
 	c := unWarpConfig(config)
 	AppendGlobalCmdFlagsToConfig(cmd.Flags(), c)
 
@@ -35,8 +49,7 @@ func printManifestHandler(cmd *cobra.Command, args []string) {
 	c.TargetRoot = targetRoot
 	m, err := api.BuildManifest(c)
 	if err != nil {
-		fmt.Println(err)
-		return
+		exitWithError(buildErrorMessage(err))
 	}
 	fmt.Println(m.String())
 }
@@ -46,14 +59,15 @@ func ManifestCommand() *cobra.Command {
 	var config string
 	var targetRoot string
 	var nightly bool
+	var manifestFile string
 	var cmdPrintConfig = &cobra.Command{
 		Use:   "manifest [ELF file]",
 		Short: "Print the manifest to console",
-		Args:  cobra.MinimumNArgs(1),
 		Run:   printManifestHandler,
 	}
 	cmdPrintConfig.PersistentFlags().StringVarP(&config, "config", "c", "", "ops config file")
 	cmdPrintConfig.PersistentFlags().StringVarP(&targetRoot, "target-root", "r", "", "target root")
 	cmdPrintConfig.PersistentFlags().BoolVarP(&nightly, "nightly", "n", false, "nightly build")
+	cmdPrintConfig.PersistentFlags().StringVar(&manifestFile, "manifest-file", "", "read and print manifest file instead of building one from ELF")
 	return cmdPrintConfig
 }
@@ -12,11 +12,13 @@ func GetRootCommand() *cobra.Command {
 	rootCmd.PersistentFlags().Bool("show-warnings", false, "display warning messages")
 	rootCmd.PersistentFlags().Bool("show-errors", false, "display error messages")
 	rootCmd.PersistentFlags().Bool("show-debug", false, "display debug messages")
+	rootCmd.PersistentFlags().StringVar(&configProfile, "profile", "", "config profile to apply on top of the config file")
 
 	rootCmd.AddCommand(RunCommand())
 	rootCmd.AddCommand(NetCommands())
 	rootCmd.AddCommand(BuildCommand())
 	rootCmd.AddCommand(ManifestCommand())
+	rootCmd.AddCommand(DepsCommand())
 	rootCmd.AddCommand(VersionCommand())
 	rootCmd.AddCommand(ProfileCommand())
 	rootCmd.AddCommand(UpdateCommand())
@@ -25,6 +27,9 @@ func GetRootCommand() *cobra.Command {
 	rootCmd.AddCommand(InstanceCommands())
 	rootCmd.AddCommand(ImageCommands())
 	rootCmd.AddCommand(VolumeCommands())
+	rootCmd.AddCommand(KlibCommands())
+	rootCmd.AddCommand(ConfigCommands())
+	rootCmd.AddCommand(CacheCommands())
 
 	return rootCmd
 }
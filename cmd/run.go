@@ -149,6 +149,21 @@ func runCommandHandler(cmd *cobra.Command, args []string) {
 		panic(err)
 	}
 
+	jar, err := cmd.Flags().GetString("jar")
+	if err != nil {
+		panic(err)
+	}
+
+	goPackage, err := cmd.Flags().GetString("go")
+	if err != nil {
+		panic(err)
+	}
+
+	noCache, err := cmd.Flags().GetBool("no-cache")
+	if err != nil {
+		panic(err)
+	}
+
 	c := unWarpConfig(config)
 	AppendGlobalCmdFlagsToConfig(cmd.Flags(), c)
 
@@ -157,12 +172,32 @@ func runCommandHandler(cmd *cobra.Command, args []string) {
 		manifestName = c.ManifestName
 	}
 
-	c.Program = args[0]
+	if noCache {
+		c.NoCache = true
+	}
+	if jar != "" {
+		c.Java.Jar = jar
+	}
+	if goPackage != "" {
+		c.Go.Package = goPackage
+	}
+	program := c.Java.Jar
+	if c.Go.Package != "" {
+		program = goProgramName(c.Go.Package)
+	}
+	if len(args) > 0 {
+		program = args[0]
+	}
+	if program == "" {
+		exitForCmd(cmd, "Please mention ELF file, script, --jar or --go")
+	}
+
+	c.Program = program
 	curdir, _ := os.Getwd()
-	c.ProgramPath = path.Join(curdir, args[0])
+	c.ProgramPath = path.Join(curdir, program)
 
 	if len(c.Args) == 0 {
-		c.Args = append([]string{args[0]}, cmdargs...)
+		c.Args = append([]string{program}, cmdargs...)
 	} else {
 		c.Args = append(c.Args, cmdargs...)
 	}
@@ -189,17 +224,21 @@ func runCommandHandler(cmd *cobra.Command, args []string) {
 
 		c.Debugflags = append(c.Debugflags, "noaslr")
 
-		elfFile, err := api.GetElfFileInfo(c.ProgramPath)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if api.IsDynamicLinked(elfFile) {
-			log.Fatalf("Program %s must be linked statically", c.ProgramPath)
-		}
-
-		if !api.HasDebuggingSymbols(elfFile) {
-			log.Fatalf("Program %s must be compiled with debugging symbols", c.ProgramPath)
+		// Go packages are built statically with debugging symbols in debug
+		// mode
+		if c.Go.Package == "" {
+			elfFile, err := api.GetElfFileInfo(c.ProgramPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if api.IsDynamicLinked(elfFile) {
+				log.Fatalf("Program %s must be linked statically", c.ProgramPath)
+			}
+
+			if !api.HasDebuggingSymbols(elfFile) {
+				log.Fatalf("Program %s must be compiled with debugging symbols", c.ProgramPath)
+			}
 		}
 	}
 
@@ -259,8 +298,10 @@ func runCommandHandler(cmd *cobra.Command, args []string) {
 	if !skipbuild {
 		err = buildImages(c)
 		if err != nil {
-			panic(err)
+			exitWithError(buildErrorMessage(err))
 		}
+	} else if err = api.VerifyImageSignature(c, c.RunConfig.Imagename); err != nil {
+		exitWithError(err.Error())
 	}
 
 	portsFlag, err := cmd.Flags().GetStringArray("port")
@@ -322,16 +363,19 @@ func RunCommand() *cobra.Command {
 	var syscallSummary bool
 
 	var skipbuild bool
+	var noCache bool
 	var manifestName string
 	var accel bool
 	var config string
 	var imageName string
 	var targetRoot string
+	var jar string
+	var goPackage string
 
 	var cmdRun = &cobra.Command{
 		Use:   "run [elf]",
 		Short: "Run ELF binary as unikernel",
-		Args:  cobra.MinimumNArgs(1),
+		Args:  cobra.ArbitraryArgs,
 		Run:   runCommandHandler,
 	}
 	cmdRun.PersistentFlags().StringArrayVarP(&ports, "port", "p", nil, "port to forward")
@@ -345,6 +389,8 @@ func RunCommand() *cobra.Command {
 	cmdRun.PersistentFlags().StringArrayVarP(&envs, "envs", "e", nil, "env arguments")
 	cmdRun.PersistentFlags().StringVarP(&config, "config", "c", "", "ops config file")
 	cmdRun.PersistentFlags().StringVarP(&targetRoot, "target-root", "r", "", "target root")
+	cmdRun.PersistentFlags().StringVar(&jar, "jar", "", "run a jar with the JRE on the host or in the target root")
+	cmdRun.PersistentFlags().StringVar(&goPackage, "go", "", "build and run a Go package, such as ./cmd/server")
 	cmdRun.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose")
 	cmdRun.PersistentFlags().BoolVarP(&bridged, "bridged", "b", false, "bridge networking")
 	cmdRun.PersistentFlags().StringVarP(&tap, "tapname", "t", "", "tap device name")
@@ -352,6 +398,7 @@ func RunCommand() *cobra.Command {
 	cmdRun.PersistentFlags().String("gateway", "", "network gateway")
 	cmdRun.PersistentFlags().String("netmask", "255.255.255.0", "network mask")
 	cmdRun.PersistentFlags().BoolVarP(&skipbuild, "skipbuild", "s", false, "skip building image")
+	cmdRun.PersistentFlags().BoolVar(&noCache, "no-cache", false, "build the image even if the build cache has it")
 	cmdRun.PersistentFlags().StringVarP(&imageName, "imagename", "i", "", "image name")
 	cmdRun.PersistentFlags().StringVarP(&manifestName, "manifest-name", "m", "", "save manifest to file")
 	cmdRun.PersistentFlags().BoolVar(&accel, "accel", true, "use cpu virtualization extension")
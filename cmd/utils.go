@@ -1,9 +1,7 @@
 package cmd
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -34,64 +32,74 @@ func exitForCmd(cmd *cobra.Command, errs string) {
 	os.Exit(1)
 }
 
-// unWarpConfig parses lepton config file from file
+// configProfile is the config profile selected with the --profile flag
+var configProfile string
+
+// unWarpConfig parses lepton config file from file, or the default config
+// file when file is empty, with the selected profile
 func unWarpConfig(file string) *api.Config {
-	var c api.Config
-	if file != "" {
-		c = *api.NewConfig()
-		data, err := ioutil.ReadFile(file)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error reading config: %v\n", err)
-			os.Exit(1)
-		}
-		err = json.Unmarshal(data, &c)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error config: %v\n", err)
-			os.Exit(1)
-		}
-		return &c
+	c, _ := unWarpConfigSources(file)
+	return c
+}
+
+// unWarpConfigSources is unWarpConfig that also returns the fields the
+// config files set, which mergeConfigs needs
+func unWarpConfigSources(file string) (*api.Config, api.ConfigSources) {
+	c, sources, err := loadConfig(file, configProfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error config: %v\n", err)
+		os.Exit(1)
 	}
-	c = *unWarpDefaultConfig()
-	return &c
+	return c, sources
 }
 
-// unWarpDefaultConfig gets default config file from env
-func unWarpDefaultConfig() *api.Config {
-	c := *api.NewConfig()
+// unWarpPackageConfig parses the config of a package manifest, profiles and
+// strict field checks only apply to user config files
+func unWarpPackageConfig(manifest string) *api.Config {
+	c, err := api.LoadPackageConfig(manifest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error config: %v\n", err)
+		os.Exit(1)
+	}
+	return c
+}
+
+// loadConfig loads file, or the default config file when file is empty, and
+// returns the files each value came from
+func loadConfig(file string, profile string) (*api.Config, api.ConfigSources, error) {
+	if file == "" {
+		file = defaultConfigFile()
+	}
+	return api.LoadConfig(file, profile)
+}
+
+// defaultConfigFile gets default config file from env, or ~/.opsrc when it
+// exists
+func defaultConfigFile() string {
 	conf := os.Getenv("OPS_DEFAULT_CONFIG")
 	if conf != "" {
-		data, err := ioutil.ReadFile(conf)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error reading config: %v\n", err)
-			os.Exit(1)
-		}
-		err = json.Unmarshal(data, &c)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error config: %v\n", err)
-			os.Exit(1)
-		}
-		return &c
+		return conf
 	}
 	usr, err := user.Current()
 	if err != nil {
-		return &c
+		return ""
 	}
 	conf = usr.HomeDir + "/.opsrc"
-	_, err = os.Stat(conf)
-	if err != nil {
-		return &c
+	if _, err = os.Stat(conf); err != nil {
+		return ""
 	}
-	data, err := ioutil.ReadFile(conf)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error reading config: %v\n", err)
-		os.Exit(1)
-	}
-	err = json.Unmarshal(data, &c)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error config: %v\n", err)
-		os.Exit(1)
+	return conf
+}
+
+// goProgramName returns the program name of a Go package, the directory of
+// local packages gives the name of the image like it does for 'go build'
+func goProgramName(pkg string) string {
+	if fi, err := os.Stat(pkg); err == nil && fi.IsDir() {
+		if dir, err := filepath.Abs(pkg); err == nil {
+			return dir
+		}
 	}
-	return &c
+	return pkg
 }
 
 // setDefaultImageName set default name for an image
@@ -179,7 +187,7 @@ func fixupConfigImages(c *api.Config, version string) {
 		c.Mkfs = path.Join(api.GetOpsHome(), version, "mkfs")
 	}
 
-	if c.NameServer == "" {
+	if c.NameServer == "" && len(c.NameServers) == 0 {
 		// google dns server
 		c.NameServer = "8.8.8.8"
 	}
@@ -190,7 +198,7 @@ func validateRequired(c *api.Config) {
 		fmt.Fprintf(os.Stderr, "error: %v: %v\n", c.Kernel, err)
 		os.Exit(1)
 	}
-	if _, err := os.Stat(c.Mkfs); os.IsNotExist(err) {
+	if _, err := os.Stat(c.Mkfs); !c.NativeMkfs && os.IsNotExist(err) {
 		fmt.Fprintf(os.Stderr, "error: %v: %v\n", c.Mkfs, err)
 		os.Exit(1)
 	}
@@ -198,6 +206,11 @@ func validateRequired(c *api.Config) {
 		fmt.Fprintf(os.Stderr, "error: %v: %v\n", c.Boot, err)
 		os.Exit(1)
 	}
+	// the program of a Go package is built with the image, the one of an
+	// OCI image is in its rootfs
+	if c.Go.Package != "" || c.OCI.Image != "" {
+		return
+	}
 	_, err := os.Stat(path.Join(api.GetOpsHome(), c.Program))
 	_, err1 := os.Stat(c.Program)
 
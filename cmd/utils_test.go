@@ -4,6 +4,8 @@ import (
 	"reflect"
 	"testing"
 	"time"
+
+	api "github.com/nanovms/ops/lepton"
 )
 
 func TestValidateNetworkPorts(t *testing.T) {
@@ -132,3 +134,40 @@ func TestSubtractDateNotation(t *testing.T) {
 		}
 	})
 }
+
+func TestMergeConfigs(t *testing.T) {
+	pkgConfig := &api.Config{
+		Program:    "node",
+		Args:       []string{"node"},
+		Env:        map[string]string{"NODE_ENV": "production", "PORT": "80"},
+		Kernel:     "pkg/kernel.img",
+		NameServer: "10.0.0.1",
+		RunConfig:  api.RunConfig{Memory: "2G", Ports: []string{"80"}},
+	}
+	usrConfig := &api.Config{
+		Args:      []string{"server.js"},
+		Env:       map[string]string{"PORT": "8080"},
+		RunConfig: api.RunConfig{Memory: "512M", Ports: []string{"8080"}},
+	}
+
+	c := mergeConfigs(pkgConfig, usrConfig, nil)
+	if c.Program != "node" {
+		t.Errorf("got program %q, want node", c.Program)
+	}
+	if want := []string{"node", "server.js"}; !reflect.DeepEqual(c.Args, want) {
+		t.Errorf("got args %v, want %v", c.Args, want)
+	}
+	if want := map[string]string{"NODE_ENV": "production", "PORT": "8080"}; !reflect.DeepEqual(c.Env, want) {
+		t.Errorf("got env %v, want %v", c.Env, want)
+	}
+
+	// the run configuration of the user is layered over the one of the
+	// package
+	want := api.RunConfig{Memory: "512M", Ports: []string{"8080"}}
+	if !reflect.DeepEqual(c.RunConfig, want) {
+		t.Errorf("got run config %+v, want %+v", c.RunConfig, want)
+	}
+	if c.Kernel != "pkg/kernel.img" || c.NameServer != "10.0.0.1" {
+		t.Errorf("got kernel %q and nameserver %q, want the ones of the package", c.Kernel, c.NameServer)
+	}
+}
@@ -0,0 +1,45 @@
+package fs
+
+import (
+	"fmt"
+)
+
+// FileError is returned when the contents of a file in the manifest can not
+// be read
+type FileError struct {
+	VMPath   string
+	HostPath string
+	Cause    error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("can not read '%s' for '%s': %v", e.HostPath, e.VMPath, e.Cause)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Cause
+}
+
+// ManifestError is returned for manifest entries that can not be written to
+// a filesystem
+type ManifestError struct {
+	VMPath string
+	Msg    string
+}
+
+func (e *ManifestError) Error() string {
+	return fmt.Sprintf("manifest entry '%s': %s", e.VMPath, e.Msg)
+}
+
+// SizeError is returned when the files of a filesystem do not fit in its
+// size
+type SizeError struct {
+	// Filesystem is "boot" or "root"
+	Filesystem string
+	Size       int64
+	Required   int64
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("%s filesystem of %d bytes is too small, %d bytes are required", e.Filesystem, e.Size, e.Required)
+}
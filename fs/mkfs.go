@@ -0,0 +1,196 @@
+package fs
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	// BootFSSize is the size of the boot filesystem with the kernel and the
+	// klibs
+	BootFSSize = 12 * 1024 * 1024
+
+	partitionTableOffset = 446
+	partitionEntrySize   = 16
+	partitionTypeLinux   = 0x83
+)
+
+// Options configure the image written by Mkfs
+type Options struct {
+	// Boot is the path of the boot image. It is written at the start of the
+	// image with a boot filesystem for the boot tuple of the manifest and a
+	// partition table.
+	Boot string
+
+	// Size of the root filesystem in bytes (defaults to the end of the
+	// last file).
+	Size int64
+
+	// Label of the root filesystem.
+	Label string
+
+	// UUID of the root filesystem (defaults to a random UUID).
+	UUID UUID
+
+	// Resolve returns the path to read the contents of a host file of the
+	// manifest from, such as the path in a target root.
+	Resolve func(hostpath string) (string, error)
+
+	// Progress is called after each file is written.
+	Progress func(Progress)
+}
+
+// Progress reports the files written by Mkfs
+type Progress struct {
+	// VMPath of the last file written
+	VMPath string
+
+	Files      int
+	TotalFiles int
+	Bytes      int64
+	TotalBytes int64
+}
+
+// progress counts the files written to the filesystems of an image
+type progress struct {
+	Progress
+	fn func(Progress)
+}
+
+func (p *progress) add(vmpath string, size int64) {
+	p.VMPath = vmpath
+	p.Files++
+	p.Bytes += size
+	if p.fn != nil {
+		p.fn(p.Progress)
+	}
+}
+
+// Mkfs writes the nanos filesystem of a manifest, given as its root tuple
+// with tuples, vectors and strings, to the image at path. It returns the UUID
+// of the root filesystem.
+func Mkfs(path string, manifest map[string]interface{}, opts Options) (UUID, error) {
+	uuid := opts.UUID
+	if uuid == (UUID{}) {
+		var err error
+		if uuid, err = newUUID(); err != nil {
+			return uuid, err
+		}
+	}
+
+	// the boot tuple is the root of the boot filesystem
+	rootManifest := make(map[string]interface{}, len(manifest))
+	for k, v := range manifest {
+		if k != "boot" {
+			rootManifest[k] = v
+		}
+	}
+	rootfs, err := newTFS(rootManifest, uuid, opts.Label, opts.Resolve)
+	if err != nil {
+		return uuid, err
+	}
+
+	var bootfs *tfs
+	if boot, ok := manifest["boot"].(map[string]interface{}); ok && opts.Boot != "" {
+		if bootfs, err = newTFS(boot, bootUUID(uuid), "", opts.Resolve); err != nil {
+			return uuid, err
+		}
+	}
+
+	p := &progress{fn: opts.Progress}
+	for _, t := range []*tfs{bootfs, rootfs} {
+		if t == nil {
+			continue
+		}
+		for _, f := range t.files {
+			p.TotalFiles++
+			p.TotalBytes += f.size
+		}
+	}
+
+	fd, err := os.Create(path)
+	if err != nil {
+		return uuid, err
+	}
+	defer fd.Close()
+
+	var offset int64
+	var partitions [][2]int64
+	if opts.Boot != "" {
+		boot, err := ioutil.ReadFile(opts.Boot)
+		if err != nil {
+			return uuid, err
+		}
+		if len(boot) < SectorSize {
+			return uuid, fmt.Errorf("boot image %s has no boot record", opts.Boot)
+		}
+		if _, err = fd.WriteAt(boot, 0); err != nil {
+			return uuid, err
+		}
+		offset = roundUp(int64(len(boot)), SectorSize)
+
+		if bootfs != nil {
+			if _, err = bootfs.write(fd, offset, BootFSSize, "boot", p); err != nil {
+				return uuid, err
+			}
+			partitions = append(partitions, [2]int64{offset, BootFSSize})
+			offset += BootFSSize
+		}
+	}
+
+	size, err := rootfs.write(fd, offset, opts.Size, "root", p)
+	if err != nil {
+		return uuid, err
+	}
+	if opts.Boot != "" {
+		partitions = append(partitions, [2]int64{offset, size})
+		if err = writePartitions(fd, partitions); err != nil {
+			return uuid, err
+		}
+	}
+
+	if err = fd.Truncate(offset + size); err != nil {
+		return uuid, err
+	}
+	return uuid, fd.Close()
+}
+
+// bootUUID returns the UUID of the boot filesystem of an image, derived from
+// the UUID of its root filesystem
+func bootUUID(uuid UUID) UUID {
+	var u UUID
+	sum := sha1.Sum(append([]byte("boot"), uuid[:]...))
+	copy(u[:], sum[:])
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	return u
+}
+
+// writePartitions writes the partition table of the boot record with the
+// offset and size of each filesystem
+func writePartitions(fd *os.File, partitions [][2]int64) error {
+	table := make([]byte, partitionEntrySize*len(partitions))
+	for i, part := range partitions {
+		lba, sectors := part[0]/SectorSize, sectorsOf(part[1])
+		if lba+sectors > 1<<32-1 {
+			return &SizeError{Filesystem: "root", Size: (1<<32 - 1 - lba) * SectorSize, Required: part[1]}
+		}
+
+		e := table[i*partitionEntrySize:]
+		// the root filesystem is active, CHS addresses are set to their
+		// maximum to use LBA
+		if i == len(partitions)-1 {
+			e[0] = 0x80
+		}
+		copy(e[1:4], []byte{0xfe, 0xff, 0xff})
+		e[4] = partitionTypeLinux
+		copy(e[5:8], []byte{0xfe, 0xff, 0xff})
+		binary.LittleEndian.PutUint32(e[8:12], uint32(lba))
+		binary.LittleEndian.PutUint32(e[12:16], uint32(sectors))
+	}
+	_, err := fd.WriteAt(table, partitionTableOffset)
+	return err
+}
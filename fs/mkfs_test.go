@@ -0,0 +1,151 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testManifest(hostpath string) map[string]interface{} {
+	return map[string]interface{}{
+		"children": map[string]interface{}{
+			"etc": map[string]interface{}{
+				"children": map[string]interface{}{
+					"hosts": map[string]interface{}{"contents": "127.0.0.1 localhost\n"},
+				},
+			},
+			"hello": map[string]interface{}{"contents": map[string]interface{}{"host": hostpath}},
+			"hi":    map[string]interface{}{"linktarget": "/hello"},
+		},
+		"program":   "/hello",
+		"arguments": []string{"/hello", "-v"},
+	}
+}
+
+func TestMkfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mkfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hello := bytes.Repeat([]byte("hello"), 200)
+	ioutil.WriteFile(filepath.Join(dir, "hello"), hello, 0755)
+
+	var progress []Progress
+	uuid := UUID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	image := filepath.Join(dir, "image")
+	got, err := Mkfs(image, testManifest(filepath.Join(dir, "hello")), Options{
+		UUID:     uuid,
+		Label:    "data",
+		Progress: func(p Progress) { progress = append(progress, p) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uuid, got)
+	assert.Equal(t, "01020304-0506-0708-090a-0b0c0d0e0f10", got.String())
+
+	b, err := ioutil.ReadFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, logExtensionSize+SectorSize+1024, len(b))
+	assert.Equal(t, []byte(tfsMagic), b[:6])
+	assert.Equal(t, []byte{3, 0x90, 0x00}, b[6:9], "version and log size in sectors")
+	assert.Equal(t, uuid[:], b[9:25])
+	assert.Equal(t, []byte("data\x00"), b[25:30])
+	assert.Equal(t, byte(tupleAvailable), b[57])
+	assert.Contains(t, string(b[:logExtensionSize]), "filelength")
+
+	// the contents of files follow the log in the order of their paths
+	assert.Equal(t, []byte("127.0.0.1 localhost\n"), b[logExtensionSize:logExtensionSize+20])
+	assert.True(t, bytes.Equal(hello, b[logExtensionSize+SectorSize:logExtensionSize+SectorSize+1000]))
+
+	assert.Equal(t, []Progress{
+		{VMPath: "/etc/hosts", Files: 1, TotalFiles: 2, Bytes: 20, TotalBytes: 1020},
+		{VMPath: "/hello", Files: 2, TotalFiles: 2, Bytes: 1020, TotalBytes: 1020},
+	}, progress)
+}
+
+func TestMkfsBoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mkfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	boot := make([]byte, 1000)
+	boot[510], boot[511] = 0x55, 0xaa
+	ioutil.WriteFile(filepath.Join(dir, "boot.img"), boot, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "kernel.img"), []byte("kernel"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "hello"), []byte("hello"), 0755)
+
+	manifest := testManifest(filepath.Join(dir, "hello"))
+	manifest["boot"] = map[string]interface{}{
+		"children": map[string]interface{}{
+			"kernel": map[string]interface{}{"contents": map[string]interface{}{"host": filepath.Join(dir, "kernel.img")}},
+		},
+	}
+	image := filepath.Join(dir, "image")
+	if _, err = Mkfs(image, manifest, Options{Boot: filepath.Join(dir, "boot.img")}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bootfs := int64(1024)
+	rootfs := bootfs + BootFSSize
+	assert.Equal(t, rootfs+logExtensionSize+2*SectorSize, int64(len(b)))
+	assert.Equal(t, []byte{0x55, 0xaa}, b[510:512])
+	assert.Equal(t, []byte(tfsMagic), b[bootfs:bootfs+6])
+	assert.Equal(t, []byte("kernel"), b[bootfs+logExtensionSize:bootfs+logExtensionSize+6])
+	assert.Equal(t, []byte(tfsMagic), b[rootfs:rootfs+6])
+	assert.NotContains(t, string(b[rootfs:rootfs+logExtensionSize]), "kernel")
+
+	part := func(i int) (byte, uint32, uint32) {
+		e := b[partitionTableOffset+i*partitionEntrySize:]
+		return e[0], binary.LittleEndian.Uint32(e[8:]), binary.LittleEndian.Uint32(e[12:])
+	}
+	status, lba, sectors := part(0)
+	assert.Equal(t, byte(0), status)
+	assert.Equal(t, uint32(2), lba)
+	assert.Equal(t, uint32(BootFSSize/SectorSize), sectors)
+	status, lba, sectors = part(1)
+	assert.Equal(t, byte(0x80), status)
+	assert.Equal(t, uint32(rootfs/SectorSize), lba)
+	assert.Equal(t, uint32(logExtensionSize/SectorSize+2), sectors)
+}
+
+func TestMkfsErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mkfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image := filepath.Join(dir, "image")
+
+	_, err = Mkfs(image, testManifest(filepath.Join(dir, "missing")), Options{})
+	var fileErr *FileError
+	if assert.True(t, errors.As(err, &fileErr)) {
+		assert.Equal(t, "/hello", fileErr.VMPath)
+		assert.True(t, os.IsNotExist(fileErr.Cause))
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "hello"), []byte("hello"), 0755)
+	_, err = Mkfs(image, testManifest(filepath.Join(dir, "hello")), Options{Size: logExtensionSize})
+	assert.Equal(t, &SizeError{Filesystem: "root", Size: logExtensionSize, Required: logExtensionSize + 2*SectorSize}, err)
+
+	manifest := testManifest(filepath.Join(dir, "hello"))
+	manifest["children"].(map[string]interface{})["bad"] = "file"
+	_, err = Mkfs(image, manifest, Options{})
+	assert.Equal(t, &ManifestError{VMPath: "/bad", Msg: "entry must be a tuple"}, err)
+}
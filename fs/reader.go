@@ -0,0 +1,511 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLinks is the number of symbolic links followed to resolve a path
+const maxLinks = 40
+
+var (
+	errNotDir     = errors.New("not a directory")
+	errIsDir      = errors.New("is a directory")
+	errTooManySym = errors.New("too many levels of symbolic links")
+)
+
+// FormatError is returned when a file is not a nanos image or filesystem
+type FormatError struct {
+	Path string
+	Msg  string
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Msg)
+}
+
+// Reader reads the files of the root filesystem of a nanos image or volume
+type Reader struct {
+	UUID  UUID
+	Label string
+
+	fd     *os.File
+	path   string
+	offset int64
+	root   *tuple
+
+	// the decoder of the log, and the offsets of the end of the log and of
+	// the end of its last extension in the filesystem
+	log      *decoder
+	logEnd   int64
+	logLimit int64
+}
+
+// Open opens the image or volume at path
+func Open(path string) (*Reader, error) {
+	return openImage(path, os.O_RDONLY)
+}
+
+func openImage(path string, flag int) (*Reader, error) {
+	fd, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{fd: fd, path: path}
+	if err = r.readRoot(); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close closes the image
+func (r *Reader) Close() error {
+	return r.fd.Close()
+}
+
+// readRoot finds the root filesystem, which starts the file of volumes and
+// is the active partition of images, and reads its log
+func (r *Reader) readRoot() error {
+	mbr := make([]byte, SectorSize)
+	if _, err := io.ReadFull(r.fd, mbr); err != nil {
+		return &FormatError{Path: r.path, Msg: "file is too small"}
+	}
+
+	if string(mbr[:len(tfsMagic)]) != tfsMagic {
+		if mbr[510] != 0x55 || mbr[511] != 0xaa {
+			return &FormatError{Path: r.path, Msg: "no nanos filesystem or boot record"}
+		}
+		var found bool
+		for i := 0; i < 4; i++ {
+			e := mbr[partitionTableOffset+i*partitionEntrySize:]
+			if e[4] != partitionTypeLinux {
+				continue
+			}
+			if !found || e[0] == 0x80 {
+				r.offset = int64(binary.LittleEndian.Uint32(e[8:12])) * SectorSize
+				found = true
+			}
+		}
+		if !found {
+			return &FormatError{Path: r.path, Msg: "no filesystem partition"}
+		}
+	}
+
+	return r.readLog(0)
+}
+
+// readLog decodes the entries of the log extensions starting at offset in
+// the filesystem
+func (r *Reader) readLog(offset int64) error {
+	d := newDecoder()
+	for {
+		sr := io.NewSectionReader(r.fd, r.offset+offset, 1<<62)
+		br := bufio.NewReader(sr)
+		magic := make([]byte, len(tfsMagic))
+		if _, err := io.ReadFull(br, magic); err != nil || string(magic) != tfsMagic {
+			return &FormatError{Path: r.path, Msg: fmt.Sprintf("no filesystem log at offset %d", r.offset+offset)}
+		}
+		version, err := readVarint(br)
+		if err != nil {
+			return r.formatError(err)
+		}
+		if version != tfsVersion {
+			return &FormatError{Path: r.path, Msg: fmt.Sprintf("unsupported filesystem version %d", version)}
+		}
+		sectors, err := readVarint(br)
+		if err != nil {
+			return r.formatError(err)
+		}
+		header := make([]byte, uuidLength+labelLength)
+		if _, err = io.ReadFull(br, header); err != nil {
+			return r.formatError(err)
+		}
+		if offset == 0 {
+			copy(r.UUID[:], header)
+			r.Label = string(bytes.TrimRight(header[uuidLength:], "\x00"))
+		}
+
+		next, err := r.readEntries(br, d)
+		if err != nil {
+			return r.formatError(err)
+		}
+		if next == 0 {
+			// the end of log entry is the last byte read
+			pos, _ := sr.Seek(0, io.SeekCurrent)
+			r.logEnd = offset + pos - int64(br.Buffered()) - 1
+			r.logLimit = offset + int64(sectors)*SectorSize
+			break
+		}
+		offset = next
+	}
+	r.log = d
+
+	root, ok := d.dictionary[1].(*tuple)
+	if !ok {
+		return &FormatError{Path: r.path, Msg: "filesystem has no root"}
+	}
+	r.root = root
+	return nil
+}
+
+// readEntries decodes the entries of a log extension, it returns the offset
+// of the next extension or 0 at the end of the log
+func (r *Reader) readEntries(br *bufio.Reader, d *decoder) (int64, error) {
+	for {
+		entry, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch entry {
+		case tupleAvailable:
+			if _, err = d.decodeValue(br); err != nil {
+				return 0, err
+			}
+		case tupleExtended:
+			// entries added to a tuple written before, such as the
+			// extents of a file written after its tuple
+			if err = d.decodeExtension(br); err != nil {
+				return 0, err
+			}
+		case endOfSegment:
+			// segments only split the log of an extension
+		case endOfLog:
+			return 0, nil
+		case logExtensionLink:
+			sectors, err := readVarint(br)
+			if err != nil {
+				return 0, err
+			}
+			if _, err = readVarint(br); err != nil {
+				return 0, err
+			}
+			return int64(sectors) * SectorSize, nil
+		default:
+			return 0, fmt.Errorf("unsupported log entry %d", entry)
+		}
+	}
+}
+
+func (r *Reader) formatError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &FormatError{Path: r.path, Msg: "filesystem log is truncated"}
+	}
+	return &FormatError{Path: r.path, Msg: err.Error()}
+}
+
+// lookup returns the tuple at vmpath, the last element is only resolved
+// when it is a link if follow is set
+func (r *Reader) lookup(vmpath string, follow bool) (*tuple, error) {
+	parts := strings.FieldsFunc(vmpath, func(c rune) bool { return c == '/' })
+	dir := r.root
+	var dirpath string
+	links := 0
+	for i := 0; i < len(parts); i++ {
+		children, ok := dir.entries["children"].(*tuple)
+		if !ok {
+			return nil, &os.PathError{Op: "open", Path: vmpath, Err: errNotDir}
+		}
+		child, ok := children.entries[parts[i]].(*tuple)
+		if !ok {
+			return nil, &os.PathError{Op: "open", Path: vmpath, Err: os.ErrNotExist}
+		}
+
+		target, isLink := child.entries["linktarget"].(string)
+		if isLink && (i < len(parts)-1 || follow) {
+			if links++; links > maxLinks {
+				return nil, &os.PathError{Op: "open", Path: vmpath, Err: errTooManySym}
+			}
+			if !strings.HasPrefix(target, "/") {
+				target = path.Join(dirpath, target)
+			}
+			rest := strings.FieldsFunc(target, func(c rune) bool { return c == '/' })
+			parts = append(rest, parts[i+1:]...)
+			dir, dirpath, i = r.root, "", -1
+			continue
+		}
+
+		dir = child
+		dirpath = path.Join(dirpath, parts[i])
+	}
+	return dir, nil
+}
+
+// fileInfo describes a file of the filesystem
+type fileInfo struct {
+	name string
+	t    *tuple
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	if fi.IsDir() {
+		return 0
+	}
+	if target, ok := fi.t.entries["linktarget"].(string); ok {
+		return int64(len(target))
+	}
+	size, _ := strconv.ParseInt(stringEntry(fi.t, "filelength"), 10, 64)
+	return size
+}
+
+// Mode returns the mode recorded for the file, or 0755 for directories and
+// 0644 for files without one
+func (fi *fileInfo) Mode() os.FileMode {
+	var mode os.FileMode = 0644
+	switch {
+	case fi.IsDir():
+		mode = os.ModeDir | 0755
+	case fi.t.entries["linktarget"] != nil:
+		return os.ModeSymlink | 0777
+	}
+	if m, err := strconv.ParseUint(stringEntry(fi.t, "mode"), 8, 32); err == nil {
+		mode = mode&os.ModeType | os.FileMode(m).Perm()
+	}
+	return mode
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	mtime, _ := strconv.ParseInt(stringEntry(fi.t, "mtime"), 10, 64)
+	return time.Unix(mtime, 0)
+}
+
+func (fi *fileInfo) IsDir() bool {
+	_, ok := fi.t.entries["children"].(*tuple)
+	return ok
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return nil
+}
+
+func stringEntry(t *tuple, name string) string {
+	s, _ := t.entries[name].(string)
+	return s
+}
+
+// Stat describes the file at vmpath, links are followed
+func (r *Reader) Stat(vmpath string) (os.FileInfo, error) {
+	t, err := r.lookup(vmpath, true)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: path.Base("/" + vmpath), t: t}, nil
+}
+
+// Lstat describes the file at vmpath without following a link
+func (r *Reader) Lstat(vmpath string) (os.FileInfo, error) {
+	t, err := r.lookup(vmpath, false)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: path.Base("/" + vmpath), t: t}, nil
+}
+
+// Readlink returns the target of the link at vmpath
+func (r *Reader) Readlink(vmpath string) (string, error) {
+	t, err := r.lookup(vmpath, false)
+	if err != nil {
+		return "", err
+	}
+	target, ok := t.entries["linktarget"].(string)
+	if !ok {
+		return "", &os.PathError{Op: "readlink", Path: vmpath, Err: errors.New("not a link")}
+	}
+	return target, nil
+}
+
+// ReadDir returns the files of the directory at vmpath sorted by name
+func (r *Reader) ReadDir(vmpath string) ([]os.FileInfo, error) {
+	t, err := r.lookup(vmpath, true)
+	if err != nil {
+		return nil, err
+	}
+	children, ok := t.entries["children"].(*tuple)
+	if !ok {
+		return nil, &os.PathError{Op: "readdir", Path: vmpath, Err: errNotDir}
+	}
+
+	var files []os.FileInfo
+	for _, name := range children.keys() {
+		child, ok := children.entries[name].(*tuple)
+		if !ok || name == "." || name == ".." {
+			continue
+		}
+		files = append(files, &fileInfo{name: name, t: child})
+	}
+	return files, nil
+}
+
+// extent is a range of a file stored in the filesystem
+type extent struct {
+	// offsets are in bytes, relative to the file and to the filesystem
+	fileOffset int64
+	offset     int64
+	length     int64
+}
+
+// CopyFile writes the contents of the file at vmpath to w
+func (r *Reader) CopyFile(w io.Writer, vmpath string) error {
+	t, err := r.lookup(vmpath, true)
+	if err != nil {
+		return err
+	}
+	if _, ok := t.entries["children"].(*tuple); ok {
+		return &os.PathError{Op: "read", Path: vmpath, Err: errIsDir}
+	}
+	size, _ := strconv.ParseInt(stringEntry(t, "filelength"), 10, 64)
+
+	var extents []extent
+	if e, ok := t.entries["extents"].(*tuple); ok {
+		for _, k := range e.keys() {
+			v, ok := e.entries[k].(*tuple)
+			fileOffset, err1 := strconv.ParseInt(k, 10, 64)
+			offset, err2 := strconv.ParseInt(stringEntry(v, "offset"), 10, 64)
+			length, err3 := strconv.ParseInt(stringEntry(v, "length"), 10, 64)
+			if !ok || err1 != nil || err2 != nil || err3 != nil {
+				return &FormatError{Path: r.path, Msg: fmt.Sprintf("invalid extent %s of %s", k, vmpath)}
+			}
+			extents = append(extents, extent{fileOffset * SectorSize, offset * SectorSize, length * SectorSize})
+		}
+	}
+	sort.Slice(extents, func(i, j int) bool { return extents[i].fileOffset < extents[j].fileOffset })
+
+	// ranges without extents are holes
+	var pos int64
+	for _, e := range extents {
+		if e.fileOffset >= size {
+			break
+		}
+		if err = writeZeros(w, e.fileOffset-pos); err != nil {
+			return err
+		}
+		length := e.length
+		if e.fileOffset+length > size {
+			length = size - e.fileOffset
+		}
+		if _, err = io.Copy(w, io.NewSectionReader(r.fd, r.offset+e.offset, length)); err != nil {
+			return err
+		}
+		pos = e.fileOffset + length
+	}
+	return writeZeros(w, size-pos)
+}
+
+func writeZeros(w io.Writer, n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	_, err := io.CopyN(w, zeros{}, n)
+	return err
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// Extract writes the file or directory at vmpath and everything below it to
+// dir on the host. Files are only written below dir, links on the host are
+// replaced and never followed.
+func (r *Reader) Extract(vmpath string, dir string) error {
+	fi, err := r.Stat(vmpath)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return r.extractFile(vmpath, filepath.Join(dir, fi.Name()), fi)
+	}
+	return r.extractDir(vmpath, dir)
+}
+
+// extractDir writes the files of the directory at vmpath to the directory
+// hostdir
+func (r *Reader) extractDir(vmpath string, hostdir string) error {
+	files, err := r.ReadDir(vmpath)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return &FormatError{Path: r.path, Msg: fmt.Sprintf("invalid file name %q in %s", name, vmpath)}
+		}
+		childpath := path.Join("/", vmpath, name)
+		hostpath := filepath.Join(hostdir, name)
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := r.Readlink(childpath)
+			if err != nil {
+				return err
+			}
+			os.Remove(hostpath)
+			err = os.Symlink(target, hostpath)
+		case fi.IsDir():
+			if err = mkdirNoFollow(hostpath); err == nil {
+				err = r.extractDir(childpath, hostpath)
+			}
+		default:
+			err = r.extractFile(childpath, hostpath, fi)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mkdirNoFollow creates the directory hostpath unless it exists, a link in
+// its place is an error
+func mkdirNoFollow(hostpath string) error {
+	fi, err := os.Lstat(hostpath)
+	if os.IsNotExist(err) {
+		return os.Mkdir(hostpath, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return &os.PathError{Op: "mkdir", Path: hostpath, Err: errNotDir}
+	}
+	return nil
+}
+
+func (r *Reader) extractFile(vmpath string, hostpath string, fi os.FileInfo) error {
+	// a link is replaced instead of writing to its target
+	if hfi, err := os.Lstat(hostpath); err == nil && hfi.Mode()&os.ModeSymlink != 0 {
+		if err = os.Remove(hostpath); err != nil {
+			return err
+		}
+	}
+	fd, err := os.OpenFile(hostpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err = r.CopyFile(fd, vmpath); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
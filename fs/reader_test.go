@@ -0,0 +1,284 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestImage writes an image with a boot filesystem from testManifest
+func newTestImage(t *testing.T, dir string) string {
+	boot := make([]byte, 1000)
+	boot[510], boot[511] = 0x55, 0xaa
+	ioutil.WriteFile(filepath.Join(dir, "boot.img"), boot, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "kernel.img"), []byte("kernel"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "hello"), bytes.Repeat([]byte("hello"), 300), 0755)
+
+	manifest := testManifest(filepath.Join(dir, "hello"))
+	manifest["boot"] = map[string]interface{}{
+		"children": map[string]interface{}{
+			"kernel": map[string]interface{}{"contents": map[string]interface{}{"host": filepath.Join(dir, "kernel.img")}},
+		},
+	}
+	manifest["children"].(map[string]interface{})["hello"].(map[string]interface{})["mode"] = "0700"
+
+	image := filepath.Join(dir, "image")
+	if _, err := Mkfs(image, manifest, Options{Boot: filepath.Join(dir, "boot.img"), Label: "root"}); err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+func TestReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := Open(newTestImage(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	assert.Equal(t, "root", r.Label)
+
+	files, err := r.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	assert.Equal(t, []string{"etc", "hello", "hi"}, names)
+	assert.True(t, files[0].IsDir())
+	assert.Equal(t, int64(1500), files[1].Size())
+	assert.Equal(t, os.FileMode(0700), files[1].Mode())
+	assert.Equal(t, os.ModeSymlink, files[2].Mode()&os.ModeSymlink)
+
+	var b bytes.Buffer
+	if err = r.CopyFile(&b, "/hi"); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, bytes.Equal(bytes.Repeat([]byte("hello"), 300), b.Bytes()))
+
+	b.Reset()
+	if err = r.CopyFile(&b, "/etc/../etc/./hosts"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "127.0.0.1 localhost\n", b.String())
+
+	_, err = r.Stat("/etc/missing")
+	assert.True(t, os.IsNotExist(err))
+	err = r.CopyFile(&b, "/etc")
+	assert.Error(t, err)
+	_, err = r.ReadDir("/hello")
+	assert.Error(t, err)
+}
+
+func TestReaderExtract(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// volumes have no boot record
+	manifest := testManifest(filepath.Join(dir, "hello"))
+	ioutil.WriteFile(filepath.Join(dir, "hello"), []byte("hello"), 0755)
+	volume := filepath.Join(dir, "volume.raw")
+	uuid, err := Mkfs(volume, manifest, Options{Label: "data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open(volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	assert.Equal(t, uuid, r.UUID)
+	assert.Equal(t, "data", r.Label)
+
+	out := filepath.Join(dir, "out")
+	if err = r.Extract("/", out); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(out, "etc", "hosts"))
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1 localhost\n", string(contents))
+	contents, err = ioutil.ReadFile(filepath.Join(out, "hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(contents))
+	target, err := os.Readlink(filepath.Join(out, "hi"))
+	assert.NoError(t, err)
+	assert.Equal(t, "/hello", target)
+
+	if err = r.Extract("/etc/hosts", dir); err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(filepath.Join(dir, "hosts"))
+	assert.NoError(t, err)
+
+	ioutil.WriteFile(filepath.Join(dir, "text"), bytes.Repeat([]byte("text"), 200), 0644)
+	_, err = Open(filepath.Join(dir, "text"))
+	assert.IsType(t, &FormatError{}, err)
+}
+
+func TestReaderExtractStaysInDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "hello"), []byte("hello"), 0755)
+	volume := filepath.Join(dir, "volume.raw")
+	if _, err = Mkfs(volume, testManifest(filepath.Join(dir, "hello")), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// links on the host are replaced instead of written through
+	out := filepath.Join(dir, "out")
+	outside := filepath.Join(dir, "outside")
+	os.MkdirAll(out, 0755)
+	ioutil.WriteFile(outside, []byte("outside"), 0644)
+	os.Symlink(outside, filepath.Join(out, "hello"))
+	os.Symlink(dir, filepath.Join(out, "etc"))
+	assert.Error(t, r.Extract("/", out))
+	os.Remove(filepath.Join(out, "etc"))
+	assert.NoError(t, r.Extract("/", out))
+	contents, _ := ioutil.ReadFile(outside)
+	assert.Equal(t, "outside", string(contents))
+	_, err = os.Stat(filepath.Join(dir, "hosts"))
+	assert.True(t, os.IsNotExist(err))
+
+	for _, name := range []string{"", "../escape", "a/b"} {
+		children := newTuple()
+		children.set(name, newTuple())
+		root := newTuple()
+		root.set("children", children)
+		r.root = root
+		err = r.Extract("/", filepath.Join(dir, "names"))
+		assert.IsType(t, &FormatError{}, err, name)
+	}
+	_, err = os.Stat(filepath.Join(dir, "escape"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReadEntries(t *testing.T) {
+	root := newTuple()
+	root.set("children", newTuple())
+	root.set("self", root)
+
+	var b bytes.Buffer
+	e := newEncoder()
+	b.WriteByte(endOfSegment)
+	b.WriteByte(tupleAvailable)
+	e.encodeTuple(&b, root)
+	e.encodeExtension(&b, root, "mode", "0755")
+	b.WriteByte(endOfSegment)
+	b.WriteByte(endOfLog)
+
+	d := newDecoder()
+	next, err := (&Reader{}).readEntries(bufio.NewReader(&b), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(0), next)
+	decoded, ok := d.dictionary[1].(*tuple)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"children", "mode", "self"}, decoded.keys())
+	assert.True(t, decoded.entries["self"] == decoded)
+	assert.Equal(t, "0755", decoded.entries["mode"])
+
+	_, err = (&Reader{}).readEntries(bufio.NewReader(bytes.NewReader([]byte{42})), newDecoder())
+	assert.Error(t, err)
+
+	// extended entries refer to a tuple written before
+	b.Reset()
+	b.WriteByte(tupleExtended)
+	writeHeader(&b, reference, typeTuple, 0)
+	writeVarint(&b, 7)
+	_, err = (&Reader{}).readEntries(bufio.NewReader(&b), newDecoder())
+	assert.EqualError(t, err, "reference to unknown tuple 7")
+}
+
+// TestReaderMkfsLog reads a volume with the log the mkfs program of nanos
+// writes: the tuples of the manifest, with empty extents for files, followed
+// by extended tuple entries that add the extents and the length of each file
+// once its contents are written.
+func TestReaderMkfsLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	extents := newTuple()
+	hello := newTuple()
+	hello.set("extents", extents)
+	children := newTuple()
+	children.set("hello", hello)
+	root := newTuple()
+	root.set("children", children)
+	children.set(".", root)
+	children.set("..", root)
+
+	logSize := int64(logExtensionSize)
+	var b bytes.Buffer
+	b.WriteString(tfsMagic)
+	writeVarint(&b, tfsVersion)
+	writeVarint(&b, uint64(logSize/SectorSize))
+	b.Write(make([]byte, uuidLength))
+	b.Write(append([]byte("mkfs"), make([]byte, labelLength-4)...))
+
+	e := newEncoder()
+	b.WriteByte(tupleAvailable)
+	e.encodeTuple(&b, root)
+	extent := newTuple()
+	extent.set("offset", strconv.FormatInt(logSize/SectorSize, 10))
+	extent.set("length", "1")
+	extent.set("allocated", "1")
+	e.encodeExtension(&b, extents, "0", extent)
+	e.encodeExtension(&b, hello, "filelength", "5")
+	b.WriteByte(endOfLog)
+
+	volume := make([]byte, logSize+SectorSize)
+	copy(volume, b.Bytes())
+	copy(volume[logSize:], "hello")
+	path := filepath.Join(dir, "volume.raw")
+	if err = ioutil.WriteFile(path, volume, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	assert.Equal(t, "mkfs", r.Label)
+
+	fi, err := r.Stat("/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(5), fi.Size())
+	var contents bytes.Buffer
+	if err = r.CopyFile(&contents, "/hello"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "hello", contents.String())
+}
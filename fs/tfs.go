@@ -0,0 +1,325 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+const (
+	// SectorSize is the unit of offsets and lengths in nanos filesystems
+	SectorSize = 512
+
+	tfsMagic   = "NVMTFS"
+	tfsVersion = 3
+
+	uuidLength  = 16
+	labelLength = 32
+
+	// logExtensionSize is the size the log at the start of a filesystem is
+	// a multiple of
+	logExtensionSize = 1024 * 1024
+
+	// maxExtentSize is the largest extent of a file
+	maxExtentSize = 1024 * 1024 * 1024
+)
+
+// log entry types
+const (
+	endOfLog         = 1
+	tupleAvailable   = 2
+	tupleExtended    = 3
+	endOfSegment     = 4
+	logExtensionLink = 5
+)
+
+// UUID identifies a filesystem
+type UUID [uuidLength]byte
+
+func (u UUID) String() string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// newUUID returns a random UUID
+func newUUID() (UUID, error) {
+	var u UUID
+	if _, err := rand.Read(u[:]); err != nil {
+		return u, err
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return u, nil
+}
+
+// file is a file of a filesystem, its contents are stored after the log
+type file struct {
+	vmpath   string
+	hostpath string
+	contents []byte
+	size     int64
+
+	// offset of the contents in the filesystem
+	offset int64
+
+	// t gets the extents of the contents on layout
+	t *tuple
+}
+
+// tfs is a nanos filesystem: a log with the tuples of the manifest, in which
+// files have extents instead of contents, followed by the contents of the
+// files
+type tfs struct {
+	root    *tuple
+	files   []*file
+	uuid    UUID
+	label   string
+	resolve func(string) (string, error)
+}
+
+// newTFS returns the filesystem of a manifest, resolve returns the path to
+// read the contents of a host file from
+func newTFS(manifest map[string]interface{}, uuid UUID, label string, resolve func(string) (string, error)) (*tfs, error) {
+	if len(label) >= labelLength {
+		return nil, fmt.Errorf("label '%s' is longer than %d characters", label, labelLength-1)
+	}
+	t := &tfs{uuid: uuid, label: label, resolve: resolve}
+	root, err := t.tuple(manifest, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	t.root = root
+	return t, nil
+}
+
+// tuple converts a manifest tuple. Directories have children, and files
+// have contents that are replaced with extents.
+func (t *tfs) tuple(m map[string]interface{}, vmpath string, parent *tuple) (*tuple, error) {
+	n := newTuple()
+	for _, k := range sortedKeys(m) {
+		switch v := m[k]; k {
+		case "children":
+			children, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, &ManifestError{VMPath: vmpath, Msg: "children must be a tuple"}
+			}
+			c, err := t.children(children, vmpath, n, parent)
+			if err != nil {
+				return nil, err
+			}
+			n.set(k, c)
+		case "contents":
+			if err := t.file(v, vmpath, n); err != nil {
+				return nil, err
+			}
+		default:
+			value, err := t.value(v, vmpath)
+			if err != nil {
+				return nil, err
+			}
+			n.set(k, value)
+		}
+	}
+	return n, nil
+}
+
+// children converts the entries of the directory dir, which refer to dir and
+// its parent as '.' and '..'
+func (t *tfs) children(m map[string]interface{}, vmpath string, dir *tuple, parent *tuple) (*tuple, error) {
+	c := newTuple()
+	for _, name := range sortedKeys(m) {
+		entry, ok := m[name].(map[string]interface{})
+		if !ok {
+			return nil, &ManifestError{VMPath: vmpath + "/" + name, Msg: "entry must be a tuple"}
+		}
+		child, err := t.tuple(entry, vmpath+"/"+name, dir)
+		if err != nil {
+			return nil, err
+		}
+		c.set(name, child)
+	}
+
+	if parent == nil {
+		parent = dir
+	}
+	c.set(".", dir)
+	c.set("..", parent)
+	return c, nil
+}
+
+// file adds the file with the contents of a manifest entry, which are either
+// inline or (host:path)
+func (t *tfs) file(contents interface{}, vmpath string, n *tuple) error {
+	f := &file{vmpath: vmpath, t: n}
+	switch v := contents.(type) {
+	case string:
+		f.contents = []byte(v)
+		f.size = int64(len(v))
+	case map[string]interface{}:
+		host, ok := v["host"].(string)
+		if !ok {
+			return &ManifestError{VMPath: vmpath, Msg: "contents must be a string or (host:path)"}
+		}
+		f.hostpath = host
+		if t.resolve != nil {
+			resolved, err := t.resolve(host)
+			if err != nil {
+				return &FileError{VMPath: vmpath, HostPath: host, Cause: err}
+			}
+			f.hostpath = resolved
+		}
+		fi, err := os.Stat(f.hostpath)
+		if err != nil {
+			return &FileError{VMPath: vmpath, HostPath: host, Cause: err}
+		}
+		if fi.IsDir() {
+			return &FileError{VMPath: vmpath, HostPath: host, Cause: fmt.Errorf("is a directory")}
+		}
+		f.size = fi.Size()
+	default:
+		return &ManifestError{VMPath: vmpath, Msg: "contents must be a string or (host:path)"}
+	}
+	t.files = append(t.files, f)
+	return nil
+}
+
+// value converts the value of an attribute, vectors are tuples indexed by
+// the position of their elements
+func (t *tfs) value(v interface{}, vmpath string) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case []string:
+		vector := newTuple()
+		for i, s := range v {
+			vector.set(strconv.Itoa(i), s)
+		}
+		return vector, nil
+	case map[string]interface{}:
+		return t.tuple(v, vmpath, nil)
+	}
+	return nil, &ManifestError{VMPath: vmpath, Msg: fmt.Sprintf("unsupported value %v", v)}
+}
+
+// layout places the contents of the files after a log of logSize bytes,
+// and returns the log and the end of the contents
+func (t *tfs) layout(logSize int64) ([]byte, int64) {
+	next := logSize
+	for _, f := range t.files {
+		f.offset = next
+		extents := newTuple()
+		for off := int64(0); off < f.size; off += maxExtentSize {
+			length := f.size - off
+			if length > maxExtentSize {
+				length = maxExtentSize
+			}
+			sectors := strconv.FormatInt(sectorsOf(length), 10)
+			e := newTuple()
+			e.set("offset", strconv.FormatInt((f.offset+off)/SectorSize, 10))
+			e.set("length", sectors)
+			e.set("allocated", sectors)
+			extents.set(strconv.FormatInt(off/SectorSize, 10), e)
+		}
+		f.t.set("extents", extents)
+		f.t.set("filelength", strconv.FormatInt(f.size, 10))
+		next += sectorsOf(f.size) * SectorSize
+	}
+
+	var b bytes.Buffer
+	b.WriteString(tfsMagic)
+	writeVarint(&b, tfsVersion)
+	writeVarint(&b, uint64(logSize/SectorSize))
+	b.Write(t.uuid[:])
+	label := make([]byte, labelLength)
+	copy(label, t.label)
+	b.Write(label)
+	b.WriteByte(tupleAvailable)
+	newEncoder().encodeTuple(&b, t.root)
+	b.WriteByte(endOfLog)
+	return b.Bytes(), next
+}
+
+// write writes the filesystem at offset, it takes size bytes or ends after
+// the last file when size is 0. It returns the size of the filesystem.
+func (t *tfs) write(w io.WriterAt, offset int64, size int64, name string, p *progress) (int64, error) {
+	logSize := int64(logExtensionSize)
+	log, end := t.layout(logSize)
+	for int64(len(log)) > logSize {
+		// the extents of the files move with the log, so it is laid out
+		// again until it fits
+		logSize = roundUp(int64(len(log)), logExtensionSize)
+		log, end = t.layout(logSize)
+	}
+	if size == 0 {
+		size = end
+	} else if end > size {
+		return 0, &SizeError{Filesystem: name, Size: size, Required: end}
+	}
+
+	if _, err := w.WriteAt(log, offset); err != nil {
+		return 0, err
+	}
+	for _, f := range t.files {
+		out := &offsetWriter{w: w, offset: offset + f.offset}
+		if f.hostpath == "" {
+			if _, err := out.Write(f.contents); err != nil {
+				return 0, err
+			}
+		} else if err := copyFile(out, f); err != nil {
+			return 0, err
+		}
+		p.add(f.vmpath, f.size)
+	}
+	return size, nil
+}
+
+// copyFile copies the contents of a host file, which must not have changed
+// size since it was laid out
+func copyFile(w io.Writer, f *file) error {
+	fd, err := os.Open(f.hostpath)
+	if err != nil {
+		return &FileError{VMPath: f.vmpath, HostPath: f.hostpath, Cause: err}
+	}
+	defer fd.Close()
+
+	n, err := io.Copy(w, io.LimitReader(fd, f.size))
+	if err == nil && n != f.size {
+		err = fmt.Errorf("file was truncated to %d bytes", n)
+	}
+	if err != nil {
+		return &FileError{VMPath: f.vmpath, HostPath: f.hostpath, Cause: err}
+	}
+	return nil
+}
+
+// offsetWriter writes sequentially from an offset of a WriterAt
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sectorsOf(n int64) int64 {
+	return (n + SectorSize - 1) / SectorSize
+}
+
+func roundUp(n int64, unit int64) int64 {
+	return (n + unit - 1) / unit * unit
+}
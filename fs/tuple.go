@@ -0,0 +1,300 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// flags of encoded values
+const (
+	reference = 0
+	immediate = 1
+
+	typeBuffer = 0
+	typeTuple  = 1
+)
+
+// tuple is a node of the filesystem metadata, its values are strings or
+// tuples
+type tuple struct {
+	entries map[string]interface{}
+}
+
+func newTuple() *tuple {
+	return &tuple{entries: make(map[string]interface{})}
+}
+
+func (t *tuple) set(name string, value interface{}) {
+	t.entries[name] = value
+}
+
+// keys returns the names of the entries of t in sorted order, so that
+// filesystems only depend on their contents
+func (t *tuple) keys() []string {
+	keys := make([]string, 0, len(t.entries))
+	for k := range t.entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// encoder serializes tuples in the format of the nanos log. Symbols and
+// tuples are numbered in the order they are first written and are written
+// as a reference to that number afterwards. A symbol reference has the
+// number in its header, a tuple reference has the number of entries it adds
+// to the tuple in its header followed by the number of the tuple.
+type encoder struct {
+	symbols map[string]uint64
+	tuples  map[*tuple]uint64
+	count   uint64
+}
+
+func newEncoder() *encoder {
+	return &encoder{
+		symbols: make(map[string]uint64),
+		tuples:  make(map[*tuple]uint64),
+	}
+}
+
+// encodeTuple writes t with the names and values of its entries. A tuple is
+// numbered before its entries so that they can refer to it.
+func (e *encoder) encodeTuple(b *bytes.Buffer, t *tuple) {
+	if n, ok := e.tuples[t]; ok {
+		writeHeader(b, reference, typeTuple, 0)
+		writeVarint(b, n)
+		return
+	}
+	writeHeader(b, immediate, typeTuple, uint64(len(t.entries)))
+	e.count++
+	e.tuples[t] = e.count
+
+	for _, k := range t.keys() {
+		e.encodeSymbol(b, k)
+		switch v := t.entries[k].(type) {
+		case *tuple:
+			e.encodeTuple(b, v)
+		case string:
+			writeHeader(b, immediate, typeBuffer, uint64(len(v)))
+			b.WriteString(v)
+		}
+	}
+}
+
+// encodeExtension writes the entry of the log that sets name to value in
+// the tuple t written before
+func (e *encoder) encodeExtension(b *bytes.Buffer, t *tuple, name string, value interface{}) {
+	b.WriteByte(tupleExtended)
+	writeHeader(b, reference, typeTuple, 1)
+	writeVarint(b, e.tuples[t])
+	e.encodeSymbol(b, name)
+	switch v := value.(type) {
+	case *tuple:
+		e.encodeTuple(b, v)
+	case string:
+		writeHeader(b, immediate, typeBuffer, uint64(len(v)))
+		b.WriteString(v)
+	}
+}
+
+// encodeSymbol writes the name of an entry
+func (e *encoder) encodeSymbol(b *bytes.Buffer, s string) {
+	if n, ok := e.symbols[s]; ok {
+		writeHeader(b, reference, typeBuffer, n)
+		return
+	}
+	writeHeader(b, immediate, typeBuffer, uint64(len(s)))
+	b.WriteString(s)
+	e.count++
+	e.symbols[s] = e.count
+}
+
+// writeHeader writes the flags of a value with its length, or the number of
+// the value it refers to. The first byte has the 5 most significant bits of
+// the number and a flag for the bytes that follow with 7 bits each.
+func writeHeader(b *bytes.Buffer, imm byte, typ byte, n uint64) {
+	words := 0
+	for n>>(7*uint(words)) >= 1<<5 {
+		words++
+	}
+	first := imm<<7 | typ<<6 | byte(n>>(7*uint(words)))
+	if words > 0 {
+		first |= 1 << 5
+	}
+	b.WriteByte(first)
+	writeWords(b, n, words)
+}
+
+// writeVarint writes n in 7 bit words, most significant first, with the high
+// bit set on all but the last
+func writeVarint(b *bytes.Buffer, n uint64) {
+	words := 1
+	for n>>(7*uint(words)) != 0 {
+		words++
+	}
+	writeWords(b, n, words)
+}
+
+func writeWords(b *bytes.Buffer, n uint64, words int) {
+	for i := words - 1; i >= 0; i-- {
+		c := byte(n>>(7*uint(i))) & 0x7f
+		if i > 0 {
+			c |= 0x80
+		}
+		b.WriteByte(c)
+	}
+}
+
+// decoder reads tuples written by an encoder, the dictionary has the
+// symbols and tuples by number
+type decoder struct {
+	dictionary map[uint64]interface{}
+	count      uint64
+}
+
+func newDecoder() *decoder {
+	return &decoder{dictionary: make(map[uint64]interface{})}
+}
+
+// encoder returns an encoder that continues the log d has read, so that it
+// refers to the symbols and tuples of the log by their numbers
+func (d *decoder) encoder() *encoder {
+	e := newEncoder()
+	e.count = d.count
+	for n, v := range d.dictionary {
+		switch v := v.(type) {
+		case string:
+			e.symbols[v] = n
+		case *tuple:
+			e.tuples[v] = n
+		}
+	}
+	return e
+}
+
+// decodeValue reads a tuple or a string
+func (d *decoder) decodeValue(r *bufio.Reader) (interface{}, error) {
+	imm, typ, n, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if typ == typeTuple {
+		return d.decodeTuple(r, imm, n)
+	}
+	if imm == reference {
+		v, ok := d.dictionary[n].(string)
+		if !ok {
+			return nil, fmt.Errorf("reference to unknown value %d", n)
+		}
+		return v, nil
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+// decodeTuple reads the n entries of a new tuple, or of the tuple a
+// reference refers to, which they are added to
+func (d *decoder) decodeTuple(r *bufio.Reader, imm byte, n uint64) (*tuple, error) {
+	var t *tuple
+	if imm == reference {
+		id, err := readVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if t, ok = d.dictionary[id].(*tuple); !ok {
+			return nil, fmt.Errorf("reference to unknown tuple %d", id)
+		}
+	} else {
+		t = newTuple()
+		d.count++
+		d.dictionary[d.count] = t
+	}
+
+	for i := uint64(0); i < n; i++ {
+		name, err := d.decodeSymbol(r)
+		if err != nil {
+			return nil, err
+		}
+		if t.entries[name], err = d.decodeValue(r); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// decodeExtension reads the entries an extended tuple entry of the log adds
+// to a tuple written before
+func (d *decoder) decodeExtension(r *bufio.Reader) error {
+	imm, typ, n, err := readHeader(r)
+	if err != nil {
+		return err
+	}
+	if imm != reference || typ != typeTuple {
+		return fmt.Errorf("extended tuple entry without a tuple reference")
+	}
+	_, err = d.decodeTuple(r, imm, n)
+	return err
+}
+
+// decodeSymbol reads the name of an entry
+func (d *decoder) decodeSymbol(r *bufio.Reader) (string, error) {
+	imm, typ, n, err := readHeader(r)
+	if err != nil {
+		return "", err
+	}
+	if typ != typeBuffer {
+		return "", fmt.Errorf("tuple in place of a symbol")
+	}
+	if imm == reference {
+		s, ok := d.dictionary[n].(string)
+		if !ok {
+			return "", fmt.Errorf("reference to unknown symbol %d", n)
+		}
+		return s, nil
+	}
+	b := make([]byte, n)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	d.count++
+	d.dictionary[d.count] = string(b)
+	return string(b), nil
+}
+
+// readHeader reads the flags of a value with its length or number
+func readHeader(r *bufio.Reader) (imm byte, typ byte, n uint64, err error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	imm, typ, n = first>>7, first>>6&1, uint64(first&0x1f)
+	for more := first&(1<<5) != 0; more; {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		n = n<<7 | uint64(c&0x7f)
+		more = c&0x80 != 0
+	}
+	return imm, typ, n, nil
+}
+
+// readVarint reads a number written by writeVarint
+func readVarint(r *bufio.Reader) (uint64, error) {
+	var n uint64
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n = n<<7 | uint64(c&0x7f)
+		if c&0x80 == 0 {
+			return n, nil
+		}
+	}
+}
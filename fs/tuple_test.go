@@ -0,0 +1,92 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteHeader(t *testing.T) {
+	tests := []struct {
+		imm  byte
+		typ  byte
+		n    uint64
+		want []byte
+	}{
+		{immediate, typeBuffer, 3, []byte{0x83}},
+		{immediate, typeTuple, 31, []byte{0xdf}},
+		{reference, typeTuple, 1, []byte{0x41}},
+		{reference, typeBuffer, 40, []byte{0x20, 0x28}},
+		{immediate, typeBuffer, 5000, []byte{0xa0, 0xa7, 0x08}},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		writeHeader(&b, tt.imm, tt.typ, tt.n)
+		assert.Equal(t, tt.want, b.Bytes(), "%d", tt.n)
+	}
+}
+
+func TestWriteVarint(t *testing.T) {
+	var b bytes.Buffer
+	writeVarint(&b, 0)
+	writeVarint(&b, 127)
+	writeVarint(&b, 2048)
+	assert.Equal(t, []byte{0x00, 0x7f, 0x90, 0x00}, b.Bytes())
+}
+
+func TestEncodeTuple(t *testing.T) {
+	root := newTuple()
+	root.set("a", "x")
+	root.set("self", root)
+	child := newTuple()
+	child.set("a", "y")
+	root.set("b", child)
+
+	var b bytes.Buffer
+	newEncoder().encodeTuple(&b, root)
+	assert.Equal(t, []byte{
+		0xc3,      // tuple of 3 entries, number 1
+		0x81, 'a', // symbol number 2
+		0x81, 'x', // buffer
+		0x81, 'b', // symbol number 3
+		0xc1,      // tuple of 1 entry, number 4
+		0x02,      // reference to symbol 2
+		0x81, 'y', // buffer
+		0x84, 's', 'e', 'l', 'f', // symbol number 5
+		0x40, 0x01, // reference to tuple 1
+	}, b.Bytes())
+}
+
+func TestDecodeTuple(t *testing.T) {
+	root := newTuple()
+	root.set("self", root)
+	child := newTuple()
+	child.set("name", string(bytes.Repeat([]byte("x"), 5000)))
+	root.set("child", child)
+	root.set("again", child)
+
+	var b bytes.Buffer
+	newEncoder().encodeTuple(&b, root)
+	v, err := newDecoder().decodeValue(bufio.NewReader(&b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := v.(*tuple)
+	assert.Equal(t, []string{"again", "child", "self"}, decoded.keys())
+	assert.True(t, decoded.entries["self"] == decoded)
+	assert.True(t, decoded.entries["again"] == decoded.entries["child"])
+	assert.Equal(t, child.entries["name"], decoded.entries["child"].(*tuple).entries["name"])
+}
+
+func TestReadHeader(t *testing.T) {
+	for _, n := range []uint64{0, 31, 32, 4096, 5000, 1 << 40} {
+		var b bytes.Buffer
+		writeHeader(&b, reference, typeTuple, n)
+		imm, typ, got, err := readHeader(bufio.NewReader(&b))
+		assert.NoError(t, err)
+		assert.Equal(t, []interface{}{byte(reference), byte(typeTuple), n}, []interface{}{imm, typ, got})
+	}
+}
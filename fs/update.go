@@ -0,0 +1,67 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// SetFileContents replaces the contents of the file at vmpath in the image
+// or volume at path. The contents are written to the sectors allocated to
+// the start of the file, which must be large enough for them, and the new
+// length of the file is added to the log like the kernel does for files
+// written at runtime.
+func SetFileContents(path string, vmpath string, contents []byte) error {
+	r, err := openImage(path, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	t, err := r.lookup(vmpath, true)
+	if err != nil {
+		return err
+	}
+	if _, ok := t.entries["children"].(*tuple); ok {
+		return &os.PathError{Op: "write", Path: vmpath, Err: errIsDir}
+	}
+	first := newTuple()
+	if extents, ok := t.entries["extents"].(*tuple); ok {
+		if e, ok := extents.entries["0"].(*tuple); ok {
+			first = e
+		}
+	}
+	offset, err1 := strconv.ParseInt(stringEntry(first, "offset"), 10, 64)
+	allocated, err2 := strconv.ParseInt(stringEntry(first, "allocated"), 10, 64)
+	if err1 != nil || err2 != nil {
+		return &FormatError{Path: path, Msg: fmt.Sprintf("%s has no extent at its start", vmpath)}
+	}
+	if int64(len(contents)) > allocated*SectorSize {
+		return &os.PathError{Op: "write", Path: vmpath, Err: fmt.Errorf("%d bytes do not fit in the %d bytes allocated to the file", len(contents), allocated*SectorSize)}
+	}
+
+	// the rest of the previous contents is cleared
+	size, _ := strconv.ParseInt(stringEntry(t, "filelength"), 10, 64)
+	if size > allocated*SectorSize {
+		size = allocated * SectorSize
+	}
+	if size < int64(len(contents)) {
+		size = int64(len(contents))
+	}
+	data := make([]byte, sectorsOf(size)*SectorSize)
+	copy(data, contents)
+
+	var log bytes.Buffer
+	r.log.encoder().encodeExtension(&log, t, "filelength", strconv.Itoa(len(contents)))
+	log.WriteByte(endOfLog)
+	if r.logEnd+int64(log.Len()) > r.logLimit {
+		return &FormatError{Path: path, Msg: "filesystem log is full"}
+	}
+
+	if _, err = r.fd.WriteAt(data, r.offset+offset*SectorSize); err != nil {
+		return err
+	}
+	_, err = r.fd.WriteAt(log.Bytes(), r.offset+r.logEnd)
+	return err
+}
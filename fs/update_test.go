@@ -0,0 +1,44 @@
+package fs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetFileContents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image := newTestImage(t, dir)
+
+	read := func(vmpath string) string {
+		r, err := Open(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		var b bytes.Buffer
+		if err = r.CopyFile(&b, vmpath); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+
+	// the log refers to the filelength symbol of the first update afterwards
+	assert.NoError(t, SetFileContents(image, "/etc/hosts", []byte("10.0.0.1 db\n")))
+	assert.Equal(t, "10.0.0.1 db\n", read("/etc/hosts"))
+	assert.NoError(t, SetFileContents(image, "/etc/hosts", []byte("a")))
+	assert.Equal(t, "a", read("/etc/hosts"))
+	assert.Equal(t, strings.Repeat("hello", 300), read("/hello"))
+
+	err = SetFileContents(image, "/etc/hosts", make([]byte, SectorSize+1))
+	assert.EqualError(t, err, "write /etc/hosts: 513 bytes do not fit in the 512 bytes allocated to the file")
+	assert.Error(t, SetFileContents(image, "/etc", []byte("a")))
+}
@@ -16,13 +16,14 @@ require (
 	github.com/d2g/dhcp4 v0.0.0-20170904100407-a1d1b6c41b1c
 	github.com/d2g/dhcp4client v1.0.0
 	github.com/digitalocean/godo v1.50.0
-	github.com/go-errors/errors v1.0.1
+	github.com/go-errors/errors v1.4.2
 	github.com/go-ini/ini v1.52.0 // indirect
 	github.com/golang/mock v1.4.4
 	github.com/gophercloud/gophercloud v0.12.0
 	github.com/mattn/go-runewidth v0.0.10 // indirect
 	github.com/minio/minio-go v6.0.14+incompatible
 	github.com/olekukonko/tablewriter v0.0.1
+	github.com/pelletier/go-toml v1.9.5
 	github.com/rivo/uniseg v0.2.0 // indirect
 	github.com/schollz/progressbar/v2 v2.13.2
 	github.com/schollz/progressbar/v3 v3.7.3
@@ -39,4 +40,5 @@ require (
 	golang.org/x/sys v0.0.0-20210119212857-b64e53b001e4
 	google.golang.org/api v0.7.0
 	gopkg.in/ini.v1 v1.55.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -3,11 +3,11 @@ package hyperv
 import (
 	"errors"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
 
+	"github.com/nanovms/ops/imageformat"
 	"github.com/nanovms/ops/lepton"
 	"github.com/olekukonko/tablewriter"
 )
@@ -47,14 +47,7 @@ func (p *Provider) createVhdxImage(c *lepton.Config) (imagePath string, err erro
 
 	vhdxPath := path.Join(vhdxImagesDir, c.CloudConfig.ImageName+".vhdx")
 
-	args := []string{
-		"convert",
-		"-O", "vhdx",
-		c.RunConfig.Imagename, vhdxPath,
-	}
-
-	cmd := exec.Command("qemu-img", args...)
-	_, err = cmd.CombinedOutput()
+	err = imageformat.Convert(c.RunConfig.Imagename, vhdxPath, imageformat.VHDX, imageformat.Options{})
 	if err != nil {
 		return "", err
 	}
@@ -62,9 +55,10 @@ func (p *Provider) createVhdxImage(c *lepton.Config) (imagePath string, err erro
 	return vhdxPath, nil
 }
 
-// CreateImage is a stub
+// CreateImage only verifies the signature of the image, hyper-v images
+// are local
 func (p *Provider) CreateImage(ctx *lepton.Context, imagePath string) error {
-	return nil
+	return lepton.VerifyImageSignature(ctx.Config(), ctx.Config().RunConfig.Imagename)
 }
 
 // ListImages prints hyper-v images in table format
@@ -0,0 +1,203 @@
+// Package imageformat converts raw disk images to the virtual disk formats
+// of hypervisors and cloud providers.
+package imageformat
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Format of a virtual disk
+type Format string
+
+// Formats written by Convert
+const (
+	// VHD is a fixed VHD, the raw image followed by a footer
+	VHD Format = "vhd"
+	// VHDDynamic is a dynamic VHD, blocks of zeros are left out
+	VHDDynamic Format = "vhd-dynamic"
+	VHDX       Format = "vhdx"
+	// VMDK is a stream-optimized VMDK with compressed grains
+	VMDK Format = "vmdk"
+	// VMDKFlat is a monolithicFlat VMDK, a descriptor file and a copy of the
+	// raw image with the -flat.vmdk suffix
+	VMDKFlat Format = "vmdk-flat"
+	QCOW2    Format = "qcow2"
+	// OVA is an OVF virtual machine with a stream-optimized VMDK disk
+	OVA Format = "ova"
+)
+
+// Formats lists the formats written by Convert
+var Formats = []Format{VHD, VHDDynamic, VHDX, VMDK, VMDKFlat, QCOW2, OVA}
+
+// ParseFormat returns the format with name
+func ParseFormat(name string) (Format, error) {
+	for _, f := range Formats {
+		if string(f) == strings.ToLower(name) {
+			return f, nil
+		}
+	}
+	names := make([]string, len(Formats))
+	for i, f := range Formats {
+		names[i] = string(f)
+	}
+	return "", fmt.Errorf("unknown image format %q, supported formats are %s", name, strings.Join(names, ", "))
+}
+
+// Extension returns the file extension of the format
+func (f Format) Extension() string {
+	switch f {
+	case VHDDynamic:
+		return ".vhd"
+	case VMDKFlat:
+		return ".vmdk"
+	}
+	return "." + string(f)
+}
+
+// Options configure the disk written by Convert
+type Options struct {
+	// Size of the virtual disk in bytes (defaults to the size of the raw
+	// image). The disk is larger than the raw image when it is larger.
+	Size int64
+
+	// Name of the virtual machine of an OVA (defaults to the file name).
+	Name string
+
+	// CPUs and MemoryMB of the virtual machine of an OVA (default to 1 CPU
+	// and 2048 MB).
+	CPUs     int
+	MemoryMB int
+}
+
+// Convert writes the raw image at src to dst in format
+func Convert(src string, dst string, format Format, opts Options) error {
+	r, err := openRaw(src, opts.Size)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if opts.Name == "" {
+		opts.Name = strings.TrimSuffix(filepath.Base(dst), filepath.Ext(dst))
+	}
+
+	var write func(*rawImage, *os.File, Options) error
+	switch format {
+	case VHD:
+		write = writeFixedVHD
+	case VHDDynamic:
+		write = writeDynamicVHD
+	case VHDX:
+		write = writeVHDX
+	case VMDK:
+		write = writeStreamVMDK
+	case VMDKFlat:
+		return writeFlatVMDK(r, dst)
+	case QCOW2:
+		write = writeQCOW2
+	case OVA:
+		write = writeOVA
+	default:
+		return fmt.Errorf("unknown image format %q", format)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err = write(r, out, opts); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// rawImage reads a raw image as a virtual disk of size bytes, reads past
+// the end of the file return zeros
+type rawImage struct {
+	*os.File
+	size     int64
+	fileSize int64
+}
+
+func openRaw(path string, size int64) (*rawImage, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if size < fi.Size() {
+		size = fi.Size()
+	}
+	return &rawImage{File: fd, size: roundUp(size, sectorSize), fileSize: fi.Size()}, nil
+}
+
+// block reads len(b) bytes at off and reports whether they are all zeros
+func (r *rawImage) block(b []byte, off int64) (bool, error) {
+	n := 0
+	if off < r.fileSize {
+		var err error
+		n, err = r.ReadAt(b, off)
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+	}
+	for i := n; i < len(b); i++ {
+		b[i] = 0
+	}
+	return isZero(b[:n]), nil
+}
+
+// copyTo writes the virtual disk to w
+func (r *rawImage) copyTo(w io.Writer) error {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r.File); err != nil {
+		return err
+	}
+	return writeZeros(w, r.size-r.fileSize)
+}
+
+const sectorSize = 512
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func writeZeros(w io.Writer, n int64) error {
+	zeros := make([]byte, 64*1024)
+	for n > 0 {
+		chunk := int64(len(zeros))
+		if n < chunk {
+			chunk = n
+		}
+		if _, err := w.Write(zeros[:chunk]); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+func roundUp(n int64, to int64) int64 {
+	return (n + to - 1) / to * to
+}
+
+func divRoundUp(n int64, d int64) int64 {
+	return (n + d - 1) / d
+}
@@ -0,0 +1,338 @@
+package imageformat
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/xml"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testImage writes a raw image with data at its start, in its middle and at
+// its end, and returns it as a virtual disk of size bytes
+func testImage(t *testing.T, dir string, size int64) (string, []byte) {
+	raw := make([]byte, 5*1024*1024+100)
+	copy(raw, bytes.Repeat([]byte("boot"), 1024))
+	copy(raw[4*1024*1024+7:], "middle")
+	copy(raw[len(raw)-3:], "end")
+	path := filepath.Join(dir, "disk.img")
+	if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	disk := make([]byte, roundUp(size, sectorSize))
+	if int64(len(disk)) < int64(len(raw)) {
+		disk = make([]byte, roundUp(int64(len(raw)), sectorSize))
+	}
+	copy(disk, raw)
+	return path, disk
+}
+
+// convertTest converts a test image in dir to format
+func convertTest(t *testing.T, dir string, format Format, opts Options) (string, []byte) {
+	src, disk := testImage(t, dir, opts.Size)
+	dst := filepath.Join(dir, "disk"+format.Extension())
+	if err := Convert(src, dst, format, opts); err != nil {
+		t.Fatal(err)
+	}
+	return dst, disk
+}
+
+func TestParseFormat(t *testing.T) {
+	f, err := ParseFormat("VMDK")
+	assert.NoError(t, err)
+	assert.Equal(t, VMDK, f)
+	assert.Equal(t, ".vhd", VHDDynamic.Extension())
+	_, err = ParseFormat("vdi")
+	assert.Error(t, err)
+}
+
+func TestFixedVHD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imageformat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst, disk := convertTest(t, dir, VHD, Options{Size: 20 * 1024 * 1024})
+	b, _ := ioutil.ReadFile(dst)
+	assert.Equal(t, len(disk)+512, len(b))
+	assert.True(t, bytes.Equal(disk, b[:len(disk)]))
+
+	footer := b[len(disk):]
+	assert.Equal(t, "conectix", string(footer[:8]))
+	assert.Equal(t, uint64(len(disk)), binary.BigEndian.Uint64(footer[48:]))
+	assert.Equal(t, uint32(vhdFixed), binary.BigEndian.Uint32(footer[60:]))
+	checksum := binary.BigEndian.Uint32(footer[64:])
+	binary.BigEndian.PutUint32(footer[64:], 0)
+	assert.Equal(t, vhdChecksum(footer), checksum)
+}
+
+func TestDynamicVHD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imageformat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst, disk := convertTest(t, dir, VHDDynamic, Options{})
+	b, _ := ioutil.ReadFile(dst)
+	assert.Equal(t, b[:512], b[len(b)-512:])
+	assert.Equal(t, "cxsparse", string(b[512:520]))
+
+	table := int64(binary.BigEndian.Uint64(b[512+16:]))
+	entries := int64(binary.BigEndian.Uint32(b[512+28:]))
+	out := make([]byte, entries*vhdBlockSize)
+	for i := int64(0); i < entries; i++ {
+		sector := binary.BigEndian.Uint32(b[table+i*4:])
+		if sector == vhdNoBlock {
+			continue
+		}
+		data := int64(sector)*sectorSize + sectorSize
+		copy(out[i*vhdBlockSize:], b[data:data+vhdBlockSize])
+	}
+	assert.True(t, bytes.Equal(disk, out[:len(disk)]))
+	// the block of zeros between the start and the middle is left out
+	assert.Equal(t, int64(3), entries)
+	assert.Equal(t, uint32(vhdNoBlock), binary.BigEndian.Uint32(b[table+4:]))
+}
+
+func TestVHDX(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imageformat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst, disk := convertTest(t, dir, VHDX, Options{})
+	b, _ := ioutil.ReadFile(dst)
+	assert.Equal(t, "vhdxfile", string(b[:8]))
+
+	crc := func(s []byte) uint32 {
+		c := append([]byte(nil), s...)
+		binary.LittleEndian.PutUint32(c[4:], 0)
+		return crc32.Checksum(c, crc32c)
+	}
+	header := b[vhdxHeader1Offset : vhdxHeader1Offset+vhdxHeaderSize]
+	assert.Equal(t, "head", string(header[:4]))
+	assert.Equal(t, binary.LittleEndian.Uint32(header[4:]), crc(header))
+
+	regions := b[vhdxRegionTable1 : vhdxRegionTable1+vhdxRegionTableSize]
+	assert.Equal(t, "regi", string(regions[:4]))
+	assert.Equal(t, binary.LittleEndian.Uint32(regions[4:]), crc(regions))
+	var batOffset, metadataOffset int64
+	for i := 0; i < int(binary.LittleEndian.Uint32(regions[8:])); i++ {
+		entry := regions[16+32*i:]
+		var guid [16]byte
+		copy(guid[:], entry)
+		switch guid {
+		case vhdxBATRegion:
+			batOffset = int64(binary.LittleEndian.Uint64(entry[16:]))
+		case vhdxMetadataRegion:
+			metadataOffset = int64(binary.LittleEndian.Uint64(entry[16:]))
+		}
+	}
+
+	metadata := b[metadataOffset:]
+	assert.Equal(t, "metadata", string(metadata[:8]))
+	var size int64
+	for i := 0; i < int(binary.LittleEndian.Uint16(metadata[10:])); i++ {
+		entry := metadata[32+32*i:]
+		var guid [16]byte
+		copy(guid[:], entry)
+		if guid == vhdxVirtualDiskSize {
+			size = int64(binary.LittleEndian.Uint64(metadata[binary.LittleEndian.Uint32(entry[16:]):]))
+		}
+	}
+	assert.Equal(t, int64(len(disk)), size)
+
+	out := make([]byte, roundUp(size, vhdxBlockSize))
+	for i := int64(0); i < divRoundUp(size, vhdxBlockSize); i++ {
+		entry := binary.LittleEndian.Uint64(b[batOffset+i*8:])
+		if entry&7 == vhdxBlockFullyPresent {
+			offset := int64(entry>>20) * vhdxMB
+			copy(out[i*vhdxBlockSize:], b[offset:offset+vhdxBlockSize])
+		}
+	}
+	assert.True(t, bytes.Equal(disk, out[:len(disk)]))
+}
+
+func TestStreamVMDK(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imageformat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst, disk := convertTest(t, dir, VMDK, Options{})
+	b, _ := ioutil.ReadFile(dst)
+	assert.Equal(t, uint32(vmdkMagic), binary.LittleEndian.Uint32(b))
+	assert.Contains(t, string(b[512:1024]), `createType="streamOptimized"`)
+
+	// the footer is followed by the end of stream marker
+	footer := b[len(b)-1024:]
+	assert.Equal(t, uint32(vmdkMagic), binary.LittleEndian.Uint32(footer))
+	assert.Equal(t, uint32(vmdkMarkerFooter), binary.LittleEndian.Uint32(b[len(b)-1536+12:]))
+	capacity := int64(binary.LittleEndian.Uint64(footer[12:]))
+	gdOffset := int64(binary.LittleEndian.Uint64(footer[56:])) * sectorSize
+	assert.Equal(t, int64(len(disk)/sectorSize), capacity)
+
+	grainBytes := int64(vmdkGrainSize * sectorSize)
+	out := make([]byte, roundUp(capacity*sectorSize, grainBytes))
+	grains := divRoundUp(capacity, vmdkGrainSize)
+	for i := int64(0); i < grains; i++ {
+		gt := int64(binary.LittleEndian.Uint32(b[gdOffset+i/vmdkGTEsPerGT*4:])) * sectorSize
+		grain := int64(binary.LittleEndian.Uint32(b[gt+i%vmdkGTEsPerGT*4:])) * sectorSize
+		if grain == 0 {
+			continue
+		}
+		assert.Equal(t, uint64(i*vmdkGrainSize), binary.LittleEndian.Uint64(b[grain:]))
+		size := int64(binary.LittleEndian.Uint32(b[grain+8:]))
+		zr, err := zlib.NewReader(bytes.NewReader(b[grain+12 : grain+12+size]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadFull(zr, out[i*grainBytes:(i+1)*grainBytes])
+	}
+	assert.True(t, bytes.Equal(disk, out[:len(disk)]))
+}
+
+func TestFlatVMDK(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imageformat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst, disk := convertTest(t, dir, VMDKFlat, Options{})
+	descriptor, _ := ioutil.ReadFile(dst)
+	assert.Contains(t, string(descriptor), `RW 10241 FLAT "disk-flat.vmdk" 0`)
+	b, _ := ioutil.ReadFile(strings.TrimSuffix(dst, ".vmdk") + "-flat.vmdk")
+	assert.True(t, bytes.Equal(disk, b))
+}
+
+func TestQCOW2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imageformat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst, disk := convertTest(t, dir, QCOW2, Options{Size: 1024 * 1024 * 1024})
+	b, _ := ioutil.ReadFile(dst)
+	assert.Equal(t, uint32(qcow2Magic), binary.BigEndian.Uint32(b))
+	assert.Equal(t, uint32(3), binary.BigEndian.Uint32(b[4:]))
+	size := int64(binary.BigEndian.Uint64(b[24:]))
+	assert.Equal(t, int64(len(disk)), size)
+
+	l1Size := int64(binary.BigEndian.Uint32(b[36:]))
+	l1 := int64(binary.BigEndian.Uint64(b[40:]))
+	out := make([]byte, roundUp(size, qcow2ClusterSize))
+	for i := int64(0); i < l1Size; i++ {
+		l2 := int64(binary.BigEndian.Uint64(b[l1+i*8:]) &^ qcow2Copied)
+		if l2 == 0 {
+			continue
+		}
+		for j := int64(0); j < qcow2L2Entries; j++ {
+			cluster := int64(binary.BigEndian.Uint64(b[l2+j*8:]) &^ qcow2Copied)
+			if cluster != 0 {
+				copy(out[(i*qcow2L2Entries+j)*qcow2ClusterSize:], b[cluster:cluster+qcow2ClusterSize])
+			}
+		}
+	}
+	assert.True(t, bytes.Equal(disk, out[:len(disk)]))
+
+	// every cluster of the file has a reference
+	refcountTable := int64(binary.BigEndian.Uint64(b[48:]))
+	refcounts := int64(binary.BigEndian.Uint64(b[refcountTable:]))
+	for i := int64(0); i < int64(len(b))/qcow2ClusterSize; i++ {
+		assert.Equal(t, uint16(1), binary.BigEndian.Uint16(b[refcounts+i*2:]))
+	}
+	assert.Equal(t, uint16(0), binary.BigEndian.Uint16(b[refcounts+int64(len(b))/qcow2ClusterSize*2:]))
+}
+
+func TestOVA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imageformat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst, _ := convertTest(t, dir, OVA, Options{Name: "web & db", CPUs: 2})
+	fd, err := os.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	tr := tar.NewReader(fd)
+	var names []string
+	var ovf struct {
+		Name string `xml:"VirtualSystem>Name"`
+		Disk struct {
+			Capacity string `xml:"capacity,attr"`
+		} `xml:"DiskSection>Disk"`
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if strings.HasSuffix(hdr.Name, ".ovf") {
+			assert.NoError(t, xml.NewDecoder(tr).Decode(&ovf))
+		}
+	}
+	assert.Equal(t, []string{"web & db.ovf", "web & db-disk1.vmdk", "web & db.mf"}, names)
+	assert.Equal(t, "web & db", ovf.Name)
+	assert.Equal(t, "5243392", ovf.Disk.Capacity)
+}
+
+// TestQemuImg checks the disks with qemu-img, which reads them the way
+// hypervisors and the importers of cloud providers do
+func TestQemuImg(t *testing.T) {
+	qemuImg, err := exec.LookPath("qemu-img")
+	if err != nil {
+		t.Skip("qemu-img is not installed")
+	}
+
+	// the disk of an OVA is a stream-optimized VMDK
+	formats := map[Format]string{
+		VHD:        "vpc",
+		VHDDynamic: "vpc",
+		VHDX:       "vhdx",
+		VMDK:       "vmdk",
+		VMDKFlat:   "vmdk",
+		QCOW2:      "qcow2",
+	}
+	for format, name := range formats {
+		for _, size := range []int64{0, 16 * 1024 * 1024} {
+			dir, err := ioutil.TempDir("", "imageformat")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			dst, _ := convertTest(t, dir, format, Options{Size: size})
+			src := filepath.Join(dir, "disk.img")
+			if format != VHD && format != VHDDynamic {
+				out, err := exec.Command(qemuImg, "check", "-f", name, dst).CombinedOutput()
+				assert.NoError(t, err, "%s: %s", format, out)
+			}
+			out, err := exec.Command(qemuImg, "compare", "-f", "raw", "-F", name, src, dst).CombinedOutput()
+			assert.NoError(t, err, "%s of %d bytes: %s", format, size, out)
+		}
+	}
+}
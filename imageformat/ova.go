@@ -0,0 +1,174 @@
+package imageformat
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ovfEnvelope is the OVF descriptor of a virtual machine with one disk,
+// one network interface and an IDE controller
+const ovfEnvelope = `<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1" xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData" xmlns:vssd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <References>
+    <File ovf:href="{{disk}}" ovf:id="file1" ovf:size="{{diskSize}}"/>
+  </References>
+  <DiskSection>
+    <Info>Virtual disk information</Info>
+    <Disk ovf:capacity="{{capacity}}" ovf:capacityAllocationUnits="byte" ovf:diskId="vmdisk1" ovf:fileRef="file1" ovf:format="http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"/>
+  </DiskSection>
+  <NetworkSection>
+    <Info>The list of logical networks</Info>
+    <Network ovf:name="VM Network">
+      <Description>The VM Network network</Description>
+    </Network>
+  </NetworkSection>
+  <VirtualSystem ovf:id="{{name}}">
+    <Info>A virtual machine</Info>
+    <Name>{{name}}</Name>
+    <OperatingSystemSection ovf:id="102">
+      <Info>The kind of installed guest operating system</Info>
+    </OperatingSystemSection>
+    <VirtualHardwareSection>
+      <Info>Virtual hardware requirements</Info>
+      <System>
+        <vssd:ElementName>Virtual Hardware Family</vssd:ElementName>
+        <vssd:InstanceID>0</vssd:InstanceID>
+        <vssd:VirtualSystemIdentifier>{{name}}</vssd:VirtualSystemIdentifier>
+        <vssd:VirtualSystemType>vmx-07</vssd:VirtualSystemType>
+      </System>
+      <Item>
+        <rasd:AllocationUnits>hertz * 10^6</rasd:AllocationUnits>
+        <rasd:Description>Number of Virtual CPUs</rasd:Description>
+        <rasd:ElementName>{{cpus}} virtual CPU(s)</rasd:ElementName>
+        <rasd:InstanceID>1</rasd:InstanceID>
+        <rasd:ResourceType>3</rasd:ResourceType>
+        <rasd:VirtualQuantity>{{cpus}}</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:AllocationUnits>byte * 2^20</rasd:AllocationUnits>
+        <rasd:Description>Memory Size</rasd:Description>
+        <rasd:ElementName>{{memory}}MB of memory</rasd:ElementName>
+        <rasd:InstanceID>2</rasd:InstanceID>
+        <rasd:ResourceType>4</rasd:ResourceType>
+        <rasd:VirtualQuantity>{{memory}}</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:Address>0</rasd:Address>
+        <rasd:Description>IDE Controller</rasd:Description>
+        <rasd:ElementName>ideController0</rasd:ElementName>
+        <rasd:InstanceID>3</rasd:InstanceID>
+        <rasd:ResourceType>5</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AddressOnParent>0</rasd:AddressOnParent>
+        <rasd:ElementName>disk0</rasd:ElementName>
+        <rasd:HostResource>ovf:/disk/vmdisk1</rasd:HostResource>
+        <rasd:InstanceID>4</rasd:InstanceID>
+        <rasd:Parent>3</rasd:Parent>
+        <rasd:ResourceType>17</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AutomaticAllocation>true</rasd:AutomaticAllocation>
+        <rasd:Connection>VM Network</rasd:Connection>
+        <rasd:ElementName>ethernet0</rasd:ElementName>
+        <rasd:InstanceID>5</rasd:InstanceID>
+        <rasd:ResourceSubType>E1000</rasd:ResourceSubType>
+        <rasd:ResourceType>10</rasd:ResourceType>
+      </Item>
+    </VirtualHardwareSection>
+  </VirtualSystem>
+</Envelope>
+`
+
+// writeOVA writes a tar archive with the OVF descriptor, a stream-optimized
+// VMDK and a manifest with their digests, in the order the OVF
+// specification requires
+func writeOVA(r *rawImage, out *os.File, opts Options) error {
+	if opts.CPUs == 0 {
+		opts.CPUs = 1
+	}
+	if opts.MemoryMB == 0 {
+		opts.MemoryMB = 2048
+	}
+
+	tmp, err := ioutil.TempDir("", "ova")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	diskName := opts.Name + "-disk1.vmdk"
+	disk, err := os.Create(filepath.Join(tmp, diskName))
+	if err != nil {
+		return err
+	}
+	defer disk.Close()
+	if err = writeStreamVMDK(r, disk, opts); err != nil {
+		return err
+	}
+	fi, err := disk.Stat()
+	if err != nil {
+		return err
+	}
+
+	ovf := expandOVF(ovfEnvelope, map[string]string{
+		"disk":     diskName,
+		"diskSize": fmt.Sprint(fi.Size()),
+		"capacity": fmt.Sprint(r.size),
+		"name":     opts.Name,
+		"cpus":     fmt.Sprint(opts.CPUs),
+		"memory":   fmt.Sprint(opts.MemoryMB),
+	})
+	ovfName := opts.Name + ".ovf"
+
+	tw := tar.NewWriter(out)
+	if err = tarFile(tw, ovfName, int64(len(ovf)), strings.NewReader(ovf)); err != nil {
+		return err
+	}
+	if _, err = disk.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	diskSum := sha256.New()
+	if err = tarFile(tw, diskName, fi.Size(), io.TeeReader(disk, diskSum)); err != nil {
+		return err
+	}
+	manifest := fmt.Sprintf("SHA256(%s)= %x\nSHA256(%s)= %x\n",
+		ovfName, sha256.Sum256([]byte(ovf)), diskName, diskSum.Sum(nil))
+	if err = tarFile(tw, opts.Name+".mf", int64(len(manifest)), strings.NewReader(manifest)); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// expandOVF replaces the {{name}} placeholders of the template with
+// escaped values
+func expandOVF(template string, values map[string]string) string {
+	for k, v := range values {
+		var escaped bytes.Buffer
+		xml.EscapeText(&escaped, []byte(v))
+		template = strings.Replace(template, "{{"+k+"}}", escaped.String(), -1)
+	}
+	return template
+}
+
+func tarFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, r)
+	return err
+}
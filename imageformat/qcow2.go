@@ -0,0 +1,173 @@
+package imageformat
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+const (
+	qcow2Magic         = 0x514649fb // "QFI\xfb"
+	qcow2ClusterBits   = 16
+	qcow2ClusterSize   = 1 << qcow2ClusterBits
+	qcow2RefcountOrder = 4 // 16 bit refcounts
+	qcow2HeaderLength  = 104
+	qcow2Copied        = 1 << 63
+
+	qcow2L2Entries       = qcow2ClusterSize / 8
+	qcow2RefcountEntries = qcow2ClusterSize / 2
+)
+
+// qcow2Header is the version 3 header
+type qcow2Header struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+	IncompatibleFeatures  uint64
+	CompatibleFeatures    uint64
+	AutoclearFeatures     uint64
+	RefcountOrder         uint32
+	HeaderLength          uint32
+}
+
+// qcow2Layout places the tables of a disk in clusters after the header:
+// the L1 table, the refcount table and blocks, the L2 tables and the
+// clusters with data
+type qcow2Layout struct {
+	l1Size            int64
+	l1Clusters        int64
+	refcountClusters  int64
+	refcountBlocks    int64
+	l2Tables          []int64 // L1 indexes with an L2 table
+	dataClusters      []int64 // disk clusters with data
+	totalClusters     int64
+	l1Offset          int64
+	refcountOffset    int64
+	refcountBlocksOff int64
+	l2Offset          int64
+	dataOffset        int64
+}
+
+func newQCOW2Layout(size int64, dataClusters []int64) *qcow2Layout {
+	l := &qcow2Layout{dataClusters: dataClusters}
+	l.l1Size = divRoundUp(divRoundUp(size, qcow2ClusterSize), qcow2L2Entries)
+	l.l1Clusters = divRoundUp(l.l1Size*8, qcow2ClusterSize)
+	if l.l1Clusters == 0 {
+		l.l1Clusters = 1
+	}
+	for _, c := range dataClusters {
+		if n := len(l.l2Tables); n == 0 || l.l2Tables[n-1] != c/qcow2L2Entries {
+			l.l2Tables = append(l.l2Tables, c/qcow2L2Entries)
+		}
+	}
+
+	// the refcount blocks count themselves, grow them until they cover
+	// every cluster
+	l.refcountClusters, l.refcountBlocks = 1, 1
+	for {
+		l.totalClusters = 1 + l.l1Clusters + l.refcountClusters + l.refcountBlocks +
+			int64(len(l.l2Tables)) + int64(len(dataClusters))
+		blocks := divRoundUp(l.totalClusters, qcow2RefcountEntries)
+		clusters := divRoundUp(blocks*8, qcow2ClusterSize)
+		if blocks == l.refcountBlocks && clusters == l.refcountClusters {
+			break
+		}
+		l.refcountBlocks, l.refcountClusters = blocks, clusters
+	}
+
+	l.l1Offset = qcow2ClusterSize
+	l.refcountOffset = l.l1Offset + l.l1Clusters*qcow2ClusterSize
+	l.refcountBlocksOff = l.refcountOffset + l.refcountClusters*qcow2ClusterSize
+	l.l2Offset = l.refcountBlocksOff + l.refcountBlocks*qcow2ClusterSize
+	l.dataOffset = l.l2Offset + int64(len(l.l2Tables))*qcow2ClusterSize
+	return l
+}
+
+// writeQCOW2 writes a qcow2 version 3 disk with the clusters that have data
+func writeQCOW2(r *rawImage, out *os.File, opts Options) error {
+	cluster := make([]byte, qcow2ClusterSize)
+	var dataClusters []int64
+	for i := int64(0); i < divRoundUp(r.size, qcow2ClusterSize); i++ {
+		zero, err := r.block(cluster, i*qcow2ClusterSize)
+		if err != nil {
+			return err
+		}
+		if !zero {
+			dataClusters = append(dataClusters, i)
+		}
+	}
+	l := newQCOW2Layout(r.size, dataClusters)
+
+	header := qcow2Header{
+		Magic:                 qcow2Magic,
+		Version:               3,
+		ClusterBits:           qcow2ClusterBits,
+		Size:                  uint64(r.size),
+		L1Size:                uint32(l.l1Size),
+		L1TableOffset:         uint64(l.l1Offset),
+		RefcountTableOffset:   uint64(l.refcountOffset),
+		RefcountTableClusters: uint32(l.refcountClusters),
+		RefcountOrder:         qcow2RefcountOrder,
+		HeaderLength:          qcow2HeaderLength,
+	}
+	// the header is followed by the end of header extensions, 8 zero bytes
+	headerCluster := make([]byte, qcow2ClusterSize)
+	copy(headerCluster, encodeBigEndian(&header))
+	if _, err := out.WriteAt(headerCluster, 0); err != nil {
+		return err
+	}
+
+	l1 := make([]byte, l.l1Clusters*qcow2ClusterSize)
+	for i, index := range l.l2Tables {
+		offset := l.l2Offset + int64(i)*qcow2ClusterSize
+		binary.BigEndian.PutUint64(l1[index*8:], uint64(offset)|qcow2Copied)
+	}
+	if _, err := out.WriteAt(l1, l.l1Offset); err != nil {
+		return err
+	}
+
+	refcountTable := make([]byte, l.refcountClusters*qcow2ClusterSize)
+	for i := int64(0); i < l.refcountBlocks; i++ {
+		offset := l.refcountBlocksOff + i*qcow2ClusterSize
+		binary.BigEndian.PutUint64(refcountTable[i*8:], uint64(offset))
+	}
+	if _, err := out.WriteAt(refcountTable, l.refcountOffset); err != nil {
+		return err
+	}
+	refcounts := make([]byte, l.refcountBlocks*qcow2ClusterSize)
+	for i := int64(0); i < l.totalClusters; i++ {
+		binary.BigEndian.PutUint16(refcounts[i*2:], 1)
+	}
+	if _, err := out.WriteAt(refcounts, l.refcountBlocksOff); err != nil {
+		return err
+	}
+
+	l2 := make([]byte, int64(len(l.l2Tables))*qcow2ClusterSize)
+	table := -1
+	for i, c := range dataClusters {
+		if table < 0 || l.l2Tables[table] != c/qcow2L2Entries {
+			table++
+		}
+		offset := l.dataOffset + int64(i)*qcow2ClusterSize
+		entry := int64(table)*qcow2ClusterSize + c%qcow2L2Entries*8
+		binary.BigEndian.PutUint64(l2[entry:], uint64(offset)|qcow2Copied)
+
+		if _, err := r.block(cluster, c*qcow2ClusterSize); err != nil {
+			return err
+		}
+		if _, err := out.WriteAt(cluster, offset); err != nil {
+			return err
+		}
+	}
+	_, err := out.WriteAt(l2, l.l2Offset)
+	return err
+}
@@ -0,0 +1,201 @@
+package imageformat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"os"
+	"time"
+)
+
+const (
+	vhdFixed   = 2
+	vhdDynamic = 3
+
+	vhdBlockSize  = 2 * 1024 * 1024
+	vhdNoBlock    = 0xffffffff
+	vhdNoOffset   = 0xffffffffffffffff
+	vhdHeaderSize = 1024
+)
+
+// vhdEpoch is the start of VHD timestamps
+var vhdEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// vhdFooter is the last sector of every VHD, dynamic disks have a copy in
+// the first sector
+type vhdFooter struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	Timestamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      [4]byte
+	OriginalSize       uint64
+	CurrentSize        uint64
+	Cylinders          uint16
+	Heads              uint8
+	SectorsPerTrack    uint8
+	DiskType           uint32
+	Checksum           uint32
+	UniqueID           [16]byte
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+// vhdDynamicHeader follows the footer copy of dynamic disks
+type vhdDynamicHeader struct {
+	Cookie            [8]byte
+	DataOffset        uint64
+	TableOffset       uint64
+	HeaderVersion     uint32
+	MaxTableEntries   uint32
+	BlockSize         uint32
+	Checksum          uint32
+	ParentUniqueID    [16]byte
+	ParentTimestamp   uint32
+	Reserved1         uint32
+	ParentUnicodeName [512]byte
+	ParentLocators    [8][24]byte
+	Reserved2         [256]byte
+}
+
+func newVHDFooter(size int64, diskType uint32) *vhdFooter {
+	f := &vhdFooter{
+		Features:          2,
+		FileFormatVersion: 0x00010000,
+		DataOffset:        vhdNoOffset,
+		Timestamp:         uint32(time.Since(vhdEpoch) / time.Second),
+		CreatorVersion:    0x00010000,
+		OriginalSize:      uint64(size),
+		CurrentSize:       uint64(size),
+		DiskType:          diskType,
+	}
+	copy(f.Cookie[:], "conectix")
+	copy(f.CreatorApplication[:], "ops ")
+	copy(f.CreatorHostOS[:], "Wi2k")
+	f.Cylinders, f.Heads, f.SectorsPerTrack = vhdGeometry(size)
+	rand.Read(f.UniqueID[:])
+	return f
+}
+
+// bytes returns the encoded footer with its checksum
+func (f *vhdFooter) bytes() []byte {
+	f.Checksum = 0
+	f.Checksum = vhdChecksum(encodeBigEndian(f))
+	return encodeBigEndian(f)
+}
+
+// vhdGeometry returns the CHS geometry of a disk, as computed by the
+// algorithm of the VHD specification
+func vhdGeometry(size int64) (uint16, uint8, uint8) {
+	sectors := size / sectorSize
+	if sectors > 65535*16*255 {
+		sectors = 65535 * 16 * 255
+	}
+
+	var spt, heads, cth int64
+	if sectors >= 65535*16*63 {
+		spt, heads = 255, 16
+		cth = sectors / spt
+	} else {
+		spt = 17
+		cth = sectors / spt
+		heads = (cth + 1023) / 1024
+		if heads < 4 {
+			heads = 4
+		}
+		if cth >= heads*1024 || heads > 16 {
+			spt, heads = 31, 16
+			cth = sectors / spt
+		}
+		if cth >= heads*1024 {
+			spt, heads = 63, 16
+			cth = sectors / spt
+		}
+	}
+	return uint16(cth / heads), uint8(heads), uint8(spt)
+}
+
+// vhdChecksum is the one's complement of the sum of the bytes
+func vhdChecksum(b []byte) uint32 {
+	var sum uint32
+	for _, c := range b {
+		sum += uint32(c)
+	}
+	return ^sum
+}
+
+func encodeBigEndian(v interface{}) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, v)
+	return b.Bytes()
+}
+
+// writeFixedVHD writes the disk followed by a footer
+func writeFixedVHD(r *rawImage, out *os.File, opts Options) error {
+	if err := r.copyTo(out); err != nil {
+		return err
+	}
+	_, err := out.Write(newVHDFooter(r.size, vhdFixed).bytes())
+	return err
+}
+
+// writeDynamicVHD writes the blocks of the disk with data after a block
+// allocation table
+func writeDynamicVHD(r *rawImage, out *os.File, opts Options) error {
+	blocks := divRoundUp(r.size, vhdBlockSize)
+	tableOffset := int64(sectorSize + vhdHeaderSize)
+	tableSize := roundUp(blocks*4, sectorSize)
+
+	footer := newVHDFooter(r.size, vhdDynamic)
+	footer.DataOffset = sectorSize
+	footerBytes := footer.bytes()
+
+	header := &vhdDynamicHeader{
+		DataOffset:      vhdNoOffset,
+		TableOffset:     uint64(tableOffset),
+		HeaderVersion:   0x00010000,
+		MaxTableEntries: uint32(blocks),
+		BlockSize:       vhdBlockSize,
+	}
+	copy(header.Cookie[:], "cxsparse")
+	header.Checksum = vhdChecksum(encodeBigEndian(header))
+
+	if _, err := out.Write(footerBytes); err != nil {
+		return err
+	}
+	if _, err := out.Write(encodeBigEndian(header)); err != nil {
+		return err
+	}
+
+	// blocks start with a bitmap of the sectors they have data for
+	bitmap := bytes.Repeat([]byte{0xff}, vhdBlockSize/sectorSize/8)
+	table := bytes.Repeat([]byte{0xff}, int(tableSize))
+	offset := tableOffset + tableSize
+	data := make([]byte, vhdBlockSize)
+	for i := int64(0); i < blocks; i++ {
+		zero, err := r.block(data, i*vhdBlockSize)
+		if err != nil {
+			return err
+		}
+		if zero {
+			continue
+		}
+		binary.BigEndian.PutUint32(table[i*4:], uint32(offset/sectorSize))
+		if _, err = out.WriteAt(bitmap, offset); err != nil {
+			return err
+		}
+		if _, err = out.WriteAt(data, offset+int64(len(bitmap))); err != nil {
+			return err
+		}
+		offset += int64(len(bitmap) + len(data))
+	}
+
+	if _, err := out.WriteAt(table, tableOffset); err != nil {
+		return err
+	}
+	_, err := out.WriteAt(footerBytes, offset)
+	return err
+}
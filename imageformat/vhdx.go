@@ -0,0 +1,237 @@
+package imageformat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	vhdxMB = 1024 * 1024
+
+	vhdxHeader1Offset     = 64 * 1024
+	vhdxHeader2Offset     = 128 * 1024
+	vhdxRegionTable1      = 192 * 1024
+	vhdxRegionTable2      = 256 * 1024
+	vhdxHeaderSize        = 4 * 1024
+	vhdxRegionTableSize   = 64 * 1024
+	vhdxLogOffset         = 1 * vhdxMB
+	vhdxLogLength         = 1 * vhdxMB
+	vhdxMetadataOffset    = 2 * vhdxMB
+	vhdxMetadataLength    = 1 * vhdxMB
+	vhdxMetadataItems     = 64 * 1024
+	vhdxBATOffset         = 3 * vhdxMB
+	vhdxBlockSize         = 32 * vhdxMB
+	vhdxLogicalSector     = 512
+	vhdxPhysicalSector    = 4096
+	vhdxBlockFullyPresent = 6
+
+	vhdxMetadataIsVirtualDisk = 1 << 1
+	vhdxMetadataIsRequired    = 1 << 2
+)
+
+// region and metadata item identifiers of the VHDX specification
+var (
+	vhdxBATRegion      = vhdxGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	vhdxMetadataRegion = vhdxGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+
+	vhdxFileParameters     = vhdxGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	vhdxVirtualDiskSize    = vhdxGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	vhdxPage83Data         = vhdxGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	vhdxLogicalSectorSize  = vhdxGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	vhdxPhysicalSectorSize = vhdxGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+)
+
+type vhdxHeader struct {
+	Signature      [4]byte
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGUID  [16]byte
+	DataWriteGUID  [16]byte
+	LogGUID        [16]byte
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+}
+
+type vhdxRegionTableHeader struct {
+	Signature  [4]byte
+	Checksum   uint32
+	EntryCount uint32
+	Reserved   uint32
+}
+
+type vhdxRegionTableEntry struct {
+	GUID       [16]byte
+	FileOffset uint64
+	Length     uint32
+	Required   uint32
+}
+
+type vhdxMetadataTableHeader struct {
+	Signature  [8]byte
+	Reserved   uint16
+	EntryCount uint16
+	Reserved2  [20]byte
+}
+
+type vhdxMetadataTableEntry struct {
+	ItemID   [16]byte
+	Offset   uint32
+	Length   uint32
+	Flags    uint32
+	Reserved uint32
+}
+
+// vhdxGUID encodes a GUID with its first three fields in little endian
+func vhdxGUID(s string) [16]byte {
+	var g [16]byte
+	b, _ := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	copy(g[:], b)
+	g[0], g[1], g[2], g[3] = g[3], g[2], g[1], g[0]
+	g[4], g[5] = g[5], g[4]
+	g[6], g[7] = g[7], g[6]
+	return g
+}
+
+func encodeLittleEndian(v interface{}) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, v)
+	return b.Bytes()
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// vhdxChecksum stores the CRC-32C of a structure at offset 4, it is
+// computed with the checksum field set to zero
+func vhdxChecksum(b []byte) {
+	binary.LittleEndian.PutUint32(b[4:], 0)
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(b, crc32c))
+}
+
+// writeVHDX writes a dynamic VHDX, the blocks of the disk with data follow
+// the headers, an empty log, the metadata and the block allocation table
+func writeVHDX(r *rawImage, out *os.File, opts Options) error {
+	blocks := divRoundUp(r.size, vhdxBlockSize)
+	// a sector bitmap entry follows every chunkRatio payload entries of
+	// the BAT, they are unused by disks without a parent
+	chunkRatio := int64(1<<23) * vhdxLogicalSector / vhdxBlockSize
+	entries := blocks + (blocks-1)/chunkRatio
+	batLength := roundUp(entries*8, vhdxMB)
+
+	identifier := make([]byte, vhdxHeader1Offset)
+	copy(identifier, "vhdxfile")
+	for i, c := range utf16.Encode([]rune("ops")) {
+		binary.LittleEndian.PutUint16(identifier[8+2*i:], c)
+	}
+	if _, err := out.WriteAt(identifier, 0); err != nil {
+		return err
+	}
+
+	header := vhdxHeader{
+		Version:   1,
+		LogLength: vhdxLogLength,
+		LogOffset: vhdxLogOffset,
+	}
+	copy(header.Signature[:], "head")
+	rand.Read(header.FileWriteGUID[:])
+	rand.Read(header.DataWriteGUID[:])
+	for i, offset := range []int64{vhdxHeader1Offset, vhdxHeader2Offset} {
+		header.SequenceNumber = uint64(i)
+		b := make([]byte, vhdxHeaderSize)
+		copy(b, encodeLittleEndian(&header))
+		vhdxChecksum(b)
+		if _, err := out.WriteAt(b, offset); err != nil {
+			return err
+		}
+	}
+
+	regions := make([]byte, vhdxRegionTableSize)
+	regionHeader := vhdxRegionTableHeader{EntryCount: 2}
+	copy(regionHeader.Signature[:], "regi")
+	copy(regions, encodeLittleEndian(&regionHeader))
+	copy(regions[16:], encodeLittleEndian([]vhdxRegionTableEntry{
+		{GUID: vhdxBATRegion, FileOffset: vhdxBATOffset, Length: uint32(batLength), Required: 1},
+		{GUID: vhdxMetadataRegion, FileOffset: vhdxMetadataOffset, Length: vhdxMetadataLength, Required: 1},
+	}))
+	vhdxChecksum(regions)
+	for _, offset := range []int64{vhdxRegionTable1, vhdxRegionTable2} {
+		if _, err := out.WriteAt(regions, offset); err != nil {
+			return err
+		}
+	}
+
+	if _, err := out.WriteAt(make([]byte, vhdxLogLength), vhdxLogOffset); err != nil {
+		return err
+	}
+	if _, err := out.WriteAt(vhdxMetadata(r.size), vhdxMetadataOffset); err != nil {
+		return err
+	}
+
+	bat := make([]byte, batLength)
+	offset := roundUp(vhdxBATOffset+batLength, vhdxMB)
+	data := make([]byte, vhdxBlockSize)
+	for i := int64(0); i < blocks; i++ {
+		zero, err := r.block(data, i*vhdxBlockSize)
+		if err != nil {
+			return err
+		}
+		if zero {
+			continue
+		}
+		entry := uint64(offset/vhdxMB)<<20 | vhdxBlockFullyPresent
+		binary.LittleEndian.PutUint64(bat[(i+i/chunkRatio)*8:], entry)
+		if _, err = out.WriteAt(data, offset); err != nil {
+			return err
+		}
+		offset += vhdxBlockSize
+	}
+	if _, err := out.WriteAt(bat, vhdxBATOffset); err != nil {
+		return err
+	}
+	return out.Truncate(offset)
+}
+
+// vhdxMetadata returns the metadata region with the parameters of the disk
+func vhdxMetadata(size int64) []byte {
+	var page83 [16]byte
+	rand.Read(page83[:])
+
+	items := []struct {
+		id    [16]byte
+		flags uint32
+		value interface{}
+	}{
+		{vhdxFileParameters, vhdxMetadataIsRequired, []uint32{vhdxBlockSize, 0}},
+		{vhdxVirtualDiskSize, vhdxMetadataIsVirtualDisk | vhdxMetadataIsRequired, uint64(size)},
+		{vhdxPage83Data, vhdxMetadataIsVirtualDisk | vhdxMetadataIsRequired, page83},
+		{vhdxLogicalSectorSize, vhdxMetadataIsVirtualDisk | vhdxMetadataIsRequired, uint32(vhdxLogicalSector)},
+		{vhdxPhysicalSectorSize, vhdxMetadataIsVirtualDisk | vhdxMetadataIsRequired, uint32(vhdxPhysicalSector)},
+	}
+
+	region := make([]byte, vhdxMetadataLength)
+	header := vhdxMetadataTableHeader{EntryCount: uint16(len(items))}
+	copy(header.Signature[:], "metadata")
+	copy(region, encodeLittleEndian(&header))
+
+	offset := vhdxMetadataItems
+	for i, item := range items {
+		value := encodeLittleEndian(item.value)
+		entry := vhdxMetadataTableEntry{
+			ItemID: item.id,
+			Offset: uint32(offset),
+			Length: uint32(len(value)),
+			Flags:  item.flags,
+		}
+		copy(region[32+32*i:], encodeLittleEndian(&entry))
+		copy(region[offset:], value)
+		offset += len(value)
+	}
+	return region
+}
@@ -0,0 +1,220 @@
+package imageformat
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	vmdkMagic       = 0x564d444b // "KDMV"
+	vmdkGrainSize   = 128        // sectors
+	vmdkGTEsPerGT   = 512
+	vmdkGDAtEnd     = 0xffffffffffffffff
+	vmdkCompressed  = 1 << 16
+	vmdkHasMarkers  = 1 << 17
+	vmdkNewlineTest = 1 << 0
+
+	vmdkMarkerEOS    = 0
+	vmdkMarkerGT     = 1
+	vmdkMarkerGD     = 2
+	vmdkMarkerFooter = 3
+)
+
+// vmdkHeader is the sparse extent header, the footer of stream-optimized
+// disks is a copy with the offset of the grain directory
+type vmdkHeader struct {
+	Magic              uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RGDOffset          uint64
+	GDOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  uint8
+	NonEndLineChar     uint8
+	DoubleEndLineChar1 uint8
+	DoubleEndLineChar2 uint8
+	CompressAlgorithm  uint16
+	Pad                [433]byte
+}
+
+// vmdkMarker precedes the metadata of stream-optimized disks
+type vmdkMarker struct {
+	NumSectors uint64
+	Size       uint32
+	Type       uint32
+	Pad        [496]byte
+}
+
+// vmdkDescriptor returns the text descriptor of a disk with one extent
+func vmdkDescriptor(createType string, extent string, capacity int64) string {
+	var cid [4]byte
+	rand.Read(cid[:])
+	cylinders := capacity / (16 * 63)
+	if cylinders > 16383 {
+		cylinders = 16383
+	}
+	return fmt.Sprintf(`# Disk DescriptorFile
+version=1
+CID=%x
+parentCID=ffffffff
+createType="%s"
+
+# Extent description
+%s
+
+# The Disk Data Base
+#DDB
+
+ddb.virtualHWVersion = "4"
+ddb.geometry.cylinders = "%d"
+ddb.geometry.heads = "16"
+ddb.geometry.sectors = "63"
+ddb.adapterType = "ide"
+`, cid, createType, extent, cylinders)
+}
+
+// writeStreamVMDK writes a stream-optimized VMDK. The compressed grains
+// with data come first, followed by the grain tables, the grain directory
+// and a footer with its offset.
+func writeStreamVMDK(r *rawImage, out *os.File, opts Options) error {
+	capacity := r.size / sectorSize
+	descriptor := vmdkDescriptor("streamOptimized",
+		fmt.Sprintf(`RW %d SPARSE "%s"`, capacity, filepath.Base(out.Name())), capacity)
+	descriptorSize := divRoundUp(int64(len(descriptor)), sectorSize)
+
+	header := vmdkHeader{
+		Magic:              vmdkMagic,
+		Version:            3,
+		Flags:              vmdkNewlineTest | vmdkCompressed | vmdkHasMarkers,
+		Capacity:           uint64(capacity),
+		GrainSize:          vmdkGrainSize,
+		DescriptorOffset:   1,
+		DescriptorSize:     uint64(descriptorSize),
+		NumGTEsPerGT:       vmdkGTEsPerGT,
+		GDOffset:           vmdkGDAtEnd,
+		OverHead:           uint64(roundUp(1+descriptorSize, vmdkGrainSize)),
+		SingleEndLineChar:  '\n',
+		NonEndLineChar:     ' ',
+		DoubleEndLineChar1: '\r',
+		DoubleEndLineChar2: '\n',
+		CompressAlgorithm:  1,
+	}
+
+	w := &sectorWriter{w: out}
+	w.write(encodeLittleEndian(&header))
+	w.write([]byte(descriptor))
+	w.pad(int64(header.OverHead) * sectorSize)
+
+	grains := divRoundUp(capacity, vmdkGrainSize)
+	tables := divRoundUp(grains, vmdkGTEsPerGT)
+	gt := make([]uint32, tables*vmdkGTEsPerGT)
+	data := make([]byte, vmdkGrainSize*sectorSize)
+	var compressed bytes.Buffer
+	for i := int64(0); i < grains && w.err == nil; i++ {
+		zero, err := r.block(data, i*int64(len(data)))
+		if err != nil {
+			return err
+		}
+		if zero {
+			continue
+		}
+
+		compressed.Reset()
+		zw := zlib.NewWriter(&compressed)
+		zw.Write(data)
+		zw.Close()
+
+		// grain markers have the sector of the grain and the size of the
+		// compressed data that follows
+		gt[i] = uint32(w.sector())
+		var marker [12]byte
+		binary.LittleEndian.PutUint64(marker[:], uint64(i*vmdkGrainSize))
+		binary.LittleEndian.PutUint32(marker[8:], uint32(compressed.Len()))
+		w.write(marker[:])
+		w.write(compressed.Bytes())
+		w.pad(sectorSize)
+	}
+
+	gtSectors := int64(vmdkGTEsPerGT * 4 / sectorSize)
+	gd := make([]uint32, tables)
+	for i := range gd {
+		w.write(encodeLittleEndian(&vmdkMarker{NumSectors: uint64(gtSectors), Type: vmdkMarkerGT}))
+		gd[i] = uint32(w.sector())
+		w.write(encodeLittleEndian(gt[i*vmdkGTEsPerGT : (i+1)*vmdkGTEsPerGT]))
+	}
+
+	w.write(encodeLittleEndian(&vmdkMarker{NumSectors: uint64(divRoundUp(tables*4, sectorSize)), Type: vmdkMarkerGD}))
+	header.GDOffset = uint64(w.sector())
+	w.write(encodeLittleEndian(gd))
+	w.pad(sectorSize)
+
+	w.write(encodeLittleEndian(&vmdkMarker{NumSectors: 1, Type: vmdkMarkerFooter}))
+	w.write(encodeLittleEndian(&header))
+	w.write(encodeLittleEndian(&vmdkMarker{Type: vmdkMarkerEOS}))
+	return w.err
+}
+
+// sectorWriter writes sequentially and keeps the first error
+type sectorWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (w *sectorWriter) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = w.w.Write(b)
+	w.n += int64(len(b))
+}
+
+// pad writes zeros up to a multiple of size
+func (w *sectorWriter) pad(size int64) {
+	if w.err != nil {
+		return
+	}
+	n := roundUp(w.n, size) - w.n
+	w.err = writeZeros(w.w, n)
+	w.n += n
+}
+
+func (w *sectorWriter) sector() int64 {
+	return w.n / sectorSize
+}
+
+// writeFlatVMDK writes the descriptor of a monolithicFlat disk to dst and
+// the disk to the extent next to it
+func writeFlatVMDK(r *rawImage, dst string) error {
+	extent := strings.TrimSuffix(dst, ".vmdk") + "-flat.vmdk"
+	capacity := r.size / sectorSize
+	descriptor := vmdkDescriptor("monolithicFlat",
+		fmt.Sprintf(`RW %d FLAT "%s" 0`, capacity, filepath.Base(extent)), capacity)
+
+	out, err := os.Create(extent)
+	if err != nil {
+		return err
+	}
+	if err = r.copyTo(out); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, []byte(descriptor), 0644)
+}
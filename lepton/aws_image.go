@@ -42,6 +42,10 @@ func (p *AWS) BuildImageWithPackage(ctx *Context, pkgpath string) (string, error
 // CreateImage - Creates image on AWS using nanos images
 // TODO : re-use and cache DefaultClient and instances.
 func (p *AWS) CreateImage(ctx *Context, imagePath string) error {
+	if err := VerifyImageSignature(ctx.config, ctx.config.RunConfig.Imagename); err != nil {
+		return err
+	}
+
 	// this is a really convulted setup
 	// 1) upload the image
 	// 2) create a snapshot
@@ -54,6 +54,10 @@ func (a *Azure) BuildImageWithPackage(ctx *Context, pkgpath string) (string, err
 
 // CreateImage - Creates image on Azure using nanos images
 func (a *Azure) CreateImage(ctx *Context, imagePath string) error {
+	if err := VerifyImageSignature(ctx.config, ctx.config.RunConfig.Imagename); err != nil {
+		return err
+	}
+
 	err := a.Storage.CopyToBucket(ctx.config, imagePath)
 	if err != nil {
 		return err
@@ -3,43 +3,32 @@ package lepton
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/url"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"strings"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/nanovms/ops/imageformat"
 )
 
 // AzureStorage provides Azure storage related operations
 type AzureStorage struct{}
 
-type qemuInfo struct {
-	VirtualSize uint32 `json:"virtual-size"`
-	Filename    string `json:"filename"`
-	Format      string `json:"format"`
-	ActualSize  uint32 `json:"actual-size"`
-	DirtyFlag   bool   `json:"dirty-flag"`
-}
-
 const (
 	onemb         = 1048576
 	containerName = "quickstart-nanos"
 )
 
-func roundup(x, y uint32) uint32 {
+func roundup(x, y int64) int64 {
 	n := (x + y - 1) / y
 	return (n * onemb)
 }
 
-func (az *AzureStorage) resizeLength(virtSz uint32) uint32 {
-	var azureMin uint32 = 20971520 // min disk sz
-	var max uint32
+func (az *AzureStorage) resizeLength(virtSz int64) int64 {
+	var azureMin int64 = 20971520 // min disk sz
+	var max int64
 
 	if azureMin > virtSz {
 		max = azureMin
@@ -50,64 +39,15 @@ func (az *AzureStorage) resizeLength(virtSz uint32) uint32 {
 	return roundup(max, onemb)
 }
 
-// might have to adjust this if disk sz is really large/overflows
-func (az *AzureStorage) virtualSize(archPath string) uint32 {
-	args := []string{
-		"info", "-f", "raw",
-		"--output", "json", archPath,
-	}
-
-	cmd := exec.Command("qemu-img", args...)
-	out, err := cmd.Output()
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	qi := &qemuInfo{}
-	err = json.Unmarshal([]byte(out), qi)
-
-	return qi.VirtualSize
-}
-
-func (az *AzureStorage) resizeImage(basePath string, newPath string, resizeSz uint32) {
-	in, err := os.Open(basePath)
-	if err != nil {
-		fmt.Println(err)
-	}
-	defer in.Close()
-
-	out, err := os.Create(newPath)
-	if err != nil {
-		fmt.Println(err)
-	}
-	defer out.Close()
-
-	_, err = io.Copy(out, in)
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	szstr := fmt.Sprint(resizeSz)
-
-	args := []string{
-		"resize", "-f", "raw",
-		newPath, szstr,
-	}
-
-	cmd := exec.Command("qemu-img", args...)
-	_, err = cmd.Output()
-	if err != nil {
-		fmt.Println(err)
-	}
-}
-
 // CopyToBucket copies archive to bucket
 func (az *AzureStorage) CopyToBucket(config *Config, imgPath string) error {
 
-	base := filepath.Base(imgPath)
-
 	// get virtual size
-	vs := az.virtualSize(imgPath)
+	info, err := os.Stat(imgPath)
+	if err != nil {
+		return err
+	}
+	vs := info.Size()
 	rs := az.resizeLength(vs)
 
 	debug := false
@@ -116,27 +56,13 @@ func (az *AzureStorage) CopyToBucket(config *Config, imgPath string) error {
 		fmt.Printf("resize sz: %d\n", rs)
 	}
 
-	newpath := "/tmp/" + base
-	newpath = strings.ReplaceAll(newpath, "-image", "")
-
-	// resize
-	az.resizeImage(imgPath, newpath, rs)
-
-	// convert
+	// azure needs a fixed vhd with a size in whole megabytes
 	vhdPath := "/tmp/" + config.CloudConfig.ImageName + ".vhd"
 	vhdPath = strings.ReplaceAll(vhdPath, "-image", "")
 
-	// this is probably just for hyper-v not azure
-	args := []string{
-		"convert", "-f", "raw",
-		"-O", "vpc", "-o", "subformat=fixed,force_size",
-		newpath, vhdPath,
-	}
-
-	cmd := exec.Command("qemu-img", args...)
-	err := cmd.Run()
+	err = imageformat.Convert(imgPath, vhdPath, imageformat.VHD, imageformat.Options{Size: rs})
 	if err != nil {
-		fmt.Println(err)
+		return err
 	}
 
 	ctx := context.Background()
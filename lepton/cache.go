@@ -0,0 +1,296 @@
+package lepton
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BuildCacheDir is the directory of cached images, named by the hash of
+// everything that goes into them
+var BuildCacheDir = path.Join(GetOpsHome(), "cache")
+
+// defaultBuildCacheSize is the size the build cache is trimmed to when
+// the configuration sets none
+const defaultBuildCacheSize = 10 * 1024 * 1024 * 1024
+
+// nativeMkfsVersion changes the cache keys of images written by the native
+// filesystem writer when its output changes
+const nativeMkfsVersion = "tfs-3.1"
+
+// CacheEntry is an image in the build cache
+type CacheEntry struct {
+	Key      string
+	Path     string
+	Size     int64
+	LastUsed time.Time
+}
+
+// fileHash is the hash of the contents of a host file, reused while its size
+// and modification time are the same
+type fileHash struct {
+	Size  int64
+	Mtime time.Time
+	Sum   string
+}
+
+// buildCache finds images by the hash of their manifest, the contents of the
+// host files it refers to and the tools that write them
+type buildCache struct {
+	dir    string
+	size   int64 // size the cache is trimmed to
+	hashes map[string]fileHash
+	dirty  bool
+}
+
+func newBuildCache(dir string) *buildCache {
+	bc := &buildCache{dir: dir, size: defaultBuildCacheSize, hashes: make(map[string]fileHash)}
+	// the hashes are an optimization, they are rebuilt when unreadable
+	if b, err := ioutil.ReadFile(path.Join(dir, "hashes.json")); err == nil {
+		json.Unmarshal(b, &bc.hashes)
+	}
+	return bc
+}
+
+// imagePath returns the path of the cached image with key
+func (bc *buildCache) imagePath(key string) string {
+	return path.Join(bc.dir, key+".img")
+}
+
+// key returns the cache key of the image c builds from manifest
+func (bc *buildCache) key(c *Config, manifest string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "manifest %d\n%s", len(manifest), manifest)
+	fmt.Fprintf(h, "size %s\nreproducible %v\n", c.BaseVolumeSz, c.Reproducible)
+
+	tools := []string{c.Boot}
+	if c.NativeMkfs {
+		fmt.Fprintf(h, "mkfs %s\n", nativeMkfsVersion)
+	} else {
+		tools = append(tools, c.Mkfs)
+	}
+	for _, tool := range tools {
+		if tool == "" {
+			continue
+		}
+		if err := bc.addFile(h, tool); err != nil {
+			return "", err
+		}
+	}
+
+	p := &manifestParser{data: []byte(manifest), line: 1}
+	root, err := p.parseTuple()
+	if err != nil {
+		return "", err
+	}
+	var hostFiles []string
+	collectHostFiles(root, &hostFiles)
+	sort.Strings(hostFiles)
+	for _, hostpath := range hostFiles {
+		resolved, err := lookupFile(c.TargetRoot, hostpath)
+		if err != nil {
+			return "", err
+		}
+		if err = bc.addFile(h, resolved); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// collectHostFiles appends the host paths of the files of a manifest tuple
+func collectHostFiles(t map[string]interface{}, files *[]string) {
+	for k, v := range t {
+		child, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if host, ok := child["host"].(string); ok && k == "contents" {
+			*files = append(*files, host)
+			continue
+		}
+		collectHostFiles(child, files)
+	}
+}
+
+// addFile adds the path and the hash of the contents of a host file to h
+func (bc *buildCache) addFile(h hash.Hash, hostpath string) error {
+	fi, err := os.Stat(hostpath)
+	if err != nil {
+		return err
+	}
+	fh, ok := bc.hashes[hostpath]
+	if !ok || fh.Size != fi.Size() || !fh.Mtime.Equal(fi.ModTime()) {
+		fd, err := os.Open(hostpath)
+		if err != nil {
+			return err
+		}
+		fileSum := sha256.New()
+		_, err = io.Copy(fileSum, fd)
+		fd.Close()
+		if err != nil {
+			return err
+		}
+		fh = fileHash{Size: fi.Size(), Mtime: fi.ModTime(), Sum: hex.EncodeToString(fileSum.Sum(nil))}
+		bc.hashes[hostpath] = fh
+		bc.dirty = true
+	}
+	fmt.Fprintf(h, "file %s %s\n", hostpath, fh.Sum)
+	return nil
+}
+
+// saveHashes writes the file hashes for the next build
+func (bc *buildCache) saveHashes() error {
+	if !bc.dirty {
+		return nil
+	}
+	b, err := json.Marshal(bc.hashes)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(bc.dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(bc.dir, "hashes.json"), b, 0644)
+}
+
+// get copies the cached image with key to dst, it returns false if there is
+// none
+func (bc *buildCache) get(key string, dst string) (bool, error) {
+	src := bc.imagePath(key)
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return false, nil
+	}
+	if err := copyImage(src, dst); err != nil {
+		return false, err
+	}
+	now := time.Now()
+	return true, os.Chtimes(src, now, now)
+}
+
+// put copies the image at src to the cache with key
+func (bc *buildCache) put(key string, src string) error {
+	if err := os.MkdirAll(bc.dir, 0755); err != nil {
+		return err
+	}
+	// images are copied to a temporary file first so that concurrent builds
+	// never find a partial image
+	tmp := bc.imagePath(key) + ".tmp"
+	if err := copyImage(src, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, bc.imagePath(key)); err != nil {
+		return err
+	}
+	return bc.trim(key)
+}
+
+// trim removes the least recently used images until the cache fits in its
+// size, the image with key is kept
+func (bc *buildCache) trim(key string) error {
+	entries, err := listBuildCache(bc.dir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+	for i := len(entries) - 1; i >= 0 && total > bc.size; i-- {
+		if entries[i].Key == key {
+			continue
+		}
+		if err := os.Remove(entries[i].Path); err != nil {
+			return err
+		}
+		total -= entries[i].Size
+	}
+	return nil
+}
+
+func copyImage(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := createFile(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// ListBuildCache returns the images in the build cache, the most recently
+// used first
+func ListBuildCache() ([]CacheEntry, error) {
+	return listBuildCache(BuildCacheDir)
+}
+
+func listBuildCache(dir string) ([]CacheEntry, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []CacheEntry
+	for _, fi := range files {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != ".img" {
+			continue
+		}
+		entries = append(entries, CacheEntry{
+			Key:      strings.TrimSuffix(fi.Name(), ".img"),
+			Path:     path.Join(dir, fi.Name()),
+			Size:     fi.Size(),
+			LastUsed: fi.ModTime(),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastUsed.After(entries[j].LastUsed) })
+	return entries, nil
+}
+
+// PruneBuildCache removes the images of the build cache last used before
+// the given time, and returns them
+func PruneBuildCache(before time.Time) ([]CacheEntry, error) {
+	entries, err := ListBuildCache()
+	if err != nil {
+		return nil, err
+	}
+
+	var pruned []CacheEntry
+	for _, e := range entries {
+		if !e.LastUsed.Before(before) {
+			continue
+		}
+		if err := os.Remove(e.Path); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, e)
+	}
+
+	// the hashes of host files are only worth keeping with cached images
+	if len(pruned) == len(entries) {
+		os.Remove(path.Join(BuildCacheDir, "hashes.json"))
+	}
+	return pruned, nil
+}
@@ -0,0 +1,145 @@
+package lepton
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildCacheKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hello := filepath.Join(dir, "hello")
+	ioutil.WriteFile(hello, []byte("hello"), 0755)
+	manifest := "(children:(hello:(contents:(host:" + hello + "))))"
+	c := &Config{BaseVolumeSz: "30m"}
+
+	bc := newBuildCache(filepath.Join(dir, "cache"))
+	key, err := bc.key(c, manifest)
+	assert.NoError(t, err)
+	again, err := bc.key(c, manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, key, again)
+
+	c.BaseVolumeSz = "40m"
+	other, err := bc.key(c, manifest)
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, other)
+	c.BaseVolumeSz = "30m"
+
+	// a file with new contents is hashed again
+	ioutil.WriteFile(hello, []byte("hello world"), 0755)
+	other, err = bc.key(c, manifest)
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, other)
+
+	assert.NoError(t, bc.saveHashes())
+	bc = newBuildCache(filepath.Join(dir, "cache"))
+	again, err = bc.key(c, manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, other, again)
+	assert.False(t, bc.dirty)
+
+	os.Remove(hello)
+	_, err = bc.key(c, manifest)
+	assert.Error(t, err)
+}
+
+func TestBuildCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := BuildCacheDir
+	BuildCacheDir = filepath.Join(dir, "cache")
+	defer func() { BuildCacheDir = saved }()
+
+	bc := newBuildCache(BuildCacheDir)
+	image := filepath.Join(dir, "image")
+	found, err := bc.get("a", image)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	ioutil.WriteFile(image, []byte("image a"), 0644)
+	assert.NoError(t, bc.put("a", image))
+	ioutil.WriteFile(image, []byte("image b"), 0644)
+	assert.NoError(t, bc.put("b", image))
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(bc.imagePath("a"), old, old)
+
+	entries, err := ListBuildCache()
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "b", entries[0].Key)
+		assert.Equal(t, "a", entries[1].Key)
+		assert.Equal(t, int64(7), entries[1].Size)
+	}
+
+	found, err = bc.get("a", image)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	contents, _ := ioutil.ReadFile(image)
+	assert.Equal(t, "image a", string(contents))
+
+	os.Chtimes(bc.imagePath("b"), old, old)
+	pruned, err := PruneBuildCache(time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	if assert.Len(t, pruned, 1) {
+		assert.Equal(t, "b", pruned[0].Key)
+	}
+
+	pruned, err = PruneBuildCache(time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, pruned, 1)
+	entries, err = ListBuildCache()
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestBuildCacheTrim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bc := newBuildCache(filepath.Join(dir, "cache"))
+	bc.size = 20
+	image := filepath.Join(dir, "image")
+	ioutil.WriteFile(image, []byte("image a"), 0644)
+	assert.NoError(t, bc.put("a", image))
+	ioutil.WriteFile(image, []byte("image b"), 0644)
+	assert.NoError(t, bc.put("b", image))
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(bc.imagePath("a"), old, old)
+	os.Chtimes(bc.imagePath("b"), old.Add(time.Minute), old.Add(time.Minute))
+
+	// the least recently used image goes first
+	ioutil.WriteFile(image, []byte("image c"), 0644)
+	assert.NoError(t, bc.put("c", image))
+	entries, err := listBuildCache(bc.dir)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "c", entries[0].Key)
+		assert.Equal(t, "b", entries[1].Key)
+	}
+
+	// an image larger than the cache is kept until the next one
+	bc.size = 1
+	assert.NoError(t, bc.put("d", image))
+	entries, err = listBuildCache(bc.dir)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "d", entries[0].Key)
+	}
+}
@@ -15,28 +15,86 @@ type Config struct {
 	// BuildDir
 	BuildDir string
 
+	// CacheSize limits the size of the build cache, such as '2g'. The least
+	// recently used images are removed after a build (defaults to 10g).
+	CacheSize string
+
 	// CloudConfig configures various attributes about the cloud provider.
 	CloudConfig ProviderConfig
 
+	// Cwd is the working directory of the program, an absolute image path
+	// (defaults to /).
+	Cwd string
+
 	// Debugflags
 	Debugflags []string
 
 	// Dirs defines an array of directory locations to include into the image.
 	Dirs []string
 
+	// Dlopen defines an array of shared libraries the program loads by name
+	// at runtime, such as "libnss_files.so.2". They are searched like the
+	// libraries the program needs and added with their dependencies.
+	Dlopen []string
+
 	// Env defines a map of environment variables to specify for the image
 	// runtime.
 	Env map[string]string
 
+	// Exclude defines gitignore-style patterns of files to leave out when
+	// adding Dirs and MapDirs to the image. Patterns from an .opsignore
+	// file at the root of each directory are applied before these.
+	Exclude []string
+
+	// FileMetadata overrides the mode, owner and modification time of
+	// individual files in the image, keyed by image path.
+	FileMetadata map[string]FileMetadata
+
+	// FileMetadataMode controls the metadata recorded for files in the image:
+	// "preserve" copies the mode, owner and modification time from the host,
+	// "normalize" uses mode 0644 (0755 for executables), root ownership and
+	// the SOURCE_DATE_EPOCH timestamp. Nothing is recorded when empty.
+	FileMetadataMode string
+
 	// Files defines an array of file locations to include into the image.
 	Files []string
 
 	// Force
 	Force bool
 
+	// Go builds the program from a Go package with the Go toolchain instead
+	// of running Program.
+	Go GoConfig
+
+	// Include defines glob patterns, in the same syntax as Exclude, that
+	// files in Dirs and MapDirs must match to be added to the image.
+	Include []string
+
+	// Hostname of the instance, written to /proc/sys/kernel/hostname
+	// (defaults to 'uniboot', or to RunConfig.InstanceName for images built
+	// with 'ops image create' and for onprem instances of 'ops instance
+	// create' that boot an image with the default hostname).
+	Hostname string
+
+	// Hosts defines static /etc/hosts entries as a map of IP addresses to
+	// host names.
+	Hosts map[string][]string
+
+	// InlineFiles defines a map of image paths to file contents for small
+	// files that are written directly in the manifest.
+	InlineFiles map[string]string
+
+	// Java runs a jar with a JRE from the host or the target root instead
+	// of Program.
+	Java JavaConfig
+
 	// Kernel
 	Kernel string
 
+	// Klibs configures the kernel libraries (klibs) that take options.
+	// Klibs without options are listed in RunConfig.Klibs.
+	Klibs KlibsConfig
+
 	// ManifestName defines the name of the manifest file.
 	ManifestName string
 
@@ -55,12 +113,28 @@ type Config struct {
 	// for DNS resolutions (defaults to Google's DNS server: '8.8.8.8').
 	NameServer string
 
+	// NameServers defines additional DNS servers, written to
+	// /etc/resolv.conf after NameServer.
+	NameServers []string
+
+	// NativeMkfs writes the filesystem with the TFS writer of ops instead of
+	// the Mkfs program of the kernel release. It is experimental until its
+	// output is checked against images of the Mkfs program.
+	NativeMkfs bool
+
 	// NightlyBuild
 	NightlyBuild bool
 
+	// NoCache always builds the image instead of reusing an image of the
+	// build cache that has the same manifest and files.
+	NoCache bool
+
 	// NoTrace
 	NoTrace []string
 
+	// OCI builds the image from an OCI or Docker image instead of Program.
+	OCI OCIConfig
+
 	// Program
 	Program string
 
@@ -68,20 +142,173 @@ type Config struct {
 	// attach/detach.
 	ProgramPath string
 
+	// Reproducible builds images that only depend on their inputs. The image
+	// file gets its timestamp from SOURCE_DATE_EPOCH (defaults to the unix
+	// epoch). It needs NativeMkfs.
+	Reproducible bool
+
 	// RebootOnExit defines whether the image should automatically reboot
 	// if an error/failure occurs.
 	RebootOnExit bool
 
+	// RequireSignedImages refuses to run or upload images without a
+	// signature by one of TrustedKeys.
+	RequireSignedImages bool
+
+	// ResolverOptions defines resolver options such as 'ndots:2' or
+	// 'timeout:1' for /etc/resolv.conf.
+	ResolverOptions []string
+
 	// RunConfig
 	RunConfig RunConfig
 
+	// SearchDomains defines the DNS search list for host name lookups.
+	SearchDomains []string
+
+	// SigningKey is the path of an ed25519 or ECDSA private key in PEM
+	// format. Images are signed with it after they are built.
+	SigningKey string
+
 	// TargetRoot
 	TargetRoot string
 
+	// TrustedKeys defines the paths of the public keys, in PEM format, that
+	// images are verified with when RequireSignedImages is set.
+	TrustedKeys []string
+
 	// Version
 	Version string
 }
 
+// FileMetadata overrides the metadata of a file in the image. Fields that
+// are not set keep the value chosen by FileMetadataMode, or the host value
+// when no mode is set.
+type FileMetadata struct {
+	// Mode is the octal permission mode, e.g. "0600".
+	Mode string
+
+	// UID of the file owner.
+	UID *int
+
+	// GID of the file group.
+	GID *int
+
+	// Mtime is the modification time in seconds since the unix epoch.
+	Mtime *int64
+}
+
+// KlibsConfig configures klibs and their options, setting a klib loads it
+type KlibsConfig struct {
+	// NTP keeps the clock in sync with an ntp server.
+	NTP *NTPKlibConfig
+
+	// Radar reports crashes and usage to the NanoVMs radar service. It
+	// loads the tls klib as well.
+	Radar *RadarKlibConfig
+}
+
+// NTPKlibConfig holds the options of the ntp klib
+type NTPKlibConfig struct {
+	// Address of the ntp server (defaults to pool.ntp.org).
+	Address string
+
+	// Port of the ntp server (defaults to 123).
+	Port int
+
+	// PollMin is the minimum poll interval as a power of two seconds,
+	// between 4 and 17.
+	PollMin int
+
+	// PollMax is the maximum poll interval as a power of two seconds,
+	// between 4 and 17 and not lower than PollMin.
+	PollMax int
+}
+
+// RadarKlibConfig holds the options of the radar klib
+type RadarKlibConfig struct {
+	// Key is the radar API key.
+	Key string
+}
+
+// GoConfig configures building the program from a Go package
+type GoConfig struct {
+	// Package is the Go package to build, such as './cmd/server'.
+	Package string
+
+	// CGO builds with cgo enabled. The program is then linked dynamically,
+	// or statically in debug mode.
+	CGO bool
+
+	// Tags defines build tags.
+	Tags []string
+
+	// Flags defines extra flags for 'go build'.
+	Flags []string
+}
+
+// JavaConfig configures running a Java application
+type JavaConfig struct {
+	// Home is the directory of the JRE or JDK to add to the image (defaults
+	// to JAVA_HOME, or the installation of java on the PATH).
+	Home string
+
+	// Jar is the jar file to run with 'java -jar'.
+	Jar string
+
+	// Options defines JVM options passed before the jar. They come after
+	// the defaults, such as -XX:-UsePerfData, and override them.
+	Options []string
+}
+
+// OCIConfig configures building from an OCI or Docker image
+type OCIConfig struct {
+	// Image is a 'docker save' archive or an OCI image layout directory.
+	// Its layers are unpacked to the target root, and its entrypoint,
+	// command, environment and working directory become Program, Args and
+	// Env unless they are set.
+	Image string
+
+	// FullRootFS adds every file of the image instead of only the program
+	// and the files it needs.
+	FullRootFS bool
+}
+
+// NetworkInterface configures a network interface of the instance
+type NetworkInterface struct {
+	// Mode is either "static" or "dhcp" (defaults to "static" when an
+	// address is set and to "dhcp" otherwise).
+	Mode string
+
+	// IPAddr is the IPv4 address, optionally with a prefix length such as
+	// '10.0.0.2/24'.
+	IPAddr string
+
+	// NetMask of the IPv4 address, when IPAddr has no prefix length
+	// (defaults to '255.255.255.0').
+	NetMask string
+
+	// Gateway is the IPv4 gateway.
+	Gateway string
+
+	// IPv6Addr is the IPv6 address, optionally with a prefix length such as
+	// '2001:db8::2/64' (defaults to a /64 prefix).
+	IPv6Addr string
+
+	// IPv6Gateway is the IPv6 gateway.
+	IPv6Gateway string
+
+	// MTU of the interface (defaults to 1500).
+	MTU int
+
+	// MAC address of the local qemu network device (defaults to a random
+	// address).
+	MAC string
+
+	// TapName attaches the local qemu network device to a tap interface
+	// instead of user mode networking.
+	TapName string
+}
+
 // ProviderConfig give provider details
 type ProviderConfig struct {
 	// BucketName specifies the bucket to store the ops built image artifacts.
@@ -151,6 +378,10 @@ type RunConfig struct {
 	// InstanceName
 	InstanceName string
 
+	// Interfaces configures the network interfaces of the instance, in
+	// order. IPAddr, Gateway and NetMask are ignored when it is set.
+	Interfaces []NetworkInterface
+
 	// IPAddr
 	IPAddr string
 
@@ -0,0 +1,248 @@
+package lepton
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigError is a problem found at a line of a config file, Line is 0 when
+// it is not known
+type ConfigError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", e.File, e.Msg)
+}
+
+// ConfigErrors are the problems found in a config file
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// decodeConfigFile decodes a JSON, YAML or TOML config file, chosen by the
+// file extension, to generic values. It returns the line of each key and
+// list item by its dotted path.
+func decodeConfigFile(path string, data []byte) (map[string]interface{}, map[string]int, error) {
+	var values map[string]interface{}
+	var lines map[string]int
+	var err error
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		values, lines, err = decodeYAMLConfig(data)
+	case ".toml":
+		values, lines, err = decodeTOMLConfig(data)
+	default:
+		values, lines, err = decodeJSONConfig(data)
+	}
+
+	if err != nil {
+		if ce, ok := err.(*ConfigError); ok {
+			ce.File = path
+			return nil, nil, ce
+		}
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return values, lines, nil
+}
+
+// decodeJSONConfig decodes a JSON config file
+func decodeJSONConfig(data []byte) (map[string]interface{}, map[string]int, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		switch e := err.(type) {
+		case *json.SyntaxError:
+			return nil, nil, &ConfigError{Line: lineAt(data, e.Offset), Msg: e.Error()}
+		case *json.UnmarshalTypeError:
+			return nil, nil, &ConfigError{Line: lineAt(data, e.Offset), Msg: "config must be an object"}
+		}
+		return nil, nil, err
+	}
+
+	s := &jsonLineScanner{data: data, line: 1, lines: map[string]int{}}
+	s.value("")
+	return values, s.lines, nil
+}
+
+// lineAt returns the line of the byte at offset in data
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// jsonLineScanner records the lines of the keys and list items of a JSON
+// document that is known to be valid
+type jsonLineScanner struct {
+	data  []byte
+	pos   int
+	line  int
+	lines map[string]int
+}
+
+func (s *jsonLineScanner) skipSpace() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case '\n':
+			s.line++
+		case ' ', '\t', '\r':
+		default:
+			return
+		}
+		s.pos++
+	}
+}
+
+// str skips the string at the current position and returns it undecoded
+func (s *jsonLineScanner) str() []byte {
+	start := s.pos
+	for s.pos++; s.pos < len(s.data); s.pos++ {
+		switch s.data[s.pos] {
+		case '\\':
+			s.pos++
+		case '"':
+			s.pos++
+			return s.data[start:s.pos]
+		}
+	}
+	return s.data[start:]
+}
+
+func (s *jsonLineScanner) value(path string) {
+	s.skipSpace()
+	if s.pos >= len(s.data) {
+		return
+	}
+
+	switch s.data[s.pos] {
+	case '{':
+		s.pos++
+		for {
+			s.skipSpace()
+			if s.pos >= len(s.data) || s.data[s.pos] == '}' {
+				s.pos++
+				return
+			}
+			if s.data[s.pos] == ',' {
+				s.pos++
+				continue
+			}
+			line := s.line
+			var key string
+			json.Unmarshal(s.str(), &key)
+			p := joinConfigPath(path, key)
+			s.lines[p] = line
+			s.skipSpace()
+			s.pos++ // ':'
+			s.value(p)
+		}
+	case '[':
+		s.pos++
+		for i := 0; ; {
+			s.skipSpace()
+			if s.pos >= len(s.data) || s.data[s.pos] == ']' {
+				s.pos++
+				return
+			}
+			if s.data[s.pos] == ',' {
+				s.pos++
+				continue
+			}
+			p := fmt.Sprintf("%s[%d]", path, i)
+			s.lines[p] = s.line
+			s.value(p)
+			i++
+		}
+	case '"':
+		s.str()
+	default:
+		for s.pos < len(s.data) && !strings.ContainsRune(",]} \t\r\n", rune(s.data[s.pos])) {
+			s.pos++
+		}
+	}
+}
+
+// decodeYAMLConfig decodes a YAML config file
+func decodeYAMLConfig(data []byte) (map[string]interface{}, map[string]int, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+
+	lines := map[string]int{}
+	if len(doc.Content) == 0 {
+		return map[string]interface{}{}, lines, nil
+	}
+
+	v, err := yamlConfigValue(doc.Content[0], "", lines)
+	if err != nil {
+		return nil, nil, err
+	}
+	values, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, nil, &ConfigError{Line: doc.Content[0].Line, Msg: "config must be a mapping"}
+	}
+	return values, lines, nil
+}
+
+func yamlConfigValue(n *yaml.Node, path string, lines map[string]int) (interface{}, error) {
+	switch n.Kind {
+	case yaml.AliasNode:
+		return yamlConfigValue(n.Alias, path, lines)
+	case yaml.MappingNode:
+		m := map[string]interface{}{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if k.Kind != yaml.ScalarNode || k.Tag == "!!merge" {
+				return nil, &ConfigError{Line: k.Line, Msg: "keys must be plain scalars"}
+			}
+			if _, ok := m[k.Value]; ok {
+				return nil, &ConfigError{Line: k.Line, Msg: fmt.Sprintf("key %q is already defined", k.Value)}
+			}
+			p := joinConfigPath(path, k.Value)
+			lines[p] = k.Line
+			x, err := yamlConfigValue(v, p, lines)
+			if err != nil {
+				return nil, err
+			}
+			m[k.Value] = x
+		}
+		return m, nil
+	case yaml.SequenceNode:
+		l := make([]interface{}, len(n.Content))
+		for i, item := range n.Content {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			lines[p] = item.Line
+			x, err := yamlConfigValue(item, p, lines)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = x
+		}
+		return l, nil
+	default:
+		var v interface{}
+		if err := n.Decode(&v); err != nil {
+			return nil, &ConfigError{Line: n.Line, Msg: err.Error()}
+		}
+		return v, nil
+	}
+}
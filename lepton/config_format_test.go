@@ -0,0 +1,169 @@
+package lepton
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfigFormats(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.json": `{
+			"Args": ["server.js"],
+			"Env": {"PORT": "8080"},
+			"RunConfig": {
+				"Memory": "2G",
+				"CPUs": 2,
+				"Accel": false,
+				"Interfaces": [{"IPAddr": "10.0.0.2/24"}, {"Mode": "dhcp"}]
+			},
+			"CloudConfig": {"Platform": "gcp", "ProjectID": "prod-1"}
+		}`,
+		"config.yaml": `
+# comment
+Args:
+  - server.js
+Env:
+  PORT: "8080"
+RunConfig:
+  Memory: 2G
+  CPUs: 2
+  Accel: false
+  Interfaces:
+    - IPAddr: 10.0.0.2/24
+    - Mode: dhcp
+CloudConfig: {Platform: gcp, ProjectID: prod-1}
+`,
+		"config.toml": `
+# comment
+Args = ["server.js"]
+Env.PORT = "8080"
+
+[RunConfig]
+Memory = "2G" # inline comment
+CPUs = 2
+Accel = false
+
+[[RunConfig.Interfaces]]
+IPAddr = '10.0.0.2/24'
+
+[[RunConfig.Interfaces]]
+Mode = "dhcp"
+
+[CloudConfig]
+Platform = "gcp"
+ProjectID = """prod-1"""
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	expected, _, err := LoadConfig(filepath.Join(dir, "config.json"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "2G", expected.RunConfig.Memory)
+	assert.Len(t, expected.RunConfig.Interfaces, 2)
+
+	for _, name := range []string{"config.yaml", "config.toml"} {
+		c, _, err := LoadConfig(filepath.Join(dir, name), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, c, name)
+	}
+}
+
+func TestLoadConfigUnknownFields(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.json": `{
+  "RunConfig": {
+    "Memroy": "2G",
+    "mounts": ["vol:/data"],
+    "CPUs": "2"
+  },
+  "Profiles": {
+    "prod": {"Hostname": 1}
+  }
+}`,
+		"config.yaml": `RunConfig:
+  Memory: 2G
+Mounts: data
+`,
+		"config.toml": `[RunConfig]
+Memory = "2G"
+
+[CloudConfig]
+Region = "us-west1"
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	json := filepath.Join(dir, "config.json")
+	_, _, err := LoadConfig(json, "")
+	assert.EqualError(t, err,
+		json+`:3: unknown field "Memroy" in RunConfig`+"\n"+
+			json+`:4: unknown field "mounts" in RunConfig, did you mean "Mounts"?`+"\n"+
+			json+`:5: RunConfig.CPUs must be an integer, not a string`+"\n"+
+			json+`:8: Profiles.prod.Hostname must be a string, not a number`)
+
+	yaml := filepath.Join(dir, "config.yaml")
+	_, _, err = LoadConfig(yaml, "")
+	assert.EqualError(t, err, yaml+`:3: Mounts must be an object, not a string`)
+
+	toml := filepath.Join(dir, "config.toml")
+	_, _, err = LoadConfig(toml, "")
+	assert.EqualError(t, err, toml+`:5: unknown field "Region" in ProviderConfig`)
+}
+
+func TestDecodeConfigSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"config.json", "{\n  \"Args\": [\"a\",]\n}", `config.json:2: invalid character ']' looking for beginning of value`},
+		{"config.toml", "Args = [\"a\"]\nArgs = [\"b\"]\n", `config.toml:2: The following key was defined twice: Args`},
+		{"config.toml", "[RunConfig]\nMemory = 2G\n", `config.toml:2: parsing error: no value can start with G`},
+		{"config.toml", "[RunConfig]\n[RunConfig]\n", `config.toml:2: duplicated tables`},
+		{"config.yaml", "Args: [a]\nArgs: [b]\n", `config.yaml:2: key "Args" is already defined`},
+	}
+
+	for _, tt := range tests {
+		_, _, err := decodeConfigFile(tt.name, []byte(tt.data))
+		assert.EqualError(t, err, tt.err, tt.data)
+	}
+}
+
+func TestLoadPackageConfigIgnoresUnknownFields(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"package.manifest": `{"Program": "node", "runtime": "node", "description": "node.js", "Version": "14.2.0"}`,
+	})
+	defer os.RemoveAll(dir)
+
+	c, err := LoadPackageConfig(filepath.Join(dir, "package.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "node", c.Program)
+	assert.Equal(t, "14.2.0", c.Version)
+}
+
+func TestConfigSchema(t *testing.T) {
+	schema := ConfigSchema()
+	definitions := schema["definitions"].(map[string]interface{})
+
+	for _, name := range []string{"Config", "RunConfig", "ProviderConfig", "NetworkInterface", "Tag"} {
+		assert.Contains(t, definitions, name)
+	}
+
+	properties := schema["properties"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"$ref": "#/definitions/RunConfig"}, properties["RunConfig"])
+	assert.Contains(t, properties, "Extends")
+	assert.Contains(t, properties, "Profiles")
+	assert.Equal(t, false, schema["additionalProperties"])
+
+	tag := definitions["Tag"].(map[string]interface{})["properties"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"type": "string"}, tag["key"])
+}
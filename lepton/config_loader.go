@@ -0,0 +1,468 @@
+package lepton
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	// extendsKey lists the config files a config file is layered on,
+	// relative to the directory of the file
+	extendsKey = "Extends"
+
+	// profilesKey holds the named profiles of a config file, which are
+	// layered on top of the files when selected
+	profilesKey = "Profiles"
+)
+
+// ConfigSources maps the dotted path of each field set by config files, such
+// as 'RunConfig.Memory' or 'Env.HOME', to the files that set it in merge
+// order. Slices have a source per file that appended to them.
+type ConfigSources map[string][]string
+
+// configLayer is a config file, or a profile of a config file, to merge
+type configLayer struct {
+	source string
+	values map[string]interface{}
+}
+
+// configLoader reads a config file and the files it extends
+type configLoader struct {
+	profile string
+	strict  bool
+	// untrusted files, such as the manifests of downloaded packages, keep
+	// ${NAME} as it is and cannot extend other files
+	untrusted bool
+	layers    []configLayer
+	profiles  []configLayer
+	loaded    map[string]bool
+}
+
+// LoadConfig loads the config file at path on top of the default config.
+//
+// The files listed in the Extends key of a file are merged before the file
+// itself, in order, and each file is merged at most once. When profile is
+// set, the matching entry of the Profiles key of every file is merged after
+// all the files, in the same order. ${NAME} and ${NAME:-default} in string
+// values are replaced with environment variables; '$${' stands for a literal
+// '${'.
+//
+// A later layer overrides scalars, appends to slices and merges maps and
+// structs key by key, such as Env or RunConfig. A null value resets a field
+// to its default.
+func LoadConfig(path string, profile string) (*Config, ConfigSources, error) {
+	l := &configLoader{profile: profile, strict: true, loaded: map[string]bool{}}
+	return l.config(path)
+}
+
+// LoadPackageConfig loads the config in the manifest of a package. Unlike
+// LoadConfig, it ignores unknown fields such as the package description.
+// Packages come from third parties, so their manifests cannot read host
+// environment variables through ${NAME} or host files through Extends.
+func LoadPackageConfig(path string) (*Config, error) {
+	l := &configLoader{untrusted: true, loaded: map[string]bool{}}
+	c, _, err := l.config(path)
+	return c, err
+}
+
+func (l *configLoader) config(path string) (*Config, ConfigSources, error) {
+	if path != "" {
+		if err := l.load(path, nil); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if l.profile != "" && len(l.profiles) == 0 {
+		if path == "" {
+			return nil, nil, fmt.Errorf("profile %q needs a config file", l.profile)
+		}
+		return nil, nil, fmt.Errorf("profile %q is not defined in %s", l.profile, path)
+	}
+
+	values := map[string]interface{}{}
+	sources := ConfigSources{}
+	configType := reflect.TypeOf(Config{})
+	for _, layer := range append(l.layers, l.profiles...) {
+		mergeConfigValues(values, layer.values, configType, "", layer.source, sources)
+	}
+
+	c := NewConfig()
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, sources, nil
+}
+
+// load reads the config file at path after the files it extends, stack
+// holds the files that extend it to detect cycles
+func (l *configLoader) load(path string, stack []string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for _, f := range stack {
+		if f == abs {
+			return fmt.Errorf("%s: extends cycle through %s", stack[len(stack)-1], path)
+		}
+	}
+	if l.loaded[abs] {
+		return nil
+	}
+	l.loaded[abs] = true
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values, lines, err := decodeConfigFile(path, data)
+	if err != nil {
+		return err
+	}
+
+	if !l.untrusted {
+		expanded, err := expandConfigEnv(values, "", lines)
+		if err != nil {
+			err.(*ConfigError).File = path
+			return err
+		}
+		values = expanded.(map[string]interface{})
+	}
+
+	extends, err := extendsList(takeConfigKey(values, extendsKey))
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if l.untrusted && len(extends) > 0 {
+		return fmt.Errorf("%s: %s is not allowed in package manifests", path, extendsKey)
+	}
+	profiles := takeConfigKey(values, profilesKey)
+
+	if l.strict {
+		if err = validateConfigFile(path, lines, values, profiles); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range extends {
+		if !filepath.IsAbs(e) {
+			e = filepath.Join(filepath.Dir(path), e)
+		}
+		if err = l.load(e, append(stack, abs)); err != nil {
+			return err
+		}
+	}
+
+	l.layers = append(l.layers, configLayer{source: path, values: values})
+
+	if profiles == nil || l.profile == "" {
+		return nil
+	}
+	pm, ok := profiles.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: %s must be an object of profile names to config", path, profilesKey)
+	}
+	if p, ok := pm[l.profile]; ok {
+		pv, ok := p.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: profile %q must be an object", path, l.profile)
+		}
+		source := fmt.Sprintf("%s (profile %s)", path, l.profile)
+		l.profiles = append(l.profiles, configLayer{source: source, values: pv})
+	}
+	return nil
+}
+
+// validateConfigFile checks the values of the config file at path and of
+// its profiles, reporting problems at the lines they are on
+func validateConfigFile(path string, lines map[string]int, values map[string]interface{}, profiles interface{}) error {
+	cv := &configValidator{file: path, lines: lines}
+	configType := reflect.TypeOf(Config{})
+	cv.validate(values, configType, "")
+
+	if pm, ok := profiles.(map[string]interface{}); ok {
+		for _, name := range sortedConfigKeys(pm) {
+			cv.validate(pm[name], configType, joinConfigPath(profilesKey, name))
+		}
+	}
+
+	if len(cv.errs) > 0 {
+		sort.SliceStable(cv.errs, func(i, j int) bool {
+			return cv.errs[i].Line < cv.errs[j].Line
+		})
+		return cv.errs
+	}
+	return nil
+}
+
+// takeConfigKey removes key from values, matching it case-insensitively,
+// and returns its value
+func takeConfigKey(values map[string]interface{}, key string) interface{} {
+	for k, v := range values {
+		if strings.EqualFold(k, key) {
+			delete(values, k)
+			return v
+		}
+	}
+	return nil
+}
+
+// extendsList converts the value of Extends, a file name or a list of file
+// names, to a list
+func extendsList(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		var files []string
+		for _, f := range v {
+			s, ok := f.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a file name or a list of file names", extendsKey)
+			}
+			files = append(files, s)
+		}
+		return files, nil
+	}
+	return nil, fmt.Errorf("%s must be a file name or a list of file names", extendsKey)
+}
+
+// expandConfigEnv replaces environment variables in the string values of a
+// decoded config
+func expandConfigEnv(v interface{}, path string, lines map[string]int) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		s, err := expandEnv(v)
+		if err != nil {
+			return nil, &ConfigError{Line: lines[path], Msg: fmt.Sprintf("%s: %v", path, err)}
+		}
+		return s, nil
+	case map[string]interface{}:
+		for k, e := range v {
+			x, err := expandConfigEnv(e, joinConfigPath(path, k), lines)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = x
+		}
+	case []interface{}:
+		for i, e := range v {
+			x, err := expandConfigEnv(e, fmt.Sprintf("%s[%d]", path, i), lines)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = x
+		}
+	}
+	return v, nil
+}
+
+// expandEnv replaces ${NAME} and ${NAME:-default} in s with the value of the
+// environment variable NAME, '$${' is kept as a literal '${'
+func expandEnv(s string) (string, error) {
+	var sb strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			sb.WriteString(s)
+			return sb.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			sb.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated variable in %q", s)
+		}
+
+		name := s[i+2 : i+end]
+		def, hasDefault := "", false
+		if j := strings.Index(name, ":-"); j >= 0 {
+			name, def, hasDefault = name[:j], name[j+2:], true
+		}
+		if name == "" {
+			return "", fmt.Errorf("empty variable name in %q", s)
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok || (value == "" && hasDefault) {
+			if !hasDefault {
+				return "", fmt.Errorf("environment variable %s is not set", name)
+			}
+			value = def
+		}
+
+		sb.WriteString(s[:i])
+		sb.WriteString(value)
+		s = s[i+end+1:]
+	}
+}
+
+// mergeConfigValues merges the decoded config src into dst. t is the type
+// the values decode to, which gives keys the name of the field they set.
+func mergeConfigValues(dst, src map[string]interface{}, t reflect.Type, path string, source string, sources ConfigSources) {
+	keys := make([]string, 0, len(src))
+	for k := range src {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name, ft := configField(t, key)
+		p := joinConfigPath(path, name)
+
+		switch v := src[key].(type) {
+		case nil:
+			delete(dst, name)
+			sources.reset(p, source)
+		case map[string]interface{}:
+			d, ok := dst[name].(map[string]interface{})
+			if !ok {
+				d = map[string]interface{}{}
+				dst[name] = d
+				sources.reset(p, "")
+			}
+			mergeConfigValues(d, v, ft, p, source, sources)
+		case []interface{}:
+			if d, ok := dst[name].([]interface{}); ok {
+				merged := make([]interface{}, 0, len(d)+len(v))
+				dst[name] = append(append(merged, d...), v...)
+				sources[p] = append(sources[p], source)
+			} else {
+				dst[name] = v
+				sources.reset(p, source)
+			}
+		default:
+			dst[name] = v
+			sources.reset(p, source)
+		}
+	}
+}
+
+// configField returns the name and the type of the field key sets in a value
+// of type t. Keys match field names case-insensitively, like encoding/json
+// does, and unknown keys are kept as they are.
+func configField(t reflect.Type, key string) (string, reflect.Type) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil {
+		return key, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Map:
+		return key, t.Elem()
+	case reflect.Struct:
+		var folded *reflect.StructField
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := jsonFieldName(f)
+			if name == key {
+				return name, f.Type
+			}
+			if folded == nil && strings.EqualFold(name, key) {
+				folded = &f
+			}
+		}
+		if folded != nil {
+			return jsonFieldName(*folded), folded.Type
+		}
+	}
+	return key, nil
+}
+
+// jsonFieldName returns the key encoding/json uses for a struct field
+func jsonFieldName(f reflect.StructField) string {
+	tag := f.Tag.Get("json")
+	if i := strings.IndexByte(tag, ','); i >= 0 {
+		tag = tag[:i]
+	}
+	if tag != "" && tag != "-" {
+		return tag
+	}
+	return f.Name
+}
+
+func joinConfigPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// reset makes source the only source of path and of the fields under it, an
+// empty source removes them
+func (s ConfigSources) reset(path string, source string) {
+	for p := range s {
+		if p == path || strings.HasPrefix(p, path+".") {
+			delete(s, p)
+		}
+	}
+	if source != "" {
+		s[path] = []string{source}
+	}
+}
+
+// MergeConfig merges src into dst, such as a user config over the config of
+// a package. Values src sets replace the ones of dst, slices included, and
+// maps and structs are merged key by key. Zero values leave dst unchanged
+// unless they are in set, the sources LoadConfig returned for src, so a
+// config file can turn off a boolean of dst.
+func MergeConfig(dst *Config, src *Config, set ConfigSources) {
+	mergeValue(reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem(), "", set)
+}
+
+func mergeValue(dst, src reflect.Value, path string, set ConfigSources) {
+	switch src.Kind() {
+	case reflect.Struct:
+		for i := 0; i < src.NumField(); i++ {
+			if dst.Field(i).CanSet() {
+				p := joinConfigPath(path, jsonFieldName(src.Type().Field(i)))
+				mergeValue(dst.Field(i), src.Field(i), p, set)
+			}
+		}
+	case reflect.Map:
+		if src.Len() == 0 {
+			return
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.MakeMap(src.Type()))
+		}
+		iter := src.MapRange()
+		for iter.Next() {
+			v := reflect.New(src.Type().Elem()).Elem()
+			if d := dst.MapIndex(iter.Key()); d.IsValid() {
+				v.Set(d)
+			}
+			p := joinConfigPath(path, fmt.Sprint(iter.Key().Interface()))
+			mergeValue(v, iter.Value(), p, set)
+			dst.SetMapIndex(iter.Key(), v)
+		}
+	case reflect.Slice:
+		if _, ok := set[path]; ok || src.Len() > 0 {
+			dst.Set(src)
+		}
+	default:
+		_, ok := set[path]
+		if ok || !reflect.DeepEqual(src.Interface(), reflect.Zero(src.Type()).Interface()) {
+			dst.Set(src)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package lepton
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadConfigExtends(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"base/common.json": `{
+			"Args": ["a"],
+			"Env": {"A": "1", "B": "1"},
+			"RunConfig": {"Memory": "1G", "CPUs": 2, "Ports": ["80"]},
+			"CloudConfig": {"Zone": "us-west1-b"}
+		}`,
+		"base/cloud.json": `{
+			"Extends": "common.json",
+			"CloudConfig": {"Platform": "gcp", "ProjectID": "base"}
+		}`,
+		"config.json": `{
+			"Extends": ["base/cloud.json", "base/common.json"],
+			"Args": ["b"],
+			"Env": {"B": "2"},
+			"RunConfig": {"Memory": "2G", "Ports": ["443"], "Accel": false},
+			"CloudConfig": {"ProjectID": "app"}
+		}`,
+	})
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "config.json")
+	c, sources, err := LoadConfig(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"a", "b"}, c.Args)
+	assert.Equal(t, map[string]string{"A": "1", "B": "2"}, c.Env)
+	assert.Equal(t, "2G", c.RunConfig.Memory)
+	assert.Equal(t, 2, c.RunConfig.CPUs)
+	assert.Equal(t, []string{"80", "443"}, c.RunConfig.Ports)
+	assert.False(t, c.RunConfig.Accel)
+	assert.Equal(t, ProviderConfig{Platform: "gcp", ProjectID: "app", Zone: "us-west1-b"}, c.CloudConfig)
+
+	common := filepath.Join(dir, "base/common.json")
+	assert.Equal(t, []string{common, config}, sources["Args"])
+	assert.Equal(t, []string{config}, sources["RunConfig.Memory"])
+	assert.Equal(t, []string{common}, sources["RunConfig.CPUs"])
+	assert.Equal(t, []string{filepath.Join(dir, "base/cloud.json")}, sources["CloudConfig.Platform"])
+	assert.Equal(t, []string{common}, sources["Env.A"])
+}
+
+func TestLoadConfigProfile(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"base.json": `{
+			"RunConfig": {"Memory": "1G"},
+			"Profiles": {"prod": {"RunConfig": {"CPUs": 4}}}
+		}`,
+		"config.json": `{
+			"Extends": "base.json",
+			"RunConfig": {"Memory": "2G"},
+			"Env": {"DEBUG": "1"},
+			"Profiles": {
+				"prod": {"RunConfig": {"Memory": "8G"}, "Env": null},
+				"dev": {"RunConfig": {"Memory": "512M"}}
+			}
+		}`,
+	})
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "config.json")
+	c, sources, err := LoadConfig(config, "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "8G", c.RunConfig.Memory)
+	assert.Equal(t, 4, c.RunConfig.CPUs)
+	assert.Empty(t, c.Env)
+	assert.Equal(t, []string{config + " (profile prod)"}, sources["RunConfig.Memory"])
+	_, ok := sources["Env.DEBUG"]
+	assert.False(t, ok)
+
+	c, _, err = LoadConfig(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "2G", c.RunConfig.Memory)
+
+	_, _, err = LoadConfig(config, "staging")
+	assert.EqualError(t, err, `profile "staging" is not defined in `+config)
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	os.Setenv("OPS_TEST_MEMORY", "4G")
+	defer os.Unsetenv("OPS_TEST_MEMORY")
+	os.Unsetenv("OPS_TEST_UNSET")
+
+	dir := writeConfigFiles(t, map[string]string{
+		"config.json": `{
+			"RunConfig": {"Memory": "${OPS_TEST_MEMORY}"},
+			"Env": {"ZONE": "${OPS_TEST_UNSET:-us-east1}", "LITERAL": "$${HOME}"}
+		}`,
+		"unset.json": `{"Args": ["${OPS_TEST_UNSET}"]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	c, _, err := LoadConfig(filepath.Join(dir, "config.json"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "4G", c.RunConfig.Memory)
+	assert.Equal(t, "us-east1", c.Env["ZONE"])
+	assert.Equal(t, "${HOME}", c.Env["LITERAL"])
+
+	unset := filepath.Join(dir, "unset.json")
+	_, _, err = LoadConfig(unset, "")
+	assert.EqualError(t, err, unset+":1: Args[0]: environment variable OPS_TEST_UNSET is not set")
+}
+
+func TestLoadConfigExtendsCycle(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"a.json": `{"Extends": "b.json"}`,
+		"b.json": `{"Extends": "a.json"}`,
+	})
+	defer os.RemoveAll(dir)
+
+	_, _, err := LoadConfig(filepath.Join(dir, "a.json"), "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "extends cycle")
+}
+
+func TestMergeConfig(t *testing.T) {
+	ntp := &NTPKlibConfig{Address: "time.google.com"}
+	pkg := &Config{
+		Args:      []string{"pkg"},
+		Env:       map[string]string{"A": "1"},
+		Program:   "node",
+		RunConfig: RunConfig{Memory: "1G", Ports: []string{"80"}},
+	}
+	usr := &Config{
+		Args:      []string{"usr"},
+		Env:       map[string]string{"B": "2"},
+		Klibs:     KlibsConfig{NTP: ntp},
+		RunConfig: RunConfig{CPUs: 2, Ports: []string{"443"}},
+	}
+
+	MergeConfig(pkg, usr, nil)
+
+	assert.Equal(t, []string{"usr"}, pkg.Args)
+	assert.Equal(t, map[string]string{"A": "1", "B": "2"}, pkg.Env)
+	assert.Equal(t, "node", pkg.Program)
+	assert.Equal(t, ntp, pkg.Klibs.NTP)
+	assert.Equal(t, RunConfig{Memory: "1G", CPUs: 2, Ports: []string{"443"}}, pkg.RunConfig)
+}
+
+func TestMergeConfigFromFile(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"repeat.json": `{"Dirs": ["static"], "RunConfig": {"Ports": ["8080"]}}`,
+		"off.json":    `{"RebootOnExit": false, "RunConfig": {"Memory": "", "Ports": []}}`,
+	})
+	defer os.RemoveAll(dir)
+
+	merge := func(name string) *Config {
+		c, sources, err := LoadConfig(filepath.Join(dir, name), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkg := &Config{RebootOnExit: true, Dirs: []string{"static"}, RunConfig: RunConfig{Memory: "1G", Ports: []string{"8080"}}}
+		MergeConfig(pkg, c, sources)
+		return pkg
+	}
+
+	// values the file repeats are not added twice
+	pkg := merge("repeat.json")
+	assert.Equal(t, []string{"static"}, pkg.Dirs)
+	assert.Equal(t, []string{"8080"}, pkg.RunConfig.Ports)
+	assert.True(t, pkg.RebootOnExit)
+
+	// the file turns off a boolean and clears fields of the package
+	pkg = merge("off.json")
+	assert.False(t, pkg.RebootOnExit)
+	assert.Equal(t, "", pkg.RunConfig.Memory)
+	assert.Empty(t, pkg.RunConfig.Ports)
+	assert.Equal(t, []string{"static"}, pkg.Dirs)
+}
+
+func TestLoadPackageConfig(t *testing.T) {
+	os.Setenv("OPS_TEST_SECRET", "secret")
+	defer os.Unsetenv("OPS_TEST_SECRET")
+
+	dir := writeConfigFiles(t, map[string]string{
+		"package.manifest": `{
+			"Program": "node",
+			"Description": "node package",
+			"Env": {"KEY": "${OPS_TEST_SECRET}"}
+		}`,
+		"extends.manifest": `{"Extends": "host.json"}`,
+		"host.json":        `{"Env": {"KEY": "host"}}`,
+	})
+	defer os.RemoveAll(dir)
+
+	c, err := LoadPackageConfig(filepath.Join(dir, "package.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "node", c.Program)
+	assert.Equal(t, "${OPS_TEST_SECRET}", c.Env["KEY"])
+
+	extends := filepath.Join(dir, "extends.manifest")
+	_, err = LoadPackageConfig(extends)
+	assert.EqualError(t, err, extends+": Extends is not allowed in package manifests")
+}
@@ -0,0 +1,253 @@
+package lepton
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// configValidator checks the decoded values of a config file against the
+// fields of Config
+type configValidator struct {
+	file  string
+	lines map[string]int
+	errs  ConfigErrors
+}
+
+func (cv *configValidator) errorf(path string, format string, args ...interface{}) {
+	cv.errs = append(cv.errs, &ConfigError{
+		File: cv.file,
+		Line: cv.lines[path],
+		Msg:  fmt.Sprintf(format, args...),
+	})
+}
+
+// validate checks that the keys of v name fields of t and that values have
+// the type of their field. null is accepted everywhere, it resets a field.
+func (cv *configValidator) validate(v interface{}, t reflect.Type, path string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if v == nil {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			cv.typeError(v, t, path)
+			return
+		}
+		for _, key := range sortedConfigKeys(m) {
+			p := joinConfigPath(path, key)
+			f, ok := configStructField(t, key)
+			if !ok {
+				cv.unknownField(t, key, p)
+				continue
+			}
+			cv.validate(m[key], f.Type, p)
+		}
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			cv.typeError(v, t, path)
+			return
+		}
+		for _, key := range sortedConfigKeys(m) {
+			cv.validate(m[key], t.Elem(), joinConfigPath(path, key))
+		}
+	case reflect.Slice:
+		l, ok := v.([]interface{})
+		if !ok {
+			cv.typeError(v, t, path)
+			return
+		}
+		for i, e := range l {
+			cv.validate(e, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			cv.typeError(v, t, path)
+		}
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			cv.typeError(v, t, path)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		switch n := v.(type) {
+		case int, int64:
+		case float64:
+			if n != math.Trunc(n) {
+				cv.typeError(v, t, path)
+			}
+		default:
+			cv.typeError(v, t, path)
+		}
+	case reflect.Float32, reflect.Float64:
+		switch v.(type) {
+		case int, int64, float64:
+		default:
+			cv.typeError(v, t, path)
+		}
+	}
+}
+
+func (cv *configValidator) unknownField(t reflect.Type, key string, path string) {
+	for i := 0; i < t.NumField(); i++ {
+		if name := jsonFieldName(t.Field(i)); strings.EqualFold(name, key) {
+			cv.errorf(path, "unknown field %q in %s, did you mean %q?", key, t.Name(), name)
+			return
+		}
+	}
+	cv.errorf(path, "unknown field %q in %s", key, t.Name())
+}
+
+func (cv *configValidator) typeError(v interface{}, t reflect.Type, path string) {
+	cv.errorf(path, "%s must be %s, not %s", path, schemaTypeName(t), configValueTypeName(v))
+}
+
+// configStructField returns the field of t that key names exactly
+func configStructField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath == "" && jsonFieldName(f) == key {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func sortedConfigKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func schemaTypeName(t reflect.Type) string {
+	switch schemaType(t) {
+	case "object":
+		return "an object"
+	case "array":
+		return "a list"
+	case "integer":
+		return "an integer"
+	}
+	return "a " + schemaType(t)
+}
+
+func configValueTypeName(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "a list"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	}
+	return "a number"
+}
+
+// schemaType returns the JSON Schema type of values of t
+func schemaType(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	}
+	return ""
+}
+
+// ConfigSchema returns a JSON Schema (draft 7) of config files, for editors
+// to complete and check them. Each struct of Config, such as RunConfig and
+// ProviderConfig, has a definition.
+func ConfigSchema() map[string]interface{} {
+	definitions := map[string]interface{}{}
+	schemaFor(reflect.TypeOf(Config{}), definitions)
+
+	root := map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       "ops config",
+		"definitions": definitions,
+	}
+	for k, v := range definitions["Config"].(map[string]interface{}) {
+		root[k] = v
+	}
+
+	properties := map[string]interface{}{}
+	for k, v := range root["properties"].(map[string]interface{}) {
+		properties[k] = v
+	}
+	properties[extendsKey] = map[string]interface{}{
+		"description": "config files merged before this file, relative to its directory",
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": "string"},
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		},
+	}
+	properties[profilesKey] = map[string]interface{}{
+		"description":          "named config profiles selected with --profile",
+		"type":                 "object",
+		"additionalProperties": map[string]interface{}{"$ref": "#/definitions/Config"},
+	}
+	root["properties"] = properties
+	return root
+}
+
+// schemaFor returns the schema of values of t, adding the definitions of
+// structs to definitions
+func schemaFor(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if _, ok := definitions[t.Name()]; !ok {
+			def := map[string]interface{}{"type": "object", "additionalProperties": false}
+			definitions[t.Name()] = def
+			properties := map[string]interface{}{}
+			for i := 0; i < t.NumField(); i++ {
+				f := t.Field(i)
+				if f.PkgPath != "" {
+					continue
+				}
+				properties[jsonFieldName(f)] = schemaFor(f.Type, definitions)
+			}
+			def["properties"] = properties
+		}
+		return map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": schemaFor(t.Elem(), definitions),
+		}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": schemaFor(t.Elem(), definitions),
+		}
+	}
+	return map[string]interface{}{"type": schemaType(t)}
+}
@@ -0,0 +1,56 @@
+package lepton
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	toml "github.com/pelletier/go-toml"
+)
+
+// tomlErrorPosition matches the (line, column) go-toml starts errors with
+var tomlErrorPosition = regexp.MustCompile(`^\((\d+), \d+\): (.*)$`)
+
+// decodeTOMLConfig decodes a TOML config file
+func decodeTOMLConfig(data []byte) (map[string]interface{}, map[string]int, error) {
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		if m := tomlErrorPosition.FindStringSubmatch(err.Error()); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			return nil, nil, &ConfigError{Line: line, Msg: m[2]}
+		}
+		return nil, nil, err
+	}
+
+	lines := map[string]int{}
+	tomlLines(tree, "", lines)
+	return tree.ToMap(), lines, nil
+}
+
+// tomlLines records the lines of the keys of tree by their dotted path.
+// Arrays of tables are at the line of their first table and list items at
+// the line of their key.
+func tomlLines(tree *toml.Tree, path string, lines map[string]int) {
+	for _, k := range tree.Keys() {
+		p := joinConfigPath(path, k)
+		lines[p] = tree.GetPositionPath([]string{k}).Line
+
+		switch v := tree.GetPath([]string{k}).(type) {
+		case *toml.Tree:
+			tomlLines(v, p, lines)
+		case []*toml.Tree:
+			for i, t := range v {
+				ip := fmt.Sprintf("%s[%d]", p, i)
+				lines[ip] = t.Position().Line
+				tomlLines(t, ip, lines)
+			}
+			if len(v) > 0 {
+				lines[p] = v[0].Position().Line
+			}
+		case []interface{}:
+			for i := range v {
+				lines[fmt.Sprintf("%s[%d]", p, i)] = lines[p]
+			}
+		}
+	}
+}
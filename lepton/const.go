@@ -95,22 +95,6 @@ func GetOpsHome() string {
 	return opshome
 }
 
-func getImageTempDir(c *Config) string {
-	temp := filepath.Base(c.Program) + "_temp"
-
-	if c.BuildDir == "" {
-		dir, err := ioutil.TempDir("", temp)
-		if err != nil {
-			fmt.Println(err)
-		}
-
-		c.BuildDir = dir
-
-	}
-
-	return c.BuildDir
-}
-
 // NightlyReleaseURL give URL for nightly build
 var NightlyReleaseURL = nightlyReleaseURL()
 
@@ -0,0 +1,184 @@
+package lepton
+
+import (
+	"os"
+	"sort"
+
+	"github.com/go-errors/errors"
+)
+
+// fileSources records why the files of a manifest are in the image
+type fileSources struct {
+	// entry is the config entry recorded for the files added next
+	entry string
+
+	entries  map[string]string // config entry that added a file, by image path
+	neededBy map[string]string // ELF file that needs a library, by image path
+	outside  map[string]bool   // libraries found outside the target root
+
+	// keepGoing records the libraries that can not be found in missing
+	// instead of failing the build
+	keepGoing bool
+	missing   []*LibraryNotFoundError
+}
+
+func newFileSources() fileSources {
+	return fileSources{
+		entries:  map[string]string{},
+		neededBy: map[string]string{},
+		outside:  map[string]bool{},
+	}
+}
+
+func (s *fileSources) add(vmpath string) {
+	s.entries[cleanImagePath(vmpath)] = s.entry
+}
+
+// setSource sets the config entry recorded for the files added next
+func (m *Manifest) setSource(entry string) {
+	m.sources.entry = entry
+}
+
+// Dependency is a file in the image and the libraries it pulled in
+type Dependency struct {
+	Path     string
+	HostPath string `json:",omitempty"`
+	Size     int64
+	// TotalSize is the size of the file and of its dependencies
+	TotalSize         int64
+	Missing           bool          `json:",omitempty"`
+	OutsideTargetRoot bool          `json:",omitempty"`
+	Dependencies      []*Dependency `json:",omitempty"`
+}
+
+func (d *Dependency) total() int64 {
+	d.TotalSize = d.Size
+	for _, dep := range d.Dependencies {
+		d.TotalSize += dep.total()
+	}
+	return d.TotalSize
+}
+
+// DependencySource is a config entry and the files it added to the image
+type DependencySource struct {
+	Entry     string
+	TotalSize int64
+	Files     []*Dependency
+}
+
+// DependencyReport explains what goes into an image and why
+type DependencyReport struct {
+	// Sources are sorted by size, largest first
+	Sources           []*DependencySource
+	TotalSize         int64
+	Missing           []*LibraryNotFoundError `json:",omitempty"`
+	OutsideTargetRoot []string                `json:",omitempty"`
+}
+
+// ExplainManifest builds the manifest of c and reports why each file is in
+// it. Libraries that can not be found are reported instead of failing.
+func ExplainManifest(c *Config) (*DependencyReport, error) {
+	m := NewManifest(c.TargetRoot)
+	m.sources.keepGoing = true
+	if err := buildManifest(m, c); err != nil {
+		return nil, err
+	}
+	return m.dependencyReport()
+}
+
+// ExplainProgram reports the shared libraries the ELF program at path
+// loads, and the ones it loads with dlopen
+func ExplainProgram(targetRoot string, path string, dlopen []string) (*DependencyReport, error) {
+	m := NewManifest(targetRoot)
+	m.sources.keepGoing = true
+	m.setSource("Program")
+	if err := m.AddUserProgram(path); err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+	err := addSharedLibs(m, &Config{TargetRoot: targetRoot, Program: path, Dlopen: dlopen})
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+	return m.dependencyReport()
+}
+
+// dependencyReport groups the files of m by the config entry that added
+// them, libraries are listed under the ELF file that needs them
+func (m *Manifest) dependencyReport() (*DependencyReport, error) {
+	deps := map[string]*Dependency{}
+	var files []string
+	err := walkFiles(m.children, "", func(vmpath string, node interface{}) error {
+		dep := &Dependency{Path: vmpath, OutsideTargetRoot: m.sources.outside[vmpath]}
+		switch v := node.(type) {
+		case string:
+			dep.HostPath = v
+			hostpath, err := lookupFile(m.targetRoot, v)
+			if err != nil {
+				return err
+			}
+			fi, err := os.Stat(hostpath)
+			if err != nil {
+				return err
+			}
+			dep.Size = fi.Size()
+		case inlineFile:
+			dep.Size = int64(len(v.contents))
+		}
+		deps[vmpath] = dep
+		files = append(files, vmpath)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	report := &DependencyReport{Missing: m.sources.missing}
+	sources := map[string]*DependencySource{}
+	source := func(entry string) *DependencySource {
+		if entry == "" {
+			entry = "other"
+		}
+		if s, ok := sources[entry]; ok {
+			return s
+		}
+		s := &DependencySource{Entry: entry}
+		sources[entry] = s
+		report.Sources = append(report.Sources, s)
+		return s
+	}
+
+	for _, vmpath := range files {
+		if parent, ok := deps[m.sources.neededBy[vmpath]]; ok {
+			parent.Dependencies = append(parent.Dependencies, deps[vmpath])
+			continue
+		}
+		s := source(m.sources.entries[vmpath])
+		s.Files = append(s.Files, deps[vmpath])
+	}
+
+	for _, e := range m.sources.missing {
+		dep := &Dependency{Path: e.Library, Missing: true}
+		if parent, ok := deps[e.NeededBy]; ok {
+			parent.Dependencies = append(parent.Dependencies, dep)
+		} else {
+			s := source("")
+			s.Files = append(s.Files, dep)
+		}
+	}
+
+	for _, s := range report.Sources {
+		for _, dep := range s.Files {
+			s.TotalSize += dep.total()
+		}
+		report.TotalSize += s.TotalSize
+	}
+	sort.SliceStable(report.Sources, func(i, j int) bool {
+		return report.Sources[i].TotalSize > report.Sources[j].TotalSize
+	})
+
+	for vmpath := range m.sources.outside {
+		report.OutsideTargetRoot = append(report.OutsideTargetRoot, vmpath)
+	}
+	sort.Strings(report.OutsideTargetRoot)
+	return report, nil
+}
@@ -0,0 +1,63 @@
+package lepton
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func dependencyPaths(deps []*Dependency) []string {
+	var paths []string
+	for _, dep := range deps {
+		paths = append(paths, dep.Path)
+		paths = append(paths, dependencyPaths(dep.Dependencies)...)
+	}
+	return paths
+}
+
+func TestExplainProgram(t *testing.T) {
+	root, libs := newTargetRoot(t, dynamicSystemLs(t))
+	defer os.RemoveAll(root)
+
+	report, err := ExplainProgram(root, "/bin/ls", []string{"libmissing.so.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, report.Sources, 1)
+	assert.Equal(t, "Program", report.Sources[0].Entry)
+	program := report.Sources[0].Files[0]
+	assert.Equal(t, "/bin/ls", program.Path)
+	assert.ElementsMatch(t, append(libs, "libmissing.so.1"), dependencyPaths(program.Dependencies))
+	assert.Equal(t, report.TotalSize, program.TotalSize)
+
+	assert.Equal(t, []*LibraryNotFoundError{{Library: "libmissing.so.1", NeededBy: "/bin/ls"}}, report.Missing)
+	assert.Empty(t, report.OutsideTargetRoot)
+}
+
+func TestExplainProgramOutsideTargetRoot(t *testing.T) {
+	libs := dynamicSystemLs(t)
+
+	root, err := ioutil.TempDir("", "targetroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	data, err := ioutil.ReadFile("/bin/ls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(root, "bin"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "bin/ls"), data, 0755)
+
+	// the target root has no libraries, they are found on the host
+	report, err := ExplainProgram(root, "/bin/ls", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.ElementsMatch(t, libs, report.OutsideTargetRoot)
+	assert.Empty(t, report.Missing)
+}
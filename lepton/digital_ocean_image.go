@@ -18,6 +18,10 @@ import (
 //
 // https://github.com/nanovms/ops/issues/468
 func (do *DigitalOcean) CreateImage(ctx *Context, imagePath string) error {
+	if err := VerifyImageSignature(ctx.config, ctx.config.RunConfig.Imagename); err != nil {
+		return err
+	}
+
 	err := do.Storage.CopyToBucket(ctx.config, imagePath)
 	if err != nil {
 		return err
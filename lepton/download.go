@@ -30,6 +30,11 @@ func (wc *WriteCounter) Write(p []byte) (int, error) {
 	return wc.n, nil
 }
 
+// Add adds n bytes to the progress bar
+func (wc *WriteCounter) Add(n int) {
+	wc.bar.Add(n)
+}
+
 // Start progress bar
 func (wc *WriteCounter) Start() {
 	wc.bar.RenderBlank()
@@ -69,6 +69,10 @@ func (p *GCloud) BuildImageWithPackage(ctx *Context, pkgpath string) (string, er
 // CreateImage - Creates image on GCP using nanos images
 // TODO : re-use and cache DefaultClient and instances.
 func (p *GCloud) CreateImage(ctx *Context, imagePath string) error {
+	if err := VerifyImageSignature(ctx.config, ctx.config.RunConfig.Imagename); err != nil {
+		return err
+	}
+
 	err := p.Storage.CopyToBucket(ctx.config, imagePath)
 	if err != nil {
 		return err
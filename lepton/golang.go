@@ -0,0 +1,213 @@
+package lepton
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// goDirectives are the //ops: comments Go source files may have, they take
+// paths relative to the directory of the package
+var goDirectives = map[string]bool{
+	// //ops:files adds the files matching glob patterns
+	"files": true,
+	// //ops:dirs adds directories
+	"dirs": true,
+}
+
+// goDirective is an //ops: comment of a Go source file
+type goDirective struct {
+	// pos is the file and line of the comment
+	pos  string
+	name string
+	args []string
+}
+
+// goProgram is a program built from a Go package
+type goProgram struct {
+	// dir is the directory of the package
+	dir string
+
+	// path of the binary on the host and in the image
+	binary string
+	vmpath string
+
+	directives []goDirective
+}
+
+// buildGoProgram builds the Go package of c for the image. It is linked
+// statically unless cgo is enabled, and keeps its debugging symbols in debug
+// mode only.
+func buildGoProgram(c *Config) (*goProgram, error) {
+	pkg := c.Go.Package
+	g := &goProgram{}
+
+	// local packages are built in their directory so that the go.mod file
+	// around them is used
+	var workdir, target string
+	if fi, err := os.Stat(pkg); err == nil && fi.IsDir() {
+		workdir, target = pkg, "."
+		g.dir = pkg
+	} else {
+		target = pkg
+		out, err := exec.Command("go", "list", "-f", "{{.Dir}}", pkg).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("go list %s: %v\n%s", pkg, err, out)
+		}
+		g.dir = strings.TrimSpace(string(out))
+	}
+
+	dir, err := filepath.Abs(g.dir)
+	if err != nil {
+		return nil, err
+	}
+	g.directives, err = readGoDirectives(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	name := filepath.Base(dir)
+	sum := sha1.Sum([]byte(dir))
+	g.binary = filepath.Join(GetOpsHome(), "go", hex.EncodeToString(sum[:4]), name)
+	g.vmpath = "/" + name
+
+	goarch := os.Getenv("GOARCH")
+	if goarch == "" {
+		goarch = "amd64"
+	}
+	cgo := "0"
+	if c.Go.CGO {
+		cgo = "1"
+	}
+
+	args := []string{"build", "-o", g.binary}
+	if len(c.Go.Tags) > 0 {
+		args = append(args, "-tags", strings.Join(c.Go.Tags, ","))
+	}
+	if c.Reproducible {
+		args = append(args, "-trimpath")
+	}
+	var ldflags []string
+	if c.RunConfig.Debug {
+		// the debugger needs a static binary with its symbols
+		args = append(args, "-gcflags=all=-N -l")
+		if c.Go.CGO {
+			ldflags = append(ldflags, "-linkmode=external", "-extldflags=-static")
+		}
+	} else {
+		ldflags = append(ldflags, "-s", "-w")
+	}
+	args = append(args, "-ldflags="+strings.Join(ldflags, " "))
+	args = append(args, c.Go.Flags...)
+	args = append(args, target)
+
+	cmd := exec.Command("go", args...)
+	cmd.Dir = workdir
+	cmd.Env = append(os.Environ(), "GOOS=linux", "GOARCH="+goarch, "CGO_ENABLED="+cgo)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("go build %s: %v\n%s", pkg, err, out)
+	}
+	return g, nil
+}
+
+// readGoDirectives reads the //ops: comments of the Go source files in dir
+func readGoDirectives(dir string) ([]goDirective, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var directives []goDirective
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		fd, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(fd)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if !strings.HasPrefix(text, "//ops:") {
+				continue
+			}
+			pos := fmt.Sprintf("%s:%d", filepath.Base(file), line)
+			fields := strings.Fields(text[len("//ops:"):])
+			if len(fields) == 0 || !goDirectives[fields[0]] {
+				fd.Close()
+				return nil, fmt.Errorf("%s: unknown directive %s", pos, text)
+			}
+			directives = append(directives, goDirective{pos: pos, name: fields[0], args: fields[1:]})
+		}
+		err = scanner.Err()
+		fd.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return directives, nil
+}
+
+// config returns a copy of c that runs the binary of g
+func (g *goProgram) config(c *Config) *Config {
+	gc := *c
+	gc.Program = g.binary
+	args := []string{g.vmpath}
+	if len(c.Args) > 1 {
+		args = append(args, c.Args[1:]...)
+	}
+	gc.Args = args
+	return &gc
+}
+
+// addGoDirectives adds the files of the //ops: directives of g to m, at
+// their path relative to the directory of the package
+func addGoDirectives(m *Manifest, g *goProgram) error {
+	for _, d := range g.directives {
+		m.setSource("//ops:" + d.name + " in " + d.pos)
+		for _, arg := range d.args {
+			switch d.name {
+			case "files":
+				matches, err := filepath.Glob(filepath.Join(g.dir, arg))
+				if err != nil {
+					return fmt.Errorf("%s: %v", d.pos, err)
+				}
+				if len(matches) == 0 {
+					return fmt.Errorf("%s: no files match %s", d.pos, arg)
+				}
+				for _, match := range matches {
+					rel, err := filepath.Rel(g.dir, match)
+					if err != nil {
+						return err
+					}
+					if err = m.AddFile(path.Join("/", filepath.ToSlash(rel)), match); err != nil {
+						return err
+					}
+				}
+			case "dirs":
+				dir := filepath.Join(g.dir, arg)
+				rel, err := filepath.Rel(g.dir, dir)
+				if err != nil {
+					return err
+				}
+				if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+					return fmt.Errorf("%s: %s is not a directory", d.pos, arg)
+				}
+				if err = addMappedFiles(filepath.Join(dir, "*"), path.Join("/", filepath.ToSlash(rel)), m); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package lepton
+
+import (
+	"debug/elf"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newGoModule returns a Go module with a main package in cmd/server that
+// has //ops: directives
+func newGoModule(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gomodule")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := filepath.Join(dir, "cmd", "server")
+	os.MkdirAll(filepath.Join(server, "config"), 0755)
+	os.MkdirAll(filepath.Join(server, "static", "css"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/app\n\ngo 1.13\n"), 0644)
+	ioutil.WriteFile(filepath.Join(server, "main.go"), []byte(`package main
+
+//ops:files config/*.json
+//ops:dirs static
+import "fmt"
+
+func main() {
+	fmt.Println("hello")
+}
+`), 0644)
+	ioutil.WriteFile(filepath.Join(server, "main_test.go"), []byte("package main\n\n//ops:unknown\n"), 0644)
+	ioutil.WriteFile(filepath.Join(server, "config", "app.json"), []byte("{}"), 0644)
+	ioutil.WriteFile(filepath.Join(server, "static", "css", "app.css"), []byte("body {}"), 0644)
+	return dir
+}
+
+func TestReadGoDirectives(t *testing.T) {
+	dir := newGoModule(t)
+	defer os.RemoveAll(dir)
+
+	server := filepath.Join(dir, "cmd", "server")
+	directives, err := readGoDirectives(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []goDirective{
+		{pos: "main.go:3", name: "files", args: []string{"config/*.json"}},
+		{pos: "main.go:4", name: "dirs", args: []string{"static"}},
+	}, directives)
+
+	ioutil.WriteFile(filepath.Join(server, "extra.go"), []byte("package main\n\n//ops:mount /data\n"), 0644)
+	_, err = readGoDirectives(server)
+	assert.EqualError(t, err, "extra.go:3: unknown directive //ops:mount /data")
+}
+
+func TestBuildGoProgram(t *testing.T) {
+	dir := newGoModule(t)
+	defer os.RemoveAll(dir)
+
+	c := &Config{Go: GoConfig{Package: filepath.Join(dir, "cmd", "server")}, Args: []string{"server", "-v"}}
+	g, err := buildGoProgram(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(g.binary)
+
+	f, err := elf.Open(g.binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	assert.Equal(t, elf.EM_X86_64, f.Machine)
+	assert.Nil(t, f.Section(".interp"), "program must be linked statically")
+
+	gc := g.config(c)
+	assert.Equal(t, g.binary, gc.Program)
+	assert.Equal(t, []string{"/server", "-v"}, gc.Args)
+
+	m := NewManifest("")
+	if err = m.addProgram(g.vmpath, gc.Program); err != nil {
+		t.Fatal(err)
+	}
+	if err = addGoDirectives(m, g); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/server", m.Program())
+	assert.True(t, m.FileExists("/config/app.json"))
+	assert.True(t, m.FileExists("/static/css/app.css"))
+}
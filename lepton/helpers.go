@@ -189,7 +189,8 @@ func Bytes2Human(b int64) string {
 		float64(b)/float64(div), "kMGTPE"[exp])
 }
 
-func parseBytes(s string) (int64, error) {
+// ParseBytes parses a size such as 512m or 2GiB in bytes
+func ParseBytes(s string) (int64, error) {
 	lastDigit := 0
 	hasComma := false
 	for _, r := range s {
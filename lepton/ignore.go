@@ -0,0 +1,253 @@
+package lepton
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignoreFile holds exclude patterns for the directory it is in
+const ignoreFile = ".opsignore"
+
+// ignorePattern is a compiled gitignore-style pattern
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// fileFilter selects the files added to the image when walking a directory
+type fileFilter struct {
+	// ignores holds the patterns of the .opsignore files read so far by
+	// the directory they are in, relative to the walked directory
+	ignores  map[string][]*ignorePattern
+	excludes []*ignorePattern
+	includes []*ignorePattern
+}
+
+// newFileFilter returns the filter for a walk of root, made of the
+// patterns in the .opsignore files of root and of the directories below it
+// followed by excludes, and the include globs
+func newFileFilter(root string, excludes []string, includes []string) (*fileFilter, error) {
+	f := &fileFilter{ignores: map[string][]*ignorePattern{}}
+	if err := f.readIgnores(root, "."); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if f.excludes, err = parseIgnorePatterns(excludes); err != nil {
+		return nil, err
+	}
+	if f.includes, err = parseIgnorePatterns(includes); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// readIgnores reads the .opsignore file of the directory at relpath below
+// root
+func (f *fileFilter) readIgnores(root string, relpath string) error {
+	lines, err := readIgnoreFile(filepath.Join(root, relpath, ignoreFile))
+	if err != nil {
+		return err
+	}
+	patterns, err := parseIgnorePatterns(lines)
+	if err != nil {
+		return err
+	}
+	if len(patterns) > 0 {
+		f.ignores[filepath.ToSlash(relpath)] = patterns
+	}
+	return nil
+}
+
+// parseIgnorePatterns compiles the patterns of lines
+func parseIgnorePatterns(lines []string) ([]*ignorePattern, error) {
+	var patterns []*ignorePattern
+	for _, line := range lines {
+		ip, err := parseIgnorePattern(line)
+		if err != nil {
+			return nil, err
+		}
+		if ip != nil {
+			patterns = append(patterns, ip)
+		}
+	}
+	return patterns, nil
+}
+
+// readIgnoreFile reads the patterns of an .opsignore file, which does not
+// have to exist
+func readIgnoreFile(path string) ([]string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer fd.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return patterns, nil
+}
+
+// skip checks whether the file or directory at relpath, relative to the
+// walked directory, is left out of the image. The patterns of an .opsignore
+// file are relative to its directory and take precedence over the ones of
+// the directories above, excludes over all of them. Excluded directories
+// are skipped as a whole while include globs only apply to files.
+func (f *fileFilter) skip(relpath string, isDir bool) bool {
+	relpath = filepath.ToSlash(relpath)
+	if relpath == "." {
+		return false
+	}
+	if !isDir && path.Base(relpath) == ignoreFile {
+		return true
+	}
+
+	excluded := false
+	match := func(patterns []*ignorePattern, relpath string) {
+		for _, p := range patterns {
+			if p.match(relpath, isDir) {
+				excluded = !p.negate
+			}
+		}
+	}
+	match(f.ignores["."], relpath)
+	for i := 0; i < len(relpath); i++ {
+		if relpath[i] == '/' {
+			match(f.ignores[relpath[:i]], relpath[i+1:])
+		}
+	}
+	match(f.excludes, relpath)
+	if excluded {
+		return true
+	}
+
+	if isDir || len(f.includes) == 0 {
+		return false
+	}
+	for _, p := range f.includes {
+		if p.match(relpath, isDir) && !p.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// skipPath checks whether hostpath, found while walking root, is left out of
+// the image. It returns filepath.SkipDir for excluded directories so their
+// contents are not walked, and reads the .opsignore file of the others.
+func (f *fileFilter) skipPath(root string, hostpath string, info os.FileInfo) (bool, error) {
+	relpath, err := filepath.Rel(root, hostpath)
+	if err != nil {
+		return true, err
+	}
+	if !f.skip(relpath, info.IsDir()) {
+		if info.IsDir() && relpath != "." {
+			return false, f.readIgnores(root, relpath)
+		}
+		return false, nil
+	}
+	if info.IsDir() {
+		return true, filepath.SkipDir
+	}
+	return true, nil
+}
+
+func (p *ignorePattern) match(relpath string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	return p.re.MatchString(relpath)
+}
+
+// parseIgnorePattern compiles a line of an .opsignore file. It returns nil
+// for blank lines and comments.
+//
+// Patterns follow gitignore: a leading '!' negates the pattern, a trailing
+// '/' only matches directories, patterns without a '/' match at any depth,
+// '*' and '?' do not match '/' and '**' matches any number of directories.
+func parseIgnorePattern(line string) (*ignorePattern, error) {
+	pattern := strings.TrimRight(line, " \t\r")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return nil, nil
+	}
+
+	p := &ignorePattern{}
+	if strings.HasPrefix(pattern, "!") {
+		p.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, "\\#") || strings.HasPrefix(pattern, "\\!") {
+		pattern = pattern[1:]
+	}
+
+	if strings.HasSuffix(pattern, "/") {
+		p.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if pattern == "" {
+		return nil, nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	if !anchored {
+		sb.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.Replace(class, "\\", "\\\\", -1) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", line, err)
+	}
+	p.re = re
+	return p, nil
+}
@@ -0,0 +1,115 @@
+package lepton
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileFilterSkip(t *testing.T) {
+	f, err := newFileFilter("", []string{
+		"# editor files",
+		"*.swp",
+		".git/",
+		"node_modules/.cache",
+		"/build",
+		"test/**/fixtures",
+		"*.log",
+		"!keep.log",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		isDir bool
+		skip  bool
+	}{
+		{"main.js", false, false},
+		{"src/.main.js.swp", false, true},
+		{".git", true, true},
+		{"src/.git", false, false},
+		{"node_modules/.cache", true, true},
+		{"lib/node_modules/.cache", true, false},
+		{"build", true, true},
+		{"src/build", true, false},
+		{"test/unit/data/fixtures", true, true},
+		{"test/fixtures", true, true},
+		{"logs/app.log", false, true},
+		{"logs/keep.log", false, false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.skip, f.skip(tt.path, tt.isDir), tt.path)
+	}
+}
+
+func TestFileFilterInclude(t *testing.T) {
+	f, err := newFileFilter("", []string{"vendor/"}, []string{"**/*.py", "config/*.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.False(t, f.skip("app.py", false))
+	assert.False(t, f.skip("pkg/mod/util.py", false))
+	assert.False(t, f.skip("config/app.json", false))
+	assert.False(t, f.skip("pkg", true))
+	assert.True(t, f.skip("config/nested/app.json", false))
+	assert.True(t, f.skip("README.md", false))
+	assert.True(t, f.skip("vendor", true))
+}
+
+func TestAddDirectoryOpsIgnore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opsignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		".opsignore":           "*.tmp\n.git/\n",
+		"app.js":               "",
+		"cache.tmp":            "",
+		".git/HEAD":            "",
+		"lib/util.js":          "",
+		"lib/util_test.js":     "",
+		"lib/fixtures/a.json":  "",
+		"lib/fixtures/b.json~": "",
+		"lib/.opsignore":       "data/\n!util.tmp\n",
+		"lib/util.tmp":         "",
+		"lib/data/a.json":      "",
+		"data/a.json":          "",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewManifest("")
+	m.SetFileFilter([]string{"*_test.js", "fixtures/"}, nil)
+	err = m.AddRelativeDirectory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, m.FileExists("/app.js"))
+	assert.True(t, m.FileExists("/lib/util.js"))
+	assert.False(t, m.FileExists("/cache.tmp"))
+	assert.False(t, m.FileExists("/.git/HEAD"))
+	assert.False(t, m.FileExists("/lib/util_test.js"))
+	assert.False(t, m.FileExists("/lib/fixtures/a.json"))
+
+	// the patterns of nested .opsignore files apply below their directory
+	assert.True(t, m.FileExists("/lib/util.tmp"))
+	assert.False(t, m.FileExists("/lib/data/a.json"))
+	assert.True(t, m.FileExists("/data/a.json"))
+	assert.False(t, m.FileExists("/.opsignore"))
+	assert.False(t, m.FileExists("/lib/.opsignore"))
+}
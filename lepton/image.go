@@ -5,15 +5,18 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-errors/errors"
+	"github.com/nanovms/ops/fs"
 )
 
 var localImageDir = path.Join(GetOpsHome(), "images")
@@ -33,6 +36,17 @@ func BuildImage(c Config) error {
 	return nil
 }
 
+// BuildImageFromManifest builds a unikernel image from a manifest
+// previously read with ReadManifestFile
+func BuildImageFromManifest(c Config, m *Manifest) error {
+	m.nightly = c.NightlyBuild
+	if err := buildImage(&c, m); err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	return nil
+}
+
 // rebuildImage rebuilds a unikernel image for user
 // supplied ELF binary after volume attach/detach
 func rebuildImage(c Config) error {
@@ -62,53 +76,93 @@ func createFile(filepath string) (*os.File, error) {
 	return fd, nil
 }
 
-// add /etc/resolv.conf
-func addDNSConfig(m *Manifest, c *Config) {
-	temp := getImageTempDir(c)
-	resolv := path.Join(temp, "resolv.conf")
-	data := []byte("nameserver ")
-	data = append(data, []byte(c.NameServer)...)
-	err := ioutil.WriteFile(resolv, data, 0644)
-	if err != nil {
-		panic(err)
+// sourceDateEpoch returns the build timestamp of reproducible builds, taken
+// from SOURCE_DATE_EPOCH when set.
+// See https://reproducible-builds.org/specs/source-date-epoch/
+func sourceDateEpoch() (time.Time, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return time.Unix(0, 0).UTC(), nil
 	}
-	err = m.AddFile("/etc/resolv.conf", resolv)
+
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
 	if err != nil {
-		panic(err)
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %v", epoch, err)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// add /etc/resolv.conf
+func addDNSConfig(m *Manifest, c *Config) error {
+	var sb strings.Builder
+	nameservers := c.NameServers
+	if c.NameServer != "" {
+		nameservers = append([]string{c.NameServer}, nameservers...)
+	}
+	for _, ns := range nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("invalid nameserver address %q", ns)
+		}
+		sb.WriteString("nameserver " + ns + "\n")
 	}
+	if len(c.SearchDomains) > 0 {
+		sb.WriteString("search " + strings.Join(c.SearchDomains, " ") + "\n")
+	}
+	if len(c.ResolverOptions) > 0 {
+		sb.WriteString("options " + strings.Join(c.ResolverOptions, " ") + "\n")
+	}
+	return m.AddFileContents("/etc/resolv.conf", []byte(sb.String()), 0644)
 }
 
+const (
+	hostnamePath    = "/proc/sys/kernel/hostname"
+	defaultHostname = "uniboot"
+)
+
 // /proc/sys/kernel/hostname
-func addHostName(m *Manifest, c *Config) {
-	temp := getImageTempDir(c)
-	hostname := path.Join(temp, "hostname")
-	data := []byte("uniboot")
-	err := ioutil.WriteFile(hostname, data, 0644)
-	if err != nil {
-		panic(err)
+func addHostName(m *Manifest, c *Config) error {
+	hostname := c.Hostname
+	if hostname == "" {
+		hostname = defaultHostname
 	}
-	err = m.AddFile("/proc/sys/kernel/hostname", hostname)
-	if err != nil {
-		panic(err)
+	if strings.ContainsAny(hostname, " \t\r\n") {
+		return fmt.Errorf("invalid hostname %q", hostname)
 	}
+	return m.AddFileContents(hostnamePath, []byte(hostname), 0644)
 }
 
-func addPasswd(m *Manifest, c *Config) {
-	// Skip adding password file if present in package
-	if m.FileExists("/etc/passwd") {
-		return
+// add /etc/hosts with the static entries of the configuration
+func addHosts(m *Manifest, c *Config) error {
+	if len(c.Hosts) == 0 {
+		return nil
 	}
-	temp := getImageTempDir(c)
-	passwd := path.Join(temp, "passwd")
-	data := []byte("root:x:0:0:root:/root:/bin/nobash")
-	err := ioutil.WriteFile(passwd, data, 0644)
-	if err != nil {
-		panic(err)
+
+	addresses := make([]string, 0, len(c.Hosts))
+	for ip := range c.Hosts {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid /etc/hosts address %q", ip)
+		}
+		addresses = append(addresses, ip)
 	}
-	err = m.AddFile("/etc/passwd", passwd)
-	if err != nil {
-		panic(err)
+	sort.Strings(addresses)
+
+	var sb strings.Builder
+	sb.WriteString("127.0.0.1 localhost\n")
+	for _, ip := range addresses {
+		if len(c.Hosts[ip]) == 0 {
+			return fmt.Errorf("no host names for /etc/hosts address %s", ip)
+		}
+		sb.WriteString(ip + " " + strings.Join(c.Hosts[ip], " ") + "\n")
 	}
+	return m.AddFileContents("/etc/hosts", []byte(sb.String()), 0644)
+}
+
+func addPasswd(m *Manifest, c *Config) error {
+	// Skip adding password file if present in package
+	if m.FileExists("/etc/passwd") {
+		return nil
+	}
+	return m.AddFileContents("/etc/passwd", []byte("root:x:0:0:root:/root:/bin/nobash"), 0644)
 }
 
 // bunch of default files that's required.
@@ -149,12 +203,12 @@ func addDefaultFiles(m *Manifest, c *Config) error {
 	return nil
 }
 
-func addFilesFromPackage(packagepath string, m *Manifest) {
+func addFilesFromPackage(packagepath string, m *Manifest) error {
 
 	rootPath := filepath.Join(packagepath, "sysroot")
 	packageName := filepath.Base(packagepath)
 
-	filepath.Walk(rootPath, func(hostpath string, info os.FileInfo, err error) error {
+	err := filepath.Walk(rootPath, func(hostpath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -170,8 +224,11 @@ func addFilesFromPackage(packagepath string, m *Manifest) {
 		}
 		return nil
 	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 
-	filepath.Walk(packagepath, func(hostpath string, info os.FileInfo, err error) error {
+	return filepath.Walk(packagepath, func(hostpath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -199,11 +256,14 @@ func BuildPackageManifest(packagepath string, c *Config) (*Manifest, error) {
 	m := NewManifest(c.TargetRoot)
 
 	// Add files from package
-	addFilesFromPackage(packagepath, m)
+	err := addFilesFromPackage(packagepath, m)
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
 
 	m.nightly = c.NightlyBuild
 	m.program = c.Program
-	err := addFromConfig(m, c)
+	err = addFromConfig(m, c)
 	if err != nil {
 		return nil, errors.Wrap(err, 1)
 	}
@@ -211,21 +271,45 @@ func BuildPackageManifest(packagepath string, c *Config) (*Manifest, error) {
 		if _, err := os.Stat(c.Args[1]); err == nil {
 			err = m.AddFile(c.Args[1], c.Args[1])
 			if err != nil {
-				return nil, err
+				return nil, errors.Wrap(err, 1)
 			}
 		}
 	}
 
+	err = addFileMetadata(m, c)
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
 	return m, nil
 }
 
 func addFromConfig(m *Manifest, c *Config) error {
 	m.AddKernel(c.Kernel)
-	addDNSConfig(m, c)
-	addHostName(m, c)
-	addPasswd(m, c)
-	m.AddKlibs(c.RunConfig.Klibs)
+	m.setSource("generated")
+	err := addDNSConfig(m, c)
+	if err != nil {
+		return err
+	}
+	err = addHostName(m, c)
+	if err != nil {
+		return err
+	}
+	err = addHosts(m, c)
+	if err != nil {
+		return err
+	}
+	err = addPasswd(m, c)
+	if err != nil {
+		return err
+	}
+	err = addKlibsFromConfig(m, c)
+	if err != nil {
+		return err
+	}
+	m.SetFileFilter(c.Exclude, c.Include)
 
+	m.setSource("Files")
 	for _, f := range c.Files {
 		err := m.AddFile(f, f)
 		if err != nil {
@@ -233,20 +317,42 @@ func addFromConfig(m *Manifest, c *Config) error {
 		}
 	}
 
-	for k, v := range c.MapDirs {
-		err := addMappedFiles(k, v, m)
+	// walk mapped directories in a stable order so overlapping mappings
+	// always resolve the same way
+	mapDirs := make([]string, 0, len(c.MapDirs))
+	for k := range c.MapDirs {
+		mapDirs = append(mapDirs, k)
+	}
+	sort.Strings(mapDirs)
+	for _, k := range mapDirs {
+		m.setSource(fmt.Sprintf("MapDirs[%s]", k))
+		err := addMappedFiles(k, c.MapDirs[k], m)
 		if err != nil {
 			return err
 		}
 	}
 
 	for _, d := range c.Dirs {
+		m.setSource(fmt.Sprintf("Dirs[%s]", d))
 		err := m.AddDirectory(d)
 		if err != nil {
 			return err
 		}
 	}
 
+	inlineFiles := make([]string, 0, len(c.InlineFiles))
+	for k := range c.InlineFiles {
+		inlineFiles = append(inlineFiles, k)
+	}
+	sort.Strings(inlineFiles)
+	m.setSource("InlineFiles")
+	for _, k := range inlineFiles {
+		err := m.AddFileContents(k, []byte(c.InlineFiles[k]), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
 	for _, a := range c.Args {
 		m.AddArgument(a)
 	}
@@ -263,8 +369,17 @@ func addFromConfig(m *Manifest, c *Config) error {
 		m.AddNoTrace(syscallName)
 	}
 
+	pwd := "/"
+	if c.Cwd != "" {
+		if !path.IsAbs(c.Cwd) {
+			return fmt.Errorf("working directory %s must be an absolute path", c.Cwd)
+		}
+		pwd = path.Clean(c.Cwd)
+		m.SetWorkingDirectory(pwd)
+	}
+
 	m.AddEnvironmentVariable("USER", "root")
-	m.AddEnvironmentVariable("PWD", "/")
+	m.AddEnvironmentVariable("PWD", pwd)
 	m.AddEnvironmentVariable("OPS_VERSION", Version)
 	m.AddEnvironmentVariable("NANOS_VERSION", LocalReleaseVersion)
 	for k, v := range c.Env {
@@ -281,42 +396,214 @@ func addFromConfig(m *Manifest, c *Config) error {
 // BuildManifest builds manifest using config
 func BuildManifest(c *Config) (*Manifest, error) {
 	m := NewManifest(c.TargetRoot)
+	if err := buildManifest(m, c); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func buildManifest(m *Manifest, c *Config) error {
+	// Go packages are built first, jars are run by the java launcher and
+	// scripts by the interpreter of their shebang line
+	var g *goProgram
+	var j *javaApp
+	var s *script
+	var err error
+	if c.Go.Package != "" {
+		if g, err = buildGoProgram(c); err != nil {
+			return errors.Wrap(err, 1)
+		}
+		c = g.config(c)
+	} else if c.Java.Jar != "" {
+		if j, err = findJava(c); err != nil {
+			return errors.Wrap(err, 1)
+		}
+		c = j.config(c)
+	} else {
+		if s, err = readScript(c.TargetRoot, c.Program); err != nil {
+			return errors.Wrap(err, 1)
+		}
+		if s != nil {
+			c = s.config(c)
+		}
+	}
 
-	addDefaultFiles(m, c)
+	m.setSource("default files")
+	err = addDefaultFiles(m, c)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
 
-	err := addFromConfig(m, c)
+	err = addFromConfig(m, c)
 	if err != nil {
-		return nil, errors.Wrap(err, 1)
+		return errors.Wrap(err, 1)
 	}
 
 	m.nightly = c.NightlyBuild
-	m.AddUserProgram(c.Program)
+	m.setSource("Program")
+	if g != nil {
+		err = m.addProgram(g.vmpath, c.Program)
+	} else {
+		err = m.AddUserProgram(c.Program)
+	}
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+	if g != nil {
+		err = addGoDirectives(m, g)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
+	if s != nil {
+		err = addScript(m, c, s)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
+	if j != nil {
+		err = addJava(m, c, j)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
 
-	deps, err := getSharedLibs(c.TargetRoot, c.Program)
+	err = addSharedLibs(m, c)
 	if err != nil {
-		return nil, errors.Wrap(err, 1)
+		return errors.Wrap(err, 1)
+	}
+
+	// the files of the image are added last so that the files above, such
+	// as the default files, take precedence
+	if c.OCI.Image != "" && c.OCI.FullRootFS {
+		m.setSource("OCI.FullRootFS")
+		err = addRootFS(m, c.TargetRoot)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
 	}
-	for _, libpath := range deps {
-		m.AddLibrary(libpath)
+
+	err = addNetworkConfig(m, &c.RunConfig)
+	if err != nil {
+		return errors.Wrap(err, 1)
 	}
 
-	if c.RunConfig.IPAddr != "" {
-		m.AddNetworkConfig(&ManifestNetworkConfig{
-			IP:      c.RunConfig.IPAddr,
-			Gateway: c.RunConfig.Gateway,
-			NetMask: c.RunConfig.NetMask,
-		})
+	err = addFileMetadata(m, c)
+	if err != nil {
+		return errors.Wrap(err, 1)
 	}
 
-	return m, nil
+	return nil
+}
+
+// addFileMetadata records the mode, owner and modification time of the files
+// in the image as selected by c.FileMetadataMode and c.FileMetadata
+func addFileMetadata(m *Manifest, c *Config) error {
+	if c.FileMetadataMode == "" && len(c.FileMetadata) == 0 {
+		return nil
+	}
+	if c.FileMetadataMode != "" && c.FileMetadataMode != "preserve" && c.FileMetadataMode != "normalize" {
+		return fmt.Errorf("invalid file metadata mode %q, expected preserve or normalize", c.FileMetadataMode)
+	}
+
+	epoch, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+
+	overrides := make(map[string]FileMetadata)
+	for vmpath, override := range c.FileMetadata {
+		if !m.FileExists(vmpath) {
+			return fmt.Errorf("file metadata for '%s': file is not in the image", vmpath)
+		}
+		overrides[cleanImagePath(vmpath)] = override
+	}
+
+	return walkFiles(m.children, "", func(vmpath string, node interface{}) error {
+		override, ok := overrides[vmpath]
+		if c.FileMetadataMode == "" && !ok {
+			return nil
+		}
+
+		md, err := imageFileMetadata(m.targetRoot, node, c.FileMetadataMode, epoch)
+		if err != nil {
+			return err
+		}
+		// inline files keep the mode they were added with
+		if _, inline := node.(inlineFile); inline {
+			if added, ok := m.metadata[vmpath]; ok {
+				md.mode = added.mode
+			}
+		}
+
+		if override.Mode != "" {
+			mode, err := strconv.ParseUint(override.Mode, 8, 32)
+			if err != nil {
+				return fmt.Errorf("file metadata for '%s': invalid mode %q", vmpath, override.Mode)
+			}
+			md.mode = os.FileMode(mode)
+		}
+		if override.UID != nil {
+			md.uid = *override.UID
+		}
+		if override.GID != nil {
+			md.gid = *override.GID
+		}
+		if override.Mtime != nil {
+			md.mtime = time.Unix(*override.Mtime, 0).UTC()
+		}
+
+		return m.SetFileMetadata(vmpath, md.mode, md.uid, md.gid, md.mtime)
+	})
+}
+
+// imageFileMetadata returns the metadata of a manifest file, either copied
+// from the host file or normalized. Inline files have no host file and are
+// always normalized.
+func imageFileMetadata(targetRoot string, node interface{}, metadataMode string, epoch time.Time) (fileMetadata, error) {
+	md := fileMetadata{mode: 0644, mtime: epoch}
+
+	hostpath, ok := node.(string)
+	if !ok {
+		return md, nil
+	}
+
+	path, err := lookupFile(targetRoot, hostpath)
+	if err != nil {
+		return md, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return md, err
+	}
+
+	if metadataMode == "normalize" {
+		if info.Mode().Perm()&0111 != 0 {
+			md.mode = 0755
+		}
+		return md, nil
+	}
+
+	md.mode = info.Mode().Perm()
+	md.uid, md.gid = fileOwner(info)
+	md.mtime = info.ModTime().UTC()
+	return md, nil
 }
 
 func addMappedFiles(src string, dest string, m *Manifest) error {
 	dir, pattern := filepath.Split(src)
-	err := filepath.Walk(dir, func(hostpath string, info os.FileInfo, err error) error {
+	filter, err := newFileFilter(dir, m.exclude, m.include)
+	if err != nil {
+		return err
+	}
+
+	err = filepath.Walk(dir, func(hostpath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if skip, err := filter.skipPath(dir, hostpath, info); skip || err != nil {
+			return err
+		}
 		if info.IsDir() {
 			return nil
 		}
@@ -339,6 +626,21 @@ func addMappedFiles(src string, dest string, m *Manifest) error {
 }
 
 func buildImage(c *Config, m *Manifest) error {
+	if c.Reproducible {
+		// the mkfs program gives every filesystem a random UUID
+		if !c.NativeMkfs {
+			return errors.Wrap(fmt.Errorf("reproducible builds need \"NativeMkfs\": true, the mkfs program writes a random filesystem UUID"), 1)
+		}
+		if _, err := sourceDateEpoch(); err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
+
+	err := m.checkKlibs()
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
 	//  prepare manifest file
 	var elfmanifest string
 	elfmanifest = m.String()
@@ -360,6 +662,81 @@ func buildImage(c *Config, m *Manifest) error {
 
 	defer cleanup(c)
 
+	// images are reused from the build cache when their manifest and the
+	// contents of their files did not change
+	var bc *buildCache
+	var key string
+	var cached bool
+	if !c.NoCache {
+		bc = newBuildCache(BuildCacheDir)
+		if c.CacheSize != "" {
+			if bc.size, err = parseVolumeSize(c.CacheSize); err != nil {
+				return errors.Wrap(fmt.Errorf("invalid cache size %s", c.CacheSize), 1)
+			}
+		}
+		if key, err = bc.key(c, elfmanifest); err != nil {
+			return errors.Wrap(err, 1)
+		}
+		if cached, err = bc.get(key, c.RunConfig.Imagename); err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
+
+	if !cached {
+		if c.NativeMkfs {
+			opts := fs.Options{Boot: c.Boot, Progress: mkfsProgress()}
+			_, err = writeFilesystem(c, elfmanifest, c.RunConfig.Imagename, opts)
+		} else {
+			err = runMkfs(c, elfmanifest)
+		}
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
+
+	if bc != nil {
+		if !cached {
+			err = bc.put(key, c.RunConfig.Imagename)
+		}
+		if err == nil {
+			err = bc.saveHashes()
+		}
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
+
+	if c.Reproducible {
+		epoch, err := sourceDateEpoch()
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+		err = os.Chtimes(c.RunConfig.Imagename, epoch, epoch)
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+	}
+
+	p, err := newProvenance(c, m)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+	if err = writeProvenance(c.RunConfig.Imagename, p); err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	// a signature of the previous build would not match the new image
+	if c.SigningKey == "" {
+		os.Remove(SignaturePath(c.RunConfig.Imagename))
+	} else if _, err = SignImage(c.RunConfig.Imagename, c.SigningKey); err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	return nil
+}
+
+// runMkfs writes the image with the mkfs program of the kernel release
+func runMkfs(c *Config, elfmanifest string) error {
 	mkfsCommand := NewMkfsCommand(c.Mkfs)
 
 	if c.TargetRoot != "" {
@@ -389,7 +766,6 @@ func buildImage(c *Config, m *Manifest) error {
 		log.Println("mkfs:" + string(mkfsCommand.GetOutput()))
 		return errors.Wrap(err, 1)
 	}
-
 	return nil
 }
 
@@ -582,3 +958,45 @@ func lookupFile(targetRoot string, path string) (string, error) {
 
 	return path, err
 }
+
+// resolveImagePath follows the symlinks of the file at path in the target
+// root and returns the path of the file they point to in the target root
+func resolveImagePath(targetRoot string, path string) (string, error) {
+	hostPath, err := lookupFile(targetRoot, path)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(hostPath); err == nil {
+		hostPath = resolved
+	}
+	if targetRoot != "" {
+		root, err := filepath.EvalSymlinks(targetRoot)
+		if err != nil {
+			root = filepath.Clean(targetRoot)
+		}
+		if strings.HasPrefix(hostPath, root+"/") {
+			return hostPath[len(root):], nil
+		}
+	}
+	return hostPath, nil
+}
+
+// addTargetDir adds the files in the directory at dir in the target root to
+// the same path in the image. It returns false when there is no such
+// directory.
+func addTargetDir(m *Manifest, targetRoot string, dir string) (bool, error) {
+	hostDir, err := lookupFile(targetRoot, dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if resolved, err := filepath.EvalSymlinks(hostDir); err == nil {
+		hostDir = resolved
+	}
+	if fi, err := os.Stat(hostDir); err != nil || !fi.IsDir() {
+		return false, nil
+	}
+	return true, addMappedFiles(filepath.Join(hostDir, "*"), dir, m)
+}
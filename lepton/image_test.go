@@ -0,0 +1,127 @@
+package lepton
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nanovms/ops/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildImageReproducible(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv("SOURCE_DATE_EPOCH", "1600000000")
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+
+	hello := filepath.Join(dir, "hello")
+	require.NoError(t, ioutil.WriteFile(hello, []byte("hello"), 0755))
+
+	build := func(name string, native bool) (string, error) {
+		m := NewManifest("")
+		require.NoError(t, m.addProgram("/hello", hello))
+		c := &Config{Args: []string{"hello"}, NativeMkfs: native, NoCache: true, Reproducible: true}
+		c.RunConfig.Imagename = filepath.Join(dir, name)
+		if err := buildImage(c, m); err != nil {
+			return "", err
+		}
+		return sha256File(c.RunConfig.Imagename)
+	}
+
+	first, err := build("first.img", true)
+	require.NoError(t, err)
+	second, err := build("second.img", true)
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	// the mkfs program writes a random filesystem UUID
+	_, err = build("mkfs.img", false)
+	assert.Error(t, err)
+}
+
+// readImageFiles returns the contents of the files of the image at path by
+// image path, directories have no contents
+func readImageFiles(t *testing.T, path string) map[string]string {
+	r, err := fs.Open(path)
+	require.NoError(t, err)
+	defer r.Close()
+
+	files := map[string]string{}
+	var walk func(dir string)
+	walk = func(dir string) {
+		entries, err := r.ReadDir(dir)
+		require.NoError(t, err)
+		for _, fi := range entries {
+			vmpath := filepath.Join(dir, fi.Name())
+			if fi.IsDir() {
+				files[vmpath+"/"] = ""
+				walk(vmpath)
+				continue
+			}
+			var b bytes.Buffer
+			require.NoError(t, r.CopyFile(&b, vmpath))
+			files[vmpath] = b.String()
+		}
+	}
+	walk("/")
+	return files
+}
+
+// TestBuildImageMatchesMkfsProgram checks the on-disk format of the native
+// writer against the image the mkfs program of the installed kernel release
+// writes from the same manifest
+func TestBuildImageMatchesMkfsProgram(t *testing.T) {
+	release := filepath.Join(GetOpsHome(), LocalReleaseVersion)
+	mkfs := filepath.Join(release, "mkfs")
+	boot := filepath.Join(release, "boot.img")
+	for _, f := range []string{mkfs, boot} {
+		if _, err := os.Stat(f); err != nil {
+			t.Skipf("no kernel release: %v", err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "image")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	hello := filepath.Join(dir, "hello")
+	require.NoError(t, ioutil.WriteFile(hello, bytes.Repeat([]byte("hello"), 300), 0755))
+	data := filepath.Join(dir, "data")
+	require.NoError(t, ioutil.WriteFile(data, []byte("data"), 0644))
+
+	build := func(name string, native bool) string {
+		m := NewManifest("")
+		require.NoError(t, m.addProgram("/hello", hello))
+		require.NoError(t, m.AddFile("/etc/data", data))
+		c := &Config{Args: []string{"hello"}, Boot: boot, Mkfs: mkfs, NativeMkfs: native, NoCache: true}
+		c.RunConfig.Imagename = filepath.Join(dir, name)
+		require.NoError(t, buildImage(c, m))
+		return c.RunConfig.Imagename
+	}
+
+	golden := readImageFiles(t, build("mkfs.img", false))
+	assert.Equal(t, strings.Repeat("hello", 300), golden["/hello"])
+	assert.Equal(t, golden, readImageFiles(t, build("native.img", true)))
+}
+
+func TestBuildImageFromManifestNightly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	hello := filepath.Join(dir, "hello")
+	require.NoError(t, ioutil.WriteFile(hello, []byte("hello"), 0755))
+	m, err := ParseManifest(strings.NewReader("(children:(hello:(contents:(host:"+hello+"))) program:/hello)"), "")
+	require.NoError(t, err)
+
+	c := Config{NativeMkfs: true, NightlyBuild: true, NoCache: true}
+	c.RunConfig.Imagename = filepath.Join(dir, "hello.img")
+	require.NoError(t, BuildImageFromManifest(c, m))
+	assert.True(t, m.nightly)
+}
@@ -7,6 +7,9 @@ import (
 type instance struct {
 	Image string   `json:"image"`
 	Ports []string `json:"ports"`
+	// ImagePath is the image the instance boots, a copy in the
+	// instance-images directory is removed with the instance
+	ImagePath string `json:"image_path,omitempty"`
 }
 
 func (in *instance) portList() string {
@@ -0,0 +1,153 @@
+package lepton
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// JavaNotFoundError is returned when no JRE can be found for a jar
+type JavaNotFoundError struct {
+	Home string
+}
+
+func (e *JavaNotFoundError) Error() string {
+	if e.Home == "" {
+		return "no JRE found, please set Java.Home or JAVA_HOME"
+	}
+	return fmt.Sprintf("no JRE found in %s", e.Home)
+}
+
+// defaultJavaOptions are passed before the options of the config, which
+// override them
+var defaultJavaOptions = []string{
+	// the JVM writes performance data to a memory mapped file in /tmp
+	"-XX:-UsePerfData",
+}
+
+// javaFiles are the files of a JRE, relative to its home, that the JVM
+// needs to run an application. Other files of lib are optional.
+var javaFiles = []string{
+	"lib/jvm.cfg",
+	"lib/modules",
+	"lib/server/libjvm.so",
+	"lib/libjava.so",
+	"lib/libjimage.so",
+}
+
+// javaOptionalFiles are added when the JRE has them
+var javaOptionalFiles = []string{
+	"lib/tzdb.dat",
+	"lib/libzip.so",
+	"lib/libnio.so",
+	"lib/libnet.so",
+	"lib/libverify.so",
+	"lib/libextnet.so",
+	"lib/libsunec.so",
+}
+
+// javaDirs are the directories of a JRE, relative to its home, with its
+// security settings and certificates
+var javaDirs = []string{
+	"conf",
+	"lib/security",
+}
+
+// javaApp is a jar run by the java launcher of a JRE
+type javaApp struct {
+	// home of the JRE in the target root
+	home string
+
+	// path of the jar on the host and in the image
+	jar    string
+	vmpath string
+
+	options []string
+}
+
+// findJava locates the JRE that runs the jar of c in the target root or on
+// the host
+func findJava(c *Config) (*javaApp, error) {
+	home := c.Java.Home
+	if home == "" && c.TargetRoot == "" {
+		home = os.Getenv("JAVA_HOME")
+	}
+	if home == "" {
+		java := lookInterpreter(c.TargetRoot, "java")
+		if java == "" {
+			return nil, &JavaNotFoundError{}
+		}
+		resolved, err := resolveImagePath(c.TargetRoot, java)
+		if err != nil {
+			return nil, err
+		}
+		home = path.Dir(path.Dir(resolved))
+	}
+
+	// the JRE of a JDK 8 is in a subdirectory
+	if _, err := lookupFile(c.TargetRoot, path.Join(home, "jre", "bin", "java")); err == nil {
+		home = path.Join(home, "jre")
+	}
+	if _, err := lookupFile(c.TargetRoot, path.Join(home, "bin", "java")); err != nil {
+		return nil, &JavaNotFoundError{Home: home}
+	}
+
+	return &javaApp{
+		home:    home,
+		jar:     c.Java.Jar,
+		vmpath:  path.Join("/", c.Java.Jar),
+		options: append(append([]string{}, defaultJavaOptions...), c.Java.Options...),
+	}, nil
+}
+
+// config returns a copy of c that runs the java launcher of j, with the
+// options and the jar before the arguments of the application
+func (j *javaApp) config(c *Config) *Config {
+	jc := *c
+	jc.Program = path.Join(j.home, "bin", "java")
+	args := append([]string{jc.Program}, j.options...)
+	args = append(args, "-jar", j.vmpath)
+	if len(c.Args) > 1 {
+		args = append(args, c.Args[1:]...)
+	}
+	jc.Args = args
+	return &jc
+}
+
+// addJava adds the jar and the files of the JRE the JVM needs to m, their
+// shared libraries are found with the other ELF files of the image
+func addJava(m *Manifest, c *Config, j *javaApp) error {
+	err := m.AddFile(j.vmpath, j.jar)
+	if err != nil {
+		return err
+	}
+
+	// a JRE 8 has no modules file, its class libraries are jar files all
+	// over lib
+	if _, err := lookupFile(c.TargetRoot, path.Join(j.home, "lib", "modules")); os.IsNotExist(err) {
+		_, err = addTargetDir(m, c.TargetRoot, j.home)
+		return err
+	}
+
+	for _, f := range javaFiles {
+		err := m.AddFile(path.Join(j.home, f), path.Join(j.home, f))
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range javaOptionalFiles {
+		if _, err := lookupFile(c.TargetRoot, path.Join(j.home, f)); err != nil {
+			continue
+		}
+		err := m.AddFile(path.Join(j.home, f), path.Join(j.home, f))
+		if err != nil {
+			return err
+		}
+	}
+	for _, dir := range javaDirs {
+		if _, err := addTargetDir(m, c.TargetRoot, path.Join(j.home, dir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package lepton
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newJavaRoot returns a target root with a JRE in /usr/lib/jvm/java-11 and
+// java on the PATH
+func newJavaRoot(t *testing.T) string {
+	root, err := ioutil.TempDir("", "targetroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	home := filepath.Join(root, "usr/lib/jvm/java-11")
+	for _, f := range []string{"bin/java", "lib/jvm.cfg", "lib/modules", "lib/server/libjvm.so", "lib/libjava.so",
+		"lib/libjimage.so", "lib/libnet.so", "lib/security/cacerts", "conf/security/java.security", "lib/src.zip"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(home, f)), 0755)
+		ioutil.WriteFile(filepath.Join(home, f), []byte(f), 0755)
+	}
+	os.MkdirAll(filepath.Join(root, "usr/bin"), 0755)
+	os.Symlink("/usr/lib/jvm/java-11/bin/java", filepath.Join(root, "usr/bin/java"))
+
+	ioutil.WriteFile(filepath.Join(root, "app.jar"), []byte("PK"), 0644)
+	return root
+}
+
+func TestFindJava(t *testing.T) {
+	root := newJavaRoot(t)
+	defer os.RemoveAll(root)
+
+	c := &Config{TargetRoot: root, Java: JavaConfig{Jar: "/app.jar", Options: []string{"-Xmx512m"}}}
+	j, err := findJava(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/usr/lib/jvm/java-11", j.home)
+
+	jc := j.config(&Config{Args: []string{"app.jar", "--port", "8080"}})
+	assert.Equal(t, "/usr/lib/jvm/java-11/bin/java", jc.Program)
+	assert.Equal(t, []string{"/usr/lib/jvm/java-11/bin/java", "-XX:-UsePerfData", "-Xmx512m", "-jar", "/app.jar", "--port", "8080"}, jc.Args)
+
+	c.Java.Home = "/opt/jdk"
+	_, err = findJava(c)
+	assert.Equal(t, &JavaNotFoundError{Home: "/opt/jdk"}, err)
+}
+
+func TestAddJava(t *testing.T) {
+	root := newJavaRoot(t)
+	defer os.RemoveAll(root)
+
+	c := &Config{TargetRoot: root, Java: JavaConfig{Jar: "/app.jar"}}
+	j, err := findJava(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManifest(root)
+	if err = addJava(m, j.config(c), j); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []string{"/app.jar", "/usr/lib/jvm/java-11/lib/modules", "/usr/lib/jvm/java-11/lib/server/libjvm.so",
+		"/usr/lib/jvm/java-11/lib/libnet.so", "/usr/lib/jvm/java-11/lib/security/cacerts", "/usr/lib/jvm/java-11/conf/security/java.security"} {
+		assert.True(t, m.FileExists(f), f)
+	}
+	assert.False(t, m.FileExists("/usr/lib/jvm/java-11/lib/src.zip"))
+}
@@ -0,0 +1,143 @@
+package lepton
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+const (
+	ntpPollLimitMin = 4
+	ntpPollLimitMax = 17
+)
+
+// klibEnv maps the environment variables that configured klibs before
+// Config.Klibs to the options that replace them
+var klibEnv = map[string]string{
+	"RADAR_KEY":  "Klibs.Radar.Key",
+	"ntpAddress": "Klibs.NTP.Address",
+	"ntpPort":    "Klibs.NTP.Port",
+	"ntpPollMin": "Klibs.NTP.PollMin",
+	"ntpPollMax": "Klibs.NTP.PollMax",
+}
+
+// ListKlibs returns the names of the klibs shipped with the current kernel
+// release
+func ListKlibs(nightly bool) ([]string, error) {
+	dir := getKlibsDir(nightly)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var klibs []string
+	for _, f := range files {
+		if !f.IsDir() {
+			klibs = append(klibs, f.Name())
+		}
+	}
+	return klibs, nil
+}
+
+// validate checks the klib options
+func (k KlibsConfig) validate() error {
+	if k.NTP != nil {
+		if err := k.NTP.validate(); err != nil {
+			return fmt.Errorf("klibs: ntp: %v", err)
+		}
+	}
+	if k.Radar != nil && k.Radar.Key == "" {
+		return fmt.Errorf("klibs: radar: Key is required")
+	}
+	return nil
+}
+
+func (n *NTPKlibConfig) validate() error {
+	if n.Port < 0 || n.Port > 65535 {
+		return fmt.Errorf("invalid Port %d", n.Port)
+	}
+	if n.PollMin != 0 && (n.PollMin < ntpPollLimitMin || n.PollMin > ntpPollLimitMax) {
+		return fmt.Errorf("PollMin %d is not between %d and %d", n.PollMin, ntpPollLimitMin, ntpPollLimitMax)
+	}
+	if n.PollMax != 0 && (n.PollMax < ntpPollLimitMin || n.PollMax > ntpPollLimitMax) {
+		return fmt.Errorf("PollMax %d is not between %d and %d", n.PollMax, ntpPollLimitMin, ntpPollLimitMax)
+	}
+	if n.PollMin != 0 && n.PollMax != 0 && n.PollMin > n.PollMax {
+		return fmt.Errorf("PollMin %d is greater than PollMax %d", n.PollMin, n.PollMax)
+	}
+	return nil
+}
+
+// checkKlibEnv fails for the environment variables that configured klibs
+// before Config.Klibs, unless the klib they configured is set up there, so
+// that existing configs do not silently build images without the klib
+func checkKlibEnv(c *Config) error {
+	names := make([]string, 0, len(c.Env))
+	for name := range c.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		option, ok := klibEnv[name]
+		if !ok {
+			continue
+		}
+		configured := c.Klibs.NTP != nil
+		if name == "RADAR_KEY" {
+			configured = c.Klibs.Radar != nil
+		}
+		if configured {
+			continue
+		}
+		return fmt.Errorf("environment variable %s no longer configures klibs, set %s in the config instead", name, option)
+	}
+	return nil
+}
+
+// addKlibsFromConfig adds the klibs of the configuration with their options
+func addKlibsFromConfig(m *Manifest, c *Config) error {
+	err := c.Klibs.validate()
+	if err != nil {
+		return err
+	}
+
+	err = checkKlibEnv(c)
+	if err != nil {
+		return err
+	}
+
+	m.AddKlibs(c.RunConfig.Klibs)
+
+	if c.Klibs.NTP != nil {
+		m.AddNTPConfig(c.Klibs.NTP)
+	}
+
+	if c.Klibs.Radar != nil {
+		m.AddKlibs([]string{"tls", "radar"})
+		m.AddEnvironmentVariable("RADAR_KEY", c.Klibs.Radar.Key)
+	}
+
+	return nil
+}
+
+// checkKlibs verifies that every klib of the manifest is part of the kernel
+// release
+func (m *Manifest) checkKlibs() error {
+	if len(m.klibs) == 0 {
+		return nil
+	}
+
+	dir := getKlibsDir(m.nightly)
+	for _, klib := range m.klibs {
+		if _, err := os.Stat(path.Join(dir, klib)); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("klib %s not found in %s, see 'ops klib list' for the available klibs", klib, dir)
+			}
+			return err
+		}
+	}
+	return nil
+}
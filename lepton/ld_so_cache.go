@@ -0,0 +1,184 @@
+package lepton
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ldSoCache = "/etc/ld.so.cache"
+	ldSoConf  = "/etc/ld.so.conf"
+
+	// ldSoCacheMagic starts the glibc cache format, which may follow the
+	// entries of the old libc5 format in the same file
+	ldSoCacheMagic = "glibc-ld.so.cache1.1"
+
+	ldSoCacheHeaderSize = 48
+	ldSoCacheEntrySize  = 24
+
+	// flags of cache entries for glibc libraries, with the architecture in
+	// the second byte
+	ldSoCacheFlagELFLibc6   = 0x0003
+	ldSoCacheFlagX8664Lib64 = 0x0300
+	ldSoCacheFlagAArch64    = 0x0a00
+	ldSoCacheFlagMask       = 0xffff
+)
+
+// ldSoCacheFlags returns the flags of ld.so.cache entries for libraries that
+// can be loaded with an ELF file of the given class and machine, or -1 for
+// machines the cache does not know about
+func ldSoCacheFlags(class elf.Class, machine elf.Machine) int {
+	switch {
+	case class == elf.ELFCLASS64 && machine == elf.EM_X86_64:
+		return ldSoCacheFlagELFLibc6 | ldSoCacheFlagX8664Lib64
+	case class == elf.ELFCLASS64 && machine == elf.EM_AARCH64:
+		return ldSoCacheFlagELFLibc6 | ldSoCacheFlagAArch64
+	case class == elf.ELFCLASS32 && machine == elf.EM_386:
+		return ldSoCacheFlagELFLibc6
+	}
+	return -1
+}
+
+// ldSoCacheEntry maps a library soname to its path
+type ldSoCacheEntry struct {
+	flags  int
+	soname string
+	path   string
+}
+
+// readLdSoCache reads the library entries of the ld.so.cache in targetRoot.
+// A missing cache has no entries.
+func readLdSoCache(targetRoot string) ([]ldSoCacheEntry, error) {
+	data, err := ioutil.ReadFile(filepath.Join(targetRoot, ldSoCache))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	entries, err := parseLdSoCache(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Join(targetRoot, ldSoCache), err)
+	}
+	return entries, nil
+}
+
+// parseLdSoCache parses the glibc format of ld.so.cache, string offsets are
+// relative to the start of its header
+func parseLdSoCache(data []byte) ([]ldSoCacheEntry, error) {
+	start := bytes.Index(data, []byte(ldSoCacheMagic))
+	if start < 0 {
+		return nil, fmt.Errorf("unsupported cache format")
+	}
+	data = data[start:]
+	if len(data) < ldSoCacheHeaderSize {
+		return nil, fmt.Errorf("truncated header")
+	}
+
+	order := binary.LittleEndian
+	nlibs := int(order.Uint32(data[len(ldSoCacheMagic):]))
+	if nlibs < 0 || ldSoCacheHeaderSize+nlibs*ldSoCacheEntrySize > len(data) {
+		return nil, fmt.Errorf("truncated entries")
+	}
+
+	str := func(offset uint32) (string, error) {
+		if int(offset) >= len(data) {
+			return "", fmt.Errorf("string offset %d out of range", offset)
+		}
+		s := data[offset:]
+		if end := bytes.IndexByte(s, 0); end >= 0 {
+			s = s[:end]
+		}
+		return string(s), nil
+	}
+
+	entries := make([]ldSoCacheEntry, 0, nlibs)
+	for i := 0; i < nlibs; i++ {
+		e := data[ldSoCacheHeaderSize+i*ldSoCacheEntrySize:]
+		soname, err := str(order.Uint32(e[4:]))
+		if err != nil {
+			return nil, err
+		}
+		path, err := str(order.Uint32(e[8:]))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, ldSoCacheEntry{
+			flags:  int(int32(order.Uint32(e))),
+			soname: soname,
+			path:   path,
+		})
+	}
+	return entries, nil
+}
+
+// readLdSoConf returns the library directories listed in the ld.so.conf of
+// targetRoot and in the files it includes
+func readLdSoConf(targetRoot string) ([]string, error) {
+	var dirs []string
+	err := readLdSoConfFile(targetRoot, ldSoConf, map[string]bool{}, &dirs)
+	return dirs, err
+}
+
+func readLdSoConfFile(targetRoot string, conf string, seen map[string]bool, dirs *[]string) error {
+	if seen[conf] {
+		return nil
+	}
+	seen[conf] = true
+
+	fd, err := os.Open(filepath.Join(targetRoot, conf))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == ',' || r == ':' || r == '='
+		})
+		if len(fields) == 0 || fields[0] == "hwcap" {
+			continue
+		}
+
+		if fields[0] != "include" {
+			*dirs = append(*dirs, fields...)
+			continue
+		}
+
+		for _, pattern := range fields[1:] {
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(conf), pattern)
+			}
+			matches, err := filepath.Glob(filepath.Join(targetRoot, pattern))
+			if err != nil {
+				return fmt.Errorf("%s: %v", conf, err)
+			}
+			for _, match := range matches {
+				rel, err := filepath.Rel(filepath.Join("/", targetRoot), match)
+				if err != nil {
+					return err
+				}
+				if err := readLdSoConfFile(targetRoot, filepath.Join("/", rel), seen, dirs); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return scanner.Err()
+}
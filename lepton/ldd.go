@@ -0,0 +1,642 @@
+package lepton
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// LibraryNotFoundError is returned when a shared library needed by an ELF
+// file can not be found in the target root
+type LibraryNotFoundError struct {
+	Library  string
+	NeededBy string
+}
+
+func (e *LibraryNotFoundError) Error() string {
+	return fmt.Sprintf("library %s needed by %s not found", e.Library, e.NeededBy)
+}
+
+// NotELFError is returned when the program of an image is not an ELF binary
+type NotELFError struct {
+	Path string
+}
+
+func (e *NotELFError) Error() string {
+	return fmt.Sprintf("only ELF binaries are supported, is %s a Linux binary? run 'file %s' on it", e.Path, e.Path)
+}
+
+// GetElfFileInfo returns an object with elf information of the path program
+func GetElfFileInfo(path string) (*elf.File, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	efd, err := elf.NewFile(fd)
+	if err != nil {
+		return nil, err
+	}
+	return efd, nil
+}
+
+// HasDebuggingSymbols checks whether elf file has debugging symbols
+func HasDebuggingSymbols(efd *elf.File) bool {
+	for _, phdr := range efd.Sections {
+		if strings.Compare(phdr.Name, ".debug_info") == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsDynamicLinked checks whether elf file was linked dynamically
+func IsDynamicLinked(efd *elf.File) bool {
+	for _, phdr := range efd.Progs {
+		if phdr.Type == elf.PT_DYNAMIC {
+			return true
+		}
+	}
+
+	return false
+}
+
+// elfObject is an ELF file the dynamic loader loads
+type elfObject struct {
+	// path of the file in the image
+	path string
+
+	// origin is the directory $ORIGIN expands to
+	origin string
+
+	interp  string
+	needed  []string
+	rpath   []string
+	runpath []string
+
+	// loader is the object that needed this one, its RPATH applies to the
+	// libraries this one needs when it has no RUNPATH
+	loader *elfObject
+
+	// inImage is set for files that are in the image already
+	inImage bool
+	// outside is set for files found on the host because the target root
+	// does not have them
+	outside bool
+}
+
+// elfResolver finds the shared libraries of an ELF program the way the
+// dynamic loader of the target root does, without running the program
+type elfResolver struct {
+	targetRoot string
+	class      elf.Class
+	machine    elf.Machine
+	// lib is the value of $LIB, see libDir
+	lib string
+
+	// ldLibraryPathEnv is the LD_LIBRARY_PATH of the program in the image
+	ldLibraryPathEnv string
+
+	ldLibraryPath []string
+	cache         map[string]string
+	confDirs      []string
+
+	// image returns the host path of a file in the image, these are found
+	// before the files of the target root
+	image func(path string) (string, bool)
+
+	// loaded maps the sonames of loaded libraries to their paths
+	loaded map[string]string
+	added  map[string]bool
+	// libs are the libraries to add to the image, in load order
+	libs []*elfObject
+
+	// keepGoing records the libraries that can not be found in missing
+	// instead of failing
+	keepGoing bool
+	missing   []*LibraryNotFoundError
+}
+
+func newELFResolver(targetRoot string) (*elfResolver, error) {
+	r := &elfResolver{
+		targetRoot: targetRoot,
+		loaded:     map[string]string{},
+		added:      map[string]bool{},
+	}
+	if targetRoot != "" {
+		root, err := filepath.Abs(targetRoot)
+		if err != nil {
+			return nil, err
+		}
+		r.targetRoot = root
+	}
+	return r, nil
+}
+
+// getSharedLibs returns the dynamic loader and the shared libraries the ELF
+// program at path loads, in load order
+func getSharedLibs(targetRoot string, path string) ([]string, error) {
+	r, err := newELFResolver(targetRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	program, err := r.openProgram(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.load(program, path); err != nil {
+		return nil, err
+	}
+	return r.imageLibs(), nil
+}
+
+// addSharedLibs adds the dynamic loader and the shared libraries of the
+// program to m, along with the libraries c.Dlopen names and the ones the
+// other ELF files in m need. Libraries that are in m already are not added
+// again. Statically linked programs can not load libraries, only the ELF
+// files in m get theirs.
+func addSharedLibs(m *Manifest, c *Config) error {
+	r, err := newELFResolver(c.TargetRoot)
+	if err != nil {
+		return err
+	}
+	r.image = m.hostFile
+	r.keepGoing = m.sources.keepGoing
+	r.ldLibraryPathEnv = c.Env["LD_LIBRARY_PATH"]
+
+	program, err := r.openProgram(c.Program)
+	if err != nil {
+		return err
+	}
+	if program.interp == "" && len(program.needed) == 0 {
+		if len(c.Dlopen) > 0 {
+			return fmt.Errorf("%s is linked statically and can not load the Dlopen libraries %s", c.Program, strings.Join(c.Dlopen, ", "))
+		}
+		if err = r.readSearchPaths(); err != nil {
+			return err
+		}
+	} else if err = r.load(program, c.Program); err != nil {
+		return err
+	}
+
+	// libraries loaded with dlopen are searched from the program
+	dlopen := map[*elfObject]bool{}
+	for _, name := range c.Dlopen {
+		lib, err := r.search(name, program)
+		if err != nil {
+			return err
+		}
+		if lib == nil {
+			if !r.keepGoing {
+				return &LibraryNotFoundError{Library: name, NeededBy: c.Program}
+			}
+			r.missing = append(r.missing, &LibraryNotFoundError{Library: name, NeededBy: program.path})
+			continue
+		}
+		dlopen[lib] = true
+		r.add(name, lib)
+		if err = r.load(lib, lib.path); err != nil {
+			return err
+		}
+	}
+
+	// other ELF files in the image are plugins or helpers the program
+	// loads, a library they need that can not be found fails only them
+	err = walkFiles(m.children, "", func(vmpath string, node interface{}) error {
+		hostpath, ok := node.(string)
+		if !ok || vmpath == m.program || r.added[vmpath] {
+			return nil
+		}
+		obj, err := r.openImageFile(vmpath, hostpath)
+		if obj == nil || err != nil {
+			return err
+		}
+		r.added[vmpath] = true
+
+		err = r.load(obj, vmpath)
+		if _, ok := err.(*LibraryNotFoundError); ok {
+			fmt.Printf("warning: %v\n", err)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	imagePath := func(path string) string {
+		if path == program.path {
+			return m.program
+		}
+		return cleanImagePath(libPath(path))
+	}
+	for _, lib := range r.libs {
+		m.setSource("")
+		if dlopen[lib] {
+			m.setSource("Dlopen")
+		} else if lib.loader != nil {
+			m.sources.neededBy[imagePath(lib.path)] = imagePath(lib.loader.path)
+		}
+		if lib.outside {
+			m.sources.outside[imagePath(lib.path)] = true
+		}
+		if err = m.AddLibrary(libPath(lib.path)); err != nil {
+			return err
+		}
+	}
+	for _, e := range r.missing {
+		m.sources.missing = append(m.sources.missing, &LibraryNotFoundError{Library: e.Library, NeededBy: imagePath(e.NeededBy)})
+	}
+	return nil
+}
+
+// imageLibs returns the paths the libraries are added at
+func (r *elfResolver) imageLibs() []string {
+	var libs []string
+	for _, lib := range r.libs {
+		libs = append(libs, libPath(lib.path))
+	}
+	return libs
+}
+
+// libPath returns the path the library at path is added at, libraries next
+// to the program are added at the same relative path
+func libPath(path string) string {
+	dir, _ := os.Getwd()
+	if strings.HasPrefix(path, dir+"/") {
+		return path[len(dir)+1:]
+	}
+	return path
+}
+
+// openProgram reads the program at path, the libraries it loads must be
+// built for the same class and machine
+func (r *elfResolver) openProgram(path string) (*elfObject, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	hostPath, err := lookupFile(r.targetRoot, abs)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, path, 0)
+	}
+
+	fd, err := elf.Open(hostPath)
+	if err != nil {
+		if _, ok := err.(*elf.FormatError); ok {
+			return nil, &NotELFError{Path: path}
+		}
+		return nil, errors.WrapPrefix(err, path, 0)
+	}
+	r.class = fd.Class
+	r.machine = fd.Machine
+	program, err := readELFObject(fd, abs)
+	fd.Close()
+	if err != nil {
+		return nil, errors.WrapPrefix(err, path, 0)
+	}
+
+	if program.interp == "" && len(program.needed) == 0 {
+		return program, nil
+	}
+	if err = r.readSearchPaths(); err != nil {
+		return nil, err
+	}
+	return program, nil
+}
+
+// openImageFile reads the file at vmpath in the image when it is a
+// dynamically linked ELF file built for the machine of the program, and
+// returns nil otherwise
+func (r *elfResolver) openImageFile(vmpath string, hostpath string) (*elfObject, error) {
+	hostPath, err := lookupFile(r.targetRoot, hostpath)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, vmpath, 0)
+	}
+	fd, err := elf.Open(hostPath)
+	if err != nil {
+		return nil, nil
+	}
+	defer fd.Close()
+	if fd.Class != r.class || fd.Machine != r.machine || !IsDynamicLinked(fd) {
+		return nil, nil
+	}
+
+	obj, err := readELFObject(fd, vmpath)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, vmpath, 0)
+	}
+	obj.inImage = true
+	return obj, nil
+}
+
+// load loads the interpreter of obj and the libraries it needs, breadth
+// first and each soname once. neededBy names obj in errors.
+func (r *elfResolver) load(obj *elfObject, neededBy string) error {
+	if obj.interp != "" {
+		if _, ok := r.loaded[filepath.Base(obj.interp)]; !ok {
+			interp, err := r.open(obj.interp, obj)
+			if err != nil {
+				return err
+			}
+			if interp == nil {
+				if !r.keepGoing {
+					return &LibraryNotFoundError{Library: obj.interp, NeededBy: neededBy}
+				}
+				r.missing = append(r.missing, &LibraryNotFoundError{Library: obj.interp, NeededBy: obj.path})
+			} else {
+				r.add(filepath.Base(interp.path), interp)
+			}
+		}
+	}
+
+	queue := []*elfObject{obj}
+	for len(queue) > 0 {
+		o := queue[0]
+		queue = queue[1:]
+
+		for _, name := range o.needed {
+			if _, ok := r.loaded[name]; ok {
+				continue
+			}
+
+			lib, err := r.search(name, o)
+			if err != nil {
+				return err
+			}
+			if lib == nil {
+				if r.keepGoing {
+					r.missing = append(r.missing, &LibraryNotFoundError{Library: name, NeededBy: o.path})
+					continue
+				}
+				if o != obj {
+					neededBy = o.path
+				}
+				return &LibraryNotFoundError{Library: name, NeededBy: neededBy}
+			}
+
+			if r.add(name, lib) {
+				queue = append(queue, lib)
+			}
+		}
+	}
+	return nil
+}
+
+// add records lib as loaded for name and returns whether it was not
+// loaded before
+func (r *elfResolver) add(name string, lib *elfObject) bool {
+	r.loaded[name] = lib.path
+	if r.added[lib.path] {
+		return false
+	}
+	r.added[lib.path] = true
+	if !lib.inImage {
+		r.libs = append(r.libs, lib)
+	}
+	return true
+}
+
+// readSearchPaths reads the LD_LIBRARY_PATH of the program and the
+// ld.so.cache and ld.so.conf of the target root
+func (r *elfResolver) readSearchPaths() error {
+	if val := strings.TrimSpace(r.ldLibraryPathEnv); val != "" {
+		r.ldLibraryPath = splitSearchPath(val)
+	}
+
+	entries, err := readLdSoCache(r.targetRoot)
+	if err != nil {
+		return err
+	}
+	flags := ldSoCacheFlags(r.class, r.machine)
+	r.cache = map[string]string{}
+	for _, e := range entries {
+		if e.flags&ldSoCacheFlagMask != flags {
+			continue
+		}
+		if _, ok := r.cache[e.soname]; !ok {
+			r.cache[e.soname] = e.path
+		}
+	}
+
+	r.confDirs, err = readLdSoConf(r.targetRoot)
+	return err
+}
+
+// search looks for the library name needed by obj in the directories the
+// dynamic loader searches, in order: the RPATH of obj and of the objects
+// that loaded it when obj has no RUNPATH, LD_LIBRARY_PATH, the RUNPATH of
+// obj, ld.so.cache, the directories of ld.so.conf and the default
+// directories. It returns nil when the library is not found.
+func (r *elfResolver) search(name string, obj *elfObject) (*elfObject, error) {
+	if strings.Contains(name, "/") {
+		return r.open(r.expand(name, obj), obj)
+	}
+
+	var dirs []string
+	if len(obj.runpath) == 0 {
+		for o := obj; o != nil; o = o.loader {
+			if len(o.runpath) == 0 {
+				dirs = append(dirs, r.expandAll(o.rpath, o)...)
+			}
+		}
+	}
+	dirs = append(dirs, r.ldLibraryPath...)
+	dirs = append(dirs, r.expandAll(obj.runpath, obj)...)
+
+	for _, dir := range dirs {
+		lib, err := r.open(filepath.Join(dir, name), obj)
+		if lib != nil || err != nil {
+			return lib, err
+		}
+	}
+
+	if path, ok := r.cache[name]; ok {
+		lib, err := r.open(path, obj)
+		if lib != nil || err != nil {
+			return lib, err
+		}
+	}
+
+	for _, dir := range append(r.confDirs, r.defaultDirs()...) {
+		lib, err := r.open(filepath.Join(dir, name), obj)
+		if lib != nil || err != nil {
+			return lib, err
+		}
+	}
+	return nil, nil
+}
+
+// open reads the ELF file at path in the image or the target root. It
+// returns nil when the file does not exist or is not built for the machine
+// of the program, the dynamic loader skips these as well.
+func (r *elfResolver) open(path string, loader *elfObject) (*elfObject, error) {
+	path = filepath.Clean(path)
+	hostPath, inImage := path, false
+	if r.image != nil {
+		if p, ok := r.image(path); ok {
+			hostPath, inImage = p, true
+		}
+	}
+	hostPath, err := lookupFile(r.targetRoot, hostPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WrapPrefix(err, path, 0)
+	}
+
+	fd, err := elf.Open(hostPath)
+	if err != nil {
+		return nil, nil
+	}
+	defer fd.Close()
+	if fd.Class != r.class || fd.Machine != r.machine {
+		return nil, nil
+	}
+
+	obj, err := readELFObject(fd, path)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, path, 0)
+	}
+	obj.loader = loader
+	obj.inImage = inImage
+	obj.outside = !inImage && r.targetRoot != "" && !strings.HasPrefix(hostPath, r.targetRoot+"/")
+	return obj, nil
+}
+
+// readELFObject reads the dynamic section and the interpreter of the ELF
+// file at path
+func readELFObject(fd *elf.File, path string) (*elfObject, error) {
+	obj := &elfObject{path: path, origin: filepath.Dir(path)}
+
+	for _, prog := range fd.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		data := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(data, 0); err != nil {
+			return nil, err
+		}
+		obj.interp = strings.TrimRight(string(data), "\x00")
+	}
+
+	if !IsDynamicLinked(fd) {
+		return obj, nil
+	}
+
+	var err error
+	if obj.needed, err = fd.DynString(elf.DT_NEEDED); err != nil {
+		return nil, err
+	}
+	rpath, err := fd.DynString(elf.DT_RPATH)
+	if err != nil {
+		return nil, err
+	}
+	runpath, err := fd.DynString(elf.DT_RUNPATH)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range rpath {
+		obj.rpath = append(obj.rpath, splitSearchPath(p)...)
+	}
+	for _, p := range runpath {
+		obj.runpath = append(obj.runpath, splitSearchPath(p)...)
+	}
+	return obj, nil
+}
+
+// splitSearchPath splits a colon separated list of directories, an empty
+// entry is the current directory
+func splitSearchPath(s string) []string {
+	dirs := strings.Split(s, ":")
+	for i, d := range dirs {
+		if d == "" {
+			dirs[i] = "."
+		}
+	}
+	return dirs
+}
+
+func (r *elfResolver) expandAll(dirs []string, obj *elfObject) []string {
+	expanded := make([]string, len(dirs))
+	for i, d := range dirs {
+		expanded[i] = r.expand(d, obj)
+	}
+	return expanded
+}
+
+// expand replaces the $ORIGIN, $LIB and $PLATFORM tokens of a search path
+func (r *elfResolver) expand(s string, obj *elfObject) string {
+	platform := ""
+	switch r.machine {
+	case elf.EM_X86_64:
+		platform = "x86_64"
+	case elf.EM_AARCH64:
+		platform = "aarch64"
+	case elf.EM_386:
+		platform = "i686"
+	}
+
+	for token, value := range map[string]string{
+		"ORIGIN":   obj.origin,
+		"LIB":      r.libDir(),
+		"PLATFORM": platform,
+	} {
+		s = strings.Replace(s, "${"+token+"}", value, -1)
+		s = strings.Replace(s, "$"+token, value, -1)
+	}
+	return s
+}
+
+// libDir returns the value of $LIB, which depends on how the loader of the
+// target root was built: the multiarch directory on Debian based systems,
+// lib64 on other 64-bit systems and lib otherwise
+func (r *elfResolver) libDir() string {
+	if r.lib != "" {
+		return r.lib
+	}
+	r.lib = "lib"
+	if r.class == elf.ELFCLASS64 {
+		r.lib = "lib64"
+	}
+	if triplet := multiarchTriplet(r.machine); triplet != "" {
+		dir := filepath.Join("lib", triplet)
+		if fi, err := os.Stat(filepath.Join(r.targetRoot, "/", dir)); err == nil && fi.IsDir() {
+			r.lib = dir
+		}
+	}
+	return r.lib
+}
+
+// multiarchTriplet returns the name of the multiarch directories of Debian
+// based systems for machine
+func multiarchTriplet(machine elf.Machine) string {
+	switch machine {
+	case elf.EM_X86_64:
+		return "x86_64-linux-gnu"
+	case elf.EM_AARCH64:
+		return "aarch64-linux-gnu"
+	case elf.EM_386:
+		return "i386-linux-gnu"
+	}
+	return ""
+}
+
+// defaultDirs returns the directories the dynamic loader searches last, the
+// multiarch directories of Debian based systems come first
+func (r *elfResolver) defaultDirs() []string {
+	var dirs []string
+	if triplet := multiarchTriplet(r.machine); triplet != "" {
+		dirs = append(dirs, "/lib/"+triplet, "/usr/lib/"+triplet)
+	}
+	if r.class == elf.ELFCLASS64 {
+		dirs = append(dirs, "/lib64", "/usr/lib64")
+	}
+	return append(dirs, "/lib", "/usr/lib")
+}
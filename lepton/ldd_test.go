@@ -1,8 +1,16 @@
 package lepton
 
 import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestGetSharedLibs(t *testing.T) {
@@ -25,3 +33,280 @@ func TestGetSharedLibsSystemLs(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// dynamicSystemLs returns the loader and libraries of the host /bin/ls, or
+// skips the test when it is not a dynamically linked x86_64 binary
+func dynamicSystemLs(t *testing.T) []string {
+	fd, err := elf.Open("/bin/ls")
+	if err != nil {
+		t.Skip("could not open /bin/ls:", err)
+	}
+	defer fd.Close()
+	if fd.Machine != elf.EM_X86_64 || !IsDynamicLinked(fd) {
+		t.Skip("/bin/ls is not a dynamically linked x86_64 binary")
+	}
+
+	libs, err := getSharedLibs("", "/bin/ls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return libs
+}
+
+func TestGetSharedLibsLoader(t *testing.T) {
+	libs := dynamicSystemLs(t)
+
+	assert.Equal(t, "/lib64/ld-linux-x86-64.so.2", libs[0])
+	var libc bool
+	for _, lib := range libs {
+		libc = libc || filepath.Base(lib) == "libc.so.6"
+	}
+	assert.True(t, libc, "libc.so.6 in %v", libs)
+}
+
+// newTargetRoot copies /bin/ls and its libraries to a target root that
+// keeps the libraries in a directory the host does not search, listed in an
+// included ld.so.conf file. It returns the root and the paths of the
+// libraries in it.
+func newTargetRoot(t *testing.T, libs []string) (string, []string) {
+	root, err := ioutil.TempDir("", "targetroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copyFile := func(src, dst string) {
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst = filepath.Join(root, dst)
+		os.MkdirAll(filepath.Dir(dst), 0755)
+		if err := ioutil.WriteFile(dst, data, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	copyFile("/bin/ls", "/bin/ls")
+	copyFile(libs[0], libs[0])
+	targetLibs := []string{libs[0]}
+	for _, lib := range libs[1:] {
+		copyFile(lib, filepath.Join("/opt/target/lib", filepath.Base(lib)))
+		targetLibs = append(targetLibs, filepath.Join("/opt/target/lib", filepath.Base(lib)))
+	}
+	os.MkdirAll(filepath.Join(root, "etc/ld.so.conf.d"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "etc/ld.so.conf"), []byte("include /etc/ld.so.conf.d/*.conf\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "etc/ld.so.conf.d/target.conf"), []byte("# target libraries\n/opt/target/lib\n"), 0644)
+	return root, targetLibs
+}
+
+func TestGetSharedLibsTargetRoot(t *testing.T) {
+	root, expected := newTargetRoot(t, dynamicSystemLs(t))
+	defer os.RemoveAll(root)
+
+	targetLibs, err := getSharedLibs(root, "/bin/ls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, targetLibs)
+}
+
+// libcProgram returns the path of libc in the target root, which is
+// executable and only needs the loader, or skips the test
+func libcProgram(t *testing.T, root string, libs []string) string {
+	for _, lib := range libs {
+		if filepath.Base(lib) != "libc.so.6" {
+			continue
+		}
+		needed, err := getSharedLibs(root, lib)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(needed) != 1 {
+			t.Skip("libc.so.6 is not executable")
+		}
+		return lib
+	}
+	t.Skip("no libc.so.6 in", libs)
+	return ""
+}
+
+func TestAddSharedLibsImageFiles(t *testing.T) {
+	root, libs := newTargetRoot(t, dynamicSystemLs(t))
+	defer os.RemoveAll(root)
+	program := libcProgram(t, root, libs)
+
+	m := NewManifest(root)
+	m.AddUserProgram(program)
+	// ls is a helper in the image, the libraries it needs are added too
+	m.AddFile("/app/ls", filepath.Join(root, "bin/ls"))
+	err := addSharedLibs(m, &Config{TargetRoot: root, Program: program})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, lib := range libs {
+		assert.True(t, m.FileExists(lib), lib)
+	}
+}
+
+func TestAddSharedLibsDlopen(t *testing.T) {
+	root, libs := newTargetRoot(t, dynamicSystemLs(t))
+	defer os.RemoveAll(root)
+	program := libcProgram(t, root, libs)
+
+	var dlopen string
+	for _, lib := range libs {
+		if lib != program && !strings.HasPrefix(filepath.Base(lib), "ld-") {
+			dlopen = lib
+			break
+		}
+	}
+
+	m := NewManifest(root)
+	m.AddUserProgram(program)
+	err := addSharedLibs(m, &Config{TargetRoot: root, Program: program, Dlopen: []string{filepath.Base(dlopen)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, m.FileExists(dlopen), dlopen)
+
+	err = addSharedLibs(m, &Config{TargetRoot: root, Program: program, Dlopen: []string{"libmissing.so.1"}})
+	assert.Equal(t, &LibraryNotFoundError{Library: "libmissing.so.1", NeededBy: program}, err)
+}
+
+func TestAddSharedLibsLdLibraryPath(t *testing.T) {
+	root, libs := newTargetRoot(t, dynamicSystemLs(t))
+	defer os.RemoveAll(root)
+	os.Remove(filepath.Join(root, "etc/ld.so.conf.d/target.conf"))
+
+	// the LD_LIBRARY_PATH of the host does not apply to the image
+	os.Setenv("LD_LIBRARY_PATH", "/opt/target/lib")
+	defer os.Unsetenv("LD_LIBRARY_PATH")
+	m := NewManifest(root)
+	m.AddUserProgram("/bin/ls")
+	if err := addSharedLibs(m, &Config{TargetRoot: root, Program: "/bin/ls"}); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, m.FileExists(libs[1]), libs[1])
+
+	m = NewManifest(root)
+	m.AddUserProgram("/bin/ls")
+	c := &Config{TargetRoot: root, Program: "/bin/ls", Env: map[string]string{"LD_LIBRARY_PATH": "/opt/target/lib"}}
+	if err := addSharedLibs(m, c); err != nil {
+		t.Fatal(err)
+	}
+	for _, lib := range libs {
+		assert.True(t, m.FileExists(lib), lib)
+	}
+}
+
+func TestAddSharedLibsStaticProgram(t *testing.T) {
+	libs := dynamicSystemLs(t)
+	dir := newGoModule(t)
+	defer os.RemoveAll(dir)
+	g, err := buildGoProgram(&Config{Go: GoConfig{Package: filepath.Join(dir, "cmd", "server")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(g.binary)
+
+	// the libraries of the ELF files in the image are added all the same
+	m := NewManifest("")
+	m.AddUserProgram(g.binary)
+	m.AddFile("/app/ls", "/bin/ls")
+	if err = addSharedLibs(m, &Config{Program: g.binary}); err != nil {
+		t.Fatal(err)
+	}
+	for _, lib := range libs {
+		assert.True(t, m.FileExists(lib), lib)
+	}
+
+	err = addSharedLibs(NewManifest(""), &Config{Program: g.binary, Dlopen: []string{"libc.so.6"}})
+	assert.EqualError(t, err, g.binary+" is linked statically and can not load the Dlopen libraries libc.so.6")
+}
+
+func TestGetSharedLibsNotELF(t *testing.T) {
+	fd, err := ioutil.TempFile("", "script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("#!/bin/sh\necho hello\n")
+	fd.Close()
+
+	_, err = getSharedLibs("", fd.Name())
+	_, ok := err.(*NotELFError)
+	assert.True(t, ok, "%v", err)
+}
+
+func TestParseLdSoCache(t *testing.T) {
+	var strs bytes.Buffer
+	strOffset := func(s string) uint32 {
+		offset := ldSoCacheHeaderSize + 3*ldSoCacheEntrySize + strs.Len()
+		strs.WriteString(s + "\x00")
+		return uint32(offset)
+	}
+
+	type entry struct {
+		flags        int32
+		soname, path string
+	}
+	entries := []entry{
+		{0x0303, "libc.so.6", "/lib/x86_64-linux-gnu/libc.so.6"},
+		{0x0003, "libc.so.6", "/lib/i386-linux-gnu/libc.so.6"},
+		{0x0a03, "libz.so.1", "/lib/aarch64-linux-gnu/libz.so.1"},
+	}
+
+	var data bytes.Buffer
+	// entries of the old format come before the glibc format
+	data.WriteString("ld.so-1.7.0\x00\x00\x00\x00\x00")
+	start := data.Len()
+	data.WriteString(ldSoCacheMagic)
+	binary.Write(&data, binary.LittleEndian, uint32(len(entries)))
+	data.Write(make([]byte, ldSoCacheHeaderSize-len(ldSoCacheMagic)-4))
+	for _, e := range entries {
+		binary.Write(&data, binary.LittleEndian, e.flags)
+		binary.Write(&data, binary.LittleEndian, strOffset(e.soname))
+		binary.Write(&data, binary.LittleEndian, strOffset(e.path))
+		data.Write(make([]byte, ldSoCacheEntrySize-12))
+	}
+	assert.Equal(t, start+ldSoCacheHeaderSize+3*ldSoCacheEntrySize, data.Len())
+	data.Write(strs.Bytes())
+
+	parsed, err := parseLdSoCache(data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []ldSoCacheEntry{
+		{0x0303, "libc.so.6", "/lib/x86_64-linux-gnu/libc.so.6"},
+		{0x0003, "libc.so.6", "/lib/i386-linux-gnu/libc.so.6"},
+		{0x0a03, "libz.so.1", "/lib/aarch64-linux-gnu/libz.so.1"},
+	}, parsed)
+
+	assert.Equal(t, 0x0303, ldSoCacheFlags(elf.ELFCLASS64, elf.EM_X86_64))
+	assert.Equal(t, 0x0a03, ldSoCacheFlags(elf.ELFCLASS64, elf.EM_AARCH64))
+
+	_, err = parseLdSoCache(data.Bytes()[:start+ldSoCacheHeaderSize+10])
+	assert.Error(t, err)
+}
+
+func TestExpandSearchPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "target-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	r := &elfResolver{targetRoot: root, class: elf.ELFCLASS64, machine: elf.EM_X86_64}
+	obj := &elfObject{origin: "/opt/app/bin"}
+
+	assert.Equal(t, "/opt/app/bin/../lib", r.expand("$ORIGIN/../lib", obj))
+	assert.Equal(t, "/opt/app/bin/plugins", r.expand("${ORIGIN}/plugins", obj))
+	assert.Equal(t, "/usr/lib64/x86_64", r.expand("/usr/$LIB/$PLATFORM", obj))
+
+	// $LIB is the multiarch directory in Debian based target roots
+	os.MkdirAll(filepath.Join(root, "lib/x86_64-linux-gnu"), 0755)
+	r = &elfResolver{targetRoot: root, class: elf.ELFCLASS64, machine: elf.EM_X86_64}
+	assert.Equal(t, "/opt/lib/x86_64-linux-gnu/app", r.expand("/opt/$LIB/app", obj))
+	assert.Equal(t, []string{"/opt/lib", ".", "/usr/lib"}, splitSearchPath("/opt/lib::/usr/lib"))
+}
@@ -5,9 +5,9 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"reflect"
-	"strconv"
+	"sort"
 	"strings"
+	"time"
 )
 
 var localManifestDir = path.Join(GetOpsHome(), "manifests")
@@ -17,11 +17,36 @@ type link struct {
 	path string
 }
 
+// inlineFile refers to a file whose contents are written in the manifest
+// instead of being read from the host
+type inlineFile struct {
+	contents []byte
+}
+
+// fileMetadata holds the mode, owner and modification time recorded for a
+// file in the image
+type fileMetadata struct {
+	mode  os.FileMode
+	uid   int
+	gid   int
+	mtime time.Time
+}
+
+// isDir checks whether a manifest node is a directory
+func isDir(node interface{}) bool {
+	_, ok := node.(map[string]interface{})
+	return ok
+}
+
 // ManifestNetworkConfig has network configuration to set static IP
 type ManifestNetworkConfig struct {
-	IP      string
-	Gateway string
-	NetMask string
+	IP          string
+	Gateway     string
+	NetMask     string
+	IPv6        string
+	IPv6Prefix  int
+	IPv6Gateway string
+	MTU         int
 }
 
 // Manifest represent the filesystem.
@@ -30,6 +55,7 @@ type Manifest struct {
 	children      map[string]interface{} // root fs
 	boot          map[string]interface{} // boot fs
 	program       string
+	cwd           string
 	args          []string
 	debugFlags    map[string]rune
 	noTrace       []string
@@ -39,6 +65,12 @@ type Manifest struct {
 	klibs         []string
 	nightly       bool
 	networkConfig *ManifestNetworkConfig
+	interfaces    []*ManifestNetworkConfig
+	ntp           *NTPKlibConfig
+	metadata      map[string]fileMetadata // file metadata by image path
+	exclude       []string                // exclude patterns of directory walks
+	include       []string                // include globs of directory walks
+	sources       fileSources             // why files are in the image
 }
 
 // NewManifest init
@@ -50,6 +82,8 @@ func NewManifest(targetRoot string) *Manifest {
 		environment: make(map[string]string),
 		targetRoot:  targetRoot,
 		mounts:      make(map[string]string),
+		metadata:    make(map[string]fileMetadata),
+		sources:     newFileSources(),
 	}
 }
 
@@ -58,17 +92,25 @@ func (m *Manifest) AddNetworkConfig(networkConfig *ManifestNetworkConfig) {
 	m.networkConfig = networkConfig
 }
 
+// AddInterface adds the configuration of the next network interface. The
+// first interface is en1.
+func (m *Manifest) AddInterface(iface *ManifestNetworkConfig) {
+	m.interfaces = append(m.interfaces, iface)
+}
+
 // AddUserProgram adds user program
-func (m *Manifest) AddUserProgram(imgpath string) {
+func (m *Manifest) AddUserProgram(imgpath string) error {
 	parts := strings.Split(imgpath, "/")
 	if parts[0] == "." {
 		parts = parts[1:]
 	}
-	m.program = path.Join("/", path.Join(parts...))
-	err := m.AddFile(m.program, imgpath)
-	if err != nil {
-		panic(err)
-	}
+	return m.addProgram(path.Join("/", path.Join(parts...)), imgpath)
+}
+
+// addProgram adds the user program at vmpath
+func (m *Manifest) addProgram(vmpath string, hostpath string) error {
+	m.program = cleanImagePath(vmpath)
+	return m.AddFile(m.program, hostpath)
 }
 
 // AddMount adds mount
@@ -81,11 +123,6 @@ func (m *Manifest) AddMount(label, path string) {
 // AddEnvironmentVariable adds environment variables
 func (m *Manifest) AddEnvironmentVariable(name string, value string) {
 	m.environment[name] = value
-
-	if name == "RADAR_KEY" {
-		m.AddKlibs([]string{"tls", "radar"})
-	}
-
 }
 
 // AddKlibs append klibs to manifest file if they don't exist
@@ -105,6 +142,17 @@ func (m *Manifest) AddKlibs(klibs []string) {
 	}
 }
 
+// AddNTPConfig loads the ntp klib with the given options
+func (m *Manifest) AddNTPConfig(ntp *NTPKlibConfig) {
+	m.AddKlibs([]string{"ntp"})
+	m.ntp = ntp
+}
+
+// SetWorkingDirectory sets the directory the program starts in
+func (m *Manifest) SetWorkingDirectory(dir string) {
+	m.cwd = dir
+}
+
 // AddArgument add commandline arguments to
 // user program
 func (m *Manifest) AddArgument(arg string) {
@@ -121,11 +169,15 @@ func (m *Manifest) AddNoTrace(name string) {
 	m.noTrace = append(m.noTrace, name)
 }
 
-// AddKernel the kernel to use
+// AddKernel the kernel to use, other files of the boot filesystem are kept
 func (m *Manifest) AddKernel(path string) {
-	node := make(map[string]interface{})
-	node["kernel"] = path
-	m.boot = node
+	m.boot["kernel"] = path
+}
+
+// HasKernel reports whether the boot filesystem has a kernel
+func (m *Manifest) HasKernel() bool {
+	_, ok := m.boot["kernel"]
+	return ok
 }
 
 // AddRelative path
@@ -133,13 +185,29 @@ func (m *Manifest) AddRelative(key string, path string) {
 	m.children[key] = path
 }
 
+// SetFileFilter sets the gitignore-style exclude patterns and the include
+// globs applied, along with .opsignore files, when adding directories
+func (m *Manifest) SetFileFilter(exclude []string, include []string) {
+	m.exclude = exclude
+	m.include = include
+}
+
 // AddDirectory adds all files in dir to image
 func (m *Manifest) AddDirectory(dir string) error {
-	err := filepath.Walk(dir, func(hostpath string, info os.FileInfo, err error) error {
+	filter, err := newFileFilter(dir, m.exclude, m.include)
+	if err != nil {
+		return err
+	}
+
+	err = filepath.Walk(dir, func(hostpath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
+		if skip, err := filter.skipPath(dir, hostpath, info); skip || err != nil {
+			return err
+		}
+
 		// if the path is relative then root it to image path
 		var vmpath string
 		if hostpath[0] != '/' {
@@ -167,17 +235,9 @@ func (m *Manifest) AddDirectory(dir string) error {
 
 		if info.IsDir() {
 			parts := strings.FieldsFunc(vmpath, func(c rune) bool { return c == '/' })
-			node := m.children
-			for i := 0; i < len(parts); i++ {
-				if _, ok := node[parts[i]]; !ok {
-					node[parts[i]] = make(map[string]interface{})
-				}
-				if reflect.TypeOf(node[parts[i]]).Kind() == reflect.String {
-					err := fmt.Errorf("directory %s is conflicting with an existing file", hostpath)
-					fmt.Println(err)
-					return err
-				}
-				node = node[parts[i]].(map[string]interface{})
+			_, err = m.mkdirAll(parts, hostpath)
+			if err != nil {
+				return err
 			}
 		} else {
 			err = m.AddFile(vmpath, hostpath)
@@ -193,11 +253,20 @@ func (m *Manifest) AddDirectory(dir string) error {
 
 // AddRelativeDirectory adds all files in dir to image
 func (m *Manifest) AddRelativeDirectory(src string) error {
-	err := filepath.Walk(src, func(hostpath string, info os.FileInfo, err error) error {
+	filter, err := newFileFilter(src, m.exclude, m.include)
+	if err != nil {
+		return err
+	}
+
+	err = filepath.Walk(src, func(hostpath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
+		if skip, err := filter.skipPath(src, hostpath, info); skip || err != nil {
+			return err
+		}
+
 		vmpath := "/" + strings.TrimPrefix(hostpath, src)
 
 		if (info.Mode() & os.ModeSymlink) != 0 {
@@ -219,17 +288,9 @@ func (m *Manifest) AddRelativeDirectory(src string) error {
 
 		if info.IsDir() {
 			parts := strings.FieldsFunc(vmpath, func(c rune) bool { return c == '/' })
-			node := m.children
-			for i := 0; i < len(parts); i++ {
-				if _, ok := node[parts[i]]; !ok {
-					node[parts[i]] = make(map[string]interface{})
-				}
-				if reflect.TypeOf(node[parts[i]]).Kind() == reflect.String {
-					err := fmt.Errorf("directory %s is conflicting with an existing file", hostpath)
-					fmt.Println(err)
-					return err
-				}
-				node = node[parts[i]].(map[string]interface{})
+			_, err = m.mkdirAll(parts, hostpath)
+			if err != nil {
+				return err
 			}
 		} else {
 			err = m.AddFile(vmpath, hostpath)
@@ -245,109 +306,240 @@ func (m *Manifest) AddRelativeDirectory(src string) error {
 // FileExists checks if file is present at path in manifest
 func (m *Manifest) FileExists(filepath string) bool {
 	parts := strings.FieldsFunc(filepath, func(c rune) bool { return c == '/' })
+	if len(parts) == 0 {
+		return false
+	}
 	node := m.children
 	for i := 0; i < len(parts)-1; i++ {
-		if _, ok := node[parts[i]]; !ok {
+		child, ok := node[parts[i]].(map[string]interface{})
+		if !ok {
 			return false
 		}
-		node = node[parts[i]].(map[string]interface{})
+		node = child
 	}
-	pathtest := node[parts[len(parts)-1]]
-	if pathtest != nil && reflect.TypeOf(pathtest).Kind() == reflect.String {
+	switch node[parts[len(parts)-1]].(type) {
+	case string, inlineFile:
 		return true
 	}
 	return false
 }
 
-// AddLink to add a file to manifest
-func (m *Manifest) AddLink(filepath string, hostpath string) error {
-	parts := strings.FieldsFunc(filepath, func(c rune) bool { return c == '/' })
-	node := m.children
-
-	for i := 0; i < len(parts)-1; i++ {
-		if _, ok := node[parts[i]]; !ok {
-			node[parts[i]] = make(map[string]interface{})
+// hostFile returns the host path of the file at vmpath in the image,
+// following the symlinks in the image
+func (m *Manifest) hostFile(vmpath string) (string, bool) {
+	for hops := 0; hops < 40; hops++ {
+		if hostpath := m.HostPath(vmpath); hostpath != "" {
+			return hostpath, true
 		}
-		node = node[parts[i]].(map[string]interface{})
+		l, ok := m.node(vmpath).(link)
+		if !ok {
+			return "", false
+		}
+		if !path.IsAbs(l.path) {
+			l.path = path.Join(path.Dir(cleanImagePath(vmpath)), l.path)
+		}
+		vmpath = l.path
 	}
+	return "", false
+}
 
-	pathtest := node[parts[len(parts)-1]]
-	if pathtest != nil && reflect.TypeOf(pathtest).Kind() != reflect.String {
-		err := fmt.Errorf("file %s overriding an existing directory", filepath)
-		fmt.Println(err)
+// AddLink to add a file to manifest
+func (m *Manifest) AddLink(filepath string, hostpath string) error {
+	node, name, err := m.fileParent(filepath, hostpath)
+	if err != nil {
 		return err
 	}
 
-	if pathtest != nil && reflect.TypeOf(pathtest).Kind() == reflect.String && node[parts[len(parts)-1]] != hostpath {
-		fmt.Printf("warning: overwriting existing file %s hostpath old: %s new: %s\n", filepath, node[parts[len(parts)-1]], hostpath)
+	if old, ok := node[name].(string); ok && old != hostpath {
+		fmt.Printf("warning: overwriting existing file %s hostpath old: %s new: %s\n", filepath, old, hostpath)
 	}
 
-	_, err := lookupFile(m.targetRoot, hostpath)
+	_, err = lookupFile(m.targetRoot, hostpath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			fmt.Fprintf(os.Stderr, "please check your manifest for the missing file: %v\n", err)
-			os.Exit(1)
+			return &MissingFileError{VMPath: filepath, HostPath: hostpath, Cause: err}
 		}
-		return err
+		return fmt.Errorf("file '%s' (host path '%s'): %v", filepath, hostpath, err)
 	}
 
 	s, err := os.Readlink(hostpath)
 	if err != nil {
-		fmt.Println("bad link")
-		os.Exit(1)
+		return &BadLinkError{VMPath: filepath, HostPath: hostpath, Cause: err}
 	}
 
-	node[parts[len(parts)-1]] = link{path: s}
+	node[name] = link{path: s}
+	m.sources.add(filepath)
+	return nil
+}
+
+// addLinkTarget adds a symlink to target at vmpath, for links that point
+// to files of a target root rather than of the host
+func (m *Manifest) addLinkTarget(vmpath string, hostpath string, target string) error {
+	node, name, err := m.fileParent(vmpath, hostpath)
+	if err != nil {
+		return err
+	}
+	node[name] = link{path: target}
+	m.sources.add(vmpath)
 	return nil
 }
 
 // AddFile to add a file to manifest
 func (m *Manifest) AddFile(filepath string, hostpath string) error {
-	parts := strings.FieldsFunc(filepath, func(c rune) bool { return c == '/' })
-	node := m.children
+	node, name, err := m.fileParent(filepath, hostpath)
+	if err != nil {
+		return err
+	}
 
-	for i := 0; i < len(parts)-1; i++ {
+	if old, ok := node[name].(string); ok && old != hostpath {
+		fmt.Printf("warning: overwriting existing file %s hostpath old: %s new: %s\n", filepath, old, hostpath)
+	}
+
+	_, err = lookupFile(m.targetRoot, hostpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &MissingFileError{VMPath: filepath, HostPath: hostpath, Cause: err}
+		}
+		return fmt.Errorf("file '%s' (host path '%s'): %v", filepath, hostpath, err)
+	}
+
+	node[name] = hostpath
+	m.sources.add(filepath)
+	return nil
+}
+
+// fileParent creates the parent directories of the file at vmpath and
+// returns the parent directory and the file name
+func (m *Manifest) fileParent(vmpath string, hostpath string) (map[string]interface{}, string, error) {
+	parts := strings.FieldsFunc(vmpath, func(c rune) bool { return c == '/' })
+	if len(parts) == 0 {
+		return nil, "", &FileConflictError{VMPath: vmpath, HostPath: hostpath}
+	}
+
+	node, err := m.mkdirAll(parts[:len(parts)-1], hostpath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	name := parts[len(parts)-1]
+	if isDir(node[name]) {
+		return nil, "", &FileConflictError{VMPath: vmpath, HostPath: hostpath}
+	}
+	return node, name, nil
+}
+
+// mkdirAll creates the directories in parts and returns the last one
+func (m *Manifest) mkdirAll(parts []string, hostpath string) (map[string]interface{}, error) {
+	node := m.children
+	for i := 0; i < len(parts); i++ {
 		if _, ok := node[parts[i]]; !ok {
 			node[parts[i]] = make(map[string]interface{})
 		}
+		if !isDir(node[parts[i]]) {
+			vmpath := "/" + strings.Join(parts[:i+1], "/")
+			return nil, &FileConflictError{VMPath: vmpath, HostPath: hostpath, IsDir: true}
+		}
 		node = node[parts[i]].(map[string]interface{})
 	}
+	return node, nil
+}
 
-	pathtest := node[parts[len(parts)-1]]
-	if pathtest != nil && reflect.TypeOf(pathtest).Kind() != reflect.String {
-		err := fmt.Errorf("file '%s' overriding an existing directory", filepath)
-		fmt.Println(err)
-		os.Exit(1)
-	}
+// Program returns the image path of the user program
+func (m *Manifest) Program() string {
+	return m.program
+}
+
+// HostPath returns the host path of the file at vmpath, or an empty string
+// if vmpath is not a file in the manifest
+func (m *Manifest) HostPath(vmpath string) string {
+	hostpath, _ := m.node(vmpath).(string)
+	return hostpath
+}
 
-	if pathtest != nil && reflect.TypeOf(pathtest).Kind() == reflect.String && pathtest != hostpath {
-		fmt.Printf("warning: overwriting existing file %s hostpath old: %s new: %s\n", filepath, pathtest, hostpath)
+// node returns the manifest node at vmpath, or nil if there is none
+func (m *Manifest) node(vmpath string) interface{} {
+	parts := strings.FieldsFunc(vmpath, func(c rune) bool { return c == '/' })
+	if len(parts) == 0 {
+		return nil
+	}
+	node := m.children
+	for i := 0; i < len(parts)-1; i++ {
+		child, ok := node[parts[i]].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		node = child
 	}
+	return node[parts[len(parts)-1]]
+}
 
-	_, err := lookupFile(m.targetRoot, hostpath)
+// AddFileContents adds a file with the given contents and mode to manifest
+func (m *Manifest) AddFileContents(filepath string, contents []byte, mode os.FileMode) error {
+	node, name, err := m.fileParent(filepath, "")
 	if err != nil {
-		if os.IsNotExist(err) {
-			fmt.Fprintf(os.Stderr, "please check your manifest for the missing file: %v\n", err)
-			os.Exit(1)
-		}
 		return err
 	}
 
-	node[parts[len(parts)-1]] = hostpath
+	node[name] = inlineFile{contents: contents}
+	m.metadata[cleanImagePath(filepath)] = fileMetadata{mode: mode.Perm()}
+	m.sources.add(filepath)
 	return nil
 }
 
-// AddLibrary to add a dependent library
-func (m *Manifest) AddLibrary(path string) {
-	parts := strings.FieldsFunc(path, func(c rune) bool { return c == '/' })
-	node := m.children
-	for i := 0; i < len(parts)-1; i++ {
-		if _, ok := node[parts[i]]; !ok {
-			node[parts[i]] = make(map[string]interface{})
+// SetFileMetadata records the mode, owner and modification time of the file
+// at vmpath
+func (m *Manifest) SetFileMetadata(vmpath string, mode os.FileMode, uid, gid int, mtime time.Time) error {
+	if !m.FileExists(vmpath) {
+		return fmt.Errorf("file '%s' is not in the manifest", vmpath)
+	}
+	m.metadata[cleanImagePath(vmpath)] = fileMetadata{
+		mode:  mode.Perm(),
+		uid:   uid,
+		gid:   gid,
+		mtime: mtime,
+	}
+	return nil
+}
+
+// walkFiles calls fn with the image path of every file in the root
+// filesystem, in sorted order
+func walkFiles(children map[string]interface{}, dir string, fn func(vmpath string, node interface{}) error) error {
+	keys := make([]string, 0, len(children))
+	for k := range children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var err error
+		switch v := children[k].(type) {
+		case map[string]interface{}:
+			err = walkFiles(v, dir+"/"+k, fn)
+		case string, inlineFile:
+			err = fn(dir+"/"+k, v)
+		}
+		if err != nil {
+			return err
 		}
-		node = node[parts[i]].(map[string]interface{})
 	}
-	node[parts[len(parts)-1]] = path
+	return nil
+}
+
+// cleanImagePath returns vmpath in the form used to key file metadata
+func cleanImagePath(vmpath string) string {
+	parts := strings.FieldsFunc(vmpath, func(c rune) bool { return c == '/' })
+	return "/" + strings.Join(parts, "/")
+}
+
+// AddLibrary to add a dependent library
+func (m *Manifest) AddLibrary(path string) error {
+	node, name, err := m.fileParent(path, path)
+	if err != nil {
+		return err
+	}
+	node[name] = path
+	m.sources.add(path)
+	return nil
 }
 
 // AddUserData adds all files in dir to
@@ -356,11 +548,15 @@ func (m *Manifest) AddUserData(dir string) {
 	// TODO
 }
 
+// escapeValue quotes values with characters that end unquoted values, the
+// backslashes and quotes of quoted values are escaped
 func escapeValue(s string) string {
-	if strings.Contains(s, "\"") {
-		s = strings.Replace(s, "\"", "\\\"", -1)
+	if s == "" {
+		return "\"\""
 	}
-	if strings.ContainsAny(s, "\":()[] \t\n") {
+	if strings.ContainsAny(s, "\\\":()[]# \t\r\n") {
+		s = strings.Replace(s, "\\", "\\\\", -1)
+		s = strings.Replace(s, "\"", "\\\"", -1)
 		s = "\"" + s + "\""
 	}
 	return s
@@ -376,29 +572,18 @@ func (m *Manifest) String() string {
 		sb.WriteString("boot:(children:(\n")
 		toString(&m.boot, &sb, 4)
 
-		// include klibs specified in configuration if present in ops klib directory
+		// klibs are loaded from the klib directory of the kernel release,
+		// checkKlibs verifies they exist before building an image
 		if len(m.klibs) > 0 {
 			klibs := map[string]interface{}{}
 			klibsPath := getKlibsDir(m.nightly)
-			if _, err := os.Stat(klibsPath); !os.IsNotExist(err) {
-
-				sb.WriteString("    klib:(children:(\n")
-
-				for _, klibName := range m.klibs {
-					klibPath := klibsPath + "/" + klibName
-
-					if _, err := os.Stat(klibPath); !os.IsNotExist(err) {
-						klibs[klibName] = klibPath
-					} else {
-						fmt.Printf("Klib %s not found in directory %s\n", klibName, klibsPath)
-					}
-				}
-				toString(&klibs, &sb, 6)
-
-				sb.WriteString("    ))\n")
-			} else {
-				fmt.Printf("Klibs directory with path %s not found\n", klibsPath)
+			for _, klibName := range m.klibs {
+				klibs[klibName] = klibsPath + "/" + klibName
 			}
+
+			sb.WriteString("    klib:(children:(\n")
+			toString(&klibs, &sb, 6)
+			sb.WriteString("    ))\n")
 		}
 
 		sb.WriteString("))\n")
@@ -406,85 +591,45 @@ func (m *Manifest) String() string {
 
 	// write root fs
 	sb.WriteString("children:(\n")
-	toString(&m.children, &sb, 4)
+	writeChildren(m.children, &sb, 4, "", m.metadata)
 	sb.WriteString(")\n")
 
 	// program
 	if m.program != "" {
 		sb.WriteString("program:")
-		sb.WriteString(m.program)
+		sb.WriteString(escapeValue(m.program))
 		sb.WriteRune('\n')
 	}
 
-	//
+	if m.cwd != "" {
+		sb.WriteString("cwd:")
+		sb.WriteString(escapeValue(m.cwd))
+		sb.WriteRune('\n')
+	}
+
+	// klibs
 	if len(m.klibs) > 0 {
 		sb.WriteString("klibs:bootfs\n")
+	}
 
-		for _, klib := range m.klibs {
-			if klib == "ntp" {
-				var err error
-
-				var ntpAddress string
-				var ntpPort string
-				var ntpPollMin string
-				var ntpPollMax string
-
-				var pollMinNumber int
-				var pollMaxNumber int
-
-				if val, ok := m.environment["ntpAddress"]; ok {
-					ntpAddress = val
-				}
-
-				if val, ok := m.environment["ntpPort"]; ok {
-					ntpPort = val
-				}
-
-				if val, ok := m.environment["ntpPollMin"]; ok {
-					pollMinNumber, err = strconv.Atoi(val)
-					if err == nil && pollMinNumber > 3 {
-						ntpPollMin = val
-					}
-				}
-
-				if val, ok := m.environment["ntpPollMax"]; ok {
-					pollMaxNumber, err = strconv.Atoi(val)
-					if err == nil && pollMaxNumber < 18 {
-						ntpPollMax = val
-					}
-				}
-
-				if pollMinNumber != 0 && pollMaxNumber != 0 && pollMinNumber > pollMaxNumber {
-					ntpPollMin = ""
-					ntpPollMax = ""
-				}
-
-				if ntpAddress != "" {
-					sb.WriteString(fmt.Sprintf("ntp_address:%s\n", ntpAddress))
-				}
-
-				if ntpPort != "" {
-					sb.WriteString(fmt.Sprintf("ntp_port:%s\n", ntpPort))
-				}
-
-				if ntpPollMin != "" {
-					sb.WriteString(fmt.Sprintf("ntp_poll_min:%s\n", ntpPollMin))
-				}
-
-				if ntpPollMax != "" {
-					sb.WriteString(fmt.Sprintf("ntp_poll_max:%s\n", ntpPollMax))
-				}
-
-				break
-			}
+	if m.ntp != nil {
+		if m.ntp.Address != "" {
+			sb.WriteString(fmt.Sprintf("ntp_address:%s\n", escapeValue(m.ntp.Address)))
+		}
+		if m.ntp.Port != 0 {
+			sb.WriteString(fmt.Sprintf("ntp_port:%d\n", m.ntp.Port))
+		}
+		if m.ntp.PollMin != 0 {
+			sb.WriteString(fmt.Sprintf("ntp_poll_min:%d\n", m.ntp.PollMin))
+		}
+		if m.ntp.PollMax != 0 {
+			sb.WriteString(fmt.Sprintf("ntp_poll_max:%d\n", m.ntp.PollMax))
 		}
-
 	}
 
 	// arguments
 	sb.WriteString("arguments:[")
 	if len(m.args) > 0 {
-		fmt.Println(m.args)
 		escapedArgs := make([]string, len(m.args))
 		for i, arg := range m.args {
 			escapedArgs[i] = escapeValue(arg)
@@ -494,10 +639,15 @@ func (m *Manifest) String() string {
 	sb.WriteString("]\n")
 
 	// debug
-	for k, v := range m.debugFlags {
+	debugFlags := make([]string, 0, len(m.debugFlags))
+	for k := range m.debugFlags {
+		debugFlags = append(debugFlags, k)
+	}
+	sort.Strings(debugFlags)
+	for _, k := range debugFlags {
 		sb.WriteString(k)
 		sb.WriteRune(':')
-		sb.WriteRune(v)
+		sb.WriteRune(m.debugFlags[k])
 		sb.WriteRune('\n')
 	}
 
@@ -509,27 +659,35 @@ func (m *Manifest) String() string {
 	}
 
 	// environment
-	n := len(m.environment)
+	environment := make([]string, 0, len(m.environment))
+	for k := range m.environment {
+		environment = append(environment, k)
+	}
+	sort.Strings(environment)
 	sb.WriteString("environment:(")
-	for k, v := range m.environment {
-		n = n - 1
-		sb.WriteString(k)
-		sb.WriteRune(':')
-		sb.WriteString(escapeValue(v))
-		if n > 0 {
+	for i, k := range environment {
+		if i > 0 {
 			sb.WriteRune(' ')
 		}
+		sb.WriteString(k)
+		sb.WriteRune(':')
+		sb.WriteString(escapeValue(m.environment[k]))
 	}
 	sb.WriteString(")\n")
 
 	// mounts
 	if len(m.mounts) > 0 {
+		mounts := make([]string, 0, len(m.mounts))
+		for k := range m.mounts {
+			mounts = append(mounts, k)
+		}
+		sort.Strings(mounts)
 		sb.WriteString("mounts:(\n")
-		for k, v := range m.mounts {
+		for _, k := range mounts {
 			sb.WriteString("    ")
 			sb.WriteString(k)
 			sb.WriteRune(':')
-			sb.WriteString(v)
+			sb.WriteString(m.mounts[k])
 			sb.WriteRune('\n')
 		}
 		sb.WriteString(")\n")
@@ -545,13 +703,57 @@ func (m *Manifest) String() string {
 		sb.WriteRune('\n')
 	}
 
+	for i, iface := range m.interfaces {
+		sb.WriteString(fmt.Sprintf("en%d:(", i+1))
+		writeInterface(iface, &sb)
+		sb.WriteString(")\n")
+	}
+
 	//
 	sb.WriteString(")\n")
 	return sb.String()
 }
 
+// writeInterface writes the settings of a network interface, interfaces
+// without addresses use dhcp
+func writeInterface(iface *ManifestNetworkConfig, sb *strings.Builder) {
+	var attrs []string
+	if iface.IP != "" {
+		attrs = append(attrs, "ipaddr:"+iface.IP, "netmask:"+iface.NetMask)
+		if iface.Gateway != "" {
+			attrs = append(attrs, "gateway:"+iface.Gateway)
+		}
+	}
+	if iface.IPv6 != "" {
+		attrs = append(attrs, "ip6addr:"+escapeValue(iface.IPv6), fmt.Sprintf("ip6prefix:%d", iface.IPv6Prefix))
+		if iface.IPv6Gateway != "" {
+			attrs = append(attrs, "ip6gateway:"+escapeValue(iface.IPv6Gateway))
+		}
+	}
+	if iface.MTU != 0 {
+		attrs = append(attrs, fmt.Sprintf("mtu:%d", iface.MTU))
+	}
+	sb.WriteString(strings.Join(attrs, " "))
+}
+
+// toString writes the children of a directory sorted by name, so the same
+// tree always renders to the same manifest
 func toString(m *map[string]interface{}, sb *strings.Builder, indent int) {
-	for k, v := range *m {
+	writeChildren(*m, sb, indent, "", nil)
+}
+
+// writeChildren writes the children of the directory at dir, adding the
+// attributes found in metadata to files
+func writeChildren(children map[string]interface{}, sb *strings.Builder, indent int, dir string, metadata map[string]fileMetadata) {
+	keys := make([]string, 0, len(children))
+	for k := range children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := children[k]
+		vmpath := dir + "/" + k
 		sb.WriteString(strings.Repeat(" ", indent))
 
 		nvalue, nok := v.(link)
@@ -564,6 +766,17 @@ func toString(m *map[string]interface{}, sb *strings.Builder, indent int) {
 			continue
 		}
 
+		inline, iok := v.(inlineFile)
+		// file with inline contents
+		if iok {
+			sb.WriteString(escapeValue(k))
+			sb.WriteString(":(contents:")
+			sb.WriteString(escapeValue(string(inline.contents)))
+			writeFileMetadata(metadata, vmpath, sb)
+			sb.WriteString(")\n")
+			continue
+		}
+
 		value, ok := v.(string)
 
 		// file
@@ -571,7 +784,9 @@ func toString(m *map[string]interface{}, sb *strings.Builder, indent int) {
 			sb.WriteString(escapeValue(k))
 			sb.WriteString(":(contents:(host:")
 			sb.WriteString(escapeValue(value))
-			sb.WriteString("))\n")
+			sb.WriteString(")")
+			writeFileMetadata(metadata, vmpath, sb)
+			sb.WriteString(")\n")
 
 			// dir
 		} else {
@@ -581,7 +796,7 @@ func toString(m *map[string]interface{}, sb *strings.Builder, indent int) {
 			ch := v.(map[string]interface{})
 			if len(ch) > 0 {
 				sb.WriteRune('\n')
-				toString(&ch, sb, indent+4)
+				writeChildren(ch, sb, indent+4, vmpath, metadata)
 				sb.WriteString(strings.Repeat(" ", indent))
 			}
 
@@ -589,3 +804,15 @@ func toString(m *map[string]interface{}, sb *strings.Builder, indent int) {
 		}
 	}
 }
+
+// writeFileMetadata writes the attributes of the file at vmpath, if any
+func writeFileMetadata(metadata map[string]fileMetadata, vmpath string, sb *strings.Builder) {
+	md, ok := metadata[vmpath]
+	if !ok {
+		return
+	}
+	sb.WriteString(fmt.Sprintf(" mode:%04o uid:%d gid:%d", md.mode, md.uid, md.gid))
+	if !md.mtime.IsZero() {
+		sb.WriteString(fmt.Sprintf(" mtime:%d", md.mtime.Unix()))
+	}
+}
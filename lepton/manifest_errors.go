@@ -0,0 +1,59 @@
+package lepton
+
+import (
+	"fmt"
+)
+
+// FileConflictError is returned when a file and a directory are added at the
+// same image path
+type FileConflictError struct {
+	VMPath   string
+	HostPath string
+	// IsDir is set when a directory conflicts with an existing file,
+	// otherwise a file conflicts with an existing directory
+	IsDir bool
+}
+
+func (e *FileConflictError) Error() string {
+	var msg string
+	if e.IsDir {
+		msg = fmt.Sprintf("directory '%s' is conflicting with an existing file", e.VMPath)
+	} else {
+		msg = fmt.Sprintf("file '%s' overriding an existing directory", e.VMPath)
+	}
+	if e.HostPath != "" {
+		msg += fmt.Sprintf(" (host path '%s')", e.HostPath)
+	}
+	return msg
+}
+
+// MissingFileError is returned when the host file of an image path can not
+// be found
+type MissingFileError struct {
+	VMPath   string
+	HostPath string
+	Cause    error
+}
+
+func (e *MissingFileError) Error() string {
+	return fmt.Sprintf("missing file '%s' for '%s': %v", e.HostPath, e.VMPath, e.Cause)
+}
+
+func (e *MissingFileError) Unwrap() error {
+	return e.Cause
+}
+
+// BadLinkError is returned when a host symlink can not be read
+type BadLinkError struct {
+	VMPath   string
+	HostPath string
+	Cause    error
+}
+
+func (e *BadLinkError) Error() string {
+	return fmt.Sprintf("bad link '%s' for '%s': %v", e.HostPath, e.VMPath, e.Cause)
+}
+
+func (e *BadLinkError) Unwrap() error {
+	return e.Cause
+}
@@ -0,0 +1,544 @@
+package lepton
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// manifestParser reads the nanos tuple syntax produced by Manifest.String
+type manifestParser struct {
+	data []byte
+	pos  int
+	line int
+}
+
+// ParseManifest reads a nanos manifest and returns the Manifest it describes.
+// Host paths are resolved against targetRoot when the manifest is later
+// extended with AddFile or AddLink.
+func ParseManifest(r io.Reader, targetRoot string) (*Manifest, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &manifestParser{data: data, line: 1}
+	p.skipSpace()
+	if p.peek() != '(' {
+		return nil, p.errorf("manifest must start with '('")
+	}
+
+	root, err := p.parseTuple()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	if p.pos < len(p.data) {
+		return nil, p.errorf("unexpected data after end of manifest")
+	}
+
+	return manifestFromTuple(root, targetRoot)
+}
+
+// ReadManifestFile parses the manifest stored at path
+func ReadManifestFile(path string, targetRoot string) (*Manifest, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	m, err := ParseManifest(fd, targetRoot)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+func (p *manifestParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, a...))
+}
+
+func (p *manifestParser) peek() byte {
+	if p.pos >= len(p.data) {
+		return 0
+	}
+	return p.data[p.pos]
+}
+
+func (p *manifestParser) next() byte {
+	c := p.data[p.pos]
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return c
+}
+
+// skipSpace skips whitespace and comments, which run from '#' to the
+// end of the line
+func (p *manifestParser) skipSpace() {
+	for p.pos < len(p.data) {
+		c := p.peek()
+		if c == '#' {
+			for p.pos < len(p.data) && p.peek() != '\n' {
+				p.next()
+			}
+			continue
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(c)) {
+			return
+		}
+		p.next()
+	}
+}
+
+func (p *manifestParser) expect(c byte) error {
+	p.skipSpace()
+	if p.pos >= len(p.data) {
+		return p.errorf("expected '%c', got end of manifest", c)
+	}
+	if p.peek() != c {
+		return p.errorf("expected '%c', got '%c'", c, p.peek())
+	}
+	p.next()
+	return nil
+}
+
+// parseValue reads a tuple, a vector or a string
+func (p *manifestParser) parseValue() (interface{}, error) {
+	p.skipSpace()
+	switch p.peek() {
+	case '(':
+		return p.parseTuple()
+	case '[':
+		return p.parseVector()
+	default:
+		return p.parseString()
+	}
+}
+
+func (p *manifestParser) parseTuple() (map[string]interface{}, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+
+	tuple := make(map[string]interface{})
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.data) {
+			return nil, p.errorf("unterminated tuple")
+		}
+		if p.peek() == ')' {
+			p.next()
+			return tuple, nil
+		}
+
+		key, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(':'); err != nil {
+			return nil, err
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := tuple[key]; ok {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+		tuple[key] = value
+	}
+}
+
+func (p *manifestParser) parseVector() ([]string, error) {
+	if err := p.expect('['); err != nil {
+		return nil, err
+	}
+
+	vector := []string{}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.data) {
+			return nil, p.errorf("unterminated vector")
+		}
+		if p.peek() == ']' {
+			p.next()
+			return vector, nil
+		}
+
+		value, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		vector = append(vector, value)
+	}
+}
+
+// parseString reads a bare or a double quoted string, the inverse of
+// escapeValue
+func (p *manifestParser) parseString() (string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.data) {
+		return "", p.errorf("unexpected end of manifest")
+	}
+
+	var sb strings.Builder
+	if p.peek() == '"' {
+		p.next()
+		for {
+			if p.pos >= len(p.data) {
+				return "", p.errorf("unterminated string")
+			}
+			c := p.next()
+			if c == '"' {
+				return sb.String(), nil
+			}
+			if c == '\\' && (p.peek() == '"' || p.peek() == '\\') {
+				c = p.next()
+			}
+			sb.WriteByte(c)
+		}
+	}
+
+	for p.pos < len(p.data) && !strings.ContainsRune("\":()[]# \t\r\n", rune(p.peek())) {
+		sb.WriteByte(p.next())
+	}
+	if sb.Len() == 0 {
+		return "", p.errorf("unexpected '%c'", p.peek())
+	}
+	return sb.String(), nil
+}
+
+// manifestFromTuple maps the root tuple of a manifest to a Manifest
+func manifestFromTuple(root map[string]interface{}, targetRoot string) (*Manifest, error) {
+	m := NewManifest(targetRoot)
+	var networkConfig ManifestNetworkConfig
+	interfaces := make(map[int]*ManifestNetworkConfig)
+
+	for k, v := range root {
+		var err error
+
+		switch k {
+		case "boot":
+			err = m.parseBoot(v)
+		case "children":
+			var t map[string]interface{}
+			if t, err = tupleValue(k, v); err == nil {
+				m.children, err = parseChildren(t, "", m.metadata)
+			}
+		case "program":
+			m.program, err = stringValue(k, v)
+		case "cwd":
+			m.cwd, err = stringValue(k, v)
+		case "arguments":
+			m.args, err = vectorValue(k, v)
+		case "notrace":
+			m.noTrace, err = vectorValue(k, v)
+		case "environment", "mounts":
+			var t map[string]interface{}
+			if t, err = tupleValue(k, v); err != nil {
+				break
+			}
+			for name, value := range t {
+				s, err := stringValue(k+"/"+name, value)
+				if err != nil {
+					return nil, err
+				}
+				if k == "environment" {
+					m.environment[name] = s
+				} else {
+					m.mounts[name] = s
+				}
+			}
+		case "klibs":
+			// klibs are always loaded from the boot filesystem
+		case "ntp_address", "ntp_port", "ntp_poll_min", "ntp_poll_max":
+			if m.ntp == nil {
+				m.ntp = &NTPKlibConfig{}
+			}
+			err = parseNTPOption(m.ntp, k, v)
+		case "ipaddr":
+			networkConfig.IP, err = stringValue(k, v)
+		case "gateway":
+			networkConfig.Gateway, err = stringValue(k, v)
+		case "netmask":
+			networkConfig.NetMask, err = stringValue(k, v)
+		default:
+			if n, ok := interfaceNumber(k); ok {
+				interfaces[n], err = parseInterface(k, v)
+				break
+			}
+
+			// remaining entries are debug flags such as trace:t
+			var s string
+			if s, err = stringValue(k, v); err == nil {
+				if len(s) != 1 {
+					err = fmt.Errorf("unsupported manifest entry %s:%s", k, s)
+				} else {
+					m.debugFlags[k] = rune(s[0])
+				}
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if networkConfig != (ManifestNetworkConfig{}) {
+		m.AddNetworkConfig(&networkConfig)
+	}
+
+	for n := 1; n <= len(interfaces); n++ {
+		iface, ok := interfaces[n]
+		if !ok {
+			return nil, fmt.Errorf("network interface en%d is missing", n)
+		}
+		m.AddInterface(iface)
+	}
+
+	return m, nil
+}
+
+// parseBoot reads the kernel and klibs from the boot filesystem
+func (m *Manifest) parseBoot(v interface{}) error {
+	boot, err := tupleValue("boot", v)
+	if err != nil {
+		return err
+	}
+	bootChildren, err := tupleValue("boot/children", boot["children"])
+	if err != nil {
+		return err
+	}
+	children, err := parseChildren(bootChildren, "/boot", nil)
+	if err != nil {
+		return err
+	}
+
+	for name, child := range children {
+		if name != "klib" {
+			m.boot[name] = child
+			continue
+		}
+
+		klibs, ok := child.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("/boot/klib: expected a directory")
+		}
+		names := make([]string, 0, len(klibs))
+		for klib := range klibs {
+			names = append(names, klib)
+		}
+		sort.Strings(names)
+		m.AddKlibs(names)
+	}
+	return nil
+}
+
+// parseChildren converts a children tuple to the tree used by Manifest,
+// where directories are maps, files are host paths and links are link values.
+// File attributes are recorded in metadata when it is not nil.
+func parseChildren(t map[string]interface{}, dir string, metadata map[string]fileMetadata) (map[string]interface{}, error) {
+	children := make(map[string]interface{})
+
+	for name, v := range t {
+		vmpath := dir + "/" + name
+		entry, err := tupleValue(vmpath, v)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case entry["children"] != nil:
+			t, err := tupleValue(vmpath+"/children", entry["children"])
+			if err != nil {
+				return nil, err
+			}
+			children[name], err = parseChildren(t, vmpath, metadata)
+			if err != nil {
+				return nil, err
+			}
+		case entry["contents"] != nil:
+			if metadata != nil {
+				if err := parseFileMetadata(entry, vmpath, metadata); err != nil {
+					return nil, err
+				}
+			}
+			if inline, ok := entry["contents"].(string); ok {
+				children[name] = inlineFile{contents: []byte(inline)}
+				continue
+			}
+			contents, err := tupleValue(vmpath+"/contents", entry["contents"])
+			if err != nil {
+				return nil, err
+			}
+			host, err := stringValue(vmpath+"/contents/host", contents["host"])
+			if err != nil {
+				return nil, err
+			}
+			children[name] = host
+		case entry["linktarget"] != nil:
+			target, err := stringValue(vmpath+"/linktarget", entry["linktarget"])
+			if err != nil {
+				return nil, err
+			}
+			children[name] = link{path: target}
+		default:
+			return nil, fmt.Errorf("%s: expected children, contents or linktarget", vmpath)
+		}
+	}
+
+	return children, nil
+}
+
+// parseFileMetadata reads the mode, uid, gid and mtime attributes of a file
+func parseFileMetadata(entry map[string]interface{}, vmpath string, metadata map[string]fileMetadata) error {
+	if entry["mode"] == nil && entry["uid"] == nil && entry["gid"] == nil && entry["mtime"] == nil {
+		return nil
+	}
+
+	var md fileMetadata
+	for _, k := range []string{"mode", "uid", "gid", "mtime"} {
+		if entry[k] == nil {
+			continue
+		}
+		s, err := stringValue(vmpath+"/"+k, entry[k])
+		if err != nil {
+			return err
+		}
+
+		switch k {
+		case "mode":
+			var mode uint64
+			mode, err = strconv.ParseUint(s, 8, 32)
+			md.mode = os.FileMode(mode).Perm()
+		case "uid":
+			md.uid, err = strconv.Atoi(s)
+		case "gid":
+			md.gid, err = strconv.Atoi(s)
+		case "mtime":
+			var mtime int64
+			mtime, err = strconv.ParseInt(s, 10, 64)
+			md.mtime = time.Unix(mtime, 0).UTC()
+		}
+		if err != nil {
+			return fmt.Errorf("%s/%s: invalid value %q", vmpath, k, s)
+		}
+	}
+
+	metadata[vmpath] = md
+	return nil
+}
+
+// interfaceNumber returns the number of a network interface key such as en1
+func interfaceNumber(key string) (int, bool) {
+	if !strings.HasPrefix(key, "en") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(key[2:])
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return n, true
+}
+
+// parseInterface reads the settings of a network interface
+func parseInterface(name string, v interface{}) (*ManifestNetworkConfig, error) {
+	t, err := tupleValue(name, v)
+	if err != nil {
+		return nil, err
+	}
+
+	iface := &ManifestNetworkConfig{}
+	for k, v := range t {
+		s, err := stringValue(name+"/"+k, v)
+		if err != nil {
+			return nil, err
+		}
+
+		switch k {
+		case "ipaddr":
+			iface.IP = s
+		case "netmask":
+			iface.NetMask = s
+		case "gateway":
+			iface.Gateway = s
+		case "ip6addr":
+			iface.IPv6 = s
+		case "ip6gateway":
+			iface.IPv6Gateway = s
+		case "ip6prefix", "mtu":
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s/%s: expected a number, got %q", name, k, s)
+			}
+			if k == "mtu" {
+				iface.MTU = n
+			} else {
+				iface.IPv6Prefix = n
+			}
+		default:
+			return nil, fmt.Errorf("%s: unsupported setting %s", name, k)
+		}
+	}
+	return iface, nil
+}
+
+// parseNTPOption reads an option of the ntp klib
+func parseNTPOption(ntp *NTPKlibConfig, key string, v interface{}) error {
+	s, err := stringValue(key, v)
+	if err != nil {
+		return err
+	}
+	if key == "ntp_address" {
+		ntp.Address = s
+		return nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("%s: expected a number, got %q", key, s)
+	}
+	switch key {
+	case "ntp_port":
+		ntp.Port = n
+	case "ntp_poll_min":
+		ntp.PollMin = n
+	default:
+		ntp.PollMax = n
+	}
+	return nil
+}
+
+func tupleValue(name string, v interface{}) (map[string]interface{}, error) {
+	t, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a tuple", name)
+	}
+	return t, nil
+}
+
+func vectorValue(name string, v interface{}) ([]string, error) {
+	s, ok := v.([]string)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a vector", name)
+	}
+	return s, nil
+}
+
+func stringValue(name string, v interface{}) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%s: expected a string", name)
+	}
+	return s, nil
+}
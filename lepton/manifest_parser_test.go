@@ -0,0 +1,233 @@
+package lepton
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const handEditedManifest = `(
+    # comments are ignored
+    boot:(children:(kernel:(contents:(host:/ops/kernel.img))))
+    children:(
+        hw:(contents:(host:examples/hw))
+        etc:(children:(
+            "my file":(contents:(host:"/tmp/my file"))
+            localtime:(linktarget:/usr/share/zoneinfo/UTC)
+            hostname:(contents:uniboot)
+        ))
+        data:(children:())
+    )
+    program:/hw
+    arguments:[hw "hello world" -v]
+    environment:(USER:root GREETING:"a:b \"c\"")
+    mounts:(
+        vol1:/data
+    )
+    trace:t
+    notrace:[futex]
+    ipaddr:10.0.0.2
+    gateway:10.0.0.1
+    netmask:255.255.255.0
+)
+`
+
+func TestParseManifest(t *testing.T) {
+	m, err := ParseManifest(strings.NewReader(handEditedManifest), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Program() != "/hw" {
+		t.Errorf("got program %s, want /hw", m.Program())
+	}
+
+	if m.HostPath("/hw") != "examples/hw" {
+		t.Errorf("got host path %s, want examples/hw", m.HostPath("/hw"))
+	}
+
+	if m.HostPath("/etc/my file") != "/tmp/my file" {
+		t.Errorf("got host path %s, want /tmp/my file", m.HostPath("/etc/my file"))
+	}
+
+	etc := m.children["etc"].(map[string]interface{})
+	if !reflect.DeepEqual(etc["hostname"], inlineFile{contents: []byte("uniboot")}) {
+		t.Errorf("got %v, want inline file uniboot", etc["hostname"])
+	}
+
+	if etc["localtime"] != (link{path: "/usr/share/zoneinfo/UTC"}) {
+		t.Errorf("got link %v, want /usr/share/zoneinfo/UTC", etc["localtime"])
+	}
+
+	if m.boot["kernel"] != "/ops/kernel.img" {
+		t.Errorf("got kernel %v, want /ops/kernel.img", m.boot["kernel"])
+	}
+
+	wantArgs := []string{"hw", "hello world", "-v"}
+	if !reflect.DeepEqual(m.args, wantArgs) {
+		t.Errorf("got args %v, want %v", m.args, wantArgs)
+	}
+
+	if m.environment["GREETING"] != `a:b "c"` {
+		t.Errorf("got environment value %s, want %s", m.environment["GREETING"], `a:b "c"`)
+	}
+
+	if m.mounts["vol1"] != "/data" {
+		t.Errorf("got mount %s, want /data", m.mounts["vol1"])
+	}
+
+	if m.debugFlags["trace"] != 't' {
+		t.Errorf("expected trace debug flag")
+	}
+
+	want := ManifestNetworkConfig{IP: "10.0.0.2", Gateway: "10.0.0.1", NetMask: "255.255.255.0"}
+	if m.networkConfig == nil || *m.networkConfig != want {
+		t.Errorf("got network config %v, want %v", m.networkConfig, want)
+	}
+}
+
+func TestParseManifestRoundTrip(t *testing.T) {
+	m := NewManifest("")
+	m.AddKernel("kernel/kernel")
+	m.program = "/bin/app"
+	m.SetWorkingDirectory("/srv/app data")
+	m.AddLibrary("/bin/app")
+	m.AddLibrary("/lib/x86_64-linux-gnu/libc.so.6")
+	m.AddArgument("app")
+	m.AddArgument("--name=a b")
+	m.AddEnvironmentVariable("PATH", "/bin:/usr/bin")
+	m.AddDebugFlag("fault", 't')
+	m.AddFileContents("/etc/app.conf", []byte("# app\nname = \"a b\"\n"), 0644)
+	m.AddFileContents("/etc/empty", []byte{}, 0600)
+	m.SetFileMetadata("/bin/app", 0755, 0, 0, time.Unix(1600000000, 0).UTC())
+	m.AddNTPConfig(&NTPKlibConfig{Address: "pool.ntp.org", PollMin: 5})
+
+	parsed, err := ParseManifest(strings.NewReader(m.String()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(parsed.children, m.children) {
+		t.Errorf("got children %v, want %v", parsed.children, m.children)
+	}
+
+	if !reflect.DeepEqual(parsed.boot, m.boot) {
+		t.Errorf("got boot %v, want %v", parsed.boot, m.boot)
+	}
+
+	if parsed.cwd != m.cwd {
+		t.Errorf("got cwd %q, want %q", parsed.cwd, m.cwd)
+	}
+
+	if !reflect.DeepEqual(parsed.args, m.args) {
+		t.Errorf("got args %v, want %v", parsed.args, m.args)
+	}
+
+	if !reflect.DeepEqual(parsed.environment, m.environment) {
+		t.Errorf("got environment %v, want %v", parsed.environment, m.environment)
+	}
+
+	if !reflect.DeepEqual(parsed.debugFlags, m.debugFlags) {
+		t.Errorf("got debug flags %v, want %v", parsed.debugFlags, m.debugFlags)
+	}
+
+	if !reflect.DeepEqual(parsed.ntp, m.ntp) {
+		t.Errorf("got ntp %v, want %v", parsed.ntp, m.ntp)
+	}
+
+	if !reflect.DeepEqual(parsed.metadata, m.metadata) {
+		t.Errorf("got file metadata %v, want %v", parsed.metadata, m.metadata)
+	}
+}
+
+func TestParseManifestRoundTripEscapes(t *testing.T) {
+	values := []string{
+		`C:\tmp`,
+		`C:\\tmp`,
+		`say \"hi\"`,
+		`"quoted"`,
+		`trailing\`,
+		"crlf\r\nline",
+		`plain\value`,
+	}
+
+	m := NewManifest("")
+	m.program = "/opt/my app:v2/app"
+	for i, v := range values {
+		m.AddArgument(v)
+		m.AddEnvironmentVariable(fmt.Sprintf("VAR%d", i), v)
+		m.AddFileContents(fmt.Sprintf("/etc/file%d", i), []byte(v), 0644)
+	}
+
+	parsed, err := ParseManifest(strings.NewReader(m.String()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.program != m.program {
+		t.Errorf("got program %q, want %q", parsed.program, m.program)
+	}
+	if !reflect.DeepEqual(parsed.args, m.args) {
+		t.Errorf("got args %q, want %q", parsed.args, m.args)
+	}
+	if !reflect.DeepEqual(parsed.environment, m.environment) {
+		t.Errorf("got environment %q, want %q", parsed.environment, m.environment)
+	}
+	if !reflect.DeepEqual(parsed.children, m.children) {
+		t.Errorf("got children %v, want %v", parsed.children, m.children)
+	}
+}
+
+func TestParseManifestErrors(t *testing.T) {
+	tests := []struct {
+		manifest string
+		err      string
+	}{
+		{"children:()", "line 1: manifest must start with '('"},
+		{"(\nprogram:/hw\n", "line 3: unterminated tuple"},
+		{"(program:/hw program:/other)", "line 1: duplicate key \"program\""},
+		{"(children:(hw:(contents:(host:[a]))))", "/hw/contents/host: expected a string"},
+		{"(children:(hw:(size:1)))", "/hw: expected children, contents or linktarget"},
+		{"(imagesize:30M)", "unsupported manifest entry imagesize:30M"},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseManifest(strings.NewReader(tt.manifest), "")
+		if err == nil {
+			t.Errorf("expected error parsing %q", tt.manifest)
+			continue
+		}
+		if err.Error() != tt.err {
+			t.Errorf("got %q, want %q", err.Error(), tt.err)
+		}
+	}
+}
+
+func TestParseManifestBootFiles(t *testing.T) {
+	m, err := ParseManifest(strings.NewReader(`(
+    boot:(children:(kernel:(contents:(host:/ops/kernel.img)) config:(contents:(host:/ops/boot.cfg))))
+    children:()
+)`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.HasKernel() {
+		t.Fatal("expected the kernel of the manifest")
+	}
+
+	// a kernel of the user replaces the one of the manifest only
+	m.AddKernel("/release/kernel.img")
+	want := map[string]interface{}{"kernel": "/release/kernel.img", "config": "/ops/boot.cfg"}
+	if !reflect.DeepEqual(m.boot, want) {
+		t.Errorf("got boot %v, want %v", m.boot, want)
+	}
+
+	m, err = ParseManifest(strings.NewReader("(children:())"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.HasKernel() {
+		t.Error("expected no kernel")
+	}
+}
@@ -1,10 +1,14 @@
 package lepton
 
 import (
+	"errors"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -55,6 +59,226 @@ func TestAddLibs(t *testing.T) {
 	}
 }
 
+func TestAddFileContents(t *testing.T) {
+	m := NewManifest("")
+	err := m.AddFileContents("/etc/hostname", []byte("uniboot"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.AddFileContents("/etc/resolv.conf", []byte("nameserver 8.8.8.8\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.AddFileContents("/etc/shadow", []byte("root:*:0::::::\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	toString(&m.children, &sb, 0)
+	want := `etc:(children:(
+    hostname:(contents:uniboot)
+    resolv.conf:(contents:"nameserver 8.8.8.8
+")
+    shadow:(contents:"root:*:0::::::
+")
+))
+`
+	assert.Equal(t, want, sb.String())
+	assert.True(t, m.FileExists("/etc/hostname"))
+	assert.Equal(t, fileMetadata{mode: 0600}, m.metadata["/etc/shadow"])
+
+	sb.Reset()
+	writeChildren(m.children, &sb, 0, "", m.metadata)
+	assert.Contains(t, sb.String(), "hostname:(contents:uniboot mode:0644 uid:0 gid:0)")
+
+	err = m.AddFileContents("/etc", []byte("not a directory"), 0644)
+	assert.EqualError(t, err, "file '/etc' overriding an existing directory")
+}
+
+func TestAddResolverConfig(t *testing.T) {
+	c := &Config{
+		NameServer:      "8.8.8.8",
+		NameServers:     []string{"1.1.1.1"},
+		SearchDomains:   []string{"svc.local", "local"},
+		ResolverOptions: []string{"ndots:2"},
+		Hosts:           map[string][]string{"10.0.0.2": {"db", "db.local"}},
+		RunConfig:       RunConfig{InstanceName: "web-1"},
+	}
+	m := NewManifest("")
+	assert.NoError(t, addDNSConfig(m, c))
+	assert.NoError(t, addHostName(m, c))
+	assert.NoError(t, addHosts(m, c))
+
+	var sb strings.Builder
+	toString(&m.children, &sb, 0)
+	want := `etc:(children:(
+    hosts:(contents:"127.0.0.1 localhost
+10.0.0.2 db db.local
+")
+    resolv.conf:(contents:"nameserver 8.8.8.8
+nameserver 1.1.1.1
+search svc.local local
+options ndots:2
+")
+))
+proc:(children:(
+    sys:(children:(
+        kernel:(children:(
+            hostname:(contents:uniboot)
+        ))
+    ))
+))
+`
+	assert.Equal(t, want, sb.String())
+
+	c.Hostname = "api"
+	assert.NoError(t, addHostName(m, c))
+	assert.True(t, strings.Contains(m.String(), "hostname:(contents:api mode:0644 uid:0 gid:0)"))
+
+	c.NameServers = []string{"dns.example.com"}
+	assert.EqualError(t, addDNSConfig(m, c), `invalid nameserver address "dns.example.com"`)
+}
+
+func TestAddNetworkInterfaces(t *testing.T) {
+	m := NewManifest("")
+	c := &RunConfig{Interfaces: []NetworkInterface{
+		{IPAddr: "10.0.0.2/24", Gateway: "10.0.0.1", MTU: 9000},
+		{IPv6Addr: "2001:db8::2", IPv6Gateway: "2001:db8::1"},
+		{Mode: "dhcp"},
+	}}
+	err := addNetworkConfig(m, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifestFile := m.String()
+	assert.Contains(t, manifestFile, "en1:(ipaddr:10.0.0.2 netmask:255.255.255.0 gateway:10.0.0.1 mtu:9000)\n")
+	assert.Contains(t, manifestFile, `en2:(ip6addr:"2001:db8::2" ip6prefix:64 ip6gateway:"2001:db8::1")`+"\n")
+	assert.Contains(t, manifestFile, "en3:()\n")
+
+	parsed, err := ParseManifest(strings.NewReader(manifestFile), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, m.interfaces, parsed.interfaces)
+
+	tests := []struct {
+		iface NetworkInterface
+		err   string
+	}{
+		{NetworkInterface{IPAddr: "10.0.0.2/24", NetMask: "255.255.0.0"}, `network interface en1: prefix length of IPAddr "10.0.0.2/24" conflicts with NetMask`},
+		{NetworkInterface{IPAddr: "2001:db8::2"}, `network interface en1: invalid IPv4 address "2001:db8::2"`},
+		{NetworkInterface{IPv6Addr: "2001:db8::2/129"}, `network interface en1: invalid IPv6 address "2001:db8::2/129"`},
+		{NetworkInterface{Mode: "static"}, "network interface en1: static mode needs IPAddr or IPv6Addr"},
+		{NetworkInterface{Mode: "dhcp", IPAddr: "10.0.0.2"}, "network interface en1: dhcp mode does not take static addresses"},
+		{NetworkInterface{Gateway: "10.0.0.1"}, "network interface en1: an IPv4 address is needed for Gateway and NetMask"},
+		{NetworkInterface{MTU: 10}, "network interface en1: invalid MTU 10"},
+	}
+	for _, tt := range tests {
+		err := addNetworkConfig(NewManifest(""), &RunConfig{Interfaces: []NetworkInterface{tt.iface}})
+		assert.EqualError(t, err, tt.err)
+	}
+}
+
+func TestManifestErrors(t *testing.T) {
+	m := NewManifest("")
+	m.AddFileContents("/etc/hosts", []byte("127.0.0.1 localhost"), 0644)
+
+	err := m.AddFile("/etc/missing", "/nonexistent/file")
+	var missing *MissingFileError
+	if assert.True(t, errors.As(err, &missing)) {
+		assert.Equal(t, "/etc/missing", missing.VMPath)
+		assert.Equal(t, "/nonexistent/file", missing.HostPath)
+		assert.True(t, os.IsNotExist(missing.Cause))
+	}
+
+	err = m.AddFile("/etc/hosts/file", "manifest.go")
+	assert.Equal(t, &FileConflictError{VMPath: "/etc/hosts", HostPath: "manifest.go", IsDir: true}, err)
+	assert.EqualError(t, err, "directory '/etc/hosts' is conflicting with an existing file (host path 'manifest.go')")
+
+	err = m.AddFile("/etc", "manifest.go")
+	assert.Equal(t, &FileConflictError{VMPath: "/etc", HostPath: "manifest.go"}, err)
+
+	err = m.AddLink("/etc/link", "manifest.go")
+	var badLink *BadLinkError
+	assert.True(t, errors.As(err, &badLink))
+}
+
+func TestBuildManifestErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "app")
+	ioutil.WriteFile(script, []byte("#!/nonexistent/interpreter\n"), 0755)
+	_, err = BuildManifest(&Config{Program: script})
+	var interp *InterpreterNotFoundError
+	if assert.True(t, errors.As(err, &interp)) {
+		assert.Equal(t, "/nonexistent/interpreter", interp.Interpreter)
+	}
+
+	_, err = BuildPackageManifest(dir, &Config{Files: []string{"/nonexistent/file"}})
+	var missing *MissingFileError
+	if assert.True(t, errors.As(err, &missing)) {
+		assert.Equal(t, "/nonexistent/file", missing.HostPath)
+	}
+}
+
+func TestFileMetadata(t *testing.T) {
+	m := NewManifest("")
+	m.AddLibrary("/bin/app")
+	m.AddFileContents("/etc/key", []byte("secret"), 0644)
+
+	err := m.SetFileMetadata("/etc/key", 0600, 1000, 1000, time.Unix(1500000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.SetFileMetadata("/etc/missing", 0600, 0, 0, time.Unix(0, 0))
+	assert.EqualError(t, err, "file '/etc/missing' is not in the manifest")
+
+	var sb strings.Builder
+	writeChildren(m.children, &sb, 0, "", m.metadata)
+	want := `bin:(children:(
+    app:(contents:(host:/bin/app))
+))
+etc:(children:(
+    key:(contents:secret mode:0600 uid:1000 gid:1000 mtime:1500000000)
+))
+`
+	assert.Equal(t, want, sb.String())
+}
+
+func TestAddFileMetadataNormalize(t *testing.T) {
+	os.Setenv("SOURCE_DATE_EPOCH", "1600000000")
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+
+	uid := 1000
+	c := &Config{
+		FileMetadataMode: "normalize",
+		FileMetadata: map[string]FileMetadata{
+			"etc/key": {Mode: "0400", UID: &uid},
+		},
+	}
+	m := NewManifest("")
+	m.AddFileContents("/etc/key", []byte("secret"), 0644)
+	m.AddFileContents("/etc/motd", []byte("hello"), 0640)
+
+	err := addFileMetadata(m, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Unix(1600000000, 0).UTC()
+	assert.Equal(t, fileMetadata{mode: 0400, uid: 1000, mtime: mtime}, m.metadata["/etc/key"])
+	assert.Equal(t, fileMetadata{mode: 0640, mtime: mtime}, m.metadata["/etc/motd"])
+
+	c.FileMetadataMode = "keep"
+	assert.EqualError(t, addFileMetadata(m, c), `invalid file metadata mode "keep", expected preserve or normalize`)
+}
+
 func TestManifestWithDeps(t *testing.T) {
 	var c Config
 	c.Program = "../data/main"
@@ -81,6 +305,32 @@ func TestSerializeManifest(t *testing.T) {
 	}
 }
 
+func TestManifestCanonicalOrder(t *testing.T) {
+	m := NewManifest("")
+	m.AddKernel("kernel/kernel")
+	m.AddLibrary("/usr/lib/b.so")
+	m.AddLibrary("/usr/lib/a.so")
+	m.AddLibrary("/etc/c.conf")
+	m.AddEnvironmentVariable("ZED", "1")
+	m.AddEnvironmentVariable("ALPHA", "2")
+	m.AddEnvironmentVariable("MID", "3")
+	m.AddDebugFlag("trace", 't')
+	m.AddDebugFlag("fault", 't')
+	m.mounts["vol2"] = "/b"
+	m.mounts["vol1"] = "/a"
+
+	s := m.String()
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, s, m.String())
+	}
+
+	assert.Contains(t, s, "environment:(ALPHA:2 MID:3 ZED:1)\n")
+	assert.Contains(t, s, "fault:t\ntrace:t\n")
+	assert.Contains(t, s, "    vol1:/a\n    vol2:/b\n")
+	assert.True(t, strings.Index(s, "a.so") < strings.Index(s, "b.so"))
+	assert.True(t, strings.Index(s, "etc:") < strings.Index(s, "usr:"))
+}
+
 func TestAddKlibs(t *testing.T) {
 
 	t.Run("should add klibs to manifest", func(t *testing.T) {
@@ -109,9 +359,13 @@ func TestAddKlibs(t *testing.T) {
 	})
 }
 
-func TestAddRadarEnvAddKlibs(t *testing.T) {
+func TestAddRadarKlib(t *testing.T) {
 	m := NewManifest("")
-	m.AddEnvironmentVariable("RADAR_KEY", "TEST")
+	c := &Config{Klibs: KlibsConfig{Radar: &RadarKlibConfig{Key: "TEST"}}}
+	err := addKlibsFromConfig(m, c)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	got := m.klibs
 	want := []string{"tls", "radar"}
@@ -119,103 +373,87 @@ func TestAddRadarEnvAddKlibs(t *testing.T) {
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("got %v, want %v", got, want)
 	}
+	assert.Equal(t, "TEST", m.environment["RADAR_KEY"])
+}
+
+func TestKlibEnvironmentVariables(t *testing.T) {
+	tests := []struct {
+		c   Config
+		err string
+	}{
+		{Config{Env: map[string]string{"RADAR_KEY": "TEST"}}, "environment variable RADAR_KEY no longer configures klibs, set Klibs.Radar.Key in the config instead"},
+		{Config{Env: map[string]string{"ntpAddress": "127.0.0.1", "ntpPort": "1234"}}, "environment variable ntpAddress no longer configures klibs, set Klibs.NTP.Address in the config instead"},
+		{Config{Env: map[string]string{"ntpPollMin": "5"}, RunConfig: RunConfig{Klibs: []string{"ntp"}}}, "environment variable ntpPollMin no longer configures klibs, set Klibs.NTP.PollMin in the config instead"},
+		{Config{Env: map[string]string{"RADAR_KEY": "TEST"}, Klibs: KlibsConfig{Radar: &RadarKlibConfig{Key: "TEST"}}}, ""},
+		{Config{Env: map[string]string{"ntpAddress": "127.0.0.1"}, Klibs: KlibsConfig{NTP: &NTPKlibConfig{Address: "127.0.0.1"}}}, ""},
+	}
+
+	for _, tt := range tests {
+		err := addKlibsFromConfig(NewManifest(""), &tt.c)
+		if tt.err == "" {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, tt.err)
+		}
+	}
 }
 
-func TestAddNTPEnvVarsToManifestFile(t *testing.T) {
+func TestAddNTPKlibToManifestFile(t *testing.T) {
 
-	t.Run("should not add ntp manifest variables if ntp klib is not specified", func(t *testing.T) {
+	t.Run("should not add ntp manifest variables from the environment", func(t *testing.T) {
 		m := NewManifest("")
+		m.AddKlibs([]string{"ntp"})
 		m.AddEnvironmentVariable("ntpAddress", "127.0.0.1")
-		m.AddEnvironmentVariable("ntpPort", "1234")
-		m.AddEnvironmentVariable("ntpPollMin", "5")
-		m.AddEnvironmentVariable("ntpPollMax", "10")
 
 		manifestFile := m.String()
 
 		assert.NotContains(t, manifestFile, "ntp_address:127.0.0.1\n")
-		assert.NotContains(t, manifestFile, "ntp_port:1234\n")
-		assert.NotContains(t, manifestFile, "ntp_poll_min:5\n")
-		assert.NotContains(t, manifestFile, "ntp_poll_max:10\n")
 	})
 
-	t.Run("should add ntp manifest variables if ntp klib is added and environment variables are valid", func(t *testing.T) {
+	t.Run("should add ntp manifest variables from the ntp klib config", func(t *testing.T) {
 		m := NewManifest("")
-		m.AddKlibs([]string{"ntp"})
-		m.AddEnvironmentVariable("ntpAddress", "127.0.0.1")
-		m.AddEnvironmentVariable("ntpPort", "1234")
-		m.AddEnvironmentVariable("ntpPollMin", "5")
-		m.AddEnvironmentVariable("ntpPollMax", "10")
+		m.AddNTPConfig(&NTPKlibConfig{Address: "127.0.0.1", Port: 1234, PollMin: 5, PollMax: 10})
 
 		manifestFile := m.String()
 
+		assert.Equal(t, []string{"ntp"}, m.klibs)
 		assert.Contains(t, manifestFile, "ntp_address:127.0.0.1\n")
 		assert.Contains(t, manifestFile, "ntp_port:1234\n")
 		assert.Contains(t, manifestFile, "ntp_poll_min:5\n")
 		assert.Contains(t, manifestFile, "ntp_poll_max:10\n")
 	})
 
-	t.Run("should not ntp poll limits if min is greater than max", func(t *testing.T) {
+	t.Run("should only add the ntp options that are set", func(t *testing.T) {
 		m := NewManifest("")
-		m.AddKlibs([]string{"ntp"})
-		m.AddEnvironmentVariable("ntpPollMin", "10")
-		m.AddEnvironmentVariable("ntpPollMax", "5")
-
-		manifestFile := m.String()
-
-		assert.NotContains(t, manifestFile, "ntp_poll_min:10\n")
-		assert.NotContains(t, manifestFile, "ntp_poll_max:5\n")
-	})
-
-	t.Run("should not add ntp poll min value if is lower than 4", func(t *testing.T) {
-		m := NewManifest("")
-		m.AddKlibs([]string{"ntp"})
-		m.AddEnvironmentVariable("ntpPollMin", "3")
-
-		manifestFile := m.String()
-
-		assert.NotContains(t, manifestFile, "ntp_poll_min:5\n")
-	})
-
-	t.Run("should add ntp poll min value if is greater than 3", func(t *testing.T) {
-		m := NewManifest("")
-		m.AddKlibs([]string{"ntp"})
-		m.AddEnvironmentVariable("ntpPollMin", "5")
-
-		manifestFile := m.String()
-
-		assert.Contains(t, manifestFile, "ntp_poll_min:5\n")
-	})
-
-	t.Run("should not add ntp poll max value if is greater than 17", func(t *testing.T) {
-		m := NewManifest("")
-		m.AddKlibs([]string{"ntp"})
-		m.AddEnvironmentVariable("ntpPollMax", "18")
-
-		manifestFile := m.String()
-
-		assert.NotContains(t, manifestFile, "ntp_poll_max:18\n")
-	})
-
-	t.Run("should add ntp poll max value if is lower than 18", func(t *testing.T) {
-		m := NewManifest("")
-		m.AddKlibs([]string{"ntp"})
-		m.AddEnvironmentVariable("ntpPollMax", "17")
+		m.AddNTPConfig(&NTPKlibConfig{PollMax: 17})
 
 		manifestFile := m.String()
 
+		assert.NotContains(t, manifestFile, "ntp_address:")
+		assert.NotContains(t, manifestFile, "ntp_poll_min:")
 		assert.Contains(t, manifestFile, "ntp_poll_max:17\n")
 	})
+}
 
-	t.Run("should not add ntp poll max/min values if they are not numbers", func(t *testing.T) {
-		m := NewManifest("")
-		m.AddKlibs([]string{"ntp"})
-		m.AddEnvironmentVariable("ntpPollMin", "asd")
-		m.AddEnvironmentVariable("ntpPollMax", "dsa")
-
-		manifestFile := m.String()
-
-		assert.NotContains(t, manifestFile, "ntp_poll_min:asd\n")
-		assert.NotContains(t, manifestFile, "ntp_poll_max:dsa\n")
-	})
+func TestValidateKlibsConfig(t *testing.T) {
+	tests := []struct {
+		klibs KlibsConfig
+		err   string
+	}{
+		{KlibsConfig{NTP: &NTPKlibConfig{Address: "127.0.0.1", PollMin: 4, PollMax: 17}}, ""},
+		{KlibsConfig{NTP: &NTPKlibConfig{PollMin: 10, PollMax: 5}}, "klibs: ntp: PollMin 10 is greater than PollMax 5"},
+		{KlibsConfig{NTP: &NTPKlibConfig{PollMin: 3}}, "klibs: ntp: PollMin 3 is not between 4 and 17"},
+		{KlibsConfig{NTP: &NTPKlibConfig{PollMax: 18}}, "klibs: ntp: PollMax 18 is not between 4 and 17"},
+		{KlibsConfig{NTP: &NTPKlibConfig{Port: 70000}}, "klibs: ntp: invalid Port 70000"},
+		{KlibsConfig{Radar: &RadarKlibConfig{}}, "klibs: radar: Key is required"},
+	}
 
+	for _, tt := range tests {
+		err := tt.klibs.validate()
+		if tt.err == "" {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, tt.err)
+		}
+	}
 }
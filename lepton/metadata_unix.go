@@ -0,0 +1,16 @@
+// +build linux darwin
+
+package lepton
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the uid and gid of a host file
+func fileOwner(info os.FileInfo) (int, int) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), int(st.Gid)
+	}
+	return 0, 0
+}
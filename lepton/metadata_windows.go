@@ -0,0 +1,10 @@
+package lepton
+
+import (
+	"os"
+)
+
+// fileOwner stub, windows files have no uid and gid
+func fileOwner(info os.FileInfo) (int, int) {
+	return 0, 0
+}
@@ -1,11 +1,15 @@
 package lepton
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+
+	"github.com/nanovms/ops/fs"
 )
 
 var (
@@ -125,3 +129,73 @@ func uuidFromMKFS(b []byte) string {
 	}
 	return strings.TrimSpace(uuid)
 }
+
+// writeFilesystem writes the filesystem of manifest to path without the mkfs
+// program and returns its UUID. Host files are looked up in the target root
+// of c.
+func writeFilesystem(c *Config, manifest string, path string, opts fs.Options) (string, error) {
+	p := &manifestParser{data: []byte(manifest), line: 1}
+	root, err := p.parseTuple()
+	if err != nil {
+		return "", err
+	}
+
+	if c.BaseVolumeSz != "" {
+		if opts.Size, err = parseVolumeSize(c.BaseVolumeSz); err != nil {
+			return "", err
+		}
+	}
+	if c.Reproducible {
+		sum := sha256.Sum256([]byte(manifest))
+		copy(opts.UUID[:], sum[:])
+	}
+	opts.Resolve = func(hostpath string) (string, error) {
+		return lookupFile(c.TargetRoot, hostpath)
+	}
+
+	uuid, err := fs.Mkfs(path, root, opts)
+	if err != nil {
+		return "", err
+	}
+	return uuid.String(), nil
+}
+
+// mkfsProgress returns a progress callback of writeFilesystem that shows
+// the bytes of the files written so far
+func mkfsProgress() func(fs.Progress) {
+	var wc *WriteCounter
+	var written int64
+	return func(p fs.Progress) {
+		if wc == nil {
+			wc = NewWriteCounter(int(p.TotalBytes))
+			wc.Start()
+		}
+		wc.Add(int(p.Bytes - written))
+		written = p.Bytes
+		if p.Files == p.TotalFiles {
+			wc.Finish()
+		}
+	}
+}
+
+// parseVolumeSize reads a size in bytes with an optional k, m or g suffix
+func parseVolumeSize(s string) (int64, error) {
+	size := strings.TrimSuffix(strings.ToLower(s), "b")
+	var unit int64 = 1
+	switch {
+	case strings.HasSuffix(size, "k"):
+		unit = 1024
+	case strings.HasSuffix(size, "m"):
+		unit = 1024 * 1024
+	case strings.HasSuffix(size, "g"):
+		unit = 1024 * 1024 * 1024
+	}
+	if unit != 1 {
+		size = size[:len(size)-1]
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid volume size %s", s)
+	}
+	return n * unit, nil
+}
@@ -35,3 +35,25 @@ func TestMKFSCommand(t *testing.T) {
 		}
 	})
 }
+
+func TestParseVolumeSize(t *testing.T) {
+	tests := map[string]int64{
+		"512":   512,
+		"100k":  100 * 1024,
+		"64M":   64 * 1024 * 1024,
+		"2GB":   2 * 1024 * 1024 * 1024,
+		"1g":    1024 * 1024 * 1024,
+		"12 MB": 0,
+		"-1":    0,
+	}
+	for s, want := range tests {
+		got, err := parseVolumeSize(s)
+		if want == 0 {
+			if err == nil {
+				t.Errorf("parseVolumeSize(%q) = %d, want error", s, got)
+			}
+		} else if got != want || err != nil {
+			t.Errorf("parseVolumeSize(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package lepton
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultNetMask    = "255.255.255.0"
+	defaultIPv6Prefix = 64
+
+	// maxInterfaces is the number of network devices that fit on the pcie
+	// root ports of the local qemu machine
+	maxInterfaces = 6
+)
+
+// addNetworkConfig adds the static network configuration of the instance
+func addNetworkConfig(m *Manifest, c *RunConfig) error {
+	if len(c.Interfaces) == 0 {
+		if c.IPAddr != "" {
+			m.AddNetworkConfig(&ManifestNetworkConfig{
+				IP:      c.IPAddr,
+				Gateway: c.Gateway,
+				NetMask: c.NetMask,
+			})
+		}
+		return nil
+	}
+
+	if len(c.Interfaces) > maxInterfaces {
+		return fmt.Errorf("%d network interfaces configured, at most %d are supported", len(c.Interfaces), maxInterfaces)
+	}
+
+	for i, iface := range c.Interfaces {
+		nc, err := iface.manifestConfig()
+		if err != nil {
+			return fmt.Errorf("network interface en%d: %v", i+1, err)
+		}
+		m.AddInterface(nc)
+	}
+	return nil
+}
+
+// manifestConfig validates the interface settings and converts them to the
+// manifest network configuration
+func (ni NetworkInterface) manifestConfig() (*ManifestNetworkConfig, error) {
+	nc := &ManifestNetworkConfig{MTU: ni.MTU}
+
+	if ni.MTU != 0 && (ni.MTU < 68 || ni.MTU > 65535) {
+		return nil, fmt.Errorf("invalid MTU %d", ni.MTU)
+	}
+
+	if ni.MAC != "" {
+		if _, err := net.ParseMAC(ni.MAC); err != nil {
+			return nil, fmt.Errorf("invalid MAC address %q", ni.MAC)
+		}
+	}
+
+	static := ni.IPAddr != "" || ni.IPv6Addr != ""
+	switch ni.Mode {
+	case "":
+	case "static":
+		if !static {
+			return nil, fmt.Errorf("static mode needs IPAddr or IPv6Addr")
+		}
+	case "dhcp":
+		if static {
+			return nil, fmt.Errorf("dhcp mode does not take static addresses")
+		}
+	default:
+		return nil, fmt.Errorf("invalid mode %q, expected static or dhcp", ni.Mode)
+	}
+
+	if ni.IPAddr != "" {
+		ip, prefix, err := parseAddress(ni.IPAddr, 32)
+		if err != nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", ni.IPAddr)
+		}
+		nc.IP = ip.String()
+
+		switch {
+		case prefix >= 0 && ni.NetMask != "":
+			return nil, fmt.Errorf("prefix length of IPAddr %q conflicts with NetMask", ni.IPAddr)
+		case prefix >= 0:
+			nc.NetMask = net.IP(net.CIDRMask(prefix, 32)).String()
+		case ni.NetMask != "":
+			mask := net.ParseIP(ni.NetMask)
+			if mask == nil || mask.To4() == nil {
+				return nil, fmt.Errorf("invalid netmask %q", ni.NetMask)
+			}
+			nc.NetMask = mask.String()
+		default:
+			nc.NetMask = defaultNetMask
+		}
+
+		if ni.Gateway != "" {
+			gw := net.ParseIP(ni.Gateway)
+			if gw == nil || gw.To4() == nil {
+				return nil, fmt.Errorf("invalid IPv4 gateway %q", ni.Gateway)
+			}
+			nc.Gateway = gw.String()
+		}
+	} else if ni.Gateway != "" || ni.NetMask != "" {
+		return nil, fmt.Errorf("an IPv4 address is needed for Gateway and NetMask")
+	}
+
+	if ni.IPv6Addr != "" {
+		ip, prefix, err := parseAddress(ni.IPv6Addr, 128)
+		if err != nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q", ni.IPv6Addr)
+		}
+		nc.IPv6 = ip.String()
+		nc.IPv6Prefix = prefix
+		if prefix < 0 {
+			nc.IPv6Prefix = defaultIPv6Prefix
+		}
+
+		if ni.IPv6Gateway != "" {
+			gw := net.ParseIP(ni.IPv6Gateway)
+			if gw == nil || gw.To4() != nil {
+				return nil, fmt.Errorf("invalid IPv6 gateway %q", ni.IPv6Gateway)
+			}
+			nc.IPv6Gateway = gw.String()
+		}
+	} else if ni.IPv6Gateway != "" {
+		return nil, fmt.Errorf("an IPv6 address is needed for IPv6Gateway")
+	}
+
+	return nc, nil
+}
+
+// parseAddress parses an IP address with an optional prefix length, which
+// is -1 when it is not given
+func parseAddress(s string, bits int) (net.IP, int, error) {
+	addr := s
+	prefix := -1
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		addr = s[:i]
+		n, err := strconv.Atoi(s[i+1:])
+		if err != nil || n < 1 || n > bits {
+			return nil, 0, fmt.Errorf("invalid prefix length in %q", s)
+		}
+		prefix = n
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	return ip, prefix, nil
+}
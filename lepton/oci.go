@@ -0,0 +1,579 @@
+package lepton
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ociWhiteoutPrefix = ".wh."
+	ociOpaqueWhiteout = ".wh..wh..opq"
+
+	// ociDefaultPath is the PATH of images that do not set one
+	ociDefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+// ociImageConfig is the part of the configuration of an OCI or Docker image
+// that says how to run it
+type ociImageConfig struct {
+	Config struct {
+		Entrypoint []string
+		Cmd        []string
+		Env        []string
+		WorkingDir string
+	} `json:"config"`
+}
+
+// ociDescriptor points to a blob of an OCI image layout or registry
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+// ociManifest is an image manifest or an index of manifests of an OCI image
+// layout or registry
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers,omitempty"`
+	Manifests     []ociDescriptor   `json:"manifests,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// dockerManifest is an entry of the manifest.json file of 'docker save'
+// archives
+type dockerManifest struct {
+	Config string
+	Layers []string
+}
+
+// ociImage is an OCI or Docker image whose layers are unpacked in rootfs
+type ociImage struct {
+	rootfs string
+	config ociImageConfig
+}
+
+// ApplyOCIImage unpacks the image of c.OCI, a 'docker save' archive or an
+// OCI image layout directory, and changes c to run it. The merged layers
+// become the target root, and the entrypoint, command, environment and
+// working directory of the image are used unless c sets them.
+func ApplyOCIImage(c *Config) error {
+	layout := c.OCI.Image
+	if fi, err := os.Stat(layout); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		tmp, err := ioutil.TempDir("", "oci")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		if err = extractOCIArchive(layout, tmp); err != nil {
+			return fmt.Errorf("%s: %v", c.OCI.Image, err)
+		}
+		layout = tmp
+	}
+
+	config, layers, err := readOCILayout(layout)
+	if err != nil {
+		return fmt.Errorf("%s: %v", c.OCI.Image, err)
+	}
+
+	// images are unpacked once, the digest of their configuration covers
+	// the digests of their layers
+	sum := sha256.Sum256(config)
+	rootfs := filepath.Join(GetOpsHome(), "oci", hex.EncodeToString(sum[:]), "rootfs")
+	if _, err := os.Stat(rootfs); os.IsNotExist(err) {
+		tmp := rootfs + ".tmp"
+		os.RemoveAll(tmp)
+		if err = unpackOCILayers(layers, tmp); err != nil {
+			os.RemoveAll(tmp)
+			return fmt.Errorf("%s: %v", c.OCI.Image, err)
+		}
+		if err = os.Rename(tmp, rootfs); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	img := &ociImage{rootfs: rootfs}
+	if err = json.Unmarshal(config, &img.config); err != nil {
+		return fmt.Errorf("%s: image configuration: %v", c.OCI.Image, err)
+	}
+	oc, err := img.apply(c)
+	if err != nil {
+		return fmt.Errorf("%s: %v", c.OCI.Image, err)
+	}
+	*c = *oc
+	return nil
+}
+
+// apply returns a copy of c that runs the image with its rootfs as the
+// target root
+func (img *ociImage) apply(c *Config) (*Config, error) {
+	oc := *c
+	oc.TargetRoot = img.rootfs
+
+	env := make(map[string]string)
+	for _, kv := range img.config.Config.Env {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	if oc.Cwd == "" {
+		oc.Cwd = img.config.Config.WorkingDir
+	}
+	for k, v := range c.Env {
+		env[k] = v
+	}
+	oc.Env = env
+
+	if len(oc.Args) == 0 {
+		oc.Args = append(append([]string{}, img.config.Config.Entrypoint...), img.config.Config.Cmd...)
+	}
+	if oc.Program == "" {
+		if len(oc.Args) == 0 {
+			return nil, fmt.Errorf("the image has no entrypoint or command")
+		}
+		program, err := img.lookPath(oc.Args[0], env["PATH"])
+		if err != nil {
+			return nil, err
+		}
+		oc.Program = program
+	}
+	return &oc, nil
+}
+
+// lookPath finds the program name in the directories of the PATH of the
+// image, like the shell of the image would. Relative paths start at the
+// working directory of the image.
+func (img *ociImage) lookPath(name string, pathEnv string) (string, error) {
+	var candidates []string
+	if strings.Contains(name, "/") {
+		candidates = []string{path.Join("/", img.config.Config.WorkingDir, name)}
+	} else {
+		if pathEnv == "" {
+			pathEnv = ociDefaultPath
+		}
+		for _, dir := range filepath.SplitList(pathEnv) {
+			candidates = append(candidates, path.Join("/", dir, name))
+		}
+	}
+
+	// lookupFile falls back to the host for files the image does not have
+	for _, program := range candidates {
+		hostpath, err := lookupFile(img.rootfs, program)
+		if err != nil || !strings.HasPrefix(hostpath, img.rootfs+"/") {
+			continue
+		}
+		if fi, err := os.Stat(hostpath); err == nil && fi.Mode().IsRegular() {
+			return program, nil
+		}
+	}
+	return "", fmt.Errorf("program %s is not in the image", name)
+}
+
+// readOCILayout reads the configuration and the paths of the layers of the
+// image in dir, a 'docker save' archive or an OCI image layout
+func readOCILayout(dir string) ([]byte, []string, error) {
+	data, err := readInRoot(dir, "manifest.json")
+	if err == nil {
+		var manifests []dockerManifest
+		if err = json.Unmarshal(data, &manifests); err != nil {
+			return nil, nil, fmt.Errorf("manifest.json: %v", err)
+		}
+		if len(manifests) == 0 {
+			return nil, nil, fmt.Errorf("manifest.json has no image")
+		}
+		config, err := readInRoot(dir, manifests[0].Config)
+		if err != nil {
+			return nil, nil, err
+		}
+		var layers []string
+		for _, l := range manifests[0].Layers {
+			layer, err := resolveInRoot(dir, l, true)
+			if err != nil {
+				return nil, nil, err
+			}
+			layers = append(layers, layer)
+		}
+		return config, layers, nil
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	data, err = readInRoot(dir, "index.json")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("neither manifest.json nor index.json found, not a Docker or OCI image")
+		}
+		return nil, nil, err
+	}
+	var m ociManifest
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, nil, fmt.Errorf("index.json: %v", err)
+	}
+
+	// indexes may point to other indexes, such as the manifests of
+	// multi-platform images of which the linux/amd64 one is used
+	for len(m.Manifests) > 0 {
+		desc := m.Manifests[0]
+		for _, d := range m.Manifests {
+			if d.Platform != nil && d.Platform.OS == "linux" && d.Platform.Architecture == "amd64" {
+				desc = d
+				break
+			}
+		}
+		data, err = readOCIBlob(dir, desc.Digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		m = ociManifest{}
+		if err = json.Unmarshal(data, &m); err != nil {
+			return nil, nil, fmt.Errorf("manifest %s: %v", desc.Digest, err)
+		}
+	}
+
+	if m.Config.Digest == "" {
+		return nil, nil, fmt.Errorf("index.json has no image manifest")
+	}
+	config, err := readOCIBlob(dir, m.Config.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	var layers []string
+	for _, l := range m.Layers {
+		layer, err := ociBlobPath(dir, l.Digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		layers = append(layers, layer)
+	}
+	return config, layers, nil
+}
+
+// ociBlobPath returns the path of the blob with digest in the OCI image
+// layout in dir
+func ociBlobPath(dir string, digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[1], "/.") {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return resolveInRoot(dir, path.Join("blobs", parts[0], parts[1]), true)
+}
+
+func readOCIBlob(dir string, digest string) ([]byte, error) {
+	blob, err := ociBlobPath(dir, digest)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(blob)
+}
+
+func readInRoot(root string, name string) ([]byte, error) {
+	p, err := resolveInRoot(root, name, true)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(p)
+}
+
+// resolveInRoot returns the path of name in root. Symlinks are resolved as
+// if root was the root directory so that the path never leaves root, the
+// last element is only resolved if followLast is set.
+func resolveInRoot(root string, name string, followLast bool) (string, error) {
+	pending := strings.Split(path.Clean("/"+name), "/")
+	resolved := "/"
+	links := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		if len(pending) == 0 && !followLast {
+			resolved = next
+			break
+		}
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > 255 {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", name)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// extractOCIArchive extracts the files of the archive at src, such as the
+// output of 'docker save', to dir
+func extractOCIArchive(src string, dir string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = extractTarEntry(dir, hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// unpackOCILayers unpacks the layers, tar archives that may be compressed
+// with gzip, on top of each other in dir
+func unpackOCILayers(layers []string, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		if err := unpackOCILayer(layer, dir); err != nil {
+			return fmt.Errorf("layer %s: %v", filepath.Base(layer), err)
+		}
+	}
+	return nil
+}
+
+// unpackOCILayer unpacks a layer in dir. Whiteout files remove the files
+// of the layers below, opaque whiteouts the contents of their directory.
+func unpackOCILayer(layer string, dir string) error {
+	f, err := os.Open(layer)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return fmt.Errorf("zstd compressed layers are not supported")
+	}
+
+	// the files of this layer, opaque whiteouts only remove the files of
+	// the layers below
+	added := make(map[string]bool)
+	var opaque []string
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean("/" + hdr.Name)
+		parent, base := path.Split(name)
+		switch {
+		case base == ociOpaqueWhiteout:
+			opaque = append(opaque, parent)
+		case strings.HasPrefix(base, ociWhiteoutPrefix):
+			p, err := resolveInRoot(dir, path.Join(parent, base[len(ociWhiteoutPrefix):]), false)
+			if err != nil {
+				return err
+			}
+			if err = os.RemoveAll(p); err != nil {
+				return err
+			}
+		default:
+			if err = extractTarEntry(dir, hdr, tr); err != nil {
+				return err
+			}
+			added[name] = true
+		}
+	}
+
+	for _, parent := range opaque {
+		p, err := resolveInRoot(dir, parent, true)
+		if err != nil {
+			return err
+		}
+		entries, err := ioutil.ReadDir(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		for _, e := range entries {
+			if !added[path.Join(parent, e.Name())] {
+				if err = os.RemoveAll(filepath.Join(p, e.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// extractTarEntry writes the file of hdr in dir, replacing the file that
+// was there. Device files and other special files are skipped.
+func extractTarEntry(dir string, hdr *tar.Header, r io.Reader) error {
+	name := path.Clean("/" + hdr.Name)
+	if name == "/" {
+		return nil
+	}
+	p, err := resolveInRoot(dir, name, false)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	mode := os.FileMode(hdr.Mode).Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if fi, err := os.Lstat(p); err == nil && !fi.IsDir() {
+			os.Remove(p)
+		}
+		if err = os.MkdirAll(p, 0755); err != nil {
+			return err
+		}
+		// directories stay writable for the files of the layers above
+		return os.Chmod(p, mode|0700)
+	case tar.TypeReg, tar.TypeRegA:
+		if err = removeNonDir(p); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode|0600)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		if err = f.Close(); err != nil {
+			return err
+		}
+		if err = os.Chmod(p, mode|0400); err != nil {
+			return err
+		}
+		return os.Chtimes(p, hdr.ModTime, hdr.ModTime)
+	case tar.TypeSymlink:
+		if err = removeNonDir(p); err != nil {
+			return err
+		}
+		return os.Symlink(hdr.Linkname, p)
+	case tar.TypeLink:
+		target, err := resolveInRoot(dir, hdr.Linkname, false)
+		if err != nil {
+			return err
+		}
+		if err = removeNonDir(p); err != nil {
+			return err
+		}
+		return os.Link(target, p)
+	}
+	return nil
+}
+
+// removeNonDir removes the file at p unless it is a directory
+func removeNonDir(p string) error {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s is a directory", p)
+	}
+	return os.Remove(p)
+}
+
+// addRootFS adds the files of the rootfs of an image that are not in m yet
+// to the same path in the image
+func addRootFS(m *Manifest, rootfs string) error {
+	return filepath.Walk(rootfs, func(hostpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, hostpath)
+		if err != nil || rel == "." {
+			return err
+		}
+		vmpath := "/" + filepath.ToSlash(rel)
+		if node := m.node(vmpath); node != nil {
+			if info.IsDir() && !isDir(node) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(hostpath)
+			if err != nil {
+				return &BadLinkError{VMPath: vmpath, HostPath: hostpath, Cause: err}
+			}
+			return m.addLinkTarget(vmpath, hostpath, target)
+		case info.IsDir():
+			_, err = m.mkdirAll(strings.Split(rel, string(filepath.Separator)), hostpath)
+			return err
+		case info.Mode().IsRegular():
+			return m.AddFile(vmpath, hostpath)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,257 @@
+package lepton
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type ociTestEntry struct {
+	name     string
+	typeflag byte
+	contents string
+	linkname string
+}
+
+// ociTestLayer returns a tar archive with the entries, compressed with gzip
+// if compress is set
+func ociTestLayer(t *testing.T, compress bool, entries ...ociTestEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644}
+		switch e.typeflag {
+		case tar.TypeDir:
+			hdr.Mode = 0755
+		case tar.TypeReg:
+			hdr.Size = int64(len(e.contents))
+			if filepath.Dir(e.name) == "usr/bin" {
+				hdr.Mode = 0755
+			}
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(e.contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	if !compress {
+		return buf.Bytes()
+	}
+
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	zw.Write(buf.Bytes())
+	require.NoError(t, zw.Close())
+	return zbuf.Bytes()
+}
+
+func ociTestLayers(t *testing.T) [][]byte {
+	return [][]byte{
+		ociTestLayer(t, false,
+			ociTestEntry{name: "etc/", typeflag: tar.TypeDir},
+			ociTestEntry{name: "etc/a", typeflag: tar.TypeReg, contents: "a"},
+			ociTestEntry{name: "usr/bin/app", typeflag: tar.TypeReg, contents: "app"},
+			ociTestEntry{name: "bin", typeflag: tar.TypeSymlink, linkname: "usr/bin"},
+			ociTestEntry{name: "opt/old/x", typeflag: tar.TypeReg, contents: "x"},
+			ociTestEntry{name: "var/f", typeflag: tar.TypeReg, contents: "f"},
+		),
+		ociTestLayer(t, true,
+			ociTestEntry{name: "etc/.wh.a", typeflag: tar.TypeReg},
+			ociTestEntry{name: "opt/old/y", typeflag: tar.TypeReg, contents: "y"},
+			ociTestEntry{name: "opt/old/.wh..wh..opq", typeflag: tar.TypeReg},
+			ociTestEntry{name: "var/g", typeflag: tar.TypeLink, linkname: "var/f"},
+			ociTestEntry{name: "escape", typeflag: tar.TypeSymlink, linkname: "/../.."},
+			ociTestEntry{name: "escape/file", typeflag: tar.TypeReg, contents: "inside"},
+		),
+	}
+}
+
+func ociTestConfig() []byte {
+	return []byte(`{"architecture":"amd64","os":"linux","config":{
+		"Entrypoint":["app"],"Cmd":["-v"],
+		"Env":["PATH=/usr/local/bin:/usr/bin","FOO=bar"],
+		"WorkingDir":"/srv"}}`)
+}
+
+// writeDockerArchive writes a 'docker save' archive with the layers
+func writeDockerArchive(t *testing.T, file string, config []byte, layers [][]byte) {
+	files := map[string][]byte{"config.json": config}
+	manifest := dockerManifest{Config: "config.json"}
+	for i, l := range layers {
+		name := fmt.Sprintf("%d/layer.tar", i)
+		files[name] = l
+		manifest.Layers = append(manifest.Layers, name)
+	}
+	data, err := json.Marshal([]dockerManifest{manifest})
+	require.NoError(t, err)
+	files["manifest.json"] = data
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, contents := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}))
+		_, err = tw.Write(contents)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, ioutil.WriteFile(file, buf.Bytes(), 0644))
+}
+
+// writeOCILayout writes an OCI image layout with an index that points to
+// the image manifest
+func writeOCILayout(t *testing.T, dir string, config []byte, layers [][]byte) {
+	blob := func(data []byte) ociDescriptor {
+		digest := fmt.Sprintf("%x", sha256.Sum256(data))
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "blobs", "sha256", digest), data, 0644))
+		return ociDescriptor{Digest: "sha256:" + digest}
+	}
+
+	manifest := ociManifest{Config: blob(config)}
+	for _, l := range layers {
+		manifest.Layers = append(manifest.Layers, blob(l))
+	}
+	data, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	index, err := json.Marshal(ociManifest{Manifests: []ociDescriptor{blob(data)}})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.json"), index, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644))
+}
+
+func TestUnpackOCILayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var layers []string
+	for i, l := range ociTestLayers(t) {
+		layer := filepath.Join(dir, fmt.Sprintf("layer%d", i))
+		require.NoError(t, ioutil.WriteFile(layer, l, 0644))
+		layers = append(layers, layer)
+	}
+	rootfs := filepath.Join(dir, "rootfs")
+	require.NoError(t, unpackOCILayers(layers, rootfs))
+
+	// whiteouts
+	_, err = os.Lstat(filepath.Join(rootfs, "etc", "a"))
+	assert.True(t, os.IsNotExist(err))
+	assert.DirExists(t, filepath.Join(rootfs, "etc"))
+	_, err = os.Lstat(filepath.Join(rootfs, "opt", "old", "x"))
+	assert.True(t, os.IsNotExist(err))
+	assert.FileExists(t, filepath.Join(rootfs, "opt", "old", "y"))
+
+	fi, err := os.Stat(filepath.Join(rootfs, "usr", "bin", "app"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+	link, err := os.Readlink(filepath.Join(rootfs, "bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "usr/bin", link)
+
+	data, err := ioutil.ReadFile(filepath.Join(rootfs, "var", "g"))
+	require.NoError(t, err)
+	assert.Equal(t, "f", string(data))
+
+	// files below symlinks that leave the rootfs stay in the rootfs
+	data, err = ioutil.ReadFile(filepath.Join(rootfs, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "inside", string(data))
+}
+
+func TestApplyOCIImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	home := os.Getenv("HOME")
+	os.Setenv("HOME", dir)
+	defer os.Setenv("HOME", home)
+
+	archive := filepath.Join(dir, "image.tar")
+	writeDockerArchive(t, archive, ociTestConfig(), ociTestLayers(t))
+	layout := filepath.Join(dir, "layout")
+	writeOCILayout(t, layout, ociTestConfig(), ociTestLayers(t))
+
+	for _, image := range []string{archive, layout} {
+		c := &Config{Env: map[string]string{"FOO": "baz"}}
+		c.OCI.Image = image
+		require.NoError(t, ApplyOCIImage(c), image)
+
+		assert.Equal(t, filepath.Join(GetOpsHome(), "oci"), filepath.Dir(filepath.Dir(c.TargetRoot)))
+		assert.FileExists(t, filepath.Join(c.TargetRoot, "opt", "old", "y"))
+		assert.Equal(t, "/usr/bin/app", c.Program)
+		assert.Equal(t, []string{"app", "-v"}, c.Args)
+		assert.Equal(t, map[string]string{
+			"PATH": "/usr/local/bin:/usr/bin",
+			"FOO":  "baz",
+		}, c.Env)
+		assert.Equal(t, "/srv", c.Cwd)
+	}
+}
+
+func TestOCIImageApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "bin"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bin", "sh"), nil, 0755))
+
+	img := &ociImage{rootfs: dir}
+	img.config.Config.Cmd = []string{"sh", "-c", "true"}
+	c, err := img.apply(&Config{})
+	require.NoError(t, err)
+	assert.Equal(t, "/bin/sh", c.Program)
+	assert.Equal(t, []string{"sh", "-c", "true"}, c.Args)
+
+	// the arguments and the program of the configuration take precedence
+	c, err = img.apply(&Config{Program: "/bin/sh", Args: []string{"sh", "-x"}})
+	require.NoError(t, err)
+	assert.Equal(t, "/bin/sh", c.Program)
+	assert.Equal(t, []string{"sh", "-x"}, c.Args)
+
+	// relative paths start at the working directory
+	img.config.Config.WorkingDir = "/bin"
+	img.config.Config.Cmd = []string{"./sh"}
+	c, err = img.apply(&Config{})
+	require.NoError(t, err)
+	assert.Equal(t, "/bin/sh", c.Program)
+	assert.Equal(t, "/bin", c.Cwd)
+
+	img.config.Config.Cmd = []string{"missing"}
+	_, err = img.apply(&Config{})
+	assert.Error(t, err)
+
+	img.config.Config.Cmd = nil
+	_, err = img.apply(&Config{})
+	assert.Error(t, err)
+}
+
+func TestAddRootFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "etc"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "empty"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "etc", "hosts"), nil, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "etc", "os-release"), nil, 0644))
+	require.NoError(t, os.Symlink("/etc/os-release", filepath.Join(dir, "etc", "release")))
+
+	m := NewManifest(dir)
+	require.NoError(t, m.AddFileContents("/etc/hosts", []byte("127.0.0.1 localhost\n"), 0644))
+	require.NoError(t, addRootFS(m, dir))
+
+	_, inline := m.node("/etc/hosts").(inlineFile)
+	assert.True(t, inline)
+	assert.Equal(t, filepath.Join(dir, "etc", "os-release"), m.HostPath("/etc/os-release"))
+	assert.Equal(t, link{path: "/etc/os-release"}, m.node("/etc/release"))
+	assert.True(t, isDir(m.node("/empty")))
+}
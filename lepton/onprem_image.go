@@ -30,7 +30,7 @@ func (p *OnPrem) BuildImageWithPackage(ctx *Context, pkgpath string) (string, er
 // assumes local for now
 func (p *OnPrem) CreateImage(ctx *Context, imagePath string) error {
 	// this method implementation is not necessary as BuildImage and BuildImageWithPackage creates an image locally
-	return nil
+	return VerifyImageSignature(ctx.config, ctx.config.RunConfig.Imagename)
 }
 
 // ResizeImage resizes the lcoal image imagename. You should never
@@ -39,7 +39,7 @@ func (p *OnPrem) ResizeImage(ctx *Context, imagename string, hbytes string) erro
 	opshome := GetOpsHome()
 	imgpath := path.Join(opshome, "images", imagename)
 
-	bytes, err := parseBytes(hbytes)
+	bytes, err := ParseBytes(hbytes)
 	if err != nil {
 		return err
 	}
@@ -87,8 +87,10 @@ func (p *OnPrem) ListImages(ctx *Context) error {
 	}
 
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"Name", "Path", "Size", "CreatedAt"})
+	table.SetHeader([]string{"Name", "Path", "Size", "CreatedAt", "Program", "Nanos Version"})
 	table.SetHeaderColor(
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
 		tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
 		tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
 		tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
@@ -100,6 +102,13 @@ func (p *OnPrem) ListImages(ctx *Context) error {
 		row = append(row, i.Path)
 		row = append(row, Bytes2Human(i.Size))
 		row = append(row, Time2Human(i.Created))
+		// images built before provenance records have empty columns
+		var program, nanosVersion string
+		if p, err := ReadProvenance(i.Path); err == nil {
+			program, nanosVersion = p.Program, p.NanosVersion
+		}
+		row = append(row, program)
+		row = append(row, nanosVersion)
 		table.Append(row)
 	}
 	table.Render()
@@ -114,6 +123,12 @@ func (p *OnPrem) DeleteImage(ctx *Context, imagename string) error {
 	if err != nil {
 		return err
 	}
+	for _, sidecar := range []string{ProvenancePath(imgpath), SignaturePath(imgpath)} {
+		err = os.Remove(sidecar)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -1,6 +1,7 @@
 package lepton
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/nanovms/ops/fs"
 	"github.com/olekukonko/tablewriter"
 )
 
@@ -32,6 +34,14 @@ func (p *OnPrem) CreateInstance(ctx *Context) error {
 	opshome := GetOpsHome()
 	imgpath := path.Join(opshome, "images", instancename)
 
+	if err := VerifyImageSignature(c, imgpath); err != nil {
+		return err
+	}
+	imgpath, err := instanceImage(c, imgpath)
+	if err != nil {
+		return err
+	}
+
 	c.RunConfig.BaseName = instancename
 	c.RunConfig.Imagename = imgpath
 	c.RunConfig.OnPrem = true
@@ -41,6 +51,60 @@ func (p *OnPrem) CreateInstance(ctx *Context) error {
 	return nil
 }
 
+// instanceImage returns the image an instance boots. Images with another
+// hostname than the one of the instance, which is its name unless the image
+// or the configuration set one, are copied to a directory of the instance
+// with the hostname replaced. Images the TFS reader can not read, such as
+// the ones of the mkfs program, boot as they are.
+func instanceImage(c *Config, imgpath string) (string, error) {
+	r, err := fs.Open(imgpath)
+	if err != nil {
+		fmt.Printf(WarningColor, fmt.Sprintf("%v, keeping the hostname of the image\n", err))
+		return imgpath, nil
+	}
+	var current bytes.Buffer
+	err = r.CopyFile(&current, hostnamePath)
+	r.Close()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf(WarningColor, fmt.Sprintf("%v, keeping the hostname of the image\n", err))
+		return imgpath, nil
+	}
+
+	hostname := c.Hostname
+	if hostname == "" && current.String() == defaultHostname {
+		hostname = c.RunConfig.InstanceName
+	}
+	if hostname == "" || hostname == current.String() {
+		return imgpath, nil
+	}
+	if strings.ContainsAny(hostname, " \t\r\n") {
+		return "", fmt.Errorf("invalid hostname %q", hostname)
+	}
+
+	instpath := path.Join(instanceImagesDir(), c.RunConfig.InstanceName, path.Base(imgpath))
+	if err = copyImage(imgpath, instpath); err != nil {
+		return "", err
+	}
+	if err = fs.SetFileContents(instpath, hostnamePath, []byte(hostname)); err != nil {
+		return "", err
+	}
+	return instpath, nil
+}
+
+// instanceImagesDir returns the directory of the images copied for instances
+func instanceImagesDir() string {
+	return path.Join(GetOpsHome(), "instance-images")
+}
+
+// removeInstanceImage removes the image of an instance when it is a copy
+// made by instanceImage
+func removeInstanceImage(imgpath string) error {
+	if !strings.HasPrefix(imgpath, instanceImagesDir()+"/") {
+		return nil
+	}
+	return os.RemoveAll(path.Dir(imgpath))
+}
+
 // GetInstanceByID returns the instance with the id passed by argument if it exists
 func (p *OnPrem) GetInstanceByID(ctx *Context, id string) (*CloudInstance, error) {
 	return nil, errors.New("un-implemented")
@@ -145,12 +209,20 @@ func (p *OnPrem) DeleteInstance(ctx *Context, instancename string) error {
 
 	opshome := GetOpsHome()
 	ipath := path.Join(opshome, "instances", instancename)
+	body, err := ioutil.ReadFile(ipath)
+	if err != nil {
+		return err
+	}
 	err = os.Remove(ipath)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	var i instance
+	if json.Unmarshal(body, &i) != nil {
+		return nil
+	}
+	return removeInstanceImage(i.ImagePath)
 }
 
 // PrintInstanceLogs writes instance logs to console
@@ -0,0 +1,79 @@
+package lepton
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nanovms/ops/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstanceImageHostname(t *testing.T) {
+	dir, err := ioutil.TempDir("", "instance")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	home := os.Getenv("HOME")
+	os.Setenv("HOME", dir)
+	defer os.Setenv("HOME", home)
+
+	hello := filepath.Join(dir, "hello")
+	require.NoError(t, ioutil.WriteFile(hello, []byte("hello"), 0755))
+	build := func(name string, hostname string) string {
+		m := NewManifest("")
+		require.NoError(t, m.addProgram("/hello", hello))
+		c := &Config{Args: []string{"hello"}, Hostname: hostname, NativeMkfs: true, NoCache: true}
+		require.NoError(t, addHostName(m, c))
+		c.RunConfig.Imagename = filepath.Join(dir, name)
+		require.NoError(t, buildImage(c, m))
+		return c.RunConfig.Imagename
+	}
+	hostname := func(image string) string {
+		r, err := fs.Open(image)
+		require.NoError(t, err)
+		defer r.Close()
+		var b bytes.Buffer
+		require.NoError(t, r.CopyFile(&b, hostnamePath))
+		return b.String()
+	}
+
+	c := &Config{}
+	c.RunConfig.InstanceName = "web-1"
+
+	// images with the default hostname get the name of the instance
+	image := build("default.img", "")
+	instImage, err := instanceImage(c, image)
+	require.NoError(t, err)
+	assert.NotEqual(t, image, instImage)
+	assert.Equal(t, "web-1", hostname(instImage))
+	assert.Equal(t, defaultHostname, hostname(image))
+
+	// the copy is removed with the instance
+	require.NoError(t, removeInstanceImage(instImage))
+	_, err = os.Stat(filepath.Join(instanceImagesDir(), "web-1"))
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, removeInstanceImage(image))
+	_, err = os.Stat(image)
+	assert.NoError(t, err)
+
+	// images the TFS reader can not read boot as they are
+	raw := filepath.Join(dir, "raw.img")
+	require.NoError(t, ioutil.WriteFile(raw, make([]byte, 4096), 0644))
+	instImage, err = instanceImage(c, raw)
+	require.NoError(t, err)
+	assert.Equal(t, raw, instImage)
+
+	// the hostname the image was built with is kept
+	image = build("named.img", "db")
+	instImage, err = instanceImage(c, image)
+	require.NoError(t, err)
+	assert.Equal(t, image, instImage)
+
+	c.Hostname = "web"
+	instImage, err = instanceImage(c, image)
+	require.NoError(t, err)
+	assert.Equal(t, "web", hostname(instImage))
+}
@@ -101,7 +101,7 @@ func (op *OnPrem) parseSize(vol NanosVolume) string {
 		// return the default size of a volume
 		return Bytes2Human(MiByte)
 	}
-	bytes, err := parseBytes(vol.Size)
+	bytes, err := ParseBytes(vol.Size)
 	if err != nil {
 		fmt.Printf("warning: invalid size value for volume %s with UUID %s: %s\n", vol.Name, vol.ID, err.Error())
 	}
@@ -111,11 +111,8 @@ func (op *OnPrem) parseSize(vol NanosVolume) string {
 
 // buildVolumeManifest builds manifests for non-empty volume
 func buildVolumeManifest(conf *Config, out string) error {
-	m := &Manifest{
-		children:    make(map[string]interface{}),
-		debugFlags:  make(map[string]rune),
-		environment: make(map[string]string),
-	}
+	m := NewManifest("")
+	m.SetFileFilter(conf.Exclude, conf.Include)
 
 	for _, d := range conf.Dirs {
 		err := m.AddRelativeDirectory(d)
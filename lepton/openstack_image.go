@@ -105,6 +105,10 @@ func (o *OpenStack) uploadImage(imagesClient *gophercloud.ServiceClient, imageID
 
 // CreateImage - Creates image on OpenStack using nanos images
 func (o *OpenStack) CreateImage(ctx *Context, imagePath string) error {
+	if err := VerifyImageSignature(ctx.config, ctx.config.RunConfig.Imagename); err != nil {
+		return err
+	}
+
 	c := ctx.config
 	imgName := c.CloudConfig.ImageName
 
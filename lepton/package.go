@@ -237,12 +237,9 @@ func BuildImageFromPackage(packagepath string, c Config) error {
 		return errors.Wrap(err, 1)
 	}
 
-	if c.RunConfig.IPAddr != "" {
-		m.AddNetworkConfig(&ManifestNetworkConfig{
-			IP:      c.RunConfig.IPAddr,
-			Gateway: c.RunConfig.Gateway,
-			NetMask: c.RunConfig.NetMask,
-		})
+	err = addNetworkConfig(m, &c.RunConfig)
+	if err != nil {
+		return errors.Wrap(err, 1)
 	}
 
 	if err := buildImage(&c, m); err != nil {
@@ -0,0 +1,213 @@
+package lepton
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Provenance records how an image was built. It is written next to the
+// image by buildImage.
+type Provenance struct {
+	// Config is the effective configuration of the build, without the
+	// values that may be secrets
+	Config *Config
+
+	// Manifest is the manifest the filesystem was written from, without the
+	// values of environment variables and the contents of inline files
+	Manifest string
+
+	OpsVersion   string
+	NanosVersion string
+	MkfsVersion  string
+
+	// Program is the image path of the user program and ProgramSha256 the
+	// hash of its contents
+	Program       string
+	ProgramSha256 string
+
+	TargetRoot string
+	BuildHost  string
+	Built      time.Time
+}
+
+// redactedValue replaces the values of redacted configuration fields
+const redactedValue = "<redacted>"
+
+// redactConfig returns a copy of c without the values of environment
+// variables and inline files, the radar key and the cloud configuration,
+// which may hold secrets and do not change the image
+func redactConfig(c *Config) *Config {
+	rc := *c
+	rc.Env = redactValues(c.Env)
+	rc.InlineFiles = redactValues(c.InlineFiles)
+	if c.Klibs.Radar != nil {
+		rc.Klibs.Radar = &RadarKlibConfig{Key: redactedValue}
+	}
+	rc.CloudConfig = ProviderConfig{}
+	return &rc
+}
+
+func redactValues(values map[string]string) map[string]string {
+	if values == nil {
+		return nil
+	}
+	redacted := make(map[string]string, len(values))
+	for k := range values {
+		redacted[k] = redactedValue
+	}
+	return redacted
+}
+
+// redactManifest returns the text of m without the values of environment
+// variables, which include the radar key, and the contents of inline files
+func redactManifest(m *Manifest) string {
+	rm := *m
+	rm.environment = redactValues(m.environment)
+	rm.children = redactInlineFiles(m.children)
+	return rm.String()
+}
+
+func redactInlineFiles(children map[string]interface{}) map[string]interface{} {
+	if children == nil {
+		return nil
+	}
+	redacted := make(map[string]interface{}, len(children))
+	for k, v := range children {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			redacted[k] = redactInlineFiles(v)
+		case inlineFile:
+			redacted[k] = inlineFile{contents: []byte(redactedValue)}
+		default:
+			redacted[k] = v
+		}
+	}
+	return redacted
+}
+
+// redacted reports whether the record holds none of the values redactConfig
+// and redactManifest remove, records written by older versions of ops do
+func (p *Provenance) redacted() bool {
+	if p.Config != nil && !reflect.DeepEqual(redactConfig(p.Config), p.Config) {
+		return false
+	}
+	if p.Manifest == "" {
+		return true
+	}
+	m, err := ParseManifest(strings.NewReader(p.Manifest), "")
+	if err != nil {
+		return false
+	}
+	if !reflect.DeepEqual(redactValues(m.environment), m.environment) {
+		return false
+	}
+	return reflect.DeepEqual(redactInlineFiles(m.children), m.children)
+}
+
+// ProvenancePath returns the path of the provenance record of an image
+func ProvenancePath(imagePath string) string {
+	return imagePath + ".json"
+}
+
+// newProvenance returns the provenance record of the image c builds from m
+func newProvenance(c *Config, m *Manifest) (*Provenance, error) {
+	p := &Provenance{
+		Config:       redactConfig(c),
+		Manifest:     redactManifest(m),
+		OpsVersion:   Version,
+		NanosVersion: LocalReleaseVersion,
+		MkfsVersion:  c.Mkfs,
+		Program:      m.Program(),
+		TargetRoot:   c.TargetRoot,
+		Built:        time.Now().UTC(),
+	}
+	if c.NightlyBuild {
+		p.NanosVersion = "nightly"
+	}
+	if c.NativeMkfs {
+		p.MkfsVersion = "native " + nativeMkfsVersion
+	}
+	// reproducible builds have the same record on every host
+	if c.Reproducible {
+		epoch, err := sourceDateEpoch()
+		if err != nil {
+			return nil, err
+		}
+		p.Built = epoch
+		hostPaths(p.Config)
+	} else {
+		p.BuildHost, _ = os.Hostname()
+	}
+
+	if hostpath := m.HostPath(p.Program); hostpath != "" {
+		hostpath, err := lookupFile(c.TargetRoot, hostpath)
+		if err != nil {
+			return nil, err
+		}
+		if p.ProgramSha256, err = sha256File(hostpath); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// hostPaths replaces the paths ops derives from its home and build
+// directories with their base names, they differ between hosts
+func hostPaths(c *Config) {
+	c.RunConfig.Imagename = baseName(c.RunConfig.Imagename)
+	c.Boot = baseName(c.Boot)
+	c.Kernel = baseName(c.Kernel)
+	c.Mkfs = baseName(c.Mkfs)
+	c.BuildDir = ""
+}
+
+func baseName(path string) string {
+	if path == "" {
+		return ""
+	}
+	return filepath.Base(path)
+}
+
+func sha256File(hostpath string) (string, error) {
+	fd, err := os.Open(hostpath)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, fd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeProvenance writes the provenance record of an image
+func writeProvenance(imagePath string, p *Provenance) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ProvenancePath(imagePath), b, 0644)
+}
+
+// ReadProvenance reads the provenance record of an image
+func ReadProvenance(imagePath string) (*Provenance, error) {
+	b, err := ioutil.ReadFile(ProvenancePath(imagePath))
+	if err != nil {
+		return nil, err
+	}
+	p := &Provenance{}
+	if err = json.Unmarshal(b, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,126 @@
+package lepton
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProvenancePath(t *testing.T) {
+	assert.Equal(t, "/images/web.img.json", ProvenancePath("/images/web.img"))
+	assert.Equal(t, "/images/web.json", ProvenancePath("/images/web"))
+}
+
+func TestProvenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "provenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hello := filepath.Join(dir, "hello")
+	ioutil.WriteFile(hello, []byte("hello"), 0755)
+	m := NewManifest("")
+	if err = m.addProgram("/hello", hello); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{Args: []string{"hello"}, Kernel: "/home/ops/.ops/0.1.30/kernel.img", Reproducible: true}
+	c.RunConfig.Imagename = "/home/ops/.ops/images/hello.img"
+	os.Setenv("SOURCE_DATE_EPOCH", "1600000000")
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+
+	p, err := newProvenance(c, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/hello", p.Program)
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", p.ProgramSha256)
+	assert.Equal(t, time.Unix(1600000000, 0).UTC(), p.Built)
+	assert.Empty(t, p.BuildHost)
+	assert.Equal(t, m.String(), p.Manifest)
+	assert.Equal(t, "hello.img", p.Config.RunConfig.Imagename)
+	assert.Equal(t, "kernel.img", p.Config.Kernel)
+	assert.Equal(t, "/home/ops/.ops/images/hello.img", c.RunConfig.Imagename)
+
+	image := filepath.Join(dir, "hello.img")
+	if err = writeProvenance(image, p); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadProvenance(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, p.ProgramSha256, read.ProgramSha256)
+	assert.Equal(t, []string{"hello"}, read.Config.Args)
+	assert.True(t, read.Built.Equal(p.Built))
+
+	_, err = ReadProvenance(filepath.Join(dir, "missing.img"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestProvenanceRedactsSecrets(t *testing.T) {
+	c := &Config{
+		Env:         map[string]string{"DB_PASSWORD": "hunter2"},
+		InlineFiles: map[string]string{"/etc/app.conf": "token = abc"},
+		CloudConfig: ProviderConfig{ProjectID: "prod", BucketName: "images"},
+		Args:        []string{"hello"},
+	}
+	c.Klibs.Radar = &RadarKlibConfig{Key: "radar-key"}
+
+	rc := redactConfig(c)
+	assert.Equal(t, map[string]string{"DB_PASSWORD": redactedValue}, rc.Env)
+	assert.Equal(t, map[string]string{"/etc/app.conf": redactedValue}, rc.InlineFiles)
+	assert.Equal(t, redactedValue, rc.Klibs.Radar.Key)
+	assert.Equal(t, ProviderConfig{}, rc.CloudConfig)
+	assert.Equal(t, []string{"hello"}, rc.Args)
+
+	// the configuration of the build is unchanged
+	assert.Equal(t, "hunter2", c.Env["DB_PASSWORD"])
+	assert.Equal(t, "radar-key", c.Klibs.Radar.Key)
+	assert.Equal(t, "prod", c.CloudConfig.ProjectID)
+}
+
+func TestProvenanceManifestRedactsSecrets(t *testing.T) {
+	c := &Config{
+		Env:         map[string]string{"DB_PASSWORD": "hunter2"},
+		InlineFiles: map[string]string{"/etc/app.conf": "token = abc"},
+	}
+	c.Klibs.Radar = &RadarKlibConfig{Key: "radar-key"}
+
+	m := NewManifest("")
+	for k, v := range c.Env {
+		m.AddEnvironmentVariable(k, v)
+	}
+	for k, v := range c.InlineFiles {
+		if err := m.AddFileContents(k, []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := addKlibsFromConfig(m, c); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := newProvenance(c, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"hunter2", "token = abc", "radar-key"} {
+		assert.NotContains(t, string(b), secret)
+	}
+	assert.Contains(t, p.Manifest, "DB_PASSWORD:"+redactedValue)
+	assert.Contains(t, p.Manifest, "RADAR_KEY:"+redactedValue)
+	assert.True(t, p.redacted())
+
+	// the manifest of the image keeps its values
+	assert.Contains(t, m.String(), "hunter2")
+}
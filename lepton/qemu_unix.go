@@ -23,6 +23,9 @@ import (
 
 const qemuBaseCommand = "qemu-system-x86_64"
 
+// pciBus is the root bus of the q35 machine, the pcie root ports are on it
+const pciBus = "pcie.0"
+
 type drive struct {
 	path   string
 	format string
@@ -36,6 +39,7 @@ type device struct {
 	devtype string
 	mac     string
 	devid   string
+	bus     string
 }
 
 type netdev struct {
@@ -98,7 +102,11 @@ func (dv device) String() string {
 
 	// simple pci net hack -- FIXME
 	if dv.driver == "virtio-net" {
-		sb.WriteString(fmt.Sprintf("-device %s,bus=pci.3,addr=0x0,%s=%s", dv.driver, dv.devtype, dv.devid))
+		bus := dv.bus
+		if bus == "" {
+			bus = "pci.3"
+		}
+		sb.WriteString(fmt.Sprintf("-device %s,bus=%s,addr=0x0,%s=%s", dv.driver, bus, dv.devtype, dv.devid))
 	} else {
 		sb.WriteString(fmt.Sprintf("-device %s,%s=%s", dv.driver, dv.devtype, dv.devid))
 	}
@@ -203,8 +211,9 @@ func (q *qemu) Start(rconfig *RunConfig) error {
 		sbase := strings.Split(base, ".")
 
 		i := instance{
-			Image: sbase[0],
-			Ports: rconfig.Ports,
+			Image:     sbase[0],
+			Ports:     rconfig.Ports,
+			ImagePath: rconfig.Imagename,
 		}
 
 		d1, err := json.Marshal(i)
@@ -264,6 +273,14 @@ func (q *qemu) addNetDevice(devType, ifaceName, mac string, hostPorts []string,
 
 	if mac == "" {
 		dv.mac = generateMac()
+	} else {
+		dv.mac = mac
+	}
+
+	// every network device after the first one gets its own pcie root port
+	if n := len(q.ifaces); n > 0 {
+		dv.bus = fmt.Sprintf("pci.%d", n+3)
+		q.addOption("-device", fmt.Sprintf("pcie-root-port,port=0x%x,chassis=%d,id=%s,bus=%s,addr=0x3.0x%x", 0x12+n, n+3, dv.bus, pciBus, n+2))
 	}
 
 	if devType != "user" {
@@ -462,8 +479,6 @@ func (q *qemu) setConfig(rconfig *RunConfig) {
 	// add virtio drive
 	q.addDrive("hd0", rconfig.Imagename, "none")
 
-	pciBus := "pcie.0"
-
 	// pcie root ports need to come before virtio/scsi devices
 	q.addOption("-machine", "q35")
 	q.addOption("-device", "pcie-root-port,port=0x10,chassis=1,id=pci.1,bus="+pciBus+",multifunction=on,addr=0x3")
@@ -489,7 +504,20 @@ func (q *qemu) setConfig(rconfig *RunConfig) {
 
 	q.setAccel(rconfig)
 
-	q.addNetDevice(netDevType, ifaceName, "", rconfig.Ports, rconfig.UDP)
+	if len(rconfig.Interfaces) == 0 {
+		q.addNetDevice(netDevType, ifaceName, "", rconfig.Ports, rconfig.UDP)
+	}
+
+	// host ports are forwarded to the first user mode interface
+	hostPorts := rconfig.Ports
+	for _, iface := range rconfig.Interfaces {
+		if iface.TapName != "" {
+			q.addNetDevice("tap", iface.TapName, iface.MAC, nil, false)
+			continue
+		}
+		q.addNetDevice("user", "", iface.MAC, hostPorts, rconfig.UDP)
+		hostPorts = nil
+	}
 	q.addDisplay("none")
 
 	if rconfig.OnPrem {
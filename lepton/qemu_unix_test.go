@@ -112,6 +112,20 @@ func TestAddNetDevices(t *testing.T) {
 	})
 }
 
+func TestAddMultipleNetDevices(t *testing.T) {
+	q := qemu{}
+	q.addNetDevice("user", "", "", []string{"80"}, false)
+	q.addNetDevice("tap", "tap1", "52:54:00:12:34:56", nil, false)
+
+	checkQemuString(q.devices[1], "-device virtio-net,bus=pci.4,addr=0x0,netdev=n1,mac=52:54:00:12:34:56", t)
+	checkQemuString(q.ifaces[1], "-netdev tap,id=n1,ifname=tap1,script=no,downscript=no", t)
+
+	want := []string{"-device pcie-root-port,port=0x13,chassis=4,id=pci.4,bus=pcie.0,addr=0x3.0x3"}
+	if !reflect.DeepEqual(q.flags, want) {
+		t.Errorf("got %v, want %v", q.flags, want)
+	}
+}
+
 func TestQemuVersion(t *testing.T) {
 	testData := `
 QEMU emulator version 2.11.1(Debian 1:2.8+dfsg-6+deb9u5)
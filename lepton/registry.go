@@ -0,0 +1,752 @@
+package lepton
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// media types of the images pushed to OCI registries. The provenance
+// record is the configuration of the artifact, the raw image and the
+// signature are its layers.
+const (
+	ImageArtifactType = "application/vnd.nanovms.ops.image.v1"
+
+	imageLayerMediaType = "application/vnd.nanovms.ops.image.v1.raw+gzip"
+	provenanceMediaType = "application/vnd.nanovms.ops.provenance.v1+json"
+	signatureMediaType  = "application/vnd.nanovms.ops.signature.v1+json"
+
+	ociEmptyMediaType         = "application/vnd.oci.empty.v1+json"
+	ociImageManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociTitleAnnotation        = "org.opencontainers.image.title"
+	ociCreatedAnnotation      = "org.opencontainers.image.created"
+
+	dockerHubRegistry = "registry-1.docker.io"
+)
+
+var (
+	repositoryPattern = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*$`)
+	tagPattern        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+// ImageReference is an image in a repository of an OCI registry, by tag or
+// by digest
+type ImageReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseImageReference parses references such as localhost:5000/team/app:1.0
+// or registry.example.com/app@sha256:.... References without a registry
+// host are in Docker Hub, and without tag or digest refer to the latest tag.
+func ParseImageReference(reference string) (*ImageReference, error) {
+	ref := &ImageReference{}
+	name := reference
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.Digest = name[:i], name[i+1:]
+		if !strings.HasPrefix(ref.Digest, "sha256:") || len(ref.Digest) != len("sha256:")+64 {
+			return nil, fmt.Errorf("invalid image reference %q: unsupported digest %s", reference, ref.Digest)
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+		if !tagPattern.MatchString(ref.Tag) {
+			return nil, fmt.Errorf("invalid image reference %q: invalid tag %s", reference, ref.Tag)
+		}
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.Registry, ref.Repository = parts[0], parts[1]
+	} else {
+		ref.Registry, ref.Repository = "docker.io", name
+		if !strings.Contains(name, "/") {
+			ref.Repository = "library/" + name
+		}
+	}
+	if !repositoryPattern.MatchString(ref.Repository) {
+		return nil, fmt.Errorf("invalid image reference %q: invalid repository %s", reference, ref.Repository)
+	}
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	return ref, nil
+}
+
+// String returns the reference in its canonical form
+func (r *ImageReference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// reference returns the digest, or the tag, of the manifest
+func (r *ImageReference) reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// RegistryOptions configures the connection to an OCI registry
+type RegistryOptions struct {
+	// Username and Password authenticate with basic auth, or get a token
+	// from the token server of the registry. They default to the
+	// credentials of 'docker login'.
+	Username string
+	Password string
+
+	// Insecure connects with plain HTTP, it is always the case for
+	// registries on localhost.
+	Insecure bool
+}
+
+// RegistryError is an error response of an OCI registry
+type RegistryError struct {
+	Method string
+	URL    string
+	Status string
+	Errors []struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func (e *RegistryError) Error() string {
+	msg := fmt.Sprintf("%s %s: %s", e.Method, e.URL, e.Status)
+	for _, err := range e.Errors {
+		msg += fmt.Sprintf(": %s %s", err.Code, err.Message)
+	}
+	return msg
+}
+
+// registryClient sends the requests of the OCI distribution API to the
+// registry of an image reference
+type registryClient struct {
+	ref      *ImageReference
+	base     *url.URL
+	scope    string
+	username string
+	password string
+
+	// authorization is the Authorization header of the requests once the
+	// registry asked for credentials
+	authorization string
+	client        *http.Client
+}
+
+func newRegistryClient(ref *ImageReference, opts RegistryOptions, actions string) *registryClient {
+	host := ref.Registry
+	if host == "docker.io" {
+		host = dockerHubRegistry
+	}
+	scheme := "https"
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if opts.Insecure || hostname == "localhost" || net.ParseIP(hostname).IsLoopback() {
+		scheme = "http"
+	}
+
+	rc := &registryClient{
+		ref:      ref,
+		base:     &url.URL{Scheme: scheme, Host: host},
+		scope:    fmt.Sprintf("repository:%s:%s", ref.Repository, actions),
+		username: opts.Username,
+		password: opts.Password,
+		client:   &http.Client{Timeout: 30 * time.Minute},
+	}
+	if rc.username == "" && rc.password == "" {
+		rc.username, rc.password = dockerCredentials(host)
+	}
+	return rc
+}
+
+// dockerCredentials returns the credentials that 'docker login' saved for
+// host, credential helpers are not supported
+func dockerCredentials(host string) (string, string) {
+	home, err := HomeDir()
+	if err != nil {
+		return "", ""
+	}
+	data, err := ioutil.ReadFile(filepath.Join(home, ".docker", "config.json"))
+	if err != nil {
+		return "", ""
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if json.Unmarshal(data, &config) != nil {
+		return "", ""
+	}
+
+	keys := []string{host, "https://" + host, "http://" + host}
+	if host == dockerHubRegistry {
+		keys = append(keys, "https://index.docker.io/v1/", "docker.io")
+	}
+	for _, k := range keys {
+		auth, ok := config.Auths[k]
+		if !ok {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			continue
+		}
+		if i := strings.Index(string(b), ":"); i > 0 {
+			return string(b[:i]), string(b[i+1:])
+		}
+	}
+	return "", ""
+}
+
+// url returns the URL of the API path of the repository, such as
+// blobs/<digest>
+func (rc *registryClient) url(p string) string {
+	u := *rc.base
+	u.Path = path.Join("/v2", rc.ref.Repository, p)
+	// registries redirect blobs/uploads to blobs/uploads/
+	if strings.HasSuffix(p, "/") {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+// do sends the request that newRequest returns. When the registry answers
+// 401 it authenticates as the WWW-Authenticate header says and sends a new
+// request, so that request bodies are read again.
+func (rc *registryClient) do(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for retry := false; ; retry = true {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		if rc.authorization != "" {
+			req.Header.Set("Authorization", rc.authorization)
+		}
+		resp, err := rc.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || retry {
+			return resp, nil
+		}
+
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err = rc.authenticate(challenge); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// authenticate sets the authorization of the requests for a challenge of
+// the basic or bearer token scheme
+func (rc *registryClient) authenticate(challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	switch scheme {
+	case "basic":
+		if rc.username == "" && rc.password == "" {
+			return fmt.Errorf("registry %s requires credentials, set OPS_REGISTRY_USERNAME and OPS_REGISTRY_PASSWORD or run 'docker login'", rc.base.Host)
+		}
+		rc.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(rc.username+":"+rc.password))
+		return nil
+	case "bearer":
+		return rc.fetchToken(params)
+	}
+	return fmt.Errorf("registry %s: unsupported authentication challenge %q", rc.base.Host, challenge)
+}
+
+// fetchToken gets a bearer token for the scope of the client from the
+// token server of the challenge, with the credentials if there are any
+func (rc *registryClient) fetchToken(params map[string]string) error {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("registry %s: invalid token realm %q", rc.base.Host, params["realm"])
+	}
+	q := realm.Query()
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	q.Set("scope", rc.scope)
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if rc.username != "" || rc.password != "" {
+		req.SetBasicAuth(rc.username, rc.password)
+	}
+	resp, err := rc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = checkRegistryResponse(resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("token server %s: %v", realm.Host, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return fmt.Errorf("token server %s: no token in response", realm.Host)
+	}
+	rc.authorization = "Bearer " + token.Token
+	return nil
+}
+
+// parseChallenge parses a WWW-Authenticate header such as
+// Bearer realm="https://auth.example.com/token",scope="repository:app:pull,push"
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	challenge = strings.TrimSpace(challenge)
+	i := strings.IndexAny(challenge, " \t")
+	if i < 0 {
+		return strings.ToLower(challenge), params
+	}
+	scheme, rest := strings.ToLower(challenge[:i]), challenge[i+1:]
+
+	for {
+		rest = strings.TrimLeft(rest, " \t,")
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			return scheme, params
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			j := 1
+			for ; j < len(rest) && rest[j] != '"'; j++ {
+				if rest[j] == '\\' && j+1 < len(rest) {
+					j++
+				}
+				b.WriteByte(rest[j])
+			}
+			value = b.String()
+			if j < len(rest) {
+				j++
+			}
+			rest = rest[j:]
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = strings.TrimSpace(rest[:end]), rest[end:]
+		}
+		params[key] = value
+	}
+}
+
+// checkRegistryResponse returns a RegistryError unless the response has one
+// of the expected statuses
+func checkRegistryResponse(resp *http.Response, expected ...int) error {
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	e := &RegistryError{Method: resp.Request.Method, URL: resp.Request.URL.String(), Status: resp.Status}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	json.Unmarshal(body, e)
+	return e
+}
+
+// blob is a blob to push, open returns its contents
+type blob struct {
+	desc ociDescriptor
+	open func() (io.ReadCloser, error)
+}
+
+func bytesBlob(mediaType string, data []byte) blob {
+	return blob{
+		desc: ociDescriptor{
+			MediaType: mediaType,
+			Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(data)),
+			Size:      int64(len(data)),
+		},
+		open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		},
+	}
+}
+
+// pushBlob uploads a blob the repository does not have yet, in a single
+// request after starting the upload
+func (rc *registryClient) pushBlob(b blob) error {
+	resp, err := rc.do(func() (*http.Request, error) {
+		return http.NewRequest("HEAD", rc.url("blobs/"+b.desc.Digest), nil)
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	resp, err = rc.do(func() (*http.Request, error) {
+		return http.NewRequest("POST", rc.url("blobs/uploads/"), nil)
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if err = checkRegistryResponse(resp, http.StatusAccepted); err != nil {
+		return err
+	}
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return fmt.Errorf("registry %s: invalid upload location: %v", rc.base.Host, err)
+	}
+	q := location.Query()
+	q.Set("digest", b.desc.Digest)
+	location.RawQuery = q.Encode()
+
+	resp, err = rc.do(func() (*http.Request, error) {
+		body, err := b.open()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("PUT", location.String(), body)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		req.ContentLength = b.desc.Size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkRegistryResponse(resp, http.StatusCreated)
+}
+
+// fetchBlob writes the blob of desc to w and verifies its digest
+func (rc *registryClient) fetchBlob(desc ociDescriptor, w io.Writer) error {
+	resp, err := rc.do(func() (*http.Request, error) {
+		return http.NewRequest("GET", rc.url("blobs/"+desc.Digest), nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = checkRegistryResponse(resp, http.StatusOK); err != nil {
+		return err
+	}
+	return copyVerified(w, resp.Body, desc.Digest)
+}
+
+// copyVerified copies r to w and checks that the sha256 digest of what it
+// read is digest
+func copyVerified(w io.Writer, r io.Reader, digest string) error {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return fmt.Errorf("unsupported digest %s", digest)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(w, io.TeeReader(r, h)); err != nil {
+		return err
+	}
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != digest {
+		return fmt.Errorf("digest mismatch, expected %s, got %s", digest, got)
+	}
+	return nil
+}
+
+// compressImage compresses the image with gzip to a temporary file and
+// returns it as a blob. The caller removes the file.
+func compressImage(imagePath string) (blob, string, error) {
+	in, err := os.Open(imagePath)
+	if err != nil {
+		return blob{}, "", err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile("", "ops-image")
+	if err != nil {
+		return blob{}, "", err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	zw := gzip.NewWriter(io.MultiWriter(out, h))
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return blob{}, "", err
+	}
+	fi, err := out.Stat()
+	if err != nil {
+		os.Remove(out.Name())
+		return blob{}, "", err
+	}
+
+	tmp := out.Name()
+	return blob{
+		desc: ociDescriptor{
+			MediaType:   imageLayerMediaType,
+			Digest:      "sha256:" + hex.EncodeToString(h.Sum(nil)),
+			Size:        fi.Size(),
+			Annotations: map[string]string{ociTitleAnnotation: filepath.Base(imagePath)},
+		},
+		open: func() (io.ReadCloser, error) {
+			return os.Open(tmp)
+		},
+	}, tmp, nil
+}
+
+// PushImage pushes a local image, its provenance record and signature to an OCI registry as an artifact and returns the digest of
+// the artifact manifest
+func PushImage(imagePath string, reference string, opts RegistryOptions) (string, error) {
+	ref, err := ParseImageReference(reference)
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest != "" {
+		return "", fmt.Errorf("cannot push to %s, images are pushed to a tag", reference)
+	}
+	rc := newRegistryClient(ref, opts, "pull,push")
+
+	image, tmp, err := compressImage(imagePath)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociImageManifestMediaType,
+		ArtifactType:  ImageArtifactType,
+	}
+
+	// images built by older versions of ops have no provenance record
+	config := bytesBlob(ociEmptyMediaType, []byte("{}"))
+	layers := []blob{image}
+	provenance, err := ioutil.ReadFile(ProvenancePath(imagePath))
+	if err == nil {
+		config = bytesBlob(provenanceMediaType, provenance)
+		p := &Provenance{}
+		if err = json.Unmarshal(provenance, p); err != nil {
+			return "", fmt.Errorf("%s: %v", ProvenancePath(imagePath), err)
+		}
+		// the record is pushed as it is for the signature to match it
+		if !p.redacted() {
+			return "", fmt.Errorf("%s holds environment values or inline file contents, rebuild the image to push it", ProvenancePath(imagePath))
+		}
+		manifest.Annotations = map[string]string{ociCreatedAnnotation: p.Built.UTC().Format(time.RFC3339)}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	signature, err := ioutil.ReadFile(SignaturePath(imagePath))
+	if err == nil {
+		layers = append(layers, bytesBlob(signatureMediaType, signature))
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if err = rc.pushBlob(config); err != nil {
+		return "", err
+	}
+	manifest.Config = config.desc
+	for _, b := range layers {
+		if err = rc.pushBlob(b); err != nil {
+			return "", err
+		}
+		manifest.Layers = append(manifest.Layers, b.desc)
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	resp, err := rc.do(func() (*http.Request, error) {
+		req, err := http.NewRequest("PUT", rc.url("manifests/"+ref.Tag), bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", ociImageManifestMediaType)
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err = checkRegistryResponse(resp, http.StatusCreated); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data)), nil
+}
+
+// PullImage pulls an image pushed by PushImage to imagePath, with its
+// provenance record and signature next to it
+func PullImage(reference string, imagePath string, opts RegistryOptions) error {
+	ref, err := ParseImageReference(reference)
+	if err != nil {
+		return err
+	}
+	rc := newRegistryClient(ref, opts, "pull")
+
+	resp, err := rc.do(func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", rc.url("manifests/"+ref.reference()), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", ociImageManifestMediaType)
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = checkRegistryResponse(resp, http.StatusOK); err != nil {
+		return err
+	}
+	var data bytes.Buffer
+	if ref.Digest != "" {
+		err = copyVerified(&data, io.LimitReader(resp.Body, 4*1024*1024), ref.Digest)
+	} else {
+		_, err = io.Copy(&data, io.LimitReader(resp.Body, 4*1024*1024))
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", reference, err)
+	}
+
+	var manifest ociManifest
+	if err = json.Unmarshal(data.Bytes(), &manifest); err != nil {
+		return fmt.Errorf("%s: %v", reference, err)
+	}
+	if manifest.ArtifactType != ImageArtifactType {
+		return fmt.Errorf("%s is not a nanos image pushed by ops", reference)
+	}
+
+	var image, signature *ociDescriptor
+	for i, l := range manifest.Layers {
+		switch l.MediaType {
+		case imageLayerMediaType:
+			image = &manifest.Layers[i]
+		case signatureMediaType:
+			signature = &manifest.Layers[i]
+		}
+	}
+	if image == nil {
+		return fmt.Errorf("%s has no image layer", reference)
+	}
+
+	if err = rc.pullImageLayer(*image, imagePath); err != nil {
+		return fmt.Errorf("%s: %v", reference, err)
+	}
+
+	// the sidecars of a previous image with the same name are replaced
+	sidecars := []struct {
+		desc *ociDescriptor
+		path string
+	}{
+		{signature, SignaturePath(imagePath)},
+		{nil, ProvenancePath(imagePath)},
+	}
+	if manifest.Config.MediaType == provenanceMediaType {
+		sidecars[1].desc = &manifest.Config
+	}
+	for _, s := range sidecars {
+		if s.desc == nil {
+			if err = os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		var b bytes.Buffer
+		if err = rc.fetchBlob(*s.desc, &b); err != nil {
+			return fmt.Errorf("%s: %v", reference, err)
+		}
+		if err = ioutil.WriteFile(s.path, b.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pullImageLayer decompresses the image layer to imagePath
+func (rc *registryClient) pullImageLayer(desc ociDescriptor, imagePath string) error {
+	resp, err := rc.do(func() (*http.Request, error) {
+		return http.NewRequest("GET", rc.url("blobs/"+desc.Digest), nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = checkRegistryResponse(resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	tmp := imagePath + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		zr, err := gzip.NewReader(pr)
+		if err == nil {
+			_, err = io.Copy(out, zr)
+		}
+		// the rest of the layer is read for its digest
+		io.Copy(ioutil.Discard, pr)
+		done <- err
+	}()
+	err = copyVerified(pw, resp.Body, desc.Digest)
+	pw.CloseWithError(err)
+	if zerr := <-done; err == nil {
+		err = zerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, imagePath)
+}
@@ -0,0 +1,238 @@
+package lepton
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRegistry is an OCI registry that keeps blobs and manifests in memory.
+// It asks for basic auth, or for bearer tokens of its token endpoint when
+// token is set.
+type testRegistry struct {
+	sync.Mutex
+	token     bool
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	uploads   int
+}
+
+func (reg *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.Lock()
+	defer reg.Unlock()
+
+	if r.URL.Path == "/token" {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "alice" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("scope") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"token":"t0k3n"}`)
+		return
+	}
+
+	if reg.token {
+		if r.Header.Get("Authorization") != "Bearer t0k3n" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test",scope="repository:team/app:pull,push"`, r.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	} else if user, pass, ok := r.BasicAuth(); !ok || user != "alice" || pass != "secret" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	const prefix = "/v2/team/app/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	p := strings.TrimPrefix(r.URL.Path, prefix)
+	switch {
+	case r.Method == "POST" && p == "blobs/uploads/":
+		reg.uploads++
+		w.Header().Set("Location", fmt.Sprintf("/v2/team/app/blobs/uploads/%d?state=x", reg.uploads))
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "PUT" && strings.HasPrefix(p, "blobs/uploads/"):
+		data, _ := ioutil.ReadAll(r.Body)
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+		if r.URL.Query().Get("digest") != digest || r.URL.Query().Get("state") != "x" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":[{"code":"DIGEST_INVALID","message":"digest mismatch"}]}`)
+			return
+		}
+		reg.blobs[digest] = data
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(p, "blobs/"):
+		data, ok := reg.blobs[strings.TrimPrefix(p, "blobs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case r.Method == "PUT" && strings.HasPrefix(p, "manifests/"):
+		data, _ := ioutil.ReadAll(r.Body)
+		reg.manifests[strings.TrimPrefix(p, "manifests/")] = data
+		reg.manifests[fmt.Sprintf("sha256:%x", sha256.Sum256(data))] = data
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "GET" && strings.HasPrefix(p, "manifests/"):
+		data, ok := reg.manifests[strings.TrimPrefix(p, "manifests/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+			return
+		}
+		w.Header().Set("Content-Type", ociImageManifestMediaType)
+		w.Write(data)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestParseImageReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	tests := []struct {
+		in   string
+		want ImageReference
+	}{
+		{"localhost:5000/team/app:1.0", ImageReference{Registry: "localhost:5000", Repository: "team/app", Tag: "1.0"}},
+		{"registry.example.com/app", ImageReference{Registry: "registry.example.com", Repository: "app", Tag: "latest"}},
+		{"registry.example.com/app@" + digest, ImageReference{Registry: "registry.example.com", Repository: "app", Digest: digest}},
+		{"team/app:v2", ImageReference{Registry: "docker.io", Repository: "team/app", Tag: "v2"}},
+		{"app", ImageReference{Registry: "docker.io", Repository: "library/app", Tag: "latest"}},
+	}
+	for _, tt := range tests {
+		ref, err := ParseImageReference(tt.in)
+		require.NoError(t, err, tt.in)
+		assert.Equal(t, tt.want, *ref, tt.in)
+	}
+
+	for _, in := range []string{"localhost:5000/Team/app", "localhost:5000/app:bad/tag", "app@md5:1234", "localhost:5000/app:"} {
+		_, err := ParseImageReference(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:app:pull,push"`)
+	assert.Equal(t, "bearer", scheme)
+	assert.Equal(t, map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:app:pull,push",
+	}, params)
+
+	scheme, params = parseChallenge(`Basic realm="a \"quoted\" realm", charset=UTF-8`)
+	assert.Equal(t, "basic", scheme)
+	assert.Equal(t, map[string]string{"realm": `a "quoted" realm`, "charset": "UTF-8"}, params)
+}
+
+func TestPushPullImage(t *testing.T) {
+	for _, token := range []bool{false, true} {
+		reg := &testRegistry{token: token, blobs: map[string][]byte{}, manifests: map[string][]byte{}}
+		server := httptest.NewServer(reg)
+		defer server.Close()
+		host := strings.TrimPrefix(server.URL, "http://")
+
+		dir, err := ioutil.TempDir("", "registry")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		image := filepath.Join(dir, "app.img")
+		data := append(make([]byte, 1<<20), []byte("nanos")...)
+		require.NoError(t, ioutil.WriteFile(image, data, 0644))
+		p, err := json.Marshal(&Provenance{Program: "/app", Manifest: "(children:(app:(contents:(host:/app))) program:/app)"})
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(ProvenancePath(image), p, 0644))
+		require.NoError(t, ioutil.WriteFile(SignaturePath(image), []byte(`{"KeyID":"k"}`), 0644))
+
+		opts := RegistryOptions{Username: "alice", Password: "secret"}
+		digest, err := PushImage(image, host+"/team/app:1.0", opts)
+		require.NoError(t, err)
+
+		var m ociManifest
+		require.NoError(t, json.Unmarshal(reg.manifests["1.0"], &m))
+		assert.Equal(t, ImageArtifactType, m.ArtifactType)
+		assert.Equal(t, provenanceMediaType, m.Config.MediaType)
+		require.Len(t, m.Layers, 2)
+		assert.Equal(t, []string{imageLayerMediaType, signatureMediaType},
+			[]string{m.Layers[0].MediaType, m.Layers[1].MediaType})
+		assert.True(t, m.Layers[0].Size < int64(len(data)))
+
+		// blobs the registry has are not uploaded again
+		uploads := reg.uploads
+		_, err = PushImage(image, host+"/team/app:latest", opts)
+		require.NoError(t, err)
+		assert.Equal(t, uploads, reg.uploads)
+
+		// a stale signature of the image that is replaced is removed
+		pulled := filepath.Join(dir, "pulled.img")
+		require.NoError(t, ioutil.WriteFile(SignaturePath(pulled), []byte("stale"), 0644))
+		require.NoError(t, PullImage(host+"/team/app@"+digest, pulled, opts))
+		got, err := ioutil.ReadFile(pulled)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+		got, err = ioutil.ReadFile(ProvenancePath(pulled))
+		require.NoError(t, err)
+		assert.Equal(t, p, got)
+		got, err = ioutil.ReadFile(SignaturePath(pulled))
+		require.NoError(t, err)
+		assert.Equal(t, `{"KeyID":"k"}`, string(got))
+
+		_, err = PushImage(image, host+"/team/app:1.0", RegistryOptions{Username: "alice", Password: "wrong"})
+		assert.Error(t, err)
+		err = PullImage(host+"/team/app:missing", pulled, opts)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "MANIFEST_UNKNOWN")
+
+		// records with secrets are not published
+		uploads = reg.uploads
+		p, err = json.Marshal(&Provenance{Program: "/app", Manifest: "(children:(app:(contents:(host:/app))) program:/app environment:(TOKEN:abc))"})
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(ProvenancePath(image), p, 0644))
+		_, err = PushImage(image, host+"/team/app:1.0", opts)
+		assert.Error(t, err)
+		assert.Equal(t, uploads, reg.uploads)
+	}
+}
+
+func TestPullImageWithoutSidecars(t *testing.T) {
+	reg := &testRegistry{blobs: map[string][]byte{}, manifests: map[string][]byte{}}
+	server := httptest.NewServer(reg)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	dir, err := ioutil.TempDir("", "registry")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "old.img")
+	require.NoError(t, ioutil.WriteFile(image, []byte("old image"), 0644))
+	opts := RegistryOptions{Username: "alice", Password: "secret"}
+	_, err = PushImage(image, host+"/team/app", opts)
+	require.NoError(t, err)
+
+	pulled := filepath.Join(dir, "pulled.img")
+	require.NoError(t, ioutil.WriteFile(ProvenancePath(pulled), []byte("stale"), 0644))
+	require.NoError(t, PullImage(host+"/team/app", pulled, opts))
+	got, err := ioutil.ReadFile(pulled)
+	require.NoError(t, err)
+	assert.Equal(t, "old image", string(got))
+	_, err = os.Stat(ProvenancePath(pulled))
+	assert.True(t, os.IsNotExist(err))
+}
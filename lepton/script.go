@@ -0,0 +1,319 @@
+package lepton
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// InterpreterNotFoundError is returned when the interpreter of a script can
+// not be found in the target root
+type InterpreterNotFoundError struct {
+	Interpreter string
+	Script      string
+}
+
+func (e *InterpreterNotFoundError) Error() string {
+	return fmt.Sprintf("interpreter %s of %s not found", e.Interpreter, e.Script)
+}
+
+// InterpreterLocator finds the files an interpreter needs besides its shared
+// libraries, such as its standard library
+type InterpreterLocator interface {
+	// Dirs returns glob patterns of the directories the interpreter at
+	// interp needs, as paths in the target root. name is the file name
+	// interp resolves to, such as python3.8 for /usr/bin/python3.
+	Dirs(interp string, name string) []string
+}
+
+// interpreter locators by the prefix of interpreter names they handle
+var interpreterLocators = map[string]InterpreterLocator{
+	"node":   nodeLocator{},
+	"perl":   perlLocator{},
+	"python": pythonLocator{},
+	"ruby":   rubyLocator{},
+}
+
+// RegisterInterpreterLocator sets the locator of the interpreters whose name
+// starts with prefix, the locator of the longest matching prefix is used
+func RegisterInterpreterLocator(prefix string, l InterpreterLocator) {
+	interpreterLocators[prefix] = l
+}
+
+func findInterpreterLocator(names ...string) InterpreterLocator {
+	for _, name := range names {
+		var match string
+		for prefix := range interpreterLocators {
+			if strings.HasPrefix(name, prefix) && len(prefix) > len(match) {
+				match = prefix
+			}
+		}
+		if match != "" {
+			return interpreterLocators[match]
+		}
+	}
+	return nil
+}
+
+// script is a program run by the interpreter of its shebang line
+type script struct {
+	// path of the script on the host and in the image
+	path   string
+	vmpath string
+
+	// interp is the path of the interpreter in the target root, it is run
+	// with args before the script
+	interp string
+	args   []string
+}
+
+// extensionInterpreters names the interpreters of scripts without a shebang
+// line by the extension of the script
+var extensionInterpreters = map[string]string{
+	".js": "node",
+	".py": "python3",
+	".rb": "ruby",
+}
+
+// defaultSearchPath is searched for interpreters named with /usr/bin/env in
+// a target root
+var defaultSearchPath = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+// readScript reads the shebang line of the program at path and locates its
+// interpreter, scripts without one are run by the interpreter of their
+// extension. It returns nil for programs that are not scripts.
+func readScript(targetRoot string, program string) (*script, error) {
+	abs, err := filepath.Abs(program)
+	if err != nil {
+		return nil, err
+	}
+	hostPath, err := lookupFile(targetRoot, abs)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	fd, err := os.Open(hostPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer fd.Close()
+
+	// the kernel reads at most 256 bytes of the shebang line
+	line, err := bufio.NewReaderSize(fd, 256).ReadSlice('\n')
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if !strings.HasPrefix(string(line), "#!") {
+		name, ok := extensionInterpreters[path.Ext(program)]
+		if !ok {
+			return nil, nil
+		}
+		s := &script{path: program, vmpath: path.Join("/", program), interp: lookInterpreter(targetRoot, name)}
+		if s.interp == "" {
+			return nil, &InterpreterNotFoundError{Interpreter: name, Script: program}
+		}
+		return s, nil
+	}
+
+	// everything after the interpreter is a single argument
+	shebang := strings.TrimSpace(string(line[2:]))
+	interp, arg := shebang, ""
+	if i := strings.IndexAny(shebang, " \t"); i >= 0 {
+		interp, arg = shebang[:i], strings.TrimSpace(shebang[i:])
+	}
+	if interp == "" {
+		return nil, fmt.Errorf("%s: shebang line names no interpreter", program)
+	}
+
+	s := &script{path: program, vmpath: path.Join("/", program), interp: interp}
+	if arg != "" {
+		s.args = []string{arg}
+	}
+
+	if path.Base(interp) == "env" && arg != "" {
+		// env runs the first of its arguments that is not an option
+		fields := strings.Fields(arg)
+		for len(fields) > 0 && strings.HasPrefix(fields[0], "-") {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("%s: shebang line names no interpreter", program)
+		}
+		s.interp, s.args = lookInterpreter(targetRoot, fields[0]), fields[1:]
+		if s.interp == "" {
+			return nil, &InterpreterNotFoundError{Interpreter: fields[0], Script: program}
+		}
+		return s, nil
+	}
+
+	if _, err := lookupFile(targetRoot, interp); err != nil {
+		if os.IsNotExist(err) {
+			return nil, &InterpreterNotFoundError{Interpreter: interp, Script: program}
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// lookInterpreter searches the PATH of the host, or the default search path
+// of the target root, for an executable named name
+func lookInterpreter(targetRoot string, name string) string {
+	dirs := defaultSearchPath
+	if targetRoot == "" {
+		dirs = filepath.SplitList(os.Getenv("PATH"))
+	}
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		p := filepath.Join(dir, name)
+		hostPath, err := lookupFile(targetRoot, p)
+		if err != nil {
+			continue
+		}
+		if fi, err := os.Stat(hostPath); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+			return p
+		}
+	}
+	return ""
+}
+
+// config returns a copy of c that runs the interpreter of s, with the
+// script as its first argument after the ones of the shebang line
+func (s *script) config(c *Config) *Config {
+	sc := *c
+	sc.Program = s.interp
+	args := append([]string{s.interp}, s.args...)
+	args = append(args, s.vmpath)
+	if len(c.Args) > 1 {
+		args = append(args, c.Args[1:]...)
+	}
+	sc.Args = args
+	return &sc
+}
+
+// addScript adds the script and the directories its interpreter needs to m
+func addScript(m *Manifest, c *Config, s *script) error {
+	err := m.AddFile(s.vmpath, s.path)
+	if err != nil {
+		return err
+	}
+
+	resolved, err := resolveImagePath(c.TargetRoot, s.interp)
+	if err != nil {
+		return err
+	}
+	name := path.Base(resolved)
+	l := findInterpreterLocator(path.Base(s.interp), name)
+	if l == nil {
+		return nil
+	}
+
+	for _, pattern := range l.Dirs(s.interp, name) {
+		dirs, err := globTargetRoot(c.TargetRoot, pattern)
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			if _, err = addTargetDir(m, c.TargetRoot, dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// globTargetRoot returns the paths in the target root that match pattern,
+// or the ones on the host when the target root has none
+func globTargetRoot(targetRoot string, pattern string) ([]string, error) {
+	if targetRoot != "" {
+		matches, err := filepath.Glob(filepath.Join(targetRoot, pattern))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) > 0 {
+			for i, match := range matches {
+				matches[i] = "/" + strings.TrimPrefix(match[len(filepath.Clean(targetRoot)):], "/")
+			}
+			return matches, nil
+		}
+	}
+	return filepath.Glob(pattern)
+}
+
+// interpreterPrefix returns the installation prefix of the interpreter at
+// interp, /usr for /usr/bin/python3
+func interpreterPrefix(interp string) string {
+	return path.Dir(path.Dir(interp))
+}
+
+// pythonLocator adds the standard library and the site packages of Python
+type pythonLocator struct{}
+
+func (pythonLocator) Dirs(interp string, name string) []string {
+	version := strings.TrimPrefix(name, "python")
+	major := strings.SplitN(version, ".", 2)[0]
+	if !strings.Contains(version, ".") {
+		version += ".*"
+	}
+	p := interpreterPrefix(interp)
+	return []string{
+		path.Join(p, "lib", "python"+version),
+		path.Join(p, "lib64", "python"+version),
+		path.Join(p, "local", "lib", "python"+version),
+		// packages of Debian based systems
+		path.Join(p, "lib", "python"+major),
+	}
+}
+
+// nodeLocator adds the system wide modules of Node.js packaged by Debian
+// based systems, Node.js has its standard library built in
+type nodeLocator struct{}
+
+func (nodeLocator) Dirs(interp string, name string) []string {
+	p := interpreterPrefix(interp)
+	return []string{
+		path.Join(p, "lib", "nodejs"),
+		path.Join(p, "share", "nodejs"),
+	}
+}
+
+// rubyLocator adds the standard library and the gems of Ruby
+type rubyLocator struct{}
+
+func (rubyLocator) Dirs(interp string, name string) []string {
+	p := interpreterPrefix(interp)
+	return []string{
+		path.Join(p, "lib", "ruby"),
+		path.Join(p, "lib", "*-linux-gnu*", "ruby"),
+		path.Join(p, "share", "rubygems-integration"),
+		"/var/lib/gems",
+	}
+}
+
+// perlLocator adds the standard library and the modules of Perl
+type perlLocator struct{}
+
+func (perlLocator) Dirs(interp string, name string) []string {
+	p := interpreterPrefix(interp)
+	return []string{
+		path.Join(p, "lib", "perl5"),
+		path.Join(p, "lib64", "perl5"),
+		path.Join(p, "share", "perl"),
+		path.Join(p, "share", "perl5"),
+		path.Join(p, "lib", "*-linux-gnu*", "perl"),
+		path.Join(p, "lib", "*-linux-gnu*", "perl5"),
+		path.Join(p, "lib", "*-linux-gnu*", "perl-base"),
+		path.Join(p, "local", "share", "perl"),
+		path.Join(p, "local", "lib", "*-linux-gnu*", "perl"),
+	}
+}
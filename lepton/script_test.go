@@ -0,0 +1,131 @@
+package lepton
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadScript(t *testing.T) {
+	root, err := ioutil.TempDir("", "targetroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "usr/bin"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "usr/bin/node"), []byte("node"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "usr/bin/python3"), []byte("python"), 0755)
+
+	tests := []struct {
+		contents string
+		interp   string
+		args     []string
+	}{
+		{"#!/usr/bin/python3\nprint('hello')\n", "/usr/bin/python3", nil},
+		{"#! /usr/bin/python3 -u -B\n", "/usr/bin/python3", []string{"-u -B"}},
+		{"#!/usr/bin/env node\n", "/usr/bin/node", []string{}},
+		{"#!/usr/bin/env -S python3 -u", "/usr/bin/python3", []string{"-u"}},
+	}
+	for _, tt := range tests {
+		ioutil.WriteFile(filepath.Join(root, "app"), []byte(tt.contents), 0755)
+		s, err := readScript(root, "/app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, &script{path: "/app", vmpath: "/app", interp: tt.interp, args: tt.args}, s, tt.contents)
+	}
+
+	ioutil.WriteFile(filepath.Join(root, "app"), []byte("\x7fELF"), 0755)
+	s, err := readScript(root, "/app")
+	assert.Nil(t, s)
+	assert.NoError(t, err)
+
+	ioutil.WriteFile(filepath.Join(root, "app"), []byte("#!/usr/bin/env ruby\n"), 0755)
+	_, err = readScript(root, "/app")
+	assert.Equal(t, &InterpreterNotFoundError{Interpreter: "ruby", Script: "/app"}, err)
+}
+
+func TestReadScriptWithoutShebang(t *testing.T) {
+	root, err := ioutil.TempDir("", "targetroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "usr/bin"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "usr/bin/node"), []byte("node"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "server.js"), []byte("console.log('hello')\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "app.rb"), []byte("puts 'hello'\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "app.txt"), []byte("hello\n"), 0644)
+
+	s, err := readScript(root, "/server.js")
+	assert.NoError(t, err)
+	assert.Equal(t, &script{path: "/server.js", vmpath: "/server.js", interp: "/usr/bin/node"}, s)
+
+	_, err = readScript(root, "/app.rb")
+	assert.Equal(t, &InterpreterNotFoundError{Interpreter: "ruby", Script: "/app.rb"}, err)
+
+	s, err = readScript(root, "/app.txt")
+	assert.Nil(t, s)
+	assert.NoError(t, err)
+}
+
+func TestScriptConfig(t *testing.T) {
+	s := &script{path: "app.py", vmpath: "/app.py", interp: "/usr/bin/python3", args: []string{"-u"}}
+
+	c := s.config(&Config{Program: "app.py", Args: []string{"app.py", "--port", "8080"}})
+	assert.Equal(t, "/usr/bin/python3", c.Program)
+	assert.Equal(t, []string{"/usr/bin/python3", "-u", "/app.py", "--port", "8080"}, c.Args)
+
+	c = s.config(&Config{Program: "app.py"})
+	assert.Equal(t, []string{"/usr/bin/python3", "-u", "/app.py"}, c.Args)
+}
+
+func TestInterpreterLocators(t *testing.T) {
+	assert.Equal(t, pythonLocator{}, findInterpreterLocator("python3", "python3.8"))
+	assert.Equal(t, nodeLocator{}, findInterpreterLocator("nodejs"))
+	assert.Equal(t, perlLocator{}, findInterpreterLocator("sh", "perl"))
+	assert.Nil(t, findInterpreterLocator("sh", "dash"))
+
+	assert.Equal(t, []string{
+		"/usr/local/lib/python3.8",
+		"/usr/local/lib64/python3.8",
+		"/usr/local/local/lib/python3.8",
+		"/usr/local/lib/python3",
+	}, pythonLocator{}.Dirs("/usr/local/bin/python3", "python3.8"))
+	assert.Contains(t, pythonLocator{}.Dirs("/usr/bin/python3", "python3"), "/usr/lib/python3.*")
+}
+
+func TestAddScriptInterpreterDirs(t *testing.T) {
+	root, err := ioutil.TempDir("", "targetroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "usr/bin"), 0755)
+	os.MkdirAll(filepath.Join(root, "usr/lib/python3.8/json"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "usr/bin/python3.8"), []byte("python"), 0755)
+	os.Symlink("python3.8", filepath.Join(root, "usr/bin/python3"))
+	ioutil.WriteFile(filepath.Join(root, "usr/lib/python3.8/os.py"), []byte("import sys"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "usr/lib/python3.8/json/__init__.py"), []byte(""), 0644)
+	ioutil.WriteFile(filepath.Join(root, "app.py"), []byte("#!/usr/bin/python3\n"), 0644)
+
+	c := &Config{TargetRoot: root, Program: "/app.py"}
+	s, err := readScript(root, c.Program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManifest(root)
+	if err = addScript(m, s.config(c), s); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, m.FileExists("/app.py"))
+	assert.True(t, m.FileExists("/usr/lib/python3.8/os.py"))
+	assert.True(t, m.FileExists("/usr/lib/python3.8/json/__init__.py"))
+}
@@ -0,0 +1,274 @@
+package lepton
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+)
+
+// SignatureError is returned when an image has no valid signature
+type SignatureError struct {
+	ImagePath string
+	Msg       string
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("%s: %s", e.ImagePath, e.Msg)
+}
+
+// ImageSignature is a detached signature of the digests of an image and of
+// its provenance record
+type ImageSignature struct {
+	ImageDigest      string
+	ProvenanceDigest string
+	KeyID            string
+	Signature        []byte
+}
+
+// payload returns the signed bytes
+func (s *ImageSignature) payload() []byte {
+	provenance := s.ProvenanceDigest
+	if provenance == "" {
+		provenance = "none"
+	}
+	return []byte(fmt.Sprintf("ops image signature v1\nimage %s\nprovenance %s\n", s.ImageDigest, provenance))
+}
+
+// SignaturePath returns the path of the signature of an image
+func SignaturePath(imagePath string) string {
+	return imagePath + ".sig"
+}
+
+// imageDigests returns the digests of an image and of its provenance record,
+// the provenance digest is empty for images without one
+func imageDigests(imagePath string) (string, string, error) {
+	image, err := sha256File(imagePath)
+	if err != nil {
+		return "", "", err
+	}
+	provenance, err := sha256File(ProvenancePath(imagePath))
+	if os.IsNotExist(err) {
+		return "sha256:" + image, "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return "sha256:" + image, "sha256:" + provenance, nil
+}
+
+// keyID identifies a public key by the hash of its PKIX encoding
+func keyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// GenerateSigningKey writes a new ed25519 private key to keyPath and its
+// public key to keyPath with the .pub extension
+func GenerateSigningKey(keyPath string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyPath+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644)
+}
+
+// readPEM returns the first PEM block of a file
+func readPEM(keyPath string) (*pem.Block, error) {
+	b, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM key found", keyPath)
+	}
+	return block, nil
+}
+
+// ReadSigningKey reads an ed25519 or ECDSA private key in PKCS #8 or SEC 1
+// PEM format. Encrypted cosign keys have to be exported without a password
+// first.
+func ReadSigningKey(keyPath string) (crypto.Signer, error) {
+	block, err := readPEM(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "ENCRYPTED COSIGN PRIVATE KEY", "ENCRYPTED PRIVATE KEY":
+		return nil, fmt.Errorf("%s: encrypted keys are not supported", keyPath)
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %q", keyPath, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", keyPath, err)
+	}
+
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: only ed25519 and ECDSA keys are supported", keyPath)
+}
+
+// ReadTrustedKey reads an ed25519 or ECDSA public key in PKIX PEM format,
+// the format of cosign public keys
+func ReadTrustedKey(keyPath string) (crypto.PublicKey, error) {
+	block, err := readPEM(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s: unsupported key type %q", keyPath, block.Type)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", keyPath, err)
+	}
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: only ed25519 and ECDSA keys are supported", keyPath)
+}
+
+// SignImage writes the signature of an image and its provenance record
+// with the private key at keyPath
+func SignImage(imagePath string, keyPath string) (*ImageSignature, error) {
+	key, err := ReadSigningKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ImageSignature{}
+	if s.ImageDigest, s.ProvenanceDigest, err = imageDigests(imagePath); err != nil {
+		return nil, err
+	}
+	if s.KeyID, err = keyID(key.Public()); err != nil {
+		return nil, err
+	}
+
+	// ed25519 signs the payload itself, ECDSA its hash
+	payload := s.payload()
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		s.Signature, err = key.Sign(rand.Reader, payload, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(payload)
+		s.Signature, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return s, ioutil.WriteFile(SignaturePath(imagePath), b, 0644)
+}
+
+// VerifyImage checks that an image and its provenance record have a
+// signature by one of the public keys at keyPaths
+func VerifyImage(imagePath string, keyPaths []string) (*ImageSignature, error) {
+	if len(keyPaths) == 0 {
+		return nil, &SignatureError{imagePath, "no trusted keys to verify the signature with"}
+	}
+
+	b, err := ioutil.ReadFile(SignaturePath(imagePath))
+	if os.IsNotExist(err) {
+		return nil, &SignatureError{imagePath, "image is not signed"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &ImageSignature{}
+	if err = json.Unmarshal(b, s); err != nil {
+		return nil, &SignatureError{imagePath, fmt.Sprintf("invalid signature file: %v", err)}
+	}
+
+	image, provenance, err := imageDigests(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	if image != s.ImageDigest {
+		return nil, &SignatureError{imagePath, "image does not match its signature"}
+	}
+	if provenance != s.ProvenanceDigest {
+		return nil, &SignatureError{imagePath, "provenance record does not match the signature"}
+	}
+
+	for _, keyPath := range keyPaths {
+		pub, err := ReadTrustedKey(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		if id, err := keyID(pub); err != nil || id != s.KeyID {
+			continue
+		}
+		if !verifySignature(pub, s.payload(), s.Signature) {
+			return nil, &SignatureError{imagePath, "invalid signature"}
+		}
+		return s, nil
+	}
+	return nil, &SignatureError{imagePath, fmt.Sprintf("signed by key %s which is not trusted", s.KeyID)}
+}
+
+func verifySignature(pub crypto.PublicKey, payload []byte, signature []byte) bool {
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, payload, signature)
+	case *ecdsa.PublicKey:
+		var sig struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(signature, &sig); err != nil || len(rest) != 0 {
+			return false
+		}
+		digest := sha256.Sum256(payload)
+		return ecdsa.Verify(pub, digest[:], sig.R, sig.S)
+	}
+	return false
+}
+
+// VerifyImageSignature verifies the signature of an image with the trusted
+// keys of c when it requires signed images
+func VerifyImageSignature(c *Config, imagePath string) error {
+	if !c.RequireSignedImages {
+		return nil
+	}
+	_, err := VerifyImage(imagePath, c.TrustedKeys)
+	return err
+}
@@ -0,0 +1,101 @@
+package lepton
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeECDSAKey writes a P-256 key pair in the format of cosign public keys
+func writeECDSAKey(t *testing.T, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privDER, _ := x509.MarshalECPrivateKey(key)
+	pubDER, _ := x509.MarshalPKIXPublicKey(key.Public())
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privDER}), 0600)
+	ioutil.WriteFile(keyPath+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644)
+}
+
+func TestSignImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "web.img")
+	ioutil.WriteFile(image, []byte("image"), 0644)
+	ioutil.WriteFile(ProvenancePath(image), []byte("{}"), 0644)
+
+	edKey := filepath.Join(dir, "ed25519.key")
+	ecKey := filepath.Join(dir, "ecdsa.key")
+	assert.NoError(t, GenerateSigningKey(edKey))
+	writeECDSAKey(t, ecKey)
+
+	for _, key := range []string{edKey, ecKey} {
+		signed, err := SignImage(image, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, filepath.Join(dir, "web.img.sig"), SignaturePath(image))
+
+		s, err := VerifyImage(image, []string{edKey + ".pub", ecKey + ".pub"})
+		assert.NoError(t, err)
+		assert.Equal(t, signed.KeyID, s.KeyID)
+	}
+
+	// signed by ecKey, which is not trusted
+	_, err = VerifyImage(image, []string{edKey + ".pub"})
+	assert.IsType(t, &SignatureError{}, err)
+	_, err = VerifyImage(image, nil)
+	assert.IsType(t, &SignatureError{}, err)
+
+	ioutil.WriteFile(ProvenancePath(image), []byte(`{"Program":"/other"}`), 0644)
+	_, err = VerifyImage(image, []string{ecKey + ".pub"})
+	assert.EqualError(t, err, image+": provenance record does not match the signature")
+
+	ioutil.WriteFile(ProvenancePath(image), []byte("{}"), 0644)
+	ioutil.WriteFile(image, []byte("tampered"), 0644)
+	_, err = VerifyImage(image, []string{ecKey + ".pub"})
+	assert.EqualError(t, err, image+": image does not match its signature")
+
+	os.Remove(SignaturePath(image))
+	_, err = VerifyImage(image, []string{ecKey + ".pub"})
+	assert.EqualError(t, err, image+": image is not signed")
+}
+
+func TestVerifyImageSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "web.img")
+	ioutil.WriteFile(image, []byte("image"), 0644)
+	key := filepath.Join(dir, "key")
+	assert.NoError(t, GenerateSigningKey(key))
+
+	c := &Config{TrustedKeys: []string{key + ".pub"}}
+	assert.NoError(t, VerifyImageSignature(c, image))
+	c.RequireSignedImages = true
+	assert.Error(t, VerifyImageSignature(c, image))
+
+	_, err = SignImage(image, key)
+	assert.NoError(t, err)
+	assert.NoError(t, VerifyImageSignature(c, image))
+
+	// public keys cannot sign
+	_, err = SignImage(image, key+".pub")
+	assert.Error(t, err)
+}
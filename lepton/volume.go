@@ -2,11 +2,13 @@ package lepton
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
 
 	"github.com/go-errors/errors"
+	"github.com/nanovms/ops/fs"
 	"github.com/olekukonko/tablewriter"
 )
 
@@ -31,14 +33,10 @@ type NanosVolume struct {
 func CreateLocalVolume(config *Config, name, data, size, provider string) (NanosVolume, error) {
 	var vol NanosVolume
 	var mnfPath string
-	mkfsPath := config.Mkfs
-	var mkfsCommand = NewMkfsCommand(mkfsPath)
-	mkfsCommand.SetLabel(name)
 
 	tmp := fmt.Sprintf("%s.raw", name)
 	mnf := fmt.Sprintf("%s.manifest", name)
 	tmpPath := path.Join(config.BuildDir, tmp)
-	mkfsCommand.SetFileSystemPath(tmpPath)
 
 	if data != "" {
 		config.Dirs = append(config.Dirs, data)
@@ -47,29 +45,28 @@ func CreateLocalVolume(config *Config, name, data, size, provider string) (Nanos
 		if err != nil {
 			return vol, err
 		}
-
-		src, err := os.Open(mnfPath)
-		if err != nil {
-			return vol, err
-		}
-		defer src.Close()
-		mkfsCommand.SetStdin(src)
-	} else {
-		mkfsCommand.SetEmptyFileSystem()
 	}
 
-	if config.BaseVolumeSz != "" {
-		mkfsCommand.SetFileSystemSize(config.BaseVolumeSz)
+	var uuid string
+	var err error
+	if !config.NativeMkfs {
+		uuid, err = mkfsVolume(config, name, tmpPath, mnfPath)
+	} else {
+		manifest := []byte("(children:())")
+		if mnfPath != "" {
+			if manifest, err = ioutil.ReadFile(mnfPath); err != nil {
+				return vol, err
+			}
+		}
+		// the files of volumes are not in the target root of images
+		vc := *config
+		vc.TargetRoot = ""
+		uuid, err = writeFilesystem(&vc, string(manifest), tmpPath, fs.Options{Label: name, Progress: mkfsProgress()})
 	}
-
-	mkfsCommand.SetupCommand()
-	err := mkfsCommand.Execute()
 	if err != nil {
-		return vol, errors.Wrap(fmt.Errorf("mkfs %s: %v", strings.Join(mkfsCommand.GetArgs(), " "), err), 1)
+		return vol, errors.Wrap(err, 1)
 	}
 
-	uuid := mkfsCommand.GetUUID()
-
 	raw := fmt.Sprintf("%s%s%s.raw", name, VolumeDelimiter, uuid)
 	rawPath := path.Join(config.BuildDir, raw)
 	err = os.Rename(tmpPath, rawPath)
@@ -92,6 +89,36 @@ func CreateLocalVolume(config *Config, name, data, size, provider string) (Nanos
 	return vol, nil
 }
 
+// mkfsVolume writes a volume with the mkfs program of the kernel release,
+// from the manifest at mnfPath or empty, and returns its UUID
+func mkfsVolume(config *Config, name, path, mnfPath string) (string, error) {
+	var mkfsCommand = NewMkfsCommand(config.Mkfs)
+	mkfsCommand.SetLabel(name)
+	mkfsCommand.SetFileSystemPath(path)
+
+	if mnfPath != "" {
+		src, err := os.Open(mnfPath)
+		if err != nil {
+			return "", err
+		}
+		defer src.Close()
+		mkfsCommand.SetStdin(src)
+	} else {
+		mkfsCommand.SetEmptyFileSystem()
+	}
+
+	if config.BaseVolumeSz != "" {
+		mkfsCommand.SetFileSystemSize(config.BaseVolumeSz)
+	}
+
+	mkfsCommand.SetupCommand()
+	err := mkfsCommand.Execute()
+	if err != nil {
+		return "", fmt.Errorf("mkfs %s: %v", strings.Join(mkfsCommand.GetArgs(), " "), err)
+	}
+	return mkfsCommand.GetUUID(), nil
+}
+
 // PrintVolumesList writes into console a table with volumes details
 func PrintVolumesList(volumes *[]NanosVolume) {
 	table := tablewriter.NewWriter(os.Stdout)
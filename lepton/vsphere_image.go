@@ -48,6 +48,10 @@ func (v *Vsphere) createImage(key string, bucket string, region string) {
 // does not do this by default). This sidesteps the vmfkstools
 // transformation.
 func (v *Vsphere) CreateImage(ctx *Context, imagePath string) error {
+	if err := VerifyImageSignature(ctx.config, ctx.config.RunConfig.Imagename); err != nil {
+		return err
+	}
+
 	err := v.Storage.CopyToBucket(ctx.config, imagePath)
 	if err != nil {
 		return err
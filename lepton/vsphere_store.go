@@ -1,9 +1,9 @@
 package lepton
 
 import (
-	"fmt"
-	"os/exec"
 	"strings"
+
+	"github.com/nanovms/ops/imageformat"
 )
 
 // Datastores provides access to VSphere's Datastores
@@ -16,19 +16,7 @@ func (s *Datastores) CopyToBucket(config *Config, archPath string) error {
 
 	vmdkPath = strings.ReplaceAll(vmdkPath, "-image", "")
 
-	args := []string{
-		"convert", "-f", "raw",
-		"-O", "vmdk", "-o", "subformat=monolithicFlat",
-		archPath, vmdkPath,
-	}
-
-	cmd := exec.Command("qemu-img", args...)
-	err := cmd.Run()
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	return nil
+	return imageformat.Convert(archPath, vmdkPath, imageformat.VMDKFlat, imageformat.Options{})
 }
 
 // DeleteFromBucket deletes key from config's bucket
@@ -84,6 +84,10 @@ func (v *Vultr) destroyImage(snapshotid string) {
 
 // CreateImage - Creates image on v using nanos images
 func (v *Vultr) CreateImage(ctx *Context, imagePath string) error {
+	if err := VerifyImageSignature(ctx.config, ctx.config.RunConfig.Imagename); err != nil {
+		return err
+	}
+
 	err := v.Storage.CopyToBucket(ctx.config, imagePath)
 	if err != nil {
 		return err
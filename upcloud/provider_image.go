@@ -35,6 +35,9 @@ func (p *Provider) BuildImageWithPackage(ctx *lepton.Context, pkgpath string) (s
 
 // CreateImage creates a storage object and upload image
 func (p *Provider) CreateImage(ctx *lepton.Context, imagePath string) error {
+	if err := lepton.VerifyImageSignature(ctx.Config(), ctx.Config().RunConfig.Imagename); err != nil {
+		return err
+	}
 
 	storageDetails, err := p.createStorage(ctx, ctx.Config().CloudConfig.ImageName, imagePath)
 	if err != nil {